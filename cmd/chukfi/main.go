@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	cli_frontend_downloader "github.com/chukfi/backend/internal/cli/frontend-downloader"
+	cli_generate_openapi "github.com/chukfi/backend/internal/cli/generate-openapi"
 	cli_generate_types "github.com/chukfi/backend/internal/cli/generate-types"
 	cli_init "github.com/chukfi/backend/internal/cli/init"
 	"github.com/joho/godotenv"
@@ -29,6 +30,7 @@ func printHelp() {
 	fmt.Printf("Usage: %s <command> [options]\n", cmd)
 	fmt.Println("\nCommands:")
 	fmt.Println("  generate-types       Generate Go types from the database schema")
+	fmt.Println("  generate-openapi     Write the OpenAPI document of the API to a file")
 	fmt.Println("  setup-frontend       Clone and build the frontend application")
 	fmt.Println("  init                 Initialize the project by cloning frontend and backend repositories")
 	fmt.Println("\nUse '<command> --help' for more information about a command.")
@@ -64,6 +66,9 @@ func main() {
 		}
 
 		cli_generate_types.CLI(dsn, []interface{}{}, otherArgs)
+	case "generate-openapi":
+		// writes the openapi document, doesnt need the database
+		cli_generate_openapi.CLI(otherArgs)
 	case "setup-frontend":
 		// git clones frontend repo (or a repo specified with --url=...)
 		// and builds it with npm build
@@ -65,7 +65,7 @@ func InitDatabase(schema []interface{}) {
 		Fullname:    "Chukfi Admin",
 		Password:    string(basePassword),
 		Email:       "admin@nativeconsult.io",
-		Permissions: uint64(permissions.Admin),
+		Permissions: permissions.Admin,
 	}
 
 	// check if user exists
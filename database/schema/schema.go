@@ -3,6 +3,7 @@ package schema
 import (
 	"time"
 
+	"github.com/chukfi/backend/src/lib/permissions"
 	uuid "github.com/satori/go.uuid"
 	"gorm.io/gorm"
 )
@@ -33,13 +34,41 @@ type User struct {
 	AdminOnly
 	Fullname string `gorm:"type:varchar(100);not null"`
 	Email    string `gorm:"type:varchar(100);uniqueIndex;not null"`
-	Password string `gorm:"type:varchar(255);not null"`
+	Password string `gorm:"type:varchar(255);not null" chukfi:"writeOnly"` // bcrypt hash, never sent back
+	Disabled bool   `gorm:"not null;default:false" chukfi:"readonly"`      // disabled users can't log in
 
-	Permissions uint64 `gorm:"not null;default:1;"`
+	// a bitset without a fixed size, stored as its decimal number (see permissions.Permission). Read only in the
+	// collection api, it is changed through /admin/users and /admin/permissions
+	Permissions permissions.Permission `gorm:"type:varchar(4096);not null;default:1;" chukfi:"readPermission=ManageUsers,readonly"`
+
+	// RolePermissions are the permissions of the roles of the user, filled in when it is loaded for a request (see roles.Load)
+	RolePermissions permissions.Permission `gorm:"-:all" json:"-"`
 
 	// adminOnly string `gorm:"-:all"` // makes it so you can only access this field as admin (logged in as admin user)
 }
 
+// EffectivePermissions are the permissions granted to the user directly plus the ones of their roles
+func (user User) EffectivePermissions() permissions.Permission {
+	return user.Permissions.Union(user.RolePermissions)
+}
+
+// Role is a named set of permissions, users get the permissions of every role they have (UserRole)
+type Role struct {
+	BaseModel
+	Hidden
+	Name        string                 `gorm:"type:varchar(100);uniqueIndex;not null"`
+	Description string                 `gorm:"type:varchar(255)"`
+	Permissions permissions.Permission `gorm:"type:varchar(4096);not null;default:0"`
+}
+
+// UserRole gives a user a role
+type UserRole struct {
+	BaseModel
+	Hidden
+	UserID uuid.UUID `gorm:"type:char(36);not null;uniqueIndex:idx_user_role"`
+	RoleID uuid.UUID `gorm:"type:char(36);not null;uniqueIndex:idx_user_role;index"`
+}
+
 type UserToken struct {
 	BaseModel
 	Hidden
@@ -50,7 +79,50 @@ type UserToken struct {
 	// Hidden string `gorm:"-:all"` // hidden from metadata
 }
 
+// Media is an uploaded file, the file itself lives in the configured storage under StorageKey.
+// reference it from other schemas with a char(36) field tagged chukfi:"media"
+type Media struct {
+	BaseModel
+	Filename string `gorm:"type:varchar(255);not null"`
+	// set from the stored file, clients can't change them
+	MimeType   string `gorm:"type:varchar(100);not null;index" chukfi:"readonly"`
+	Size       int64  `gorm:"not null" chukfi:"readonly"`
+	Checksum   string `gorm:"type:char(64);not null;index" chukfi:"readonly"` // sha256, hex encoded
+	Width      int
+	Height     int
+	AltText    string `gorm:"type:varchar(255)"`
+	StorageKey string `gorm:"type:varchar(255);not null;uniqueIndex" chukfi:"nosearch,readonly"`
+	UploadedBy string `gorm:"type:char(36);index" chukfi:"readonly"`
+	Private    bool   `gorm:"not null;default:false;index"` // only served to users who can read media or through a signed url (see media.RegisterHooks)
+}
+
+func (Media) TableName() string {
+	return "media"
+}
+
+// MediaUpload is a resumable (tus) upload in progress, the received chunks are kept in storage
+// until the upload completes and is turned into a Media entry
+type MediaUpload struct {
+	BaseModel
+	Hidden
+	UploadLength int64  `gorm:"not null"`
+	UploadOffset int64  `gorm:"not null;default:0"`
+	Filename     string `gorm:"type:varchar(255)"`
+	AltText      string `gorm:"type:varchar(255)"`
+	UploadedBy   string `gorm:"type:char(36);index"`
+	ExpiresAt    int64  `gorm:"not null;index"`
+	Private      bool   `gorm:"not null;default:false"`
+	MediaID      string `gorm:"type:char(36)"` // set once the upload is complete
+
+	// CompletingUntil is set while a request turns the upload into a media entry, see media.CompleteUpload
+	CompletingUntil int64 `gorm:"not null;default:0"`
+}
+
 var DefaultSchema = []interface{}{
 	&User{},
 	&UserToken{},
+	&Media{},
+	&MediaUpload{},
+	&Role{},
+	&UserRole{},
 }
@@ -4,9 +4,13 @@ go 1.25.3
 
 require (
 	github.com/go-chi/chi/v5 v5.2.3
+	github.com/gorilla/websocket v1.5.3
+	github.com/graphql-go/graphql v0.8.1
 	github.com/joho/godotenv v1.5.1
 	github.com/satori/go.uuid v1.2.0
 	golang.org/x/crypto v0.46.0
+	golang.org/x/image v0.32.0
+	gopkg.in/yaml.v3 v3.0.1
 	gorm.io/driver/mysql v1.6.0
 	gorm.io/gorm v1.30.0
 )
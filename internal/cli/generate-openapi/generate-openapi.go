@@ -0,0 +1,133 @@
+package cli_generate_openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/chukfi/backend/database/schema"
+	"github.com/chukfi/backend/server/router"
+	"github.com/chukfi/backend/src/lib/astparser"
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+	"github.com/go-chi/chi/v5"
+	gormschema "gorm.io/gorm/schema"
+)
+
+func printHelp() {
+	// determine how the command is running (e.g go run main.go vs compiled binary)
+	cmd := os.Args[0]
+	// if it ends with .exe (windows), remove the preceding path
+	if strings.HasSuffix(cmd, ".exe") {
+		parts := strings.Split(cmd, string(os.PathSeparator))
+		cmd = parts[len(parts)-1]
+	} else if strings.Contains(cmd, "go-build") {
+		cmd = "go run main.go"
+	}
+
+	// for linux/mac, if it contains /, remove preceding path
+	if strings.Contains(cmd, "/") {
+		parts := strings.Split(cmd, string(os.PathSeparator))
+		cmd = parts[len(parts)-1]
+	}
+	fmt.Printf(`
+Usage: %s generate-openapi [options]
+
+Description:
+The generate-openapi command writes the OpenAPI 3.1 document of the chukfi routes and your schemas,
+the same document the server serves at /admin/openapi.json (including admin only collections).
+No database is needed.
+
+Options:
+  --schema=<path>    Path to a Go file containing your schema structs
+                     (e.g., --schema=./schema.go), without it only the built in schemas are included
+
+  --output=<path>    Output path for the document
+                     (default: openapi.json)
+
+Examples:
+   %s generate-openapi --schema=./schema.go
+   %s generate-openapi --schema=./schema.go --output=./docs/openapi.json
+`, cmd, cmd, cmd)
+}
+
+// registerSchemaFile registers the structs of a go schema file, the same way the server registers the models
+func registerSchemaFile(schemaPath string) error {
+	structs, err := astparser.ParseSchemaFile(schemaPath)
+	if err != nil {
+		return fmt.Errorf("failed to parse schema file: %w", err)
+	}
+
+	for _, parsed := range structs {
+		if parsed.Hidden {
+			continue
+		}
+
+		meta := schemaregistry.SchemaMetadata{
+			TableName: gormschema.NamingStrategy{}.TableName(parsed.Name),
+			AdminOnly: parsed.AdminOnly,
+		}
+		for _, field := range parsed.Fields {
+			meta.Fields = append(meta.Fields, schemaregistry.FieldMetadata{
+				Name:       field.Name,
+				Type:       field.Type,
+				GormTag:    field.GormTag,
+				JSONTag:    field.JSONTag,
+				ChukfiTag:  field.ChukfiTag,
+				Required:   field.Required,
+				PrimaryKey: strings.Contains(strings.ToLower(field.GormTag), "primarykey"),
+			})
+		}
+		schemaregistry.RegisterMetadata(meta)
+	}
+	return nil
+}
+
+// this is the main CLI function for generating the openapi document, do not call directly, use CLI by running the command
+func CLI(args []string) {
+	var schemaPath string
+	outputPath := "openapi.json"
+
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "--schema=") {
+			schemaPath = strings.TrimPrefix(arg, "--schema=")
+		}
+		if strings.HasPrefix(arg, "--output=") {
+			outputPath = strings.TrimPrefix(arg, "--output=")
+		}
+		if arg == "--help" || arg == "-h" {
+			printHelp()
+			return
+		}
+	}
+
+	schemaregistry.RegisterSchemas(schema.DefaultSchema)
+	if schemaPath != "" {
+		if err := registerSchemaFile(schemaPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// the routes are only registered to be listed, nothing is served so no database is needed
+	r := chi.NewRouter()
+	router.RegisterRoutes(r, nil)
+
+	document, err := router.GenerateOpenAPI(r, true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error generating the OpenAPI document: %v\n", err)
+		os.Exit(1)
+	}
+
+	data, err := json.MarshalIndent(document, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding the OpenAPI document: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := os.WriteFile(outputPath, append(data, '\n'), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing the OpenAPI document: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Done! The OpenAPI document has been written to %s\n", outputPath)
+}
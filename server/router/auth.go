@@ -8,6 +8,7 @@ import (
 	"github.com/chukfi/backend/database/schema"
 	"github.com/chukfi/backend/src/httpresponder"
 	"github.com/chukfi/backend/src/lib/permissions"
+	"github.com/chukfi/backend/src/lib/roles"
 	"github.com/go-chi/chi/v5"
 	uuid "github.com/satori/go.uuid"
 	"golang.org/x/crypto/bcrypt"
@@ -37,7 +38,7 @@ func RegisterAuthRoutes(r chi.Router, database *gorm.DB) {
 				Permissions []string `json:"permissions"`
 			}
 
-			perms := permissions.PermissionsToStrings(permissions.Permission(user.Permissions))
+			perms := permissions.PermissionsToStrings(user.EffectivePermissions())
 
 			httpresponder.SendNormalResponse(w, r, map[string]interface{}{
 				"user": simpleUser{
@@ -87,6 +88,14 @@ func RegisterAuthRoutes(r chi.Router, database *gorm.DB) {
 				httpresponder.SendErrorResponse(w, r, "Invalid email or password", http.StatusUnauthorized)
 				return
 			}
+			if user.Disabled {
+				httpresponder.SendErrorResponse(w, r, "This account is disabled", http.StatusForbidden)
+				return
+			}
+			if err := roles.Load(r.Context(), database, &user); err != nil {
+				httpresponder.SendErrorResponse(w, r, "Failed to load roles: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
 			// create auth token
 			token := uuid.NewV4()
 
@@ -117,7 +126,7 @@ func RegisterAuthRoutes(r chi.Router, database *gorm.DB) {
 				Permissions []string `json:"permissions"`
 			}
 
-			perms := permissions.PermissionsToStrings(permissions.Permission(user.Permissions))
+			perms := permissions.PermissionsToStrings(user.EffectivePermissions())
 
 			httpresponder.SendNormalResponse(w, r, map[string]interface{}{
 				"authToken": token.String(),
@@ -0,0 +1,400 @@
+package router
+
+// bulk writes, many creates / updates / deletes of a collection in one request
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/chukfi/backend/src/httpresponder"
+	"github.com/chukfi/backend/src/lib/filter"
+	"github.com/chukfi/backend/src/lib/permissions"
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+	"github.com/go-chi/chi/v5"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// the most operations of one /bulk request, and the most entries a by filter write may touch
+	bulkMaxOperations = 1000
+	// how many entries a by filter write may touch when the request sets no limit
+	bulkDefaultLimit = 100
+	// the biggest bulk request body accepted
+	bulkMaxBodySize = 10 << 20
+)
+
+/*
+bulk modes, atomic runs every operation in one transaction and rolls all of them back if one fails,
+bestEffort runs each on its own and keeps the ones that succeed
+*/
+const (
+	bulkAtomic     = "atomic"
+	bulkBestEffort = "bestEffort"
+)
+
+type bulkOperation struct {
+	Op   string                 `json:"op"` // create, update or delete
+	ID   string                 `json:"id"`
+	Data map[string]interface{} `json:"data"`
+}
+
+type bulkResult struct {
+	Index   int         `json:"index"`
+	Success bool        `json:"success"`
+	ID      string      `json:"id,omitempty"`
+	Error   string      `json:"error,omitempty"`
+	Status  int         `json:"status,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+type bulkResponse struct {
+	Mode      string       `json:"mode"`
+	Committed bool         `json:"committed"` // false when an atomic request was rolled back
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	Results   []bulkResult `json:"results"`
+}
+
+// errBulkRolledBack aborts the transaction of an atomic bulk request after an operation failed
+var errBulkRolledBack = errors.New("bulk operation failed")
+
+func parseBulkMode(mode string) (string, error) {
+	switch mode {
+	case "", bulkAtomic:
+		return bulkAtomic, nil
+	case bulkBestEffort:
+		return bulkBestEffort, nil
+	}
+	return "", schemaregistry.Reject("Invalid mode: %s, use %s or %s", mode, bulkAtomic, bulkBestEffort)
+}
+
+/*
+runBulk applies count operations with apply, in one transaction for atomic mode. The events of the writes
+are only published once they are committed. apply returns the id of the entry it wrote
+*/
+func runBulk(r *http.Request, database *gorm.DB, mode string, count int, apply func(r *http.Request, tx *gorm.DB, i int) (string, error)) (*bulkResponse, error) {
+	response := &bulkResponse{Mode: mode, Committed: true, Results: make([]bulkResult, count)}
+	r, flush, discard := deferEvents(r)
+
+	run := func(tx *gorm.DB) error {
+		for i := 0; i < count; i++ {
+			result := bulkResult{Index: i}
+			id, err := apply(r, tx, i)
+			if err == nil {
+				result.Success, result.ID = true, id
+				response.Results[i] = result
+				continue
+			}
+
+			result.ID = id
+			var hookErr *schemaregistry.HookError
+			if errors.As(err, &hookErr) {
+				result.Error, result.Status, result.Details = hookErr.Message, hookErr.Status, hookErr.Details
+			} else {
+				result.Error, result.Status = err.Error(), http.StatusInternalServerError
+			}
+			response.Results[i] = result
+
+			if mode == bulkAtomic {
+				// everything before was undone, everything after never ran
+				for j := 0; j < i; j++ {
+					response.Results[j].Success = false
+					response.Results[j].Error = "Rolled back, another operation failed"
+				}
+				for j := i + 1; j < count; j++ {
+					response.Results[j] = bulkResult{Index: j, Error: "Not run, another operation failed"}
+				}
+				return errBulkRolledBack
+			}
+		}
+		return nil
+	}
+
+	var err error
+	if mode == bulkAtomic {
+		err = database.WithContext(r.Context()).Transaction(run)
+	} else {
+		err = run(database)
+	}
+	if errors.Is(err, errBulkRolledBack) {
+		discard()
+		response.Committed = false
+	} else if err != nil {
+		discard()
+		return nil, err
+	}
+	flush()
+
+	for _, result := range response.Results {
+		if result.Success {
+			response.Succeeded++
+		} else {
+			response.Failed++
+		}
+	}
+	return response, nil
+}
+
+// applyBulkOperation runs one operation of a /bulk request
+func applyBulkOperation(r *http.Request, tx *gorm.DB, collectionName string, operation bulkOperation) (string, error) {
+	switch strings.ToLower(operation.Op) {
+	case "create":
+		if operation.Data == nil {
+			return "", schemaregistry.Reject("Missing data")
+		}
+		data, err := createEntry(r, tx, collectionName, operation.Data)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprint(data["ID"]), nil
+
+	case "update", "delete":
+		id, err := uuid.FromString(operation.ID)
+		if err != nil {
+			return operation.ID, schemaregistry.Reject("Invalid ID format: %s", err.Error())
+		}
+		if strings.ToLower(operation.Op) == "delete" {
+			return id.String(), deleteEntry(r, tx, collectionName, id)
+		}
+		if operation.Data == nil {
+			return id.String(), schemaregistry.Reject("Missing data")
+		}
+		return id.String(), updateEntry(r, tx, collectionName, id, operation.Data)
+	}
+	return operation.ID, schemaregistry.Reject("Invalid op: %s, use create, update or delete", operation.Op)
+}
+
+/*
+matchingIDs returns the ids of the entries matching where, a filter in the language of /get (see the filter package).
+More than limit matches is an error, so a loose filter cant touch the whole collection
+*/
+func matchingIDs(r *http.Request, database *gorm.DB, collectionName string, where map[string]interface{}, limit int) ([]string, error) {
+	expression, err := filter.Parse(collectionName, where)
+	if err != nil {
+		return nil, err
+	}
+	if expression == nil {
+		return nil, schemaregistry.Reject("Missing where, a filter is required")
+	}
+
+	query := scopeEntries(r, database, collectionName, permissions.ActionRead, database.WithContext(r.Context()).Table(collectionName).Where(expression))
+	if schemaregistry.HasSoftDelete(collectionName) {
+		query = query.Where("deleted_at IS NULL")
+	}
+
+	var ids []string
+	if err := query.Limit(limit+1).Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+	if len(ids) > limit {
+		hookErr := schemaregistry.NewHookError(http.StatusBadRequest, fmt.Sprintf("The filter matches more than %d entries, narrow it or raise the limit", limit))
+		hookErr.Details = map[string]interface{}{"limit": limit}
+		return nil, hookErr
+	}
+	return ids, nil
+}
+
+// decodeBulkBody decodes the body of a bulk request, sending the error response if it fails
+func decodeBulkBody(w http.ResponseWriter, r *http.Request, body interface{}) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, bulkMaxBodySize)).Decode(body); err != nil {
+		httpresponder.SendErrorResponse(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// bulkLimit checks the limit of a by filter write, 0 for the default
+func bulkLimit(limit int) (int, error) {
+	if limit == 0 {
+		return bulkDefaultLimit, nil
+	}
+	if limit < 0 || limit > bulkMaxOperations {
+		return 0, schemaregistry.Reject("Invalid limit, it has to be between 1 and %d", bulkMaxOperations)
+	}
+	return limit, nil
+}
+
+// bulkActions returns the actions (permissions.ActionCreate...) the operations do, unknown ops fail on their own
+func bulkActions(operations []bulkOperation) []string {
+	var actions []string
+	for _, operation := range operations {
+		action := strings.ToLower(operation.Op)
+		if slices.Contains(permissions.CollectionActions, action) && !slices.Contains(actions, action) {
+			actions = append(actions, action)
+		}
+	}
+	return actions
+}
+
+/*
+registerBulkRoutes registers the bulk routes of /collection/{collectionName}, they require the permissions of what
+they do (ManageModels, or posts.create / posts.update / posts.delete). Every operation goes through the same
+validation, hooks and events as the single entry routes.
+*/
+func registerBulkRoutes(r chi.Router, database *gorm.DB) {
+	// checks the user may do the actions on the collection, sending the error response if not
+	allowed := func(w http.ResponseWriter, r *http.Request, collectionName string, actions ...string) bool {
+		for _, action := range actions {
+			if !RequestHasCollectionPermission(r, database, collectionName, action) {
+				httpresponder.SendErrorResponse(w, r, "Forbidden: You do not have permission to "+action+" entries", http.StatusForbidden)
+				return false
+			}
+		}
+		return true
+	}
+
+	// resolves the collection and checks the actions, sending the error response if it fails
+	collectionFromRequest := func(w http.ResponseWriter, r *http.Request, actions ...string) (string, bool) {
+		collectionName := chi.URLParam(r, "collectionName")
+		resolvedName, exists := schemaregistry.ResolveTableName(collectionName)
+		if !exists {
+			httpresponder.SendErrorResponse(w, r, "Invalid collection name: "+collectionName, http.StatusBadRequest)
+			return "", false
+		}
+		return resolvedName, allowed(w, r, resolvedName, actions...)
+	}
+
+	// {"mode": "atomic", "operations": [{"op": "create", "data": {...}}, {"op": "update", "id": "...", "data": {...}}, {"op": "delete", "id": "..."}]}
+	r.Post("/bulk", func(w http.ResponseWriter, r *http.Request) {
+		collectionName, ok := collectionFromRequest(w, r)
+		if !ok {
+			return
+		}
+
+		var body struct {
+			Mode       string          `json:"mode"`
+			Operations []bulkOperation `json:"operations"`
+		}
+		if !decodeBulkBody(w, r, &body) {
+			return
+		}
+
+		mode, err := parseBulkMode(body.Mode)
+		if err != nil {
+			sendHookError(w, r, err, "")
+			return
+		}
+		if len(body.Operations) == 0 {
+			httpresponder.SendErrorResponse(w, r, "Missing operations", http.StatusBadRequest)
+			return
+		}
+		if len(body.Operations) > bulkMaxOperations {
+			httpresponder.SendErrorResponse(w, r, fmt.Sprintf("Too many operations, at most %d per request", bulkMaxOperations), http.StatusBadRequest)
+			return
+		}
+		if !allowed(w, r, collectionName, bulkActions(body.Operations)...) {
+			return
+		}
+
+		response, err := runBulk(r, database, mode, len(body.Operations), func(r *http.Request, tx *gorm.DB, i int) (string, error) {
+			return applyBulkOperation(r, tx, collectionName, body.Operations[i])
+		})
+		if err != nil {
+			sendHookError(w, r, err, "Error running bulk operations: ")
+			return
+		}
+
+		httpresponder.SendNormalResponse(w, r, response)
+	})
+
+	// {"where": {"Status": "draft"}, "data": {...}, "limit": 100, "mode": "atomic"}
+	r.Post("/update-where", func(w http.ResponseWriter, r *http.Request) {
+		collectionName, ok := collectionFromRequest(w, r, permissions.ActionUpdate)
+		if !ok {
+			return
+		}
+
+		var body struct {
+			Mode  string                 `json:"mode"`
+			Where map[string]interface{} `json:"where"`
+			Data  map[string]interface{} `json:"data"`
+			Limit int                    `json:"limit"`
+		}
+		if !decodeBulkBody(w, r, &body) {
+			return
+		}
+		if len(body.Data) == 0 {
+			httpresponder.SendErrorResponse(w, r, "Missing data", http.StatusBadRequest)
+			return
+		}
+
+		mode, err := parseBulkMode(body.Mode)
+		if err != nil {
+			sendHookError(w, r, err, "")
+			return
+		}
+		limit, err := bulkLimit(body.Limit)
+		if err != nil {
+			sendHookError(w, r, err, "")
+			return
+		}
+		ids, err := matchingIDs(r, database, collectionName, body.Where, limit)
+		if err != nil {
+			sendHookError(w, r, err, "Error finding entries: ")
+			return
+		}
+
+		response, err := runBulk(r, database, mode, len(ids), func(r *http.Request, tx *gorm.DB, i int) (string, error) {
+			// every entry gets its own copy, hooks may change the data they are given
+			data := make(map[string]interface{}, len(body.Data))
+			for key, value := range body.Data {
+				data[key] = value
+			}
+			return ids[i], updateEntry(r, tx, collectionName, uuid.FromStringOrNil(ids[i]), data)
+		})
+		if err != nil {
+			sendHookError(w, r, err, "Error updating entries: ")
+			return
+		}
+
+		httpresponder.SendNormalResponse(w, r, response)
+	})
+
+	// {"where": {"Status": "draft"}, "limit": 100, "mode": "atomic"}
+	r.Post("/delete-where", func(w http.ResponseWriter, r *http.Request) {
+		collectionName, ok := collectionFromRequest(w, r, permissions.ActionDelete)
+		if !ok {
+			return
+		}
+
+		var body struct {
+			Mode  string                 `json:"mode"`
+			Where map[string]interface{} `json:"where"`
+			Limit int                    `json:"limit"`
+		}
+		if !decodeBulkBody(w, r, &body) {
+			return
+		}
+
+		mode, err := parseBulkMode(body.Mode)
+		if err != nil {
+			sendHookError(w, r, err, "")
+			return
+		}
+		limit, err := bulkLimit(body.Limit)
+		if err != nil {
+			sendHookError(w, r, err, "")
+			return
+		}
+		ids, err := matchingIDs(r, database, collectionName, body.Where, limit)
+		if err != nil {
+			sendHookError(w, r, err, "Error finding entries: ")
+			return
+		}
+
+		response, err := runBulk(r, database, mode, len(ids), func(r *http.Request, tx *gorm.DB, i int) (string, error) {
+			return ids[i], deleteEntry(r, tx, collectionName, uuid.FromStringOrNil(ids[i]))
+		})
+		if err != nil {
+			sendHookError(w, r, err, "Error deleting entries: ")
+			return
+		}
+
+		httpresponder.SendNormalResponse(w, r, response)
+	})
+}
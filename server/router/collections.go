@@ -3,15 +3,18 @@ package router
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
 	"strings"
-	"time"
 
 	"github.com/chukfi/backend/src/httpresponder"
+	"github.com/chukfi/backend/src/lib/changefeed"
+	"github.com/chukfi/backend/src/lib/filter"
 	"github.com/chukfi/backend/src/lib/permissions"
 	"github.com/chukfi/backend/src/lib/schemaregistry"
 	"github.com/go-chi/chi/v5"
 	uuid "github.com/satori/go.uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 func RegisterCollectionRoutes(r chi.Router, database *gorm.DB) {
@@ -21,21 +24,25 @@ func RegisterCollectionRoutes(r chi.Router, database *gorm.DB) {
 
 			r.Get("/all", func(w http.ResponseWriter, r *http.Request) {
 				// gets all
-				user, err := GetUserFromRequest(r, database)
+				_, err := GetUserFromRequest(r, database)
 
 				if err != nil {
 					httpresponder.SendErrorResponse(w, r, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
 					return
 				}
 
-				hasPermission := permissions.HasPermission(permissions.Permission(user.Permissions), permissions.ViewModels)
-				if !hasPermission {
+				// ViewModels lists every collection, the read permission of a collection (posts.read) just that one
+				allSchemas := schemaregistry.GetAllRegisteredSchemas()
+				for tableName := range allSchemas {
+					if !RequestHasCollectionPermission(r, database, tableName, permissions.ActionRead) {
+						delete(allSchemas, tableName)
+					}
+				}
+				if len(allSchemas) == 0 {
 					httpresponder.SendErrorResponse(w, r, "Forbidden: You do not have permission to view models", http.StatusForbidden)
 					return
 				}
 
-				allSchemas := schemaregistry.GetAllRegisteredSchemas()
-
 				httpresponder.SendNormalResponse(w, r, map[string]interface{}{
 					"schemas": allSchemas,
 				})
@@ -50,12 +57,6 @@ func RegisterCollectionRoutes(r chi.Router, database *gorm.DB) {
 				r.Use(AuthMiddlewareWithDatabase(database))
 
 				r.Get("/metadata", func(w http.ResponseWriter, r *http.Request) {
-					hasPermission := RequestRequiresPermission(r, database, permissions.ViewModels)
-					if !hasPermission {
-						httpresponder.SendErrorResponse(w, r, "Forbidden: You do not have permission to access this collection metadata", http.StatusForbidden)
-						return
-					}
-
 					collectionName := chi.URLParam(r, "collectionName")
 
 					resolvedName, exists := schemaregistry.ResolveTableName(collectionName)
@@ -65,6 +66,12 @@ func RegisterCollectionRoutes(r chi.Router, database *gorm.DB) {
 					}
 					collectionName = resolvedName
 
+					hasPermission := RequestHasCollectionPermission(r, database, collectionName, permissions.ActionRead)
+					if !hasPermission {
+						httpresponder.SendErrorResponse(w, r, "Forbidden: You do not have permission to access this collection metadata", http.StatusForbidden)
+						return
+					}
+
 					metadata, _ := schemaregistry.GetMetadata(collectionName)
 
 					httpresponder.SendNormalResponse(w, r, metadata)
@@ -83,7 +90,7 @@ func RegisterCollectionRoutes(r chi.Router, database *gorm.DB) {
 					}
 					collectionName = resolvedName
 
-					hasPermission := RequestRequiresPermission(r, database, permissions.ManageModels)
+					hasPermission := RequestHasCollectionPermission(r, database, collectionName, permissions.ActionUpdate)
 					if !hasPermission {
 						httpresponder.SendErrorResponse(w, r, "Forbidden: You do not have permission to access this collection metadata", http.StatusForbidden)
 						return
@@ -115,25 +122,8 @@ func RegisterCollectionRoutes(r chi.Router, database *gorm.DB) {
 						return
 					}
 
-					// check if everything else is valid to IsBodyMostlyValid
-					isValid, err := schemaregistry.IsBodyMostlyValid(collectionName, data)
-					if !isValid {
-						httpresponder.SendErrorResponse(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
-						return
-					}
-
-					// set updated_at
-					data["updated_at"] = time.Now()
-
-					res, err := gorm.G[map[string]interface{}](database).Table(collectionName).Where("id = ?", id).Updates(r.Context(), data)
-
-					if err != nil {
-						httpresponder.SendErrorResponse(w, r, "Error updating entry: "+err.Error(), http.StatusInternalServerError)
-						return
-					}
-
-					if res == 0 {
-						httpresponder.SendErrorResponse(w, r, "No entry found with the given ID", http.StatusBadRequest)
+					if err := updateEntry(r, database, collectionName, id, data); err != nil {
+						sendHookError(w, r, err, "Error updating entry: ")
 						return
 					}
 
@@ -154,7 +144,7 @@ func RegisterCollectionRoutes(r chi.Router, database *gorm.DB) {
 					}
 					collectionName = resolvedName
 
-					hasPermission := RequestRequiresPermission(r, database, permissions.ManageModels)
+					hasPermission := RequestHasCollectionPermission(r, database, collectionName, permissions.ActionCreate)
 					if !hasPermission {
 						httpresponder.SendErrorResponse(w, r, "Forbidden: You do not have permission to access this collection metadata", http.StatusForbidden)
 						return
@@ -168,32 +158,60 @@ func RegisterCollectionRoutes(r chi.Router, database *gorm.DB) {
 						return
 					}
 
-					missing, unknown := schemaregistry.ValidateBody(collectionName, data)
-
-					if len(missing) > 0 {
-						httpresponder.SendErrorResponse(w, r, "Missing required fields: "+strings.Join(missing, ", "), http.StatusBadRequest)
+					data, err = createEntry(r, database, collectionName, data)
+					if err != nil {
+						sendHookError(w, r, err, "Error creating entry: ")
 						return
 					}
 
-					if len(unknown) > 0 {
-						httpresponder.SendErrorResponse(w, r, "Unknown fields: "+strings.Join(unknown, ", "), http.StatusBadRequest)
+					hideFields(r, database, collectionName, []map[string]interface{}{data})
+					httpresponder.SendNormalResponse(w, r, data)
+
+				})
+
+				r.Post("/delete", func(w http.ResponseWriter, r *http.Request) {
+					// this route deletes an entry (soft delete if the collection has a DeletedAt)
+					collectionName := chi.URLParam(r, "collectionName")
+
+					resolvedName, exists := schemaregistry.ResolveTableName(collectionName)
+					if !exists {
+						httpresponder.SendErrorResponse(w, r, "Invalid collection name: "+collectionName, http.StatusBadRequest)
 						return
 					}
+					collectionName = resolvedName
 
-					data["ID"] = uuid.NewV4()
-					data["created_at"] = time.Now()
-					data["updated_at"] = time.Now()
+					hasPermission := RequestHasCollectionPermission(r, database, collectionName, permissions.ActionDelete)
+					if !hasPermission {
+						httpresponder.SendErrorResponse(w, r, "Forbidden: You do not have permission to delete entries", http.StatusForbidden)
+						return
+					}
 
-					result := gorm.G[map[string]interface{}](database).Table(collectionName).Create(r.Context(), &data)
+					var body struct {
+						ID string `json:"ID"`
+					}
+					if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+						httpresponder.SendErrorResponse(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+						return
+					}
 
-					if result != nil {
-						httpresponder.SendErrorResponse(w, r, "Error creating entry: "+result.Error(), http.StatusInternalServerError)
+					id, err := uuid.FromString(body.ID)
+					if err != nil {
+						httpresponder.SendErrorResponse(w, r, "Invalid ID format: "+err.Error(), http.StatusBadRequest)
 						return
 					}
 
-					httpresponder.SendNormalResponse(w, r, data)
+					if err := deleteEntry(r, database, collectionName, id); err != nil {
+						sendHookError(w, r, err, "Error deleting entry: ")
+						return
+					}
 
+					httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+						"success": true,
+					})
 				})
+
+				// /bulk, /update-where and /delete-where
+				registerBulkRoutes(r, database)
 			})
 
 			r.Post("/get", func(w http.ResponseWriter, r *http.Request) {
@@ -206,24 +224,18 @@ func RegisterCollectionRoutes(r chi.Router, database *gorm.DB) {
 				}
 				collectionName = resolvedName
 
-				if schemaregistry.IsAdminOnly(collectionName) {
-					authToken, ok := r.Context().Value("authToken").(string)
-					if !ok || authToken == "" {
-						httpresponder.SendErrorResponse(w, r, "Unauthorized: Authentication required for this collection", http.StatusUnauthorized)
-						return
-					}
-					hasPermission := RequestRequiresPermission(r, database, permissions.ViewModels)
-					if !hasPermission {
-						httpresponder.SendErrorResponse(w, r, "Forbidden: You do not have permission to access this collection", http.StatusForbidden)
-						return
-					}
+				if err := checkReadAccess(r, database, collectionName); err != nil {
+					sendHookError(w, r, err, "")
+					return
 				}
 
 				var body struct {
 					Take   *int   `json:"take"`
 					Page   *int   `json:"page"`
 					Select string `json:"select"`
-					Where  string `json:"where"`
+					// a filter object, or the old "field:value,field:value" string
+					Where   json.RawMessage `json:"where"`
+					OrderBy json.RawMessage `json:"orderBy"`
 				}
 				json.NewDecoder(r.Body).Decode(&body)
 
@@ -242,44 +254,183 @@ func RegisterCollectionRoutes(r chi.Router, database *gorm.DB) {
 				}
 				offset := (page - 1) * take
 
-				query := database.Table(collectionName)
+				query := scopeEntries(r, database, collectionName, permissions.ActionRead, database.Table(collectionName))
 
 				if body.Select != "" {
-					fields := strings.Split(body.Select, ",")
-					for i := range fields {
-						fields[i] = strings.TrimSpace(fields[i])
+					columns, err := filter.Select(collectionName, body.Select)
+					if err != nil {
+						sendHookError(w, r, err, "Error fetching collection: ")
+						return
 					}
-					query = query.Select(fields)
+					query = query.Select(columns)
 				}
 
-				if body.Where != "" {
-					conditions := strings.Split(body.Where, ",")
-					for _, condition := range conditions {
-						parts := strings.SplitN(condition, ":", 2)
-						if len(parts) == 2 {
-							field := strings.TrimSpace(parts[0])
-							value := strings.TrimSpace(parts[1])
-							query = query.Where(field+" = ?", value)
-						}
-					}
+				var where clause.Expression
+				var err error
+				var legacyWhere string
+				if json.Unmarshal(body.Where, &legacyWhere) == nil {
+					where, err = filter.ParseLegacy(collectionName, legacyWhere)
+				} else {
+					where, err = filter.ParseJSON(collectionName, body.Where)
+				}
+				if err != nil {
+					sendHookError(w, r, err, "Error fetching collection: ")
+					return
+				}
+				if where != nil {
+					query = query.Where(where)
+				}
+
+				orderBy, err := filter.ParseOrderJSON(collectionName, body.OrderBy)
+				if err != nil {
+					sendHookError(w, r, err, "Error fetching collection: ")
+					return
+				}
+				for _, column := range orderBy {
+					query = query.Order(column)
 				}
 
 				query = query.Limit(take).Offset(offset)
 
-				var results []map[string]interface{}
-				err := query.Find(&results).Error
+				results, err := readWithHooks(r, collectionName, query)
 				if err != nil {
 					if err == gorm.ErrRecordNotFound {
 						httpresponder.SendErrorResponse(w, r, "Invalid collection name: "+collectionName, http.StatusBadRequest)
 						return
 					}
-					httpresponder.SendErrorResponse(w, r, "Error fetching collection: "+err.Error(), http.StatusInternalServerError)
+					sendHookError(w, r, err, "Error fetching collection: ")
 					return
 				}
 
 				httpresponder.SendNormalResponse(w, r, results)
 			})
+
+			// delta sync, the entries changed since the cursor (tombstones for deleted ones), same access rules as /get
+			r.Get("/changes", func(w http.ResponseWriter, r *http.Request) {
+				collectionName := chi.URLParam(r, "collectionName")
+
+				resolvedName, exists := schemaregistry.ResolveTableName(collectionName)
+				if !exists {
+					httpresponder.SendErrorResponse(w, r, "Invalid collection name: "+collectionName, http.StatusBadRequest)
+					return
+				}
+				collectionName = resolvedName
+
+				if err := checkReadAccess(r, database, collectionName); err != nil {
+					sendHookError(w, r, err, "")
+					return
+				}
+
+				since, err := changefeed.ParseCursor(r.URL.Query().Get("since"))
+				if err != nil {
+					httpresponder.SendErrorResponse(w, r, "Invalid since cursor", http.StatusBadRequest)
+					return
+				}
+
+				take := 100
+				if value, err := strconv.Atoi(r.URL.Query().Get("take")); err == nil && value > 0 {
+					take = min(value, 500) // max 500
+				}
+
+				page, err := changefeed.Changes(database, collectionName, since, take, func(ids []string) ([]map[string]interface{}, error) {
+					if len(ids) == 0 {
+						return nil, nil
+					}
+					// soft deleted rows are loaded too, they become tombstones
+					return readWithHooks(r, collectionName, scopeEntries(r, database, collectionName, permissions.ActionRead, database.Table(collectionName).Where("id IN ?", ids)))
+				})
+				if err != nil {
+					sendHookError(w, r, err, "Error fetching changes: ")
+					return
+				}
+
+				httpresponder.SendNormalResponse(w, r, page)
+			})
+
+			// full text search through the search engine, same access rules as /get
+			r.Post("/search", func(w http.ResponseWriter, r *http.Request) {
+				collectionName := chi.URLParam(r, "collectionName")
+
+				resolvedName, exists := schemaregistry.ResolveTableName(collectionName)
+				if !exists {
+					httpresponder.SendErrorResponse(w, r, "Invalid collection name: "+collectionName, http.StatusBadRequest)
+					return
+				}
+				collectionName = resolvedName
+
+				if err := checkReadAccess(r, database, collectionName); err != nil {
+					sendHookError(w, r, err, "")
+					return
+				}
+
+				var body searchRequest
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					httpresponder.SendErrorResponse(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+
+				runSearch(w, r, database, []string{collectionName}, body)
+			})
+
+			// a single entry, ?select=title,body&expand=AuthorID, same access rules as /get
+			r.Get("/{entryID}", func(w http.ResponseWriter, r *http.Request) {
+				collectionName := chi.URLParam(r, "collectionName")
+
+				resolvedName, exists := schemaregistry.ResolveTableName(collectionName)
+				if !exists {
+					httpresponder.SendErrorResponse(w, r, "Invalid collection name: "+collectionName, http.StatusBadRequest)
+					return
+				}
+				collectionName = resolvedName
+
+				if err := checkReadAccess(r, database, collectionName); err != nil {
+					sendHookError(w, r, err, "Error fetching entry: ")
+					return
+				}
+
+				id, err := uuid.FromString(chi.URLParam(r, "entryID"))
+				if err != nil {
+					httpresponder.SendErrorResponse(w, r, "Invalid ID format: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+
+				query := scopeEntries(r, database, collectionName, permissions.ActionRead, database.WithContext(r.Context()).Table(collectionName).Where("id = ?", id).Limit(1))
+				if schemaregistry.HasSoftDelete(collectionName) {
+					query = query.Where("deleted_at IS NULL")
+				}
+				if list := r.URL.Query().Get("select"); list != "" {
+					// the expanded references have to be selected to be expanded
+					columns, err := filter.Select(collectionName, list+","+r.URL.Query().Get("expand"))
+					if err != nil {
+						sendHookError(w, r, err, "Error fetching entry: ")
+						return
+					}
+					query = query.Select(columns)
+				}
+
+				results, err := readWithHooks(r, collectionName, query)
+				if err != nil {
+					sendHookError(w, r, err, "Error fetching entry: ")
+					return
+				}
+				if len(results) == 0 {
+					httpresponder.SendErrorResponse(w, r, "Entry not found", http.StatusNotFound)
+					return
+				}
+
+				if expand := r.URL.Query().Get("expand"); expand != "" {
+					if err := expandReferences(r, database, collectionName, results, strings.Split(expand, ",")); err != nil {
+						sendHookError(w, r, err, "Error expanding entry: ")
+						return
+					}
+				}
+
+				// may be cached, but has to be revalidated as the entry or the user's access can change
+				w.Header().Set("Cache-Control", "private, no-cache")
+				sendWithETag(w, r, results[0])
+			})
 		})
 
 	})
 }
+
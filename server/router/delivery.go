@@ -0,0 +1,261 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/chukfi/backend/src/httpresponder"
+	"github.com/chukfi/backend/src/lib/delivery"
+	"github.com/chukfi/backend/src/lib/filter"
+	"github.com/chukfi/backend/src/lib/permissions"
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+	"github.com/go-chi/chi/v5"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// getDeliveredCollection resolves the {collectionName} url param and checks the api key, sending the error response if it fails
+func getDeliveredCollection(w http.ResponseWriter, r *http.Request, database *gorm.DB) (delivery.Collection, bool) {
+	collection, ok := delivery.Get(chi.URLParam(r, "collectionName"))
+	if !ok {
+		// collections that arent delivered dont exist as far as the public api is concerned
+		httpresponder.SendErrorResponse(w, r, "Collection not found", http.StatusNotFound)
+		return collection, false
+	}
+
+	if collection.Options.RequireAPIKey {
+		if _, err := delivery.Authenticate(r.Context(), database, r.Header.Get("X-API-Key"), collection.Name); err != nil {
+			if errors.Is(err, delivery.ErrInvalidAPIKey) {
+				httpresponder.SendErrorResponse(w, r, "Unauthorized: A valid X-API-Key header is required", http.StatusUnauthorized)
+				return collection, false
+			}
+			httpresponder.SendErrorResponse(w, r, "Error checking api key: "+err.Error(), http.StatusInternalServerError)
+			return collection, false
+		}
+	}
+	return collection, true
+}
+
+// sendDeliveryResponse sends the payload with the caching headers of the collection
+func sendDeliveryResponse(w http.ResponseWriter, r *http.Request, collection delivery.Collection, payload interface{}) {
+	w.Header().Set("Cache-Control", collection.CacheControl())
+	if collection.Options.RequireAPIKey {
+		w.Header().Set("Vary", "X-API-Key")
+	}
+	sendWithETag(w, r, payload)
+}
+
+// deliveryOrder turns ?sort=title,-created_at into the columns to sort on, only fields the collection delivers can be sorted on
+func deliveryOrder(collection delivery.Collection, sort string) ([]clause.OrderByColumn, error) {
+	if sort == "" {
+		if schemaregistry.HasField(collection.Name, "created_at") {
+			return []clause.OrderByColumn{{Column: clause.Column{Name: "created_at"}, Desc: true}}, nil
+		}
+		return nil, nil
+	}
+
+	order, err := filter.ParseOrder(collection.Name, sort)
+	if err != nil {
+		return nil, err
+	}
+	for _, column := range order {
+		if collection.Columns != nil && !slices.Contains(collection.Columns, column.Column.Name) {
+			return nil, schemaregistry.Reject("Invalid sort field: %s", column.Column.Name)
+		}
+	}
+	return order, nil
+}
+
+// DeliveryPath returns where the content delivery api is served, DELIVERY_PATH or /content
+func DeliveryPath() string {
+	path := strings.ToLower(strings.TrimSpace(os.Getenv("DELIVERY_PATH")))
+	if path == "" {
+		return "/content"
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return strings.TrimSuffix(path, "/")
+}
+
+/*
+RegisterDeliveryRoutes registers the public, read only content delivery api at DeliveryPath() for the collections
+enabled with delivery.Enable. It shares no routes with /admin, so it can be cached and rate limited on its own.
+*/
+func RegisterDeliveryRoutes(r chi.Router, database *gorm.DB) {
+	r.Route(DeliveryPath(), func(r chi.Router) {
+		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+				"collections": delivery.Collections(),
+			})
+		})
+
+		// a page of entries, ?take=&page=&sort=title,-created_at
+		r.Get("/{collectionName}", func(w http.ResponseWriter, r *http.Request) {
+			collection, ok := getDeliveredCollection(w, r, database)
+			if !ok {
+				return
+			}
+
+			take := 30
+			if value, err := strconv.Atoi(r.URL.Query().Get("take")); err == nil && value > 0 {
+				take = min(value, 100) // max 100
+			}
+
+			page := 1
+			if value, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && value > 0 {
+				page = value
+			}
+
+			order, err := deliveryOrder(collection, r.URL.Query().Get("sort"))
+			if err != nil {
+				sendHookError(w, r, err, "Error fetching collection: ")
+				return
+			}
+
+			query := collection.Scope(database.WithContext(r.Context()).Table(collection.Name))
+			for _, column := range order {
+				query = query.Order(column)
+			}
+
+			results, total, err := readPageWithHooks(r, collection.Name, query, take, (page-1)*take)
+			if err != nil {
+				sendHookError(w, r, err, "Error fetching collection: ")
+				return
+			}
+			if results == nil {
+				results = []map[string]interface{}{}
+			}
+
+			sendDeliveryResponse(w, r, collection, map[string]interface{}{
+				"data":  results,
+				"total": total,
+				"page":  page,
+				"take":  take,
+			})
+		})
+
+		r.Get("/{collectionName}/{entryID}", func(w http.ResponseWriter, r *http.Request) {
+			collection, ok := getDeliveredCollection(w, r, database)
+			if !ok {
+				return
+			}
+
+			id, err := uuid.FromString(chi.URLParam(r, "entryID"))
+			if err != nil {
+				httpresponder.SendErrorResponse(w, r, "Invalid ID format: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			query := collection.Scope(database.WithContext(r.Context()).Table(collection.Name)).Where("id = ?", id).Limit(1)
+			results, err := readWithHooks(r, collection.Name, query)
+			if err != nil {
+				sendHookError(w, r, err, "Error fetching entry: ")
+				return
+			}
+			if len(results) == 0 {
+				httpresponder.SendErrorResponse(w, r, "Entry not found", http.StatusNotFound)
+				return
+			}
+
+			sendDeliveryResponse(w, r, collection, map[string]interface{}{
+				"data": results[0],
+			})
+		})
+	})
+}
+
+type apiKeyRequest struct {
+	Name        string   `json:"name"`
+	Collections []string `json:"collections"`
+}
+
+/*
+RegisterAPIKeyRoutes registers the management routes of the delivery api keys, all of them require Administrator
+*/
+func RegisterAPIKeyRoutes(r chi.Router, database *gorm.DB) {
+	r.Route("/apikeys", func(r chi.Router) {
+		r.Use(AuthMiddlewareWithDatabase(database))
+		r.Use(RoutesRequiresPermission(database, permissions.Administrator))
+
+		r.Get("/list", func(w http.ResponseWriter, r *http.Request) {
+			results, err := gorm.G[delivery.APIKey](database).Order("created_at DESC").Find(r.Context())
+			if err != nil {
+				httpresponder.SendErrorResponse(w, r, "Error fetching api keys: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+				"apiKeys": results,
+			})
+		})
+
+		r.Post("/create", func(w http.ResponseWriter, r *http.Request) {
+			var body apiKeyRequest
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				httpresponder.SendErrorResponse(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			body.Name = strings.TrimSpace(body.Name)
+			if body.Name == "" {
+				httpresponder.SendErrorResponse(w, r, "Invalid api key: name is required", http.StatusBadRequest)
+				return
+			}
+			for i, name := range body.Collections {
+				collection, ok := delivery.Get(strings.TrimSpace(name))
+				if !ok {
+					httpresponder.SendErrorResponse(w, r, "Invalid api key: collection is not delivered: "+name, http.StatusBadRequest)
+					return
+				}
+				body.Collections[i] = collection.Name
+			}
+
+			key, err := delivery.GenerateKey()
+			if err != nil {
+				httpresponder.SendErrorResponse(w, r, "Error generating api key: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			apiKey := delivery.APIKey{
+				Name:        body.Name,
+				Prefix:      key[:12],
+				KeyHash:     delivery.HashKey(key),
+				Collections: strings.Join(body.Collections, ","),
+				CreatedBy:   GetUserIDFromRequest(r),
+			}
+			if err := gorm.G[delivery.APIKey](database).Create(r.Context(), &apiKey); err != nil {
+				httpresponder.SendErrorResponse(w, r, "Error creating api key: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			// the key is only ever shown here
+			httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+				"apiKey": apiKey,
+				"key":    key,
+			})
+		})
+
+		r.Post("/{keyID}/delete", func(w http.ResponseWriter, r *http.Request) {
+			res, err := gorm.G[delivery.APIKey](database).Where("id = ?", chi.URLParam(r, "keyID")).Delete(r.Context())
+			if err != nil {
+				httpresponder.SendErrorResponse(w, r, "Error deleting api key: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if res == 0 {
+				httpresponder.SendErrorResponse(w, r, "API key not found", http.StatusNotFound)
+				return
+			}
+
+			httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+				"success": true,
+			})
+		})
+	})
+}
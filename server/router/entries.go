@@ -0,0 +1,527 @@
+package router
+
+// the reads and writes of collection entries, shared by the collection routes and the other apis
+// built on top of them, so validation, lifecycle hooks and events always happen the same way
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chukfi/backend/database/schema"
+	"github.com/chukfi/backend/src/httpresponder"
+	"github.com/chukfi/backend/src/lib/events"
+	"github.com/chukfi/backend/src/lib/media"
+	"github.com/chukfi/backend/src/lib/permissions"
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+/*
+createEntry validates the data and creates an entry with it, returning the data as written.
+Errors meant for the client are HookErrors carrying the status to send.
+*/
+func createEntry(r *http.Request, database *gorm.DB, collectionName string, data map[string]interface{}) (map[string]interface{}, error) {
+	if err := setOwner(r, database, collectionName, data); err != nil {
+		return nil, err
+	}
+	if err := policyError(authorizeEntry(r, database, collectionName, permissions.ActionCreate, data)); err != nil {
+		return nil, err
+	}
+
+	missing, unknown := schemaregistry.ValidateBody(collectionName, data)
+	if len(missing) > 0 {
+		return nil, schemaregistry.NewHookError(http.StatusBadRequest, "Missing required fields: "+strings.Join(missing, ", "))
+	}
+	if len(unknown) > 0 {
+		return nil, schemaregistry.NewHookError(http.StatusBadRequest, "Unknown fields: "+strings.Join(unknown, ", "))
+	}
+	if readOnly := schemaregistry.ReadOnlyFields(collectionName, data); len(readOnly) > 0 {
+		return nil, schemaregistry.NewHookError(http.StatusBadRequest, "Read only fields: "+strings.Join(readOnly, ", "))
+	}
+
+	id := uuid.NewV4()
+	data["ID"] = id
+	data["created_at"] = time.Now()
+	data["updated_at"] = time.Now()
+
+	hook := &schemaregistry.HookContext{Collection: collectionName, ID: id.String(), Data: data}
+	err := writeWithHooks(r, database, hook, schemaregistry.BeforeCreate, schemaregistry.AfterCreate, func(tx *gorm.DB) error {
+		// the id is fixed, a before hook cant change it
+		hook.Data["ID"] = id
+		if err := media.ValidateReferences(r.Context(), tx, collectionName, hook.Data); err != nil {
+			return schemaregistry.NewHookError(http.StatusBadRequest, "Invalid request body: "+err.Error())
+		}
+		return gorm.G[map[string]interface{}](tx).Table(collectionName).Create(r.Context(), &hook.Data)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	publishCollectionEvent(r, events.EventCreate, collectionName, id.String(), hook.Data)
+	return hook.Data, nil
+}
+
+// updateEntry validates the data and applies it to the entry, see createEntry for the errors
+func updateEntry(r *http.Request, database *gorm.DB, collectionName string, id uuid.UUID, data map[string]interface{}) error {
+	// check if everything else is valid to IsBodyMostlyValid
+	if isValid, err := schemaregistry.IsBodyMostlyValid(collectionName, data); !isValid {
+		return schemaregistry.NewHookError(http.StatusBadRequest, "Invalid request body: "+err.Error())
+	}
+	if readOnly := schemaregistry.ReadOnlyFields(collectionName, data); len(readOnly) > 0 {
+		return schemaregistry.NewHookError(http.StatusBadRequest, "Read only fields: "+strings.Join(readOnly, ", "))
+	}
+	if err := checkOwnerChange(r, database, collectionName, data); err != nil {
+		return err
+	}
+
+	// set updated_at
+	data["updated_at"] = time.Now()
+
+	allowed := entryCondition(r, database, collectionName, permissions.ActionUpdate)
+	var owner interface{}
+
+	hook := &schemaregistry.HookContext{Collection: collectionName, ID: id.String(), Data: data}
+	err := writeWithHooks(r, database, hook, schemaregistry.BeforeUpdate, schemaregistry.AfterUpdate, func(tx *gorm.DB) error {
+		if err := media.ValidateReferences(r.Context(), tx, collectionName, hook.Data); err != nil {
+			return schemaregistry.NewHookError(http.StatusBadRequest, "Invalid request body: "+err.Error())
+		}
+
+		query := gorm.G[map[string]interface{}](tx).Table(collectionName).Where("id = ?", id)
+		if allowed != nil {
+			query = query.Where(allowed)
+		}
+		res, err := query.Updates(r.Context(), hook.Data)
+		if err == nil && res == 0 {
+			return errEntryNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		// checked again on the entry as written, so an update can't move it out of what the policy allows
+		var updated map[string]interface{}
+		if err := tx.Table(collectionName).Where("id = ?", id).Take(&updated).Error; err != nil {
+			return err
+		}
+		if err := policyError(authorizeEntry(r, database, collectionName, permissions.ActionUpdate, updated)); err != nil {
+			return err
+		}
+
+		owner = ownerOf(tx, collectionName, id)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	publishCollectionEvent(r, events.EventUpdate, collectionName, id.String(), withOwner(collectionName, hook.Data, owner))
+	return nil
+}
+
+// deleteEntry deletes the entry, soft deleting it if the collection has a DeletedAt
+func deleteEntry(r *http.Request, database *gorm.DB, collectionName string, id uuid.UUID) error {
+	hook := &schemaregistry.HookContext{Collection: collectionName, ID: id.String(), Data: map[string]interface{}{
+		"ID": id.String(),
+	}}
+	allowed := entryCondition(r, database, collectionName, permissions.ActionDelete)
+	var owner interface{}
+
+	err := writeWithHooks(r, database, hook, schemaregistry.BeforeDelete, schemaregistry.AfterDelete, func(tx *gorm.DB) error {
+		// read before the delete, the event needs it once the entry is gone
+		owner = ownerOf(tx, collectionName, id)
+
+		query := gorm.G[map[string]interface{}](tx).Table(collectionName).Where("id = ?", id)
+		if allowed != nil {
+			query = query.Where(allowed)
+		}
+		var res int
+		var err error
+		if schemaregistry.HasSoftDelete(collectionName) {
+			res, err = query.Where("deleted_at IS NULL").Updates(r.Context(), map[string]interface{}{
+				"deleted_at": time.Now(),
+			})
+		} else {
+			res, err = query.Delete(r.Context())
+		}
+		if err == nil && res == 0 {
+			return errEntryNotFound
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	publishCollectionEvent(r, events.EventDelete, collectionName, id.String(), withOwner(collectionName, hook.Data, owner))
+	return nil
+}
+
+/*
+publishCollectionEvent publishes a write on the events bus, plus a publish event if the write published the entry.
+Inside deferEvents the events are held back until the caller flushes them. Write only fields are left out of the
+event, fields behind a permission are kept and hidden by whatever sends the event to a user (see realtime)
+*/
+func publishCollectionEvent(r *http.Request, eventType events.EventType, collectionName string, id string, data map[string]interface{}) {
+	eventData := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		eventData[key] = value
+	}
+	schemaregistry.HideFields(collectionName, []map[string]interface{}{eventData}, func(string) bool { return true })
+
+	event := events.Event{
+		Type:       eventType,
+		Collection: collectionName,
+		ID:         id,
+		Data:       eventData,
+		UserID:     GetUserIDFromRequest(r),
+	}
+	publish := []events.Event{event}
+
+	if eventType != events.EventDelete && isPublishing(collectionName, data) {
+		event.Type = events.EventPublish
+		publish = append(publish, event)
+	}
+
+	if pending, ok := r.Context().Value("pendingEvents").(*[]events.Event); ok {
+		*pending = append(*pending, publish...)
+		return
+	}
+	for _, event := range publish {
+		events.Publish(event)
+	}
+}
+
+/*
+deferEvents returns a request whose writes hold their events back, for writes made in a transaction the
+events must only go out once it commits. flush publishes them, discard drops them after a rollback
+*/
+func deferEvents(r *http.Request) (deferred *http.Request, flush func(), discard func()) {
+	pending := &[]events.Event{}
+	deferred = r.WithContext(context.WithValue(r.Context(), "pendingEvents", pending))
+
+	flush = func() {
+		for _, event := range *pending {
+			events.Publish(event)
+		}
+		*pending = nil
+	}
+	discard = func() {
+		*pending = nil
+	}
+	return deferred, flush, discard
+}
+
+// isPublishing checks if the data sets the Published (bool) or PublishedAt field of the collection
+func isPublishing(collectionName string, data map[string]interface{}) bool {
+	for _, name := range []string{"Published", "PublishedAt"} {
+		field, ok := schemaregistry.GetField(collectionName, name)
+		if !ok {
+			continue
+		}
+
+		value, exists := data[field.Name]
+		if !exists {
+			value, exists = data[field.Column]
+		}
+		if !exists || value == nil {
+			continue
+		}
+
+		switch v := value.(type) {
+		case bool:
+			if v {
+				return true
+			}
+		case string:
+			if v != "" && v != "false" {
+				return true
+			}
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// errEntryNotFound is returned from a write that matched no entry, it rolls the transaction back like a hook error would
+var errEntryNotFound = schemaregistry.NewHookError(http.StatusBadRequest, "No entry found with the given ID")
+
+/*
+writeWithHooks runs the before hooks, the write and the after hooks of a collection in one transaction,
+so a failing after hook undoes the write
+*/
+func writeWithHooks(r *http.Request, database *gorm.DB, hook *schemaregistry.HookContext, before schemaregistry.HookType, after schemaregistry.HookType, write func(tx *gorm.DB) error) error {
+	hook.Context = r.Context()
+	hook.UserID = GetUserIDFromRequest(r)
+
+	return database.WithContext(r.Context()).Transaction(func(tx *gorm.DB) error {
+		hook.Tx = tx
+
+		hook.Type = before
+		if err := schemaregistry.RunHooks(hook); err != nil {
+			return err
+		}
+
+		if err := write(tx); err != nil {
+			return err
+		}
+
+		hook.Type = after
+		return schemaregistry.RunHooks(hook)
+	})
+}
+
+// readWithHooks runs the query between the BeforeRead and AfterRead hooks of the collection
+func readWithHooks(r *http.Request, collectionName string, query *gorm.DB) ([]map[string]interface{}, error) {
+	hook := &schemaregistry.HookContext{
+		Context:    r.Context(),
+		Type:       schemaregistry.BeforeRead,
+		Collection: collectionName,
+		UserID:     GetUserIDFromRequest(r),
+		Query:      query,
+	}
+	if err := schemaregistry.RunHooks(hook); err != nil {
+		return nil, err
+	}
+
+	var results []map[string]interface{}
+	if err := hook.Query.Find(&results).Error; err != nil {
+		return nil, err
+	}
+
+	hook.Type = schemaregistry.AfterRead
+	hook.Results = results
+	if err := schemaregistry.RunHooks(hook); err != nil {
+		return nil, err
+	}
+	hideFields(r, hook.Query.Session(&gorm.Session{NewDB: true}), collectionName, hook.Results)
+	return hook.Results, nil
+}
+
+/*
+readPageWithHooks is readWithHooks for a page of entries, it also counts every entry the query matches
+(after the BeforeRead hooks, so a hook filtering the entries filters the total too)
+*/
+func readPageWithHooks(r *http.Request, collectionName string, query *gorm.DB, take int, offset int) ([]map[string]interface{}, int64, error) {
+	hook := &schemaregistry.HookContext{
+		Context:    r.Context(),
+		Type:       schemaregistry.BeforeRead,
+		Collection: collectionName,
+		UserID:     GetUserIDFromRequest(r),
+		Query:      query,
+	}
+	if err := schemaregistry.RunHooks(hook); err != nil {
+		return nil, 0, err
+	}
+
+	var total int64
+	if err := hook.Query.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var results []map[string]interface{}
+	if err := hook.Query.Limit(take).Offset(offset).Find(&results).Error; err != nil {
+		return nil, 0, err
+	}
+
+	hook.Type = schemaregistry.AfterRead
+	hook.Results = results
+	if err := schemaregistry.RunHooks(hook); err != nil {
+		return nil, 0, err
+	}
+	hideFields(r, hook.Query.Session(&gorm.Session{NewDB: true}), collectionName, hook.Results)
+	return hook.Results, total, nil
+}
+
+/*
+hideFields removes the fields the user of the request may not read from rows of the collection: write only fields,
+and fields whose read permission the user doesnt have. It runs after the AfterRead hooks, so hooks still see them
+*/
+func hideFields(r *http.Request, database *gorm.DB, collectionName string, rows []map[string]interface{}) {
+	schemaregistry.HideFields(collectionName, rows, permissionChecker(r, database))
+}
+
+// permissionChecker returns whether the user of the request holds a permission (by name), the user is looked up once needed
+func permissionChecker(r *http.Request, database *gorm.DB) func(name string) bool {
+	var user *schema.User
+	lookedUp := false
+	return func(name string) bool {
+		if !lookedUp {
+			user, _ = GetUserFromRequest(r, database)
+			lookedUp = true
+		}
+		if user == nil {
+			return false
+		}
+		permission, ok := permissions.GetPermissionByName(name)
+		return ok && permissions.HasPermission(user.EffectivePermissions(), permission)
+	}
+}
+
+/*
+publicAdminReads is true when ADMIN_PUBLIC_READS=true, anyone may then read the collections that aren't admin only
+through /admin, like before the content delivery api existed. By default public reads go through the delivery api
+*/
+func publicAdminReads() bool {
+	return strings.ToLower(os.Getenv("ADMIN_PUBLIC_READS")) == "true"
+}
+
+/*
+checkReadAccess applies the read rules of a collection: every collection needs a logged in user (unless
+publicAdminReads), admin only collections also ViewModels or the read permission of the collection (posts.read),
+any collection can be denied by a policy rule
+*/
+func checkReadAccess(r *http.Request, database *gorm.DB, collectionName string) error {
+	if schemaregistry.IsAdminOnly(collectionName) || !publicAdminReads() {
+		if _, err := GetUserFromRequest(r, database); err != nil {
+			return schemaregistry.NewHookError(http.StatusUnauthorized, "Unauthorized: Authentication required for this collection")
+		}
+	}
+	if !authorize(r, database, permissions.ActionRead, collectionResource(collectionName, permissions.ActionRead, nil)).Allowed {
+		return schemaregistry.NewHookError(http.StatusForbidden, "Forbidden: You do not have permission to access this collection")
+	}
+	return nil
+}
+
+// referenceKey is the key an expanded reference is added under, author_id -> author
+func referenceKey(field schemaregistry.FieldMetadata) string {
+	if key, ok := strings.CutSuffix(field.Column, "_id"); ok && key != "" {
+		return key
+	}
+	return field.Column + "_entry"
+}
+
+/*
+expandReferences adds the entries referenced by the given fields (tagged chukfi:"ref=<collection>" or
+chukfi:"media") to the results, AuthorID adds an author key holding the entry or nil. The referenced
+collection is read with its own access rules and hooks.
+*/
+func expandReferences(r *http.Request, database *gorm.DB, collectionName string, results []map[string]interface{}, expand []string) error {
+	for _, name := range expand {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		field, ok := schemaregistry.GetField(collectionName, name)
+		if !ok {
+			return schemaregistry.Reject("Unknown expand field: %s", name)
+		}
+
+		target, ok := field.Option("ref")
+		if !ok && field.HasOption("media") {
+			target, ok = "media", true
+		}
+		table, exists := schemaregistry.ResolveTableName(target)
+		if !ok || !exists {
+			return schemaregistry.Reject("Field %s does not reference a collection", name)
+		}
+		if err := checkReadAccess(r, database, table); err != nil {
+			return err
+		}
+
+		var ids []string
+		for _, row := range results {
+			if id := referenceID(row[field.Column]); id != "" {
+				ids = append(ids, id)
+			}
+		}
+
+		byID := make(map[string]map[string]interface{})
+		if len(ids) > 0 {
+			query := scopeEntries(r, database, table, permissions.ActionRead, database.WithContext(r.Context()).Table(table).Where("id IN ?", ids))
+			if schemaregistry.HasSoftDelete(table) {
+				query = query.Where("deleted_at IS NULL")
+			}
+			entries, err := readWithHooks(r, table, query)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				byID[referenceID(entry["id"])] = entry
+			}
+		}
+
+		key := referenceKey(field)
+		for _, row := range results {
+			if entry, ok := byID[referenceID(row[field.Column])]; ok {
+				row[key] = entry
+			} else {
+				row[key] = nil
+			}
+		}
+	}
+	return nil
+}
+
+// referenceID turns an id as the driver returns it into a string, "" for nil
+func referenceID(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+/*
+sendWithETag sends the payload as json with an ETag hashed from the body, clients revalidating with
+If-None-Match get a 304 while nothing changed
+*/
+func sendWithETag(w http.ResponseWriter, r *http.Request, payload interface{}) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		httpresponder.SendErrorResponse(w, r, "Error encoding response: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	if etagMatches(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(append(body, '\n'))
+}
+
+/*
+etagMatches checks the If-None-Match header of the request against etag. It takes "*" and lists of tags, and compares
+them weakly (W/"x" matches "x") like a GET has to, proxies and cdns may weaken the tag
+*/
+func etagMatches(r *http.Request, etag string) bool {
+	for _, value := range r.Header.Values("If-None-Match") {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sendHookError sends the status of a HookError, or a 500 with message prepended for any other error
+func sendHookError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	var hookErr *schemaregistry.HookError
+	if errors.As(err, &hookErr) {
+		httpresponder.SendDetailedErrorResponse(w, r, hookErr.Message, hookErr.Status, hookErr.Details)
+		return
+	}
+	httpresponder.SendErrorResponse(w, r, message+err.Error(), http.StatusInternalServerError)
+}
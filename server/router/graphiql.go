@@ -0,0 +1,100 @@
+package router
+
+import (
+	"embed"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"slices"
+
+	"github.com/chukfi/backend/src/httpresponder"
+	"github.com/chukfi/backend/src/lib/permissions"
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+//go:generate sh graphiql/download.sh
+
+/*
+graphiqlAssets are the pinned builds of GraphiQL and React (see graphiql/download.sh), served from the api itself so
+the page doesn't run script from a cdn inside an Administrator session
+*/
+//go:embed graphiql
+var graphiqlAssets embed.FS
+
+// graphiqlFiles are the assets the page loads, graphiql.js starts GraphiQL
+var graphiqlFiles = []string{"react.production.min.js", "react-dom.production.min.js", "graphiql.min.js", "graphiql.min.css", "graphiql.js"}
+
+// graphiqlPolicy only lets the page run the embedded scripts and talk to the api
+const graphiqlPolicy = "default-src 'self'; script-src 'self'; style-src 'self' 'unsafe-inline'; img-src 'self' data:; font-src 'self' data:; connect-src 'self'; frame-ancestors 'none'"
+
+// graphiqlVendored checks every asset of the page was downloaded
+func graphiqlVendored() bool {
+	for _, name := range graphiqlFiles {
+		if _, err := graphiqlAssets.Open("graphiql/" + name); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// registerGraphiQLRoutes serves GraphiQL with a GET of the graphql path and its assets under path/assets
+func registerGraphiQLRoutes(r chi.Router, database *gorm.DB, path string) {
+	r.Get(path, func(w http.ResponseWriter, r *http.Request) {
+		if os.Getenv("GRAPHIQL") != "true" {
+			httpresponder.SendErrorResponse(w, r, "Send GraphQL queries as a POST", http.StatusMethodNotAllowed)
+			return
+		}
+
+		user, err := GetUserFromRequest(r, database)
+		if err != nil {
+			httpresponder.SendErrorResponse(w, r, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !permissions.HasPermission(user.EffectivePermissions(), permissions.Administrator) {
+			httpresponder.SendErrorResponse(w, r, "Forbidden: Insufficient permissions", http.StatusForbidden)
+			return
+		}
+		if !graphiqlVendored() {
+			httpresponder.SendErrorResponse(w, r, "GraphiQL is not downloaded, run go generate ./server/router", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", graphiqlPolicy)
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, graphiqlPage, html.EscapeString(path+"/assets"), html.EscapeString(path))
+	})
+
+	r.Get(path+"/assets/{file}", func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "file")
+		if os.Getenv("GRAPHIQL") != "true" || !slices.Contains(graphiqlFiles, name) {
+			httpresponder.SendErrorResponse(w, r, "Not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		http.ServeFileFS(w, r, graphiqlAssets, "graphiql/"+name)
+	})
+}
+
+// graphiql from the embedded assets, it sends the auth cookie along with every query
+const graphiqlPage = `<!doctype html>
+<html lang="en">
+<head>
+	<meta charset="utf-8">
+	<title>Chukfi GraphiQL</title>
+	<style>body { margin: 0; height: 100vh; } #graphiql { height: 100vh; }</style>
+	<link rel="stylesheet" href="%[1]s/graphiql.min.css">
+</head>
+<body>
+	<div id="graphiql" data-endpoint="%[2]s">Loading...</div>
+	<script src="%[1]s/react.production.min.js"></script>
+	<script src="%[1]s/react-dom.production.min.js"></script>
+	<script src="%[1]s/graphiql.min.js"></script>
+	<script src="%[1]s/graphiql.js"></script>
+</body>
+</html>
+`
@@ -0,0 +1,24 @@
+#!/bin/sh
+# downloads the pinned builds of GraphiQL and React into this directory, they are embedded into the binary.
+# run it through go generate ./server/router, the versions are exact so every download gets the same files
+set -e
+
+REACT_VERSION=18.3.1
+GRAPHIQL_VERSION=3.8.3
+
+cd "$(dirname "$0")"
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+
+# fetch <package> <version> <file in the package>, npm checks the tarball against the integrity of the registry
+fetch() {
+	mkdir -p "$tmp/$1"
+	tarball=$(cd "$tmp" && npm pack --silent "$1@$2")
+	tar -xzf "$tmp/$tarball" -C "$tmp/$1"
+	cp "$tmp/$1/package/$3" .
+}
+
+fetch react "$REACT_VERSION" umd/react.production.min.js
+fetch react-dom "$REACT_VERSION" umd/react-dom.production.min.js
+fetch graphiql "$GRAPHIQL_VERSION" graphiql.min.js
+fetch graphiql "$GRAPHIQL_VERSION" graphiql.min.css
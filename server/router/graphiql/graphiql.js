@@ -0,0 +1,7 @@
+// starts GraphiQL on the endpoint set on #graphiql, the page is served by registerGraphiQLRoutes
+const root = document.getElementById("graphiql");
+const fetcher = GraphiQL.createFetcher({
+	url: root.dataset.endpoint,
+	fetch: (url, options) => fetch(url, { ...options, credentials: "same-origin" }),
+});
+ReactDOM.createRoot(root).render(React.createElement(GraphiQL, { fetcher }));
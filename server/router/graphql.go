@@ -0,0 +1,264 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chukfi/backend/database/schema"
+	"github.com/chukfi/backend/src/httpresponder"
+	"github.com/chukfi/backend/src/lib/gql"
+	"github.com/chukfi/backend/src/lib/permissions"
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+	"github.com/go-chi/chi/v5"
+	"github.com/graphql-go/graphql"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+// the biggest graphql request body accepted
+const graphqlMaxBodySize = 1 << 20
+
+// GraphQLPath returns where the graphql api is served, GRAPHQL_PATH or /admin/graphql
+func GraphQLPath() string {
+	path := strings.ToLower(strings.TrimSpace(os.Getenv("GRAPHQL_PATH")))
+	if path == "" {
+		return "/admin/graphql"
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return strings.TrimSuffix(path, "/")
+}
+
+/*
+graphqlBackend does the reads and writes of the graphql api with the same helpers, access rules,
+hooks and events as the collection routes. the request is taken from the context
+*/
+type graphqlBackend struct {
+	database *gorm.DB
+}
+
+func graphqlRequest(ctx context.Context) *http.Request {
+	r, _ := ctx.Value("graphqlRequest").(*http.Request)
+	return r
+}
+
+// canRead applies the rules of /collection/{name}/get
+func (b graphqlBackend) canRead(r *http.Request, collectionName string) error {
+	if !schemaregistry.IsRegistered(collectionName) {
+		return schemaregistry.Reject("Invalid collection name: %s", collectionName)
+	}
+	return checkReadAccess(r, b.database, collectionName)
+}
+
+// canWrite applies the rules of /collection/{name}/create, update and delete, action is permissions.ActionCreate...
+func (b graphqlBackend) canWrite(r *http.Request, collectionName string, action string) error {
+	if GetUserIDFromRequest(r) == "" {
+		return schemaregistry.NewHookError(http.StatusUnauthorized, "Unauthorized: No auth token provided")
+	}
+	if !RequestHasCollectionPermission(r, b.database, collectionName, action) {
+		return schemaregistry.NewHookError(http.StatusForbidden, "Forbidden: You do not have permission to "+action+" entries")
+	}
+	return nil
+}
+
+// hasAnyCollectionPermission checks if the user may do anything on any collection, through ViewModels / ManageModels, a collection permission or a policy rule
+func hasAnyCollectionPermission(r *http.Request, database *gorm.DB) bool {
+	if _, err := GetUserFromRequest(r, database); err != nil {
+		return false
+	}
+	for tableName := range schemaregistry.GetAllRegisteredSchemas() {
+		for _, action := range permissions.CollectionActions {
+			if RequestHasCollectionPermission(r, database, tableName, action) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (b graphqlBackend) query(r *http.Request, collectionName string) *gorm.DB {
+	query := scopeEntries(r, b.database, collectionName, permissions.ActionRead, b.database.WithContext(r.Context()).Table(collectionName))
+	if schemaregistry.HasSoftDelete(collectionName) {
+		query = query.Where("deleted_at IS NULL")
+	}
+	return query
+}
+
+func (b graphqlBackend) Get(ctx context.Context, collectionName string, id string) (map[string]interface{}, error) {
+	r := graphqlRequest(ctx)
+	if err := b.canRead(r, collectionName); err != nil {
+		return nil, err
+	}
+
+	results, err := readWithHooks(r, collectionName, b.query(r, collectionName).Where("id = ?", id).Limit(1))
+	if err != nil || len(results) == 0 {
+		return nil, err
+	}
+	return results[0], nil
+}
+
+func (b graphqlBackend) List(ctx context.Context, collectionName string, list gql.ListQuery) ([]map[string]interface{}, int64, error) {
+	r := graphqlRequest(ctx)
+	if err := b.canRead(r, collectionName); err != nil {
+		return nil, 0, err
+	}
+
+	query := b.query(r, collectionName)
+	if list.Filter != nil {
+		query = query.Where(list.Filter)
+	}
+	for _, column := range list.Order {
+		query = query.Order(column)
+	}
+
+	return readPageWithHooks(r, collectionName, query, list.Take, (list.Page-1)*list.Take)
+}
+
+func (b graphqlBackend) Create(ctx context.Context, collectionName string, data map[string]interface{}) (map[string]interface{}, error) {
+	r := graphqlRequest(ctx)
+	if err := b.canWrite(r, collectionName, permissions.ActionCreate); err != nil {
+		return nil, err
+	}
+
+	data, err := createEntry(r, b.database, collectionName, data)
+	if err != nil {
+		return nil, err
+	}
+	// read it back so the response has every column, as the read hooks leave it
+	return b.Get(ctx, collectionName, fmt.Sprint(data["ID"]))
+}
+
+func (b graphqlBackend) Update(ctx context.Context, collectionName string, id string, data map[string]interface{}) (map[string]interface{}, error) {
+	r := graphqlRequest(ctx)
+	if err := b.canWrite(r, collectionName, permissions.ActionUpdate); err != nil {
+		return nil, err
+	}
+
+	entryID, err := uuid.FromString(id)
+	if err != nil {
+		return nil, schemaregistry.Reject("Invalid ID format: %s", err.Error())
+	}
+	if err := updateEntry(r, b.database, collectionName, entryID, data); err != nil {
+		return nil, err
+	}
+	return b.Get(ctx, collectionName, entryID.String())
+}
+
+func (b graphqlBackend) Delete(ctx context.Context, collectionName string, id string) error {
+	r := graphqlRequest(ctx)
+	if err := b.canWrite(r, collectionName, permissions.ActionDelete); err != nil {
+		return err
+	}
+
+	entryID, err := uuid.FromString(id)
+	if err != nil {
+		return schemaregistry.Reject("Invalid ID format: %s", err.Error())
+	}
+	return deleteEntry(r, b.database, collectionName, entryID)
+}
+
+/*
+graphqlSchemas holds the two generated schemas: the public one (no admin only collections, no mutations)
+for anonymous users and users without any collection permission (ViewModels, ManageModels or e.g posts.update),
+and the full one for everyone else.
+They are built on the first request, so every schema registered by then is in them.
+*/
+type graphqlSchemas struct {
+	once   sync.Once
+	public graphql.Schema
+	full   graphql.Schema
+	err    error
+}
+
+func (s *graphqlSchemas) get(backend gql.Backend) (public graphql.Schema, full graphql.Schema, err error) {
+	s.once.Do(func() {
+		s.public, s.err = gql.Build(backend, gql.Options{})
+		if s.err != nil {
+			return
+		}
+		s.full, s.err = gql.Build(backend, gql.Options{AdminOnly: true, Mutations: true})
+	})
+	return s.public, s.full, s.err
+}
+
+type graphqlRequestBody struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+/*
+RegisterGraphQLRoutes serves the graphql api at GraphQLPath(). Queries are sent as a json POST,
+anonymous requests can read the collections /collection/{name}/get allows them to. With GRAPHIQL=true
+a GET of the same path opens GraphiQL, for Administrators only.
+*/
+func RegisterGraphQLRoutes(r chi.Router, database *gorm.DB) {
+	backend := graphqlBackend{database: database}
+	schemas := &graphqlSchemas{}
+	path := GraphQLPath()
+
+	r.Post(path, func(w http.ResponseWriter, r *http.Request) {
+		// only json, a form post from another site cant send it so cookie auth cant be abused for mutations
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType != "application/json" {
+			httpresponder.SendErrorResponse(w, r, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var body graphqlRequestBody
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, graphqlMaxBodySize)).Decode(&body); err != nil {
+			httpresponder.SendErrorResponse(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(body.Query) == "" {
+			httpresponder.SendErrorResponse(w, r, "Missing query", http.StatusBadRequest)
+			return
+		}
+
+		// auth is optional here, a valid token makes the user known to permission checks and hooks
+		if authToken, ok := r.Context().Value("authToken").(string); ok && authToken != "" {
+			token, err := gorm.G[schema.UserToken](database).Where("token = ? AND expires_at > ?", authToken, time.Now().Unix()).First(r.Context())
+			if err != nil {
+				httpresponder.SendErrorResponse(w, r, "Unauthorized: Invalid auth token", http.StatusUnauthorized)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), "userID", token.UserID.String()))
+		}
+
+		public, full, err := schemas.get(backend)
+		if err != nil {
+			httpresponder.SendErrorResponse(w, r, "Error building the GraphQL schema: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		selected := public
+		if hasAnyCollectionPermission(r, database) {
+			selected = full
+		}
+
+		ctx := gql.WithCache(r.Context())
+		r = r.WithContext(ctx)
+		ctx = context.WithValue(ctx, "graphqlRequest", r)
+
+		result := graphql.Do(graphql.Params{
+			Schema:         selected,
+			RequestString:  body.Query,
+			VariableValues: body.Variables,
+			OperationName:  body.OperationName,
+			Context:        ctx,
+		})
+
+		httpresponder.SendNormalResponse(w, r, result)
+	})
+
+	// GraphiQL, for Administrators when GRAPHIQL=true
+	registerGraphiQLRoutes(r, database, path)
+}
@@ -0,0 +1,417 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chukfi/backend/database/schema"
+	"github.com/chukfi/backend/src/httpresponder"
+	"github.com/chukfi/backend/src/lib/events"
+	"github.com/chukfi/backend/src/lib/imaging"
+	"github.com/chukfi/backend/src/lib/media"
+	"github.com/chukfi/backend/src/lib/permissions"
+	"github.com/chukfi/backend/src/lib/signing"
+	"github.com/chukfi/backend/src/lib/storage"
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// mediaCollection is the collection of the media entries, its permissions (media.read...) apply to the media routes
+var mediaCollection = schema.Media{}.TableName()
+
+// maxUploadSize returns the upload limit in bytes from MEDIA_MAX_UPLOAD_SIZE (in MB), default 100MB
+func maxUploadSize() int64 {
+	if value, err := strconv.ParseInt(os.Getenv("MEDIA_MAX_UPLOAD_SIZE"), 10, 64); err == nil && value > 0 {
+		return value << 20
+	}
+	return 100 << 20
+}
+
+/*
+imagePresetsOnly decides if the request may only ask for presets, arbitrary sizes are then refused.
+MEDIA_IMAGE_PRESETS_ONLY=true applies it to everyone and false to nobody, by default it applies to requests without
+a logged in user, so anonymous requests can't fill the storage with a variant for every size. Signed links keep the
+options they were signed with (canAccessMedia verifies them)
+*/
+func imagePresetsOnly(r *http.Request, database *gorm.DB) bool {
+	switch strings.ToLower(os.Getenv("MEDIA_IMAGE_PRESETS_ONLY")) {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if signing.IsSigned(r.URL.Query()) {
+		return false
+	}
+	_, err := GetUserFromRequest(r, database)
+	return err != nil
+}
+
+// getMediaFromRequest loads the media entry from the {mediaID} url param, sending the error response if it fails
+func getMediaFromRequest(w http.ResponseWriter, r *http.Request, database *gorm.DB) (*schema.Media, bool) {
+	record, err := media.Get(r.Context(), database, chi.URLParam(r, "mediaID"))
+	if err != nil {
+		if errors.Is(err, media.ErrMediaNotFound) {
+			httpresponder.SendErrorResponse(w, r, "Media not found", http.StatusNotFound)
+			return nil, false
+		}
+		httpresponder.SendErrorResponse(w, r, "Error fetching media: "+err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return record, true
+}
+
+/*
+canAccessMedia checks that the request may read the media entry. Private media needs either a valid signed url
+or a user that can read media (ViewModels or media.read), the error response is sent if it cant.
+*/
+func canAccessMedia(w http.ResponseWriter, r *http.Request, database *gorm.DB, record *schema.Media) bool {
+	// a signed link is verified for public media too, it may carry image options anonymous requests can't use
+	if signing.IsSigned(r.URL.Query()) {
+		return verifySignedURL(w, r)
+	}
+	if !record.Private {
+		return true
+	}
+
+	if authToken, ok := r.Context().Value("authToken").(string); !ok || authToken == "" {
+		httpresponder.SendErrorResponse(w, r, "Unauthorized: This media is private", http.StatusUnauthorized)
+		return false
+	}
+	if !RequestHasCollectionPermission(r, database, mediaCollection, permissions.ActionRead) {
+		httpresponder.SendErrorResponse(w, r, "Forbidden: You do not have permission to view this media", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+/*
+serveMediaFile streams the stored file of a media entry, the checksum is used as a strong ETag. Only raster images,
+video, audio and pdf are shown inline, everything else is a download, and the sandbox keeps a file from running
+script on the origin of the api
+*/
+func serveMediaFile(w http.ResponseWriter, r *http.Request, record *schema.Media) {
+	etag := `"` + record.Checksum + `"`
+	if etagMatches(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	file, err := media.Open(r.Context(), record)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotFound) {
+			httpresponder.SendErrorResponse(w, r, "Media file not found", http.StatusNotFound)
+			return
+		}
+		httpresponder.SendErrorResponse(w, r, "Error reading media file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", record.MimeType)
+	w.Header().Set("Content-Length", strconv.FormatInt(record.Size, 10))
+	disposition := "attachment"
+	if media.IsInlineType(record.MimeType) {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Disposition", disposition+`; filename="`+strings.ReplaceAll(record.Filename, `"`, "")+`"`)
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("ETag", etag)
+	if record.Private {
+		w.Header().Set("Cache-Control", "private, no-store")
+	}
+	w.Header().Set("Last-Modified", record.UpdatedAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method != http.MethodHead {
+		io.Copy(w, file)
+	}
+}
+
+func RegisterMediaRoutes(r chi.Router, database *gorm.DB) {
+	r.Route("/media", func(r chi.Router) {
+		registerUploadRoutes(r, database)
+
+		// auth mandated routes
+
+		r.Group(func(r chi.Router) {
+			r.Use(AuthMiddlewareWithDatabase(database))
+
+			r.Get("/list", func(w http.ResponseWriter, r *http.Request) {
+				if !RequestHasCollectionPermission(r, database, mediaCollection, permissions.ActionRead) {
+					httpresponder.SendErrorResponse(w, r, "Forbidden: You do not have permission to view media", http.StatusForbidden)
+					return
+				}
+
+				take := 30
+				if value, err := strconv.Atoi(r.URL.Query().Get("take")); err == nil && value > 0 {
+					take = min(value, 100) // max 100
+				}
+
+				page := 1
+				if value, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && value > 0 {
+					page = value
+				}
+
+				query := gorm.G[schema.Media](database).Order("created_at DESC")
+				if mimeType := r.URL.Query().Get("mime"); mimeType != "" {
+					// allow "image/" to list every image
+					query = query.Where("mime_type LIKE ?", strings.ReplaceAll(mimeType, "%", "")+"%")
+				}
+
+				total, err := query.Count(r.Context(), "id")
+				if err != nil {
+					httpresponder.SendErrorResponse(w, r, "Error counting media: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				results, err := query.Limit(take).Offset((page - 1) * take).Find(r.Context())
+				if err != nil {
+					httpresponder.SendErrorResponse(w, r, "Error fetching media: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+					"media": results,
+					"total": total,
+					"page":  page,
+					"take":  take,
+				})
+			})
+
+			r.Post("/upload", func(w http.ResponseWriter, r *http.Request) {
+				if !RequestHasCollectionPermission(r, database, mediaCollection, permissions.ActionCreate) {
+					httpresponder.SendErrorResponse(w, r, "Forbidden: You do not have permission to upload media", http.StatusForbidden)
+					return
+				}
+
+				r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize())
+
+				// anything over 32MB is spooled to disk by ParseMultipartForm
+				if err := r.ParseMultipartForm(32 << 20); err != nil {
+					httpresponder.SendErrorResponse(w, r, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+				defer r.MultipartForm.RemoveAll()
+
+				file, header, err := r.FormFile("file")
+				if err != nil {
+					httpresponder.SendErrorResponse(w, r, "Missing file field in upload: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+				defer file.Close()
+
+				record, err := media.Ingest(r.Context(), database, file, header.Size, header.Filename, r.FormValue("altText"), GetUserIDFromRequest(r), r.FormValue("private") == "true")
+				if errors.Is(err, media.ErrMediaTypeNotAllowed) {
+					httpresponder.SendErrorResponse(w, r, "Invalid upload: "+err.Error(), http.StatusUnsupportedMediaType)
+					return
+				}
+				if err != nil {
+					httpresponder.SendErrorResponse(w, r, "Error uploading media: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				events.Publish(events.Event{
+					Type:       events.EventCreate,
+					Collection: record.TableName(),
+					ID:         record.ID.String(),
+					UserID:     GetUserIDFromRequest(r),
+				})
+
+				httpresponder.SendNormalResponse(w, r, record)
+			})
+
+			r.Post("/{mediaID}/update", func(w http.ResponseWriter, r *http.Request) {
+				if !RequestHasCollectionPermission(r, database, mediaCollection, permissions.ActionUpdate) {
+					httpresponder.SendErrorResponse(w, r, "Forbidden: You do not have permission to update media", http.StatusForbidden)
+					return
+				}
+
+				record, ok := getMediaFromRequest(w, r, database)
+				if !ok {
+					return
+				}
+
+				var body struct {
+					Filename *string `json:"filename"`
+					AltText  *string `json:"altText"`
+					Private  *bool   `json:"private"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					httpresponder.SendErrorResponse(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+
+				updates := map[string]interface{}{
+					"updated_at": time.Now(),
+				}
+				if body.Filename != nil {
+					if *body.Filename == "" {
+						httpresponder.SendErrorResponse(w, r, "Filename cannot be empty", http.StatusBadRequest)
+						return
+					}
+					updates["filename"] = *body.Filename
+				}
+				if body.AltText != nil {
+					updates["alt_text"] = *body.AltText
+				}
+				if body.Private != nil {
+					updates["private"] = *body.Private
+				}
+
+				if err := database.WithContext(r.Context()).Model(record).Updates(updates).Error; err != nil {
+					httpresponder.SendErrorResponse(w, r, "Error updating media: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				events.Publish(events.Event{
+					Type:       events.EventUpdate,
+					Collection: record.TableName(),
+					ID:         record.ID.String(),
+					Data:       updates,
+					UserID:     GetUserIDFromRequest(r),
+				})
+
+				httpresponder.SendNormalResponse(w, r, record)
+			})
+
+			// signed link to the file (or a transformed image) that works without an account, needed for private media
+			r.Post("/{mediaID}/sign", func(w http.ResponseWriter, r *http.Request) {
+				if !RequestHasCollectionPermission(r, database, mediaCollection, permissions.ActionRead) {
+					httpresponder.SendErrorResponse(w, r, "Forbidden: You do not have permission to share media", http.StatusForbidden)
+					return
+				}
+
+				record, ok := getMediaFromRequest(w, r, database)
+				if !ok {
+					return
+				}
+
+				signMediaURL(w, r, database, record.ID.String())
+			})
+
+			r.Post("/{mediaID}/delete", func(w http.ResponseWriter, r *http.Request) {
+				if !RequestHasCollectionPermission(r, database, mediaCollection, permissions.ActionDelete) {
+					httpresponder.SendErrorResponse(w, r, "Forbidden: You do not have permission to delete media", http.StatusForbidden)
+					return
+				}
+
+				record, ok := getMediaFromRequest(w, r, database)
+				if !ok {
+					return
+				}
+
+				references, err := media.Delete(r.Context(), database, record)
+				if errors.Is(err, media.ErrMediaInUse) {
+					httpresponder.SendDetailedErrorResponse(w, r, "Media is still referenced by other entries", http.StatusConflict, map[string]interface{}{
+						"references": references,
+					})
+					return
+				}
+				if err != nil {
+					httpresponder.SendErrorResponse(w, r, "Error deleting media: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				events.Publish(events.Event{
+					Type:       events.EventDelete,
+					Collection: record.TableName(),
+					ID:         record.ID.String(),
+					UserID:     GetUserIDFromRequest(r),
+				})
+
+				httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+					"success": true,
+				})
+			})
+		})
+
+		// public routes, media is readable by anyone just like non admin only collections, except private media
+
+		r.Get("/{mediaID}", func(w http.ResponseWriter, r *http.Request) {
+			record, ok := getMediaFromRequest(w, r, database)
+			if !ok || !canAccessMedia(w, r, database, record) {
+				return
+			}
+			httpresponder.SendNormalResponse(w, r, record)
+		})
+
+		r.Get("/{mediaID}/file", func(w http.ResponseWriter, r *http.Request) {
+			record, ok := getMediaFromRequest(w, r, database)
+			if !ok || !canAccessMedia(w, r, database, record) {
+				return
+			}
+			serveMediaFile(w, r, record)
+		})
+
+		r.Get("/presets", func(w http.ResponseWriter, r *http.Request) {
+			httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+				"presets":     imaging.GetAllPresets(),
+				"formats":     imaging.EncodableFormats(),
+				"presetsOnly": imagePresetsOnly(r, database),
+			})
+		})
+
+		// resized/cropped/converted copies of images, e.g /media/{id}/image?preset=thumbnail or ?w=300&h=200&fit=cover
+		r.Get("/{mediaID}/image", func(w http.ResponseWriter, r *http.Request) {
+			record, ok := getMediaFromRequest(w, r, database)
+			if !ok || !canAccessMedia(w, r, database, record) {
+				return
+			}
+
+			options, err := imaging.ParseOptions(r.URL.Query(), imagePresetsOnly(r, database))
+			if err != nil {
+				httpresponder.SendErrorResponse(w, r, "Invalid image options: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			variant, err := imaging.GetVariant(r.Context(), record, options)
+			if err != nil {
+				switch {
+				case errors.Is(err, imaging.ErrNotAnImage), errors.Is(err, imaging.ErrInvalidOptions):
+					httpresponder.SendErrorResponse(w, r, "Cannot transform media: "+err.Error(), http.StatusBadRequest)
+				case errors.Is(err, imaging.ErrImageTooLarge):
+					httpresponder.SendErrorResponse(w, r, "Cannot transform media: "+err.Error(), http.StatusRequestEntityTooLarge)
+				case errors.Is(err, storage.ErrObjectNotFound):
+					httpresponder.SendErrorResponse(w, r, "Media file not found", http.StatusNotFound)
+				default:
+					httpresponder.SendErrorResponse(w, r, "Error transforming media: "+err.Error(), http.StatusInternalServerError)
+				}
+				return
+			}
+
+			// the url (media id + options) always maps to the same bytes, so it can be cached forever
+			etag := `"` + variant.ETag + `"`
+			if record.Private {
+				w.Header().Set("Cache-Control", "private, no-store")
+			} else {
+				w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+			}
+			w.Header().Set("ETag", etag)
+			if etagMatches(r, etag) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+
+			file, err := imaging.OpenVariant(r.Context(), variant)
+			if err != nil {
+				httpresponder.SendErrorResponse(w, r, "Error reading image: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer file.Close()
+
+			w.Header().Set("Content-Type", variant.ContentType)
+			w.Header().Set("Content-Security-Policy", "sandbox")
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.WriteHeader(http.StatusOK)
+			io.Copy(w, file)
+		})
+	})
+}
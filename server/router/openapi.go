@@ -0,0 +1,467 @@
+package router
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/chukfi/backend/src/httpresponder"
+	"github.com/chukfi/backend/src/lib/delivery"
+	"github.com/chukfi/backend/src/lib/openapi"
+	"github.com/chukfi/backend/src/lib/permissions"
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+var (
+	// security of routes that need a logged in user
+	authRequired = []map[string][]string{{"bearerAuth": {}}, {"cookieAuth": {}}}
+	// security of routes anyone can call, a logged in user may see more
+	authOptional = []map[string][]string{{}, {"bearerAuth": {}}, {"cookieAuth": {}}}
+)
+
+func object(properties map[string]*openapi.Schema, required ...string) *openapi.Schema {
+	return &openapi.Schema{Type: "object", Properties: properties, Required: required}
+}
+
+func successResponse() *openapi.Schema {
+	return object(map[string]*openapi.Schema{"success": {Type: "boolean"}}, "success")
+}
+
+var simpleUserSchema = object(map[string]*openapi.Schema{
+	"id":          {Type: "string", Format: "uuid"},
+	"fullname":    {Type: "string"},
+	"email":       {Type: "string"},
+	"permissions": {Type: "array", Items: &openapi.Schema{Type: "string"}},
+}, "id", "fullname", "email", "permissions")
+
+var schemaMetadataSchema = object(map[string]*openapi.Schema{
+	"TableName": {Type: "string"},
+	"AdminOnly": {Type: "boolean"},
+	"Fields": {Type: "array", Items: object(map[string]*openapi.Schema{
+		"Name":           {Type: "string"},
+		"Column":         {Type: "string"},
+		"Type":           {Type: "string", Description: "The go type, e.g string, uuid.UUID, time.Time"},
+		"GormTag":        {Type: "string"},
+		"JSONTag":        {Type: "string"},
+		"ChukfiTag":      {Type: "string"},
+		"Required":       {Type: "boolean"},
+		"PrimaryKey":     {Type: "boolean"},
+		"Searchable":     {Type: "boolean"},
+		"Filterable":     {Type: "boolean"},
+		"WriteOnly":      {Type: "boolean", Description: "Written but never returned"},
+		"ReadOnly":       {Type: "boolean", Description: "Set by the server, clients can't write it"},
+		"ReadPermission": {Type: "string", Description: "The permission needed to read the field, empty for none"},
+	})},
+}, "TableName", "AdminOnly", "Fields")
+
+var (
+	bulkModeSchema = &openapi.Schema{Type: "string", Enum: []interface{}{"atomic", "bestEffort"},
+		Description: "atomic (the default) rolls everything back if one operation fails, bestEffort keeps the ones that succeed"}
+	bulkWhereSchema = &openapi.Schema{Type: "object", Description: "A filter in the language of /get, e.g {\"Status\": \"draft\"}"}
+	bulkLimitSchema = &openapi.Schema{Type: "integer", Description: "The most entries the filter may match, default 100, at most 1000"}
+)
+
+var bulkResponseSchema = object(map[string]*openapi.Schema{
+	"mode":      {Type: "string"},
+	"committed": {Type: "boolean", Description: "false when an atomic request was rolled back"},
+	"succeeded": {Type: "integer"},
+	"failed":    {Type: "integer"},
+	"results": {Type: "array", Items: object(map[string]*openapi.Schema{
+		"index":   {Type: "integer"},
+		"success": {Type: "boolean"},
+		"id":      {Type: "string"},
+		"error":   {Type: "string"},
+		"status":  {Type: "integer", Description: "The http status the operation would have got on its own"},
+		"details": {},
+	}, "index", "success")},
+}, "mode", "committed", "succeeded", "failed", "results")
+
+// openAPIRoutes describes the routes that arent per collection, by "METHOD pattern"
+var openAPIRoutes = map[string]*openapi.Operation{
+	"POST /admin/auth/login": {
+		OperationID: "login",
+		Summary:     "Log in, sets the chukfi_auth_token cookie",
+		Tags:        []string{"auth"},
+		RequestBody: &openapi.RequestBody{Required: true, Content: openapi.JSON(object(map[string]*openapi.Schema{
+			"email":    {Type: "string"},
+			"password": {Type: "string"},
+		}, "email", "password"))},
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "Logged in", Content: openapi.JSON(object(map[string]*openapi.Schema{
+				"authToken": {Type: "string"},
+				"expiresAt": {Type: "integer", Description: "Unix timestamp"},
+				"user":      simpleUserSchema,
+				"success":   {Type: "boolean"},
+			}, "authToken", "expiresAt", "user", "success"))},
+			"401": {Description: "Invalid email or password", Content: openapi.JSON(openapi.Ref("Error"))},
+		},
+	},
+	"GET /admin/auth/me": {
+		OperationID: "me",
+		Summary:     "The logged in user",
+		Tags:        []string{"auth"},
+		Security:    authRequired,
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The user", Content: openapi.JSON(object(map[string]*openapi.Schema{
+				"user":    simpleUserSchema,
+				"success": {Type: "boolean"},
+			}, "user", "success"))},
+			"401": {Description: "Not logged in", Content: openapi.JSON(openapi.Ref("Error"))},
+		},
+	},
+	"GET /admin/collection/all": {
+		OperationID: "listCollections",
+		Summary:     "The registered collections the user can read (ViewModels, or a collection read permission like posts.read)",
+		Tags:        []string{"collections"},
+		Security:    authRequired,
+		Responses: map[string]*openapi.Response{
+			"200": {Description: "The collections by table name", Content: openapi.JSON(object(map[string]*openapi.Schema{
+				"schemas": {Type: "object", AdditionalProperties: object(map[string]*openapi.Schema{"AdminOnly": {Type: "boolean"}})},
+			}, "schemas"))},
+		},
+	},
+}
+
+/*
+collectionOperation describes a /collection/{collectionName}/... route for one collection,
+nil for routes it doesnt know
+*/
+func collectionOperation(method string, action string, tableName string) *openapi.Operation {
+	name := openapi.TypeName(tableName)
+	plural := openapi.PascalCase(tableName)
+	if plural == name {
+		plural = name + "List"
+	}
+
+	security := authRequired
+	if publicAdminReads() && !schemaregistry.IsAdminOnly(tableName) {
+		security = authOptional
+	}
+
+	operation := &openapi.Operation{Tags: []string{tableName}, Responses: map[string]*openapi.Response{}}
+	switch method + " " + action {
+	case "POST get":
+		operation.OperationID = "list" + plural
+		operation.Summary = "List entries, at most 30 per page"
+		operation.Security = security
+		operation.RequestBody = &openapi.RequestBody{Content: openapi.JSON(object(map[string]*openapi.Schema{
+			"take":   {Type: "integer", Description: "Defaults to 30, at most 30"},
+			"page":   {Type: "integer", Description: "Starts at 1"},
+			"select": {Type: "string", Description: "Comma separated fields to return, the ID is always returned"},
+			"where": {Type: []string{"object", "string"}, Description: "A filter, e.g {\"Views\": {\"gte\": 10}, \"or\": [...]}, " +
+				"operators eq, ne, gt, gte, lt, lte, in, nin, like, isNull. Or the old comma separated column:value pairs"},
+			"orderBy": {Type: []string{"array", "string"}, Description: "Fields to sort on, - in front (or {field, direction}) sorts descending"},
+		}))}
+		operation.Responses["200"] = &openapi.Response{Description: "The entries", Content: openapi.JSON(&openapi.Schema{Type: "array", Items: openapi.Ref(name)})}
+
+	case "POST create":
+		operation.OperationID = "create" + name
+		operation.Summary = "Create an entry (requires ManageModels or " + tableName + ".create)"
+		operation.Security = authRequired
+		operation.RequestBody = &openapi.RequestBody{Required: true, Content: openapi.JSON(openapi.Ref(name + "Input"))}
+		operation.Responses["200"] = &openapi.Response{Description: "The entry as written, keyed by field name", Content: openapi.JSON(&openapi.Schema{
+			Type:                 "object",
+			Properties:           map[string]*openapi.Schema{"ID": {Type: "string", Format: "uuid"}},
+			Required:             []string{"ID"},
+			AdditionalProperties: true,
+		})}
+
+	case "POST update":
+		operation.OperationID = "update" + name
+		operation.Summary = "Update the fields of an entry (requires ManageModels or " + tableName + ".update)"
+		operation.Security = authRequired
+		operation.RequestBody = &openapi.RequestBody{Required: true, Content: openapi.JSON(openapi.Ref(name + "Update"))}
+		operation.Responses["200"] = &openapi.Response{Description: "Updated", Content: openapi.JSON(successResponse())}
+
+	case "POST delete":
+		operation.OperationID = "delete" + name
+		operation.Summary = "Delete an entry, soft deletes when the collection has a DeletedAt (requires ManageModels or " + tableName + ".delete)"
+		operation.Security = authRequired
+		operation.RequestBody = &openapi.RequestBody{Required: true, Content: openapi.JSON(object(map[string]*openapi.Schema{
+			"ID": {Type: "string", Format: "uuid"},
+		}, "ID"))}
+		operation.Responses["200"] = &openapi.Response{Description: "Deleted", Content: openapi.JSON(successResponse())}
+
+	case "GET metadata":
+		operation.OperationID = "get" + name + "Metadata"
+		operation.Summary = "The fields of the collection (requires ViewModels or " + tableName + ".read)"
+		operation.Security = authRequired
+		operation.Responses["200"] = &openapi.Response{Description: "The metadata", Content: openapi.JSON(openapi.Ref("SchemaMetadata"))}
+
+	case "GET changes":
+		operation.OperationID = "get" + name + "Changes"
+		operation.Summary = "Entries changed since a cursor, for delta sync"
+		operation.Security = security
+		operation.Parameters = []openapi.Parameter{
+			{Name: "since", In: "query", Description: "The cursor of the last response, leave out for everything", Schema: &openapi.Schema{Type: "string"}},
+			{Name: "take", In: "query", Description: "Defaults to 100, at most 500", Schema: &openapi.Schema{Type: "integer"}},
+		}
+		operation.Responses["200"] = &openapi.Response{Description: "The changes", Content: openapi.JSON(object(map[string]*openapi.Schema{
+			"changes": {Type: "array", Items: object(map[string]*openapi.Schema{
+				"id":      {Type: "string"},
+				"seq":     {Type: "integer"},
+				"deleted": {Type: "boolean"},
+				"entry":   openapi.Ref(name),
+			}, "id", "seq", "deleted")},
+			"cursor":  {Type: "string"},
+			"hasMore": {Type: "boolean"},
+		}, "changes", "cursor", "hasMore"))}
+
+	case "POST bulk":
+		operation.OperationID = "bulk" + plural
+		operation.Summary = "Create, update and delete many entries, up to 1000 operations (requires ManageModels or the " + tableName + " permission of every op)"
+		operation.Security = authRequired
+		operation.RequestBody = &openapi.RequestBody{Required: true, Content: openapi.JSON(object(map[string]*openapi.Schema{
+			"mode": bulkModeSchema,
+			"operations": {Type: "array", Items: object(map[string]*openapi.Schema{
+				"op":   {Type: "string", Enum: []interface{}{"create", "update", "delete"}},
+				"id":   {Type: "string", Format: "uuid", Description: "The entry to update or delete"},
+				"data": {Type: "object", Description: "The fields of a create (" + name + "Input) or update"},
+			}, "op")},
+		}, "operations"))}
+		operation.Responses["200"] = &openapi.Response{Description: "The result of every operation", Content: openapi.JSON(openapi.Ref("BulkResponse"))}
+
+	case "POST update-where":
+		operation.OperationID = "update" + plural + "Where"
+		operation.Summary = "Update every entry matching a filter, fails if more than limit entries match (requires ManageModels or " + tableName + ".update)"
+		operation.Security = authRequired
+		operation.RequestBody = &openapi.RequestBody{Required: true, Content: openapi.JSON(object(map[string]*openapi.Schema{
+			"mode":  bulkModeSchema,
+			"where": bulkWhereSchema,
+			"data":  {Type: "object", Description: "The fields to set"},
+			"limit": bulkLimitSchema,
+		}, "where", "data"))}
+		operation.Responses["200"] = &openapi.Response{Description: "The result for every matching entry", Content: openapi.JSON(openapi.Ref("BulkResponse"))}
+
+	case "POST delete-where":
+		operation.OperationID = "delete" + plural + "Where"
+		operation.Summary = "Delete every entry matching a filter, fails if more than limit entries match (requires ManageModels or " + tableName + ".delete)"
+		operation.Security = authRequired
+		operation.RequestBody = &openapi.RequestBody{Required: true, Content: openapi.JSON(object(map[string]*openapi.Schema{
+			"mode":  bulkModeSchema,
+			"where": bulkWhereSchema,
+			"limit": bulkLimitSchema,
+		}, "where"))}
+		operation.Responses["200"] = &openapi.Response{Description: "The result for every matching entry", Content: openapi.JSON(openapi.Ref("BulkResponse"))}
+
+	case "GET {entryID}":
+		operation.OperationID = "get" + name
+		operation.Summary = "A single entry by ID"
+		operation.Security = security
+		operation.Parameters = []openapi.Parameter{
+			{Name: "select", In: "query", Description: "Comma separated fields to return, the ID is always returned", Schema: &openapi.Schema{Type: "string"}},
+			{Name: "expand", In: "query", Description: "Comma separated reference fields (AuthorID) whose entries are added (as author)", Schema: &openapi.Schema{Type: "string"}},
+		}
+		operation.Responses["200"] = &openapi.Response{Description: "The entry", Content: openapi.JSON(openapi.Ref(name))}
+		operation.Responses["304"] = &openapi.Response{Description: "Not modified since the ETag in If-None-Match"}
+		operation.Responses["404"] = &openapi.Response{Description: "No such entry", Content: openapi.JSON(openapi.Ref("Error"))}
+
+	case "POST search":
+		operation.OperationID = "search" + plural
+		operation.Summary = "Full text search within the collection"
+		operation.Security = security
+		operation.RequestBody = &openapi.RequestBody{Required: true, Content: openapi.JSON(&openapi.Schema{Type: "object", AdditionalProperties: true})}
+		operation.Responses["200"] = &openapi.Response{Description: "The matching entries"}
+
+	default:
+		return nil
+	}
+
+	operation.Responses["400"] = &openapi.Response{Description: "Invalid request", Content: openapi.JSON(openapi.Ref("Error"))}
+	if len(operation.Security) == len(authRequired) {
+		operation.Responses["401"] = &openapi.Response{Description: "Not logged in", Content: openapi.JSON(openapi.Ref("Error"))}
+		operation.Responses["403"] = &openapi.Response{Description: "Missing permission", Content: openapi.JSON(openapi.Ref("Error"))}
+	}
+	return operation
+}
+
+/*
+deliveryOperation describes a DeliveryPath()/{collectionName} route for one delivered collection, nil for routes it doesnt know.
+The entries only have the fields the collection delivers
+*/
+func deliveryOperation(method string, action string, collection delivery.Collection) *openapi.Operation {
+	name := openapi.TypeName(collection.Name)
+	operation := &openapi.Operation{
+		Tags:      []string{"delivery"},
+		Responses: map[string]*openapi.Response{},
+	}
+	if collection.Options.RequireAPIKey {
+		operation.Security = []map[string][]string{{"apiKey": {}}}
+		operation.Responses["401"] = &openapi.Response{Description: "Missing or invalid api key", Content: openapi.JSON(openapi.Ref("Error"))}
+	}
+
+	switch method + " " + action {
+	case "GET ":
+		operation.OperationID = "deliver" + openapi.PascalCase(collection.Name)
+		operation.Summary = "A page of " + collection.Name
+		operation.Parameters = []openapi.Parameter{
+			{Name: "take", In: "query", Schema: &openapi.Schema{Type: "integer"}, Description: "Entries per page, default 30, max 100"},
+			{Name: "page", In: "query", Schema: &openapi.Schema{Type: "integer"}},
+			{Name: "sort", In: "query", Schema: &openapi.Schema{Type: "string"}, Description: "Comma separated fields, - in front sorts descending"},
+		}
+		operation.Responses["200"] = &openapi.Response{Description: "The entries", Content: openapi.JSON(object(map[string]*openapi.Schema{
+			"data":  {Type: "array", Items: openapi.Ref(name)},
+			"total": {Type: "integer"},
+			"page":  {Type: "integer"},
+			"take":  {Type: "integer"},
+		}, "data", "total", "page", "take"))}
+	case "GET /{entryID}":
+		operation.OperationID = "deliver" + name
+		operation.Summary = "A " + schemaregistry.SingularName(collection.Name) + " by ID"
+		operation.Responses["200"] = &openapi.Response{Description: "The entry", Content: openapi.JSON(object(map[string]*openapi.Schema{
+			"data": openapi.Ref(name),
+		}, "data"))}
+		operation.Responses["404"] = &openapi.Response{Description: "No such entry", Content: openapi.JSON(openapi.Ref("Error"))}
+	default:
+		return nil
+	}
+	operation.Responses["304"] = &openapi.Response{Description: "Not modified since the ETag in If-None-Match"}
+	return operation
+}
+
+// chi patterns may hold a regexp, {id:[0-9]+}
+var routeParam = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// genericOperation describes a route nothing else describes, from its method and path
+func genericOperation(method string, path string) *openapi.Operation {
+	id := strings.ToLower(method) + openapi.PascalCase(routeParam.ReplaceAllString(path, "$1"))
+
+	tag := "other"
+	if parts := strings.Split(strings.TrimPrefix(path, "/admin/"), "/"); len(parts) > 0 && parts[0] != "" && !strings.HasPrefix(parts[0], "{") {
+		tag = parts[0]
+	}
+
+	return &openapi.Operation{
+		OperationID: id,
+		Summary:     method + " " + path,
+		Tags:        []string{tag},
+		Responses: map[string]*openapi.Response{
+			"200":     {Description: "OK"},
+			"default": {Description: "Error", Content: openapi.JSON(openapi.Ref("Error"))},
+		},
+	}
+}
+
+/*
+GenerateOpenAPI builds the OpenAPI 3.1 document of the routes registered on routes, with a component schema
+for every collection. Collection routes are listed once per collection, routes without a description
+(e.g ones added by the app) are listed with their method and path. Admin only collections are only
+included with includeAdminOnly.
+*/
+func GenerateOpenAPI(routes chi.Routes, includeAdminOnly bool) (*openapi.Document, error) {
+	document := openapi.New(openapi.Info{
+		Title:       "Chukfi API",
+		Version:     "1.0.0",
+		Description: "Generated from the registered schemas and routes",
+	})
+	document.Components.Schemas["SchemaMetadata"] = schemaMetadataSchema
+	document.Components.Schemas["BulkResponse"] = bulkResponseSchema
+	tables := document.AddCollectionSchemas(includeAdminOnly)
+
+	document.AddTag("auth", "Logging in and the current user")
+	document.AddTag("collections", "")
+	document.AddTag("delivery", "The public content delivery api")
+	for _, table := range tables {
+		document.AddTag(table, "The "+table+" collection")
+	}
+
+	usedIDs := make(map[string]int)
+	add := func(method string, path string, operation *openapi.Operation) {
+		// operation ids have to be unique
+		if count := usedIDs[operation.OperationID]; count > 0 {
+			usedIDs[operation.OperationID]++
+			operation.OperationID += strconv.Itoa(count + 1)
+		} else {
+			usedIDs[operation.OperationID] = 1
+		}
+		for _, param := range routeParam.FindAllStringSubmatch(path, -1) {
+			operation.Parameters = append(operation.Parameters, openapi.Parameter{Name: param[1], In: "path", Required: true, Schema: &openapi.Schema{Type: "string"}})
+		}
+		document.Add(method, routeParam.ReplaceAllString(path, "{$1}"), operation)
+	}
+
+	type route struct{ method, pattern string }
+	var walked []route
+	err := chi.Walk(routes, func(method string, pattern string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		walked = append(walked, route{method, pattern})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(walked, func(i, j int) bool {
+		if walked[i].pattern == walked[j].pattern {
+			return walked[i].method < walked[j].method
+		}
+		return walked[i].pattern < walked[j].pattern
+	})
+
+	for _, route := range walked {
+		path := route.pattern
+		if strings.HasSuffix(path, "/*") || route.method == http.MethodOptions || route.method == http.MethodHead {
+			// static file servers and protocol details
+			continue
+		}
+		if len(path) > 1 {
+			path = strings.TrimSuffix(path, "/")
+		}
+
+		if action, ok := strings.CutPrefix(path, "/admin/collection/{collectionName}/"); ok {
+			described := false
+			for _, table := range tables {
+				if operation := collectionOperation(route.method, action, table); operation != nil {
+					add(route.method, "/admin/collection/"+table+"/"+action, operation)
+					described = true
+				}
+			}
+			if described {
+				continue
+			}
+		}
+
+		if action, ok := strings.CutPrefix(path, DeliveryPath()+"/{collectionName}"); ok {
+			described := false
+			for _, name := range delivery.Collections() {
+				collection, _ := delivery.Get(name)
+				if operation := deliveryOperation(route.method, action, collection); operation != nil {
+					add(route.method, DeliveryPath()+"/"+name+action, operation)
+					described = true
+				}
+			}
+			if described {
+				continue
+			}
+		}
+
+		if operation, ok := openAPIRoutes[route.method+" "+path]; ok {
+			// copied, add fills in the parameters
+			copied := *operation
+			add(route.method, path, &copied)
+			continue
+		}
+		add(route.method, path, genericOperation(route.method, path))
+	}
+
+	return document, nil
+}
+
+/*
+RegisterOpenAPIRoutes serves the OpenAPI document of every route registered on r at /admin/openapi.json,
+admin only collections are only included for users with ViewModels
+*/
+func RegisterOpenAPIRoutes(r chi.Router, database *gorm.DB) {
+	r.Get("/admin/openapi.json", func(w http.ResponseWriter, req *http.Request) {
+		document, err := GenerateOpenAPI(r, RequestRequiresPermission(req, database, permissions.ViewModels))
+		if err != nil {
+			httpresponder.SendErrorResponse(w, req, "Error generating the OpenAPI document: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-cache")
+		httpresponder.SendNormalResponse(w, req, document)
+	})
+}
@@ -0,0 +1,135 @@
+package router
+
+// row level ownership. A collection with an owner field (chukfi:"owner", e.g AuthorID) only lets users read, update
+// and delete the entries they own, the owner is set to the logged in user on create. Users with the override
+// permission of the collection (posts.all) or Administrator see every entry. The rule is a condition of the sql
+// query itself (ownedCondition), so filters, counts and pages only ever see owned entries
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/chukfi/backend/src/lib/events"
+	"github.com/chukfi/backend/src/lib/permissions"
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+/*
+ownerRestriction returns the owner field of the collection and the id of the user of the request, restricted is
+true when the user may only see the entries they own. Anonymous users are restricted to owning nothing
+*/
+func ownerRestriction(r *http.Request, database *gorm.DB, collectionName string) (field schemaregistry.FieldMetadata, userID string, restricted bool) {
+	field, owned := schemaregistry.GetOwnerField(collectionName)
+	if !owned {
+		return field, "", false
+	}
+	user, err := GetUserFromRequest(r, database)
+	if err != nil {
+		return field, "", true
+	}
+	return field, user.ID.String(), !permissions.HasOwnerOverride(user.EffectivePermissions(), collectionName)
+}
+
+// ownedCondition is the condition limiting a query to the entries the user of the request owns, nil if they see every entry
+func ownedCondition(r *http.Request, database *gorm.DB, collectionName string) clause.Expression {
+	field, userID, restricted := ownerRestriction(r, database, collectionName)
+	if !restricted {
+		return nil
+	}
+	if userID == "" {
+		// nobody is logged in, so nothing is owned
+		return clause.Expr{SQL: "1 = 0"}
+	}
+	return clause.Eq{Column: clause.Column{Name: field.Column}, Value: userID}
+}
+
+/*
+setOwner sets the owner field of a new entry to the user creating it. With the override it may be set to
+someone else, without it setting another owner is an error
+*/
+func setOwner(r *http.Request, database *gorm.DB, collectionName string, data map[string]interface{}) error {
+	field, userID, restricted := ownerRestriction(r, database, collectionName)
+	if field.Name == "" {
+		return nil
+	}
+
+	for _, key := range []string{field.Name, field.Column} {
+		value, set := data[key]
+		if !set || value == nil || value == "" {
+			continue
+		}
+		if restricted && fmt.Sprint(value) != userID {
+			return schemaregistry.NewHookError(http.StatusForbidden, "Forbidden: You can only create entries you own")
+		}
+		return nil
+	}
+
+	if userID == "" {
+		return schemaregistry.NewHookError(http.StatusUnauthorized, "Unauthorized: Entries of "+collectionName+" need an owner")
+	}
+	data[field.Name] = userID
+	return nil
+}
+
+// checkOwnerChange rejects an update changing the owner of an entry, unless the user has the override
+func checkOwnerChange(r *http.Request, database *gorm.DB, collectionName string, data map[string]interface{}) error {
+	field, userID, restricted := ownerRestriction(r, database, collectionName)
+	if !restricted {
+		return nil
+	}
+	for _, key := range []string{field.Name, field.Column} {
+		if value, set := data[key]; set && fmt.Sprint(value) != userID {
+			return schemaregistry.NewHookError(http.StatusForbidden, "Forbidden: You can't change the owner of an entry")
+		}
+	}
+	return nil
+}
+
+/*
+ownerOf reads the owner of an entry, nil for collections without an owner field. Events carry it so realtime
+only sends them to the owner (see ownsEvent)
+*/
+func ownerOf(tx *gorm.DB, collectionName string, id uuid.UUID) interface{} {
+	field, owned := schemaregistry.GetOwnerField(collectionName)
+	if !owned {
+		return nil
+	}
+	var owners []string
+	tx.Table(collectionName).Where("id = ?", id).Limit(1).Pluck(field.Column, &owners)
+	if len(owners) == 0 {
+		return nil
+	}
+	return owners[0]
+}
+
+// ownsEvent checks the user of the request owns the entry of the event, or may see every entry of its collection
+func ownsEvent(r *http.Request, database *gorm.DB, event events.Event) bool {
+	field, userID, restricted := ownerRestriction(r, database, event.Collection)
+	if !restricted {
+		return true
+	}
+	owner, ok := event.Data[field.Name]
+	if !ok {
+		owner, ok = event.Data[field.Column]
+	}
+	return ok && userID != "" && fmt.Sprint(owner) == userID
+}
+
+// withOwner copies the data with the owner of the entry added, so the event of the write can be routed by it
+func withOwner(collectionName string, data map[string]interface{}, owner interface{}) map[string]interface{} {
+	field, owned := schemaregistry.GetOwnerField(collectionName)
+	if !owned || owner == nil {
+		return data
+	}
+	copied := make(map[string]interface{}, len(data)+1)
+	for key, value := range data {
+		copied[key] = value
+	}
+	if _, set := copied[field.Column]; !set {
+		copied[field.Name] = owner
+	}
+	return copied
+}
@@ -0,0 +1,272 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/chukfi/backend/src/httpresponder"
+	"github.com/chukfi/backend/src/lib/permissions"
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+	"github.com/chukfi/backend/src/lib/users"
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+type registerPermissionRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type unregisterPermissionRequest struct {
+	Name string `json:"name"`
+}
+
+type renamePermissionRequest struct {
+	Name    string `json:"name"`
+	NewName string `json:"newName"`
+}
+
+type grantPermissionsRequest struct {
+	UserID      string   `json:"userID"`
+	Permissions []string `json:"permissions"` // names, e.g ["ViewModels", "posts.update"]
+}
+
+type permissionResponse struct {
+	Name        string `json:"name"`
+	BitPosition uint   `json:"bitPosition"`
+	Description string `json:"description"`
+	Builtin     bool   `json:"builtin"`
+	Collection  bool   `json:"collection"` // a permission of a registered collection, it can't be unregistered
+}
+
+// permissionNames returns the names of the permissions, an empty list instead of nil
+func permissionNames(perms permissions.Permission) []string {
+	names := permissions.PermissionsToStrings(perms)
+	if names == nil {
+		names = []string{}
+	}
+	return names
+}
+
+// isCollectionPermission checks if name is the permission of a registered collection (posts.read, posts.all), those
+// are registered again on every start
+func isCollectionPermission(name string) bool {
+	index := strings.LastIndex(name, ".")
+	if index < 0 {
+		return false
+	}
+	collection, action := name[:index], name[index+1:]
+	return schemaregistry.IsRegistered(collection) && (slices.Contains(permissions.CollectionActions, action) || action == permissions.ActionAll)
+}
+
+// grantRequestPermissions reads a grant / revoke request, sending the error response if it fails. Unlike
+// permissions.StringsToPermission an unknown name is an error
+func grantRequestPermissions(w http.ResponseWriter, r *http.Request) (*grantPermissionsRequest, permissions.Permission, bool) {
+	var body grantPermissionsRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		httpresponder.SendErrorResponse(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return nil, permissions.Permission{}, false
+	}
+	if body.UserID == "" || len(body.Permissions) == 0 {
+		httpresponder.SendErrorResponse(w, r, "Invalid request body: userID and permissions are required", http.StatusBadRequest)
+		return nil, permissions.Permission{}, false
+	}
+	for _, name := range body.Permissions {
+		if _, ok := permissions.GetPermissionByName(name); !ok {
+			httpresponder.SendErrorResponse(w, r, "Unknown permission: "+name, http.StatusBadRequest)
+			return nil, permissions.Permission{}, false
+		}
+	}
+	return &body, permissions.StringsToPermission(body.Permissions), true
+}
+
+// sendUserPermissionsError sends the right response for an error from users.Grant or users.Revoke
+func sendUserPermissionsError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, users.ErrUserNotFound) {
+		httpresponder.SendErrorResponse(w, r, "User not found", http.StatusNotFound)
+		return
+	}
+	httpresponder.SendErrorResponse(w, r, "Error updating permissions: "+err.Error(), http.StatusInternalServerError)
+}
+
+/*
+RegisterPermissionRoutes registers the permission management routes: listing, registering, renaming and unregistering
+custom permissions and granting / revoking permissions on users. All of them require Administrator
+*/
+func RegisterPermissionRoutes(r chi.Router, database *gorm.DB) {
+	r.Route("/permissions", func(r chi.Router) {
+		r.Use(AuthMiddlewareWithDatabase(database))
+		r.Use(RoutesRequiresPermission(database, permissions.Administrator))
+
+		r.Get("/list", func(w http.ResponseWriter, r *http.Request) {
+			builtin := []permissionResponse{}
+			for bit, name := range permissions.BuiltinPermissions() {
+				builtin = append(builtin, permissionResponse{Name: name, BitPosition: uint(bit), Builtin: true})
+			}
+
+			custom := []permissionResponse{}
+			for _, cp := range permissions.GetAllCustomPermissions() {
+				custom = append(custom, permissionResponse{
+					Name:        cp.Name,
+					BitPosition: cp.BitPosition,
+					Description: cp.Description,
+					Collection:  isCollectionPermission(cp.Name),
+				})
+			}
+
+			httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+				"builtin":         builtin,
+				"custom":          custom,
+				"inconsistencies": append([]permissions.Inconsistency{}, permissions.Inconsistencies()...),
+			})
+		})
+
+		r.Post("/register", func(w http.ResponseWriter, r *http.Request) {
+			var body registerPermissionRequest
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				httpresponder.SendErrorResponse(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			body.Name = strings.TrimSpace(body.Name)
+			if err := permissions.ValidateName(body.Name); err != nil {
+				httpresponder.SendErrorResponse(w, r, "Invalid permission: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if len(body.Description) > 255 {
+				httpresponder.SendErrorResponse(w, r, "Invalid permission: the description can't be longer than 255 characters", http.StatusBadRequest)
+				return
+			}
+			if _, exists := permissions.GetPermissionByName(body.Name); exists {
+				httpresponder.SendErrorResponse(w, r, "Invalid permission: "+body.Name+" already exists", http.StatusConflict)
+				return
+			}
+
+			perm, err := permissions.RegisterPermissionWithDescription(body.Name, body.Description)
+			if err != nil {
+				httpresponder.SendErrorResponse(w, r, "Error registering permission: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			httpresponder.SendNormalResponse(w, r, permissionResponse{
+				Name:        body.Name,
+				BitPosition: perm.Bits()[0],
+				Description: body.Description,
+			})
+		})
+
+		r.Post("/unregister", func(w http.ResponseWriter, r *http.Request) {
+			var body unregisterPermissionRequest
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				httpresponder.SendErrorResponse(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if isCollectionPermission(body.Name) {
+				httpresponder.SendErrorResponse(w, r, "Cannot unregister "+body.Name+", it is the permission of a collection", http.StatusBadRequest)
+				return
+			}
+
+			if err := permissions.UnregisterPermission(body.Name); err != nil {
+				switch {
+				case errors.Is(err, permissions.ErrPermissionNotFound):
+					httpresponder.SendErrorResponse(w, r, "Permission not found", http.StatusNotFound)
+				case errors.Is(err, permissions.ErrBuiltinPermission):
+					httpresponder.SendErrorResponse(w, r, "Cannot unregister "+body.Name+", it is a builtin permission", http.StatusBadRequest)
+				default:
+					httpresponder.SendErrorResponse(w, r, "Error unregistering permission: "+err.Error(), http.StatusInternalServerError)
+				}
+				return
+			}
+
+			httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+				"success": true,
+			})
+		})
+
+		// the permission keeps its bit, so whoever had it still has it under the new name
+		r.Post("/rename", func(w http.ResponseWriter, r *http.Request) {
+			var body renamePermissionRequest
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				httpresponder.SendErrorResponse(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			body.NewName = strings.TrimSpace(body.NewName)
+			if isCollectionPermission(body.Name) {
+				httpresponder.SendErrorResponse(w, r, "Cannot rename "+body.Name+", it is the permission of a collection", http.StatusBadRequest)
+				return
+			}
+
+			if err := permissions.RenamePermission(body.Name, body.NewName); err != nil {
+				switch {
+				case errors.Is(err, permissions.ErrPermissionNotFound):
+					httpresponder.SendErrorResponse(w, r, "Permission not found", http.StatusNotFound)
+				case errors.Is(err, permissions.ErrBuiltinPermission):
+					httpresponder.SendErrorResponse(w, r, "Cannot rename "+body.Name+", it is a builtin permission", http.StatusBadRequest)
+				case errors.Is(err, permissions.ErrInvalidName):
+					httpresponder.SendErrorResponse(w, r, "Invalid permission: "+err.Error(), http.StatusBadRequest)
+				case errors.Is(err, permissions.ErrPermissionExists):
+					httpresponder.SendErrorResponse(w, r, "Invalid permission: "+body.NewName+" already exists", http.StatusConflict)
+				default:
+					httpresponder.SendErrorResponse(w, r, "Error renaming permission: "+err.Error(), http.StatusInternalServerError)
+				}
+				return
+			}
+
+			httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+				"success": true,
+			})
+		})
+
+		// takes the bits no permission has from users and roles, see the inconsistencies of /list
+		r.Post("/repair", func(w http.ResponseWriter, r *http.Request) {
+			fixed, err := permissions.StripUnregisteredBits()
+			if err != nil {
+				httpresponder.SendErrorResponse(w, r, "Error repairing permissions: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+				"fixed": append([]permissions.Inconsistency{}, fixed...),
+			})
+		})
+
+		r.Post("/grant", func(w http.ResponseWriter, r *http.Request) {
+			body, granted, ok := grantRequestPermissions(w, r)
+			if !ok {
+				return
+			}
+
+			user, err := users.Grant(r.Context(), database, body.UserID, granted)
+			if err != nil {
+				sendUserPermissionsError(w, r, err)
+				return
+			}
+
+			httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+				"userID":      user.ID.String(),
+				"permissions": permissionNames(user.Permissions),
+			})
+		})
+
+		// only takes the permissions granted to the user directly, the ones of their roles stay
+		r.Post("/revoke", func(w http.ResponseWriter, r *http.Request) {
+			body, revoked, ok := grantRequestPermissions(w, r)
+			if !ok {
+				return
+			}
+
+			user, err := users.Revoke(r.Context(), database, body.UserID, revoked)
+			if err != nil {
+				sendUserPermissionsError(w, r, err)
+				return
+			}
+
+			httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+				"userID":      user.ID.String(),
+				"permissions": permissionNames(user.Permissions),
+			})
+		})
+	})
+}
@@ -0,0 +1,324 @@
+package router
+
+// the routes authorize with the policy engine (src/lib/policy). Decisions that depend on the entry come back with
+// a filter, which becomes a condition of the sql query like the owner (see ownership.go)
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+
+	"github.com/chukfi/backend/database/schema"
+	"github.com/chukfi/backend/src/httpresponder"
+	"github.com/chukfi/backend/src/lib/events"
+	"github.com/chukfi/backend/src/lib/permissions"
+	"github.com/chukfi/backend/src/lib/policy"
+	"github.com/chukfi/backend/src/lib/roles"
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type explainRequest struct {
+	UserID     string `json:"userID"` // defaults to the logged in user
+	Action     string `json:"action"`
+	Collection string `json:"collection"`
+	EntryID    string `json:"entryID"`
+	Permission string `json:"permission"` // for the access action, the name of the permission the route requires
+	Path       string `json:"path"`
+}
+
+/*
+RegisterPolicyRoutes registers the routes for debugging policies, /policy/rules lists the rules and
+/policy/explain shows how a decision was made. Both require Administrator
+*/
+func RegisterPolicyRoutes(r chi.Router, database *gorm.DB) {
+	r.Route("/policy", func(r chi.Router) {
+		r.Use(AuthMiddlewareWithDatabase(database))
+		r.Use(RoutesRequiresPermission(database, permissions.Administrator))
+
+		r.Get("/rules", func(w http.ResponseWriter, r *http.Request) {
+			httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+				"rules": policy.GetEngine().Rules(),
+			})
+		})
+
+		r.Post("/explain", func(w http.ResponseWriter, r *http.Request) {
+			var body explainRequest
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				httpresponder.SendErrorResponse(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if body.Action == "" {
+				httpresponder.SendErrorResponse(w, r, "Invalid request body: Missing action", http.StatusBadRequest)
+				return
+			}
+
+			var user *schema.User
+			var err error
+			if body.UserID == "" {
+				user, err = GetUserFromRequest(r, database)
+			} else {
+				var found schema.User
+				found, err = gorm.G[schema.User](database).Where("id = ?", body.UserID).First(r.Context())
+				if err == nil {
+					err = roles.Load(r.Context(), database, &found)
+				}
+				user = &found
+			}
+			if err != nil {
+				httpresponder.SendErrorResponse(w, r, "User not found", http.StatusNotFound)
+				return
+			}
+
+			resource := policy.Resource{Path: body.Path}
+			if body.Action == policy.ActionAccess && body.Permission == "" {
+				httpresponder.SendErrorResponse(w, r, "Invalid request body: The access action needs a permission", http.StatusBadRequest)
+				return
+			}
+			if body.Permission != "" {
+				permission, ok := permissions.GetPermissionByName(body.Permission)
+				if !ok {
+					httpresponder.SendErrorResponse(w, r, "Invalid request body: Unknown permission "+body.Permission, http.StatusBadRequest)
+					return
+				}
+				resource.Permission = permission
+			}
+
+			response := map[string]interface{}{}
+			if body.Collection != "" {
+				collectionName, exists := schemaregistry.ResolveTableName(body.Collection)
+				if !exists {
+					httpresponder.SendErrorResponse(w, r, "Invalid collection name: "+body.Collection, http.StatusBadRequest)
+					return
+				}
+				resource.Collection = collectionName
+				resource.Public = body.Action == permissions.ActionRead && !schemaregistry.IsAdminOnly(collectionName)
+
+				if body.EntryID != "" {
+					entry := map[string]interface{}{}
+					res := database.WithContext(r.Context()).Table(collectionName).Where("id = ?", body.EntryID).Limit(1).Find(&entry)
+					if res.Error != nil || res.RowsAffected == 0 {
+						httpresponder.SendErrorResponse(w, r, "Entry not found", http.StatusNotFound)
+						return
+					}
+					resource.Entry = entryAttributes(collectionName, entry)
+				}
+
+				// the owner field restricts on top of the decision
+				if field, owned := schemaregistry.GetOwnerField(collectionName); owned {
+					response["owner"] = map[string]interface{}{
+						"field":      field.Name,
+						"restricted": !permissions.HasOwnerOverride(user.EffectivePermissions(), collectionName),
+					}
+				}
+			}
+
+			subject := subjectFromUser(user)
+			response["subject"] = subject
+			response["action"] = body.Action
+			response["resource"] = resource
+			response["decision"] = policy.Authorize(r.Context(), subject, body.Action, resource)
+			httpresponder.SendNormalResponse(w, r, response)
+		})
+	})
+}
+
+// subjectFromUser returns the subject of the user for the policy engine, the attribute provider adds to it
+func subjectFromUser(user *schema.User) policy.Subject {
+	if user == nil {
+		return policy.Subject{Attributes: map[string]interface{}{}}
+	}
+	return policy.Subject{
+		ID:          user.ID.String(),
+		Permissions: user.EffectivePermissions(),
+		Attributes: map[string]interface{}{
+			"id":       user.ID.String(),
+			"email":    user.Email,
+			"fullname": user.Fullname,
+		},
+	}
+}
+
+// authorize decides if the user of the request (or nobody, when not logged in) may do the action on the resource
+func authorize(r *http.Request, database *gorm.DB, action string, resource policy.Resource) policy.Decision {
+	user, _ := GetUserFromRequest(r, database)
+	return policy.Authorize(r.Context(), subjectFromUser(user), action, resource)
+}
+
+// collectionResource is the resource of an action on a collection, reading collections that aren't admin only needs no permission
+func collectionResource(collectionName string, action string, entry map[string]interface{}) policy.Resource {
+	return policy.Resource{
+		Collection: collectionName,
+		Entry:      entry,
+		Public:     action == permissions.ActionRead && !schemaregistry.IsAdminOnly(collectionName),
+	}
+}
+
+/*
+entryCondition is the condition limiting a query to the entries the user of the request may do the action on:
+the entries they own (see ownedCondition) that the policy allows. nil if every entry is allowed
+*/
+func entryCondition(r *http.Request, database *gorm.DB, collectionName string, action string) clause.Expression {
+	var conditions []clause.Expression
+	if owned := ownedCondition(r, database, collectionName); owned != nil {
+		conditions = append(conditions, owned)
+	}
+
+	decision := authorize(r, database, action, collectionResource(collectionName, action, nil))
+	if !decision.Allowed {
+		conditions = append(conditions, clause.Expr{SQL: "1 = 0"})
+	} else if decision.Filter != nil {
+		conditions = append(conditions, filterCondition(collectionName, decision.Filter))
+	}
+
+	switch len(conditions) {
+	case 0:
+		return nil
+	case 1:
+		return conditions[0]
+	}
+	return clause.And(conditions...)
+}
+
+// scopeEntries limits the query to the entries the user of the request may do the action on, see entryCondition
+func scopeEntries(r *http.Request, database *gorm.DB, collectionName string, action string, query *gorm.DB) *gorm.DB {
+	if condition := entryCondition(r, database, collectionName, action); condition != nil {
+		return query.Where(condition)
+	}
+	return query
+}
+
+// authorizeEntry decides if the user of the request may do the action on an entry that isn't in the database (yet)
+func authorizeEntry(r *http.Request, database *gorm.DB, collectionName string, action string, entry map[string]interface{}) policy.Decision {
+	return authorize(r, database, action, collectionResource(collectionName, action, entryAttributes(collectionName, entry)))
+}
+
+/*
+canReceiveEvent checks the user of the request may see the entry of an event. Events only carry the fields that
+changed, so when the policy depends on the entry it is checked against the entry in the database
+*/
+func canReceiveEvent(r *http.Request, database *gorm.DB, event events.Event) bool {
+	if !ownsEvent(r, database, event) {
+		return false
+	}
+
+	decision := authorize(r, database, permissions.ActionRead, collectionResource(event.Collection, permissions.ActionRead, nil))
+	if !decision.Allowed {
+		return false
+	}
+	if decision.Filter == nil {
+		return true
+	}
+
+	// soft deleted entries are checked too, their delete event is sent
+	var count int64
+	database.WithContext(r.Context()).Table(event.Collection).
+		Where("id = ?", event.ID).Where(filterCondition(event.Collection, decision.Filter)).
+		Count(&count)
+	return count > 0
+}
+
+// entryAttributes copies the entry with every field under both its name and its column, rules can use either
+func entryAttributes(collectionName string, entry map[string]interface{}) map[string]interface{} {
+	attributes := maps.Clone(entry)
+	if attributes == nil {
+		attributes = map[string]interface{}{}
+	}
+	fields, _ := schemaregistry.GetFields(collectionName)
+	for _, field := range fields {
+		if value, ok := entry[field.Name]; ok {
+			attributes[field.Column] = value
+		} else if value, ok := entry[field.Column]; ok {
+			attributes[field.Name] = value
+		}
+	}
+	for key, value := range attributes {
+		if bytes, isBytes := value.([]byte); isBytes {
+			attributes[key] = string(bytes)
+		}
+	}
+	return attributes
+}
+
+/*
+filterCondition turns the filter of a decision into sql. Every condition is true or false, never NULL, so NOT
+works the same as in policy.Filter.Matches: a missing value (NULL) isn't equal to anything
+*/
+func filterCondition(collectionName string, filter *policy.Filter) clause.Expression {
+	var conditions []clause.Expression
+	if filter.Any != nil {
+		alternatives := make([]clause.Expression, 0, len(filter.Any))
+		for _, set := range filter.Any {
+			alternatives = append(alternatives, conditionSet(collectionName, set))
+		}
+		conditions = append(conditions, clause.Or(alternatives...))
+	}
+	for _, set := range filter.None {
+		conditions = append(conditions, clause.Expr{SQL: "NOT (?)", Vars: []interface{}{conditionSet(collectionName, set)}})
+	}
+	return clause.And(conditions...)
+}
+
+// conditionSet is the sql of conditions that all have to hold
+func conditionSet(collectionName string, set []policy.Condition) clause.Expression {
+	expressions := make([]clause.Expression, 0, len(set))
+	for _, condition := range set {
+		expressions = append(expressions, conditionSQL(collectionName, condition))
+	}
+	return clause.And(expressions...)
+}
+
+var (
+	sqlTrue  = clause.Expr{SQL: "1 = 1"}
+	sqlFalse = clause.Expr{SQL: "1 = 0"}
+)
+
+// conditionSQL is the sql of one entry condition, fields that don't exist are NULL
+func conditionSQL(collectionName string, condition policy.Condition) clause.Expression {
+	field, ok := schemaregistry.GetField(collectionName, condition.Field())
+	if !ok {
+		if condition.Op == policy.OpNotIn || (condition.Op == policy.OpNe && condition.Value != nil) {
+			return sqlTrue
+		}
+		return sqlFalse
+	}
+	column := clause.Column{Name: field.Column}
+
+	switch condition.Op {
+	case policy.OpExists:
+		return clause.Expr{SQL: "(? IS NOT NULL AND ? <> '')", Vars: []interface{}{column, column}}
+	case policy.OpEq:
+		if condition.Value == nil {
+			return sqlFalse
+		}
+		return clause.Expr{SQL: "(? IS NOT NULL AND ? = ?)", Vars: []interface{}{column, column, condition.Value}}
+	case policy.OpNe:
+		if condition.Value == nil {
+			return clause.Expr{SQL: "? IS NOT NULL", Vars: []interface{}{column}}
+		}
+		return clause.Expr{SQL: "(? IS NULL OR ? <> ?)", Vars: []interface{}{column, column, condition.Value}}
+	case policy.OpIn, policy.OpNotIn:
+		values := condition.Values()
+		if len(values) == 0 {
+			if condition.Op == policy.OpIn {
+				return sqlFalse
+			}
+			return sqlTrue
+		}
+		if condition.Op == policy.OpIn {
+			return clause.Expr{SQL: "(? IS NOT NULL AND ? IN ?)", Vars: []interface{}{column, column, values}}
+		}
+		return clause.Expr{SQL: "(? IS NULL OR ? NOT IN ?)", Vars: []interface{}{column, column, values}}
+	}
+	return sqlFalse
+}
+
+// policyError is the error of a denied decision, for the routes that send HookErrors
+func policyError(decision policy.Decision) error {
+	if decision.Allowed {
+		return nil
+	}
+	return schemaregistry.NewHookError(http.StatusForbidden, "Forbidden: "+decision.Reason)
+}
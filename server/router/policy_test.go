@@ -0,0 +1,83 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/chukfi/backend/src/lib/policy"
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+type policyPost struct {
+	ID       uuid.UUID `gorm:"type:char(36);primaryKey"`
+	Status   string
+	Locked   bool
+	AuthorID string
+}
+
+func (policyPost) TableName() string {
+	return "policy_posts"
+}
+
+func init() {
+	schemaregistry.RegisterSchema(policyPost{})
+}
+
+func TestFilterCondition(t *testing.T) {
+	draft := []policy.Condition{{Attribute: "entry.Status", Op: policy.OpEq, Value: "draft"}}
+	locked := []policy.Condition{{Attribute: "entry.locked", Op: policy.OpIn, Value: []interface{}{true, 1}}}
+	mine := []policy.Condition{
+		{Attribute: "entry.author_id", Op: policy.OpEq, Value: "me"},
+		{Attribute: "entry.Status", Op: policy.OpNe, Value: "archived"},
+	}
+
+	tests := []struct {
+		name   string
+		filter *policy.Filter
+		where  string
+	}{
+		{"one alternative", &policy.Filter{Any: [][]policy.Condition{draft}},
+			"(`status` IS NOT NULL AND `status` = 'draft')"},
+		{"alternatives", &policy.Filter{Any: [][]policy.Condition{draft, mine}},
+			"(((`status` IS NOT NULL AND `status` = 'draft')) OR (((`author_id` IS NOT NULL AND `author_id` = 'me')) AND ((`status` IS NULL OR `status` <> 'archived'))))"},
+		{"exclusion", &policy.Filter{None: [][]policy.Condition{locked}},
+			"NOT ((`locked` IS NOT NULL AND `locked` IN (true,1)))"},
+		{"deny on top of the alternatives", &policy.Filter{Any: [][]policy.Condition{draft, mine}, None: [][]policy.Condition{locked}},
+			"(((`status` IS NOT NULL AND `status` = 'draft')) OR (((`author_id` IS NOT NULL AND `author_id` = 'me')) AND ((`status` IS NULL OR `status` <> 'archived')))) AND NOT ((`locked` IS NOT NULL AND `locked` IN (true,1)))"},
+		{"exists", &policy.Filter{Any: [][]policy.Condition{{{Attribute: "entry.Status", Op: policy.OpExists}}}},
+			"(`status` IS NOT NULL AND `status` <> '')"},
+		{"not in keeps null", &policy.Filter{Any: [][]policy.Condition{{{Attribute: "entry.Status", Op: policy.OpNotIn, Value: []interface{}{"a", "b"}}}}},
+			"(`status` IS NULL OR `status` NOT IN ('a','b'))"},
+		{"eq null matches nothing", &policy.Filter{Any: [][]policy.Condition{{{Attribute: "entry.Status", Op: policy.OpEq}}}},
+			"1 = 0"},
+		{"ne null is set", &policy.Filter{Any: [][]policy.Condition{{{Attribute: "entry.Status", Op: policy.OpNe}}}},
+			"`status` IS NOT NULL"},
+		{"in nothing", &policy.Filter{Any: [][]policy.Condition{{{Attribute: "entry.Status", Op: policy.OpIn, Value: []interface{}{}}}}},
+			"1 = 0"},
+		{"not in nothing", &policy.Filter{None: [][]policy.Condition{{{Attribute: "entry.Status", Op: policy.OpNotIn, Value: []interface{}{}}}}},
+			"NOT (1 = 1)"},
+		{"unknown field is null", &policy.Filter{Any: [][]policy.Condition{{{Attribute: "entry.team", Op: policy.OpEq, Value: "a"}}}},
+			"1 = 0"},
+		{"deny on an unknown field", &policy.Filter{None: [][]policy.Condition{{{Attribute: "entry.team", Op: policy.OpNe, Value: "a"}}}},
+			"NOT (1 = 1)"},
+	}
+
+	db, err := gorm.Open(mysql.New(mysql.Config{SkipInitializeWithVersion: true}), &gorm.Config{DryRun: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := db.ToSQL(func(tx *gorm.DB) *gorm.DB {
+				var rows []map[string]interface{}
+				return tx.Table("policy_posts").Where(filterCondition("policy_posts", test.filter)).Find(&rows)
+			})
+			if want := "SELECT * FROM `policy_posts` WHERE " + test.where; got != want {
+				t.Fatalf("\n got %s\nwant %s", got, want)
+			}
+		})
+	}
+}
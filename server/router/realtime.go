@@ -0,0 +1,397 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/chukfi/backend/database/schema"
+	"github.com/chukfi/backend/src/httpresponder"
+	"github.com/chukfi/backend/src/lib/events"
+	"github.com/chukfi/backend/src/lib/realtime"
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+)
+
+const (
+	// how often an idle connection gets a heartbeat, proxies tend to cut connections idle for 60s
+	realtimeHeartbeat = 25 * time.Second
+	// how long a websocket client gets to answer a ping
+	realtimePongWait = 60 * time.Second
+)
+
+// realtimeMessage is what the websocket sends, and the data of the sse reset event
+type realtimeMessage struct {
+	Type    string           `json:"type"` // event, subscribed, reset or error
+	ID      string           `json:"id,omitempty"`
+	Event   interface{}      `json:"event,omitempty"`
+	Filter  *realtime.Filter `json:"filter,omitempty"`
+	Message string           `json:"message,omitempty"`
+}
+
+// realtimeCommand is what a websocket client sends to change its subscription
+type realtimeCommand struct {
+	Action      string   `json:"action"` // subscribe or unsubscribe
+	Collections []string `json:"collections"`
+	IDs         []string `json:"ids"`
+}
+
+// canSubscribeTo checks the user may receive events of the collection, the same rules as /collection/{name}/get
+func canSubscribeTo(r *http.Request, database *gorm.DB, collection string) bool {
+	if !schemaregistry.IsRegistered(collection) {
+		return false
+	}
+	return checkReadAccess(r, database, collection) == nil
+}
+
+// visibleEvent copies the event without the fields the user cant read, the event itself is shared by every subscriber
+func visibleEvent(r *http.Request, database *gorm.DB, event events.Event) events.Event {
+	data := make(map[string]interface{}, len(event.Data))
+	for key, value := range event.Data {
+		data[key] = value
+	}
+	hideFields(r, database, event.Collection, []map[string]interface{}{data})
+	event.Data = data
+	return event
+}
+
+/*
+resolveRealtimeFilter resolves the collection names of a filter and checks the user may subscribe to them,
+"*" stays as is and means every collection the user can see
+*/
+func resolveRealtimeFilter(r *http.Request, database *gorm.DB, filter realtime.Filter) (realtime.Filter, error) {
+	resolved := realtime.Filter{IDs: filter.IDs}
+
+	for _, collection := range filter.Collections {
+		collection = strings.TrimSpace(collection)
+		if collection == "" {
+			continue
+		}
+		if collection == "*" {
+			resolved.Collections = append(resolved.Collections, collection)
+			continue
+		}
+
+		name, ok := schemaregistry.ResolveTableName(collection)
+		if !ok {
+			return resolved, fmt.Errorf("invalid collection name: %s", collection)
+		}
+		if !canSubscribeTo(r, database, name) {
+			return resolved, fmt.Errorf("you do not have permission to subscribe to %s", name)
+		}
+		resolved.Collections = append(resolved.Collections, name)
+	}
+
+	return resolved, nil
+}
+
+func splitQueryList(query url.Values, key string) []string {
+	var list []string
+	for _, value := range query[key] {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// realtimeSessionValid checks the auth token of a long running connection hasnt expired or been revoked
+func realtimeSessionValid(r *http.Request, database *gorm.DB) bool {
+	authToken, _ := r.Context().Value("authToken").(string)
+	_, err := gorm.G[schema.UserToken](database).Where("token = ? AND expires_at > ?", authToken, time.Now().Unix()).First(r.Context())
+	return err == nil
+}
+
+// realtimeUpgrader upgrades websocket connections, cross origin connections are only accepted from REALTIME_ALLOWED_ORIGINS
+var realtimeUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		if parsed, err := url.Parse(origin); err == nil && strings.EqualFold(parsed.Host, r.Host) {
+			return true
+		}
+		for _, allowed := range strings.Split(os.Getenv("REALTIME_ALLOWED_ORIGINS"), ",") {
+			if allowed = strings.TrimSpace(allowed); allowed != "" && (allowed == "*" || strings.EqualFold(allowed, origin)) {
+				return true
+			}
+		}
+		return false
+	},
+}
+
+/*
+RegisterRealtimeRoutes registers the realtime endpoints, both need auth:
+
+	GET /realtime?collections=posts,pages&ids=<id>      server sent events
+	GET /realtime/ws?collections=posts                 websocket, the subscription can be changed by sending commands
+
+events of collections the user cant see are never sent, resume with the Last-Event-ID header (or ?lastEventId=)
+*/
+func RegisterRealtimeRoutes(r chi.Router, database *gorm.DB) {
+	realtime.Listen()
+
+	r.Route("/realtime", func(r chi.Router) {
+		r.Use(AuthMiddlewareWithDatabase(database))
+
+		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			flusher, ok := w.(http.Flusher)
+			if !ok {
+				httpresponder.SendErrorResponse(w, r, "Streaming is not supported", http.StatusInternalServerError)
+				return
+			}
+
+			filter, err := resolveRealtimeFilter(r, database, realtime.Filter{
+				Collections: splitQueryList(r.URL.Query(), "collections"),
+				IDs:         splitQueryList(r.URL.Query(), "ids"),
+			})
+			if err != nil {
+				httpresponder.SendErrorResponse(w, r, err.Error(), http.StatusForbidden)
+				return
+			}
+			if filter.Empty() {
+				httpresponder.SendErrorResponse(w, r, "Subscribe to at least one collection or id", http.StatusBadRequest)
+				return
+			}
+
+			lastEventID := r.Header.Get("Last-Event-ID")
+			if lastEventID == "" {
+				lastEventID = r.URL.Query().Get("lastEventId")
+			}
+
+			subscription, missed, resumed := realtime.DefaultHub.Subscribe(filter, lastEventID)
+			defer subscription.Close()
+
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("Connection", "keep-alive")
+			w.Header().Set("X-Accel-Buffering", "no")
+			w.WriteHeader(http.StatusOK)
+
+			fmt.Fprint(w, "retry: 3000\n\n")
+			if !resumed {
+				// the events since lastEventID are gone, the client has to refetch what it shows
+				fmt.Fprint(w, "event: reset\ndata: {\"type\":\"reset\"}\n\n")
+			}
+
+			send := func(message realtime.Message) {
+				if !canSubscribeTo(r, database, message.Event.Collection) || !canReceiveEvent(r, database, message.Event) {
+					return
+				}
+				data, err := json.Marshal(visibleEvent(r, database, message.Event))
+				if err != nil {
+					return
+				}
+				fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", message.ID, message.Event.Type, data)
+			}
+
+			for _, message := range missed {
+				send(message)
+			}
+			flusher.Flush()
+
+			heartbeat := time.NewTicker(realtimeHeartbeat)
+			defer heartbeat.Stop()
+
+			for {
+				select {
+				case <-r.Context().Done():
+					return
+				case message, open := <-subscription.C:
+					if !open {
+						// too slow, the client reconnects with the last id it got
+						return
+					}
+					send(message)
+					flusher.Flush()
+				case <-heartbeat.C:
+					if !realtimeSessionValid(r, database) {
+						fmt.Fprint(w, "event: error\ndata: {\"type\":\"error\",\"message\":\"session expired\"}\n\n")
+						flusher.Flush()
+						return
+					}
+					fmt.Fprint(w, ": heartbeat\n\n")
+					flusher.Flush()
+				}
+			}
+		})
+
+		r.Get("/ws", func(w http.ResponseWriter, r *http.Request) {
+			initial, err := resolveRealtimeFilter(r, database, realtime.Filter{
+				Collections: splitQueryList(r.URL.Query(), "collections"),
+				IDs:         splitQueryList(r.URL.Query(), "ids"),
+			})
+			if err != nil {
+				httpresponder.SendErrorResponse(w, r, err.Error(), http.StatusForbidden)
+				return
+			}
+
+			conn, err := realtimeUpgrader.Upgrade(w, r, nil)
+			if err != nil {
+				// the upgrader already sent the error response
+				return
+			}
+			defer conn.Close()
+
+			subscription, missed, resumed := realtime.DefaultHub.Subscribe(initial, r.URL.Query().Get("lastEventId"))
+			defer subscription.Close()
+
+			// every write goes through this goroutine, gorilla connections allow only one writer
+			outgoing := make(chan realtimeMessage, 16)
+			done := make(chan struct{})
+			stop := make(chan struct{})
+			defer close(stop)
+
+			reply := func(message realtimeMessage) bool {
+				select {
+				case outgoing <- message:
+					return true
+				case <-stop:
+					return false
+				}
+			}
+
+			go func() {
+				defer close(done)
+				conn.SetReadLimit(64 << 10)
+				conn.SetReadDeadline(time.Now().Add(realtimePongWait))
+				conn.SetPongHandler(func(string) error {
+					return conn.SetReadDeadline(time.Now().Add(realtimePongWait))
+				})
+
+				for {
+					var command realtimeCommand
+					if err := conn.ReadJSON(&command); err != nil {
+						return
+					}
+
+					filter := subscription.Filter()
+					requested, err := resolveRealtimeFilter(r, database, realtime.Filter{Collections: command.Collections, IDs: command.IDs})
+					if err != nil {
+						if !reply(realtimeMessage{Type: "error", Message: err.Error()}) {
+							return
+						}
+						continue
+					}
+
+					switch command.Action {
+					case "subscribe":
+						filter.Collections = appendUnique(filter.Collections, requested.Collections...)
+						filter.IDs = appendUnique(filter.IDs, requested.IDs...)
+					case "unsubscribe":
+						filter.Collections = removeAll(filter.Collections, requested.Collections...)
+						filter.IDs = removeAll(filter.IDs, requested.IDs...)
+					default:
+						if !reply(realtimeMessage{Type: "error", Message: "unknown action, expected subscribe or unsubscribe"}) {
+							return
+						}
+						continue
+					}
+
+					subscription.SetFilter(filter)
+					if !reply(realtimeMessage{Type: "subscribed", Filter: &filter}) {
+						return
+					}
+				}
+			}()
+
+			write := func(message realtimeMessage) bool {
+				conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+				return conn.WriteJSON(message) == nil
+			}
+			sendEvent := func(message realtime.Message) bool {
+				if !canSubscribeTo(r, database, message.Event.Collection) || !canReceiveEvent(r, database, message.Event) {
+					return true
+				}
+				return write(realtimeMessage{Type: "event", ID: message.ID, Event: visibleEvent(r, database, message.Event)})
+			}
+
+			filter := subscription.Filter()
+			if !write(realtimeMessage{Type: "subscribed", Filter: &filter}) {
+				return
+			}
+			if !resumed && !write(realtimeMessage{Type: "reset"}) {
+				return
+			}
+			for _, message := range missed {
+				if !sendEvent(message) {
+					return
+				}
+			}
+
+			heartbeat := time.NewTicker(realtimeHeartbeat)
+			defer heartbeat.Stop()
+
+			for {
+				select {
+				case <-done:
+					return
+				case message := <-outgoing:
+					if !write(message) {
+						return
+					}
+				case message, open := <-subscription.C:
+					if !open {
+						conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"), time.Now().Add(time.Second))
+						return
+					}
+					if !sendEvent(message) {
+						return
+					}
+				case <-heartbeat.C:
+					if !realtimeSessionValid(r, database) {
+						conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session expired"), time.Now().Add(time.Second))
+						return
+					}
+					if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+						return
+					}
+				}
+			}
+		})
+	})
+}
+
+func appendUnique(list []string, values ...string) []string {
+	for _, value := range values {
+		found := false
+		for _, existing := range list {
+			if existing == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, value)
+		}
+	}
+	return list
+}
+
+func removeAll(list []string, values ...string) []string {
+	kept := []string{}
+	for _, existing := range list {
+		remove := false
+		for _, value := range values {
+			if existing == value {
+				remove = true
+				break
+			}
+		}
+		if !remove {
+			kept = append(kept, existing)
+		}
+	}
+	return kept
+}
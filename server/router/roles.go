@@ -0,0 +1,346 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/chukfi/backend/database/schema"
+	"github.com/chukfi/backend/src/httpresponder"
+	"github.com/chukfi/backend/src/lib/permissions"
+	"github.com/chukfi/backend/src/lib/roles"
+	"github.com/chukfi/backend/src/lib/users"
+	"github.com/go-chi/chi/v5"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+type roleRequest struct {
+	Name        *string   `json:"name"`
+	Description *string   `json:"description"`
+	Permissions *[]string `json:"permissions"` // names, e.g ["ViewModels", "posts.update"]
+}
+
+type roleMemberRequest struct {
+	UserID string `json:"userID"`
+}
+
+// roleResponse is a role as sent by the role routes, with its permissions by name
+type roleResponse struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Permissions []string  `json:"permissions"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+func newRoleResponse(role schema.Role) roleResponse {
+	return roleResponse{
+		ID:          role.ID.String(),
+		Name:        role.Name,
+		Description: role.Description,
+		Permissions: permissionNames(role.Permissions),
+		CreatedAt:   role.CreatedAt,
+		UpdatedAt:   role.UpdatedAt,
+	}
+}
+
+// apply copies the set fields of the request onto the role
+func (body roleRequest) apply(role *schema.Role) error {
+	if body.Name != nil {
+		role.Name = *body.Name
+	}
+	if body.Description != nil {
+		role.Description = *body.Description
+	}
+	if body.Permissions != nil {
+		perms, err := roles.ParsePermissions(*body.Permissions)
+		if err != nil {
+			return err
+		}
+		role.Permissions = perms
+	}
+	return nil
+}
+
+// getRoleFromRequest loads the role from the {roleID} url param, sending the error response if it fails
+func getRoleFromRequest(w http.ResponseWriter, r *http.Request, database *gorm.DB) (*schema.Role, bool) {
+	role, err := roles.Get(r.Context(), database, chi.URLParam(r, "roleID"))
+	if err != nil {
+		if errors.Is(err, roles.ErrRoleNotFound) {
+			httpresponder.SendErrorResponse(w, r, "Role not found", http.StatusNotFound)
+			return nil, false
+		}
+		httpresponder.SendErrorResponse(w, r, "Error fetching role: "+err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return role, true
+}
+
+// sendRoleValidationError sends the right response for an error from roles.Validate or roleRequest.apply
+func sendRoleValidationError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, roles.ErrInvalidName), errors.Is(err, roles.ErrUnknownPermission):
+		httpresponder.SendErrorResponse(w, r, "Invalid role: "+err.Error(), http.StatusBadRequest)
+	case errors.Is(err, roles.ErrNameTaken):
+		httpresponder.SendErrorResponse(w, r, "Invalid role: "+err.Error(), http.StatusConflict)
+	default:
+		httpresponder.SendErrorResponse(w, r, "Error saving role: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+/*
+canGrant checks the user of the request holds every permission of the role, so managing roles can't be used to
+give anyone (yourself included) more than you have. Administrators can grant everything
+*/
+func canGrant(w http.ResponseWriter, r *http.Request, database *gorm.DB, role *schema.Role) bool {
+	return canGrantPermissions(w, r, database, role.Permissions, "Forbidden: You can only manage roles with permissions you have yourself")
+}
+
+/*
+memberFromRequest reads the user of a role assign / unassign request, sending the error response if it fails. Like
+/admin/users, only users the request can manage (see users.CanManage) get roles given or taken
+*/
+func memberFromRequest(w http.ResponseWriter, r *http.Request, database *gorm.DB) (uuid.UUID, bool) {
+	var body roleMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		httpresponder.SendErrorResponse(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return uuid.Nil, false
+	}
+	userID, err := uuid.FromString(body.UserID)
+	if err != nil {
+		httpresponder.SendErrorResponse(w, r, "Invalid user ID: "+err.Error(), http.StatusBadRequest)
+		return uuid.Nil, false
+	}
+
+	manager, err := GetUserFromRequest(r, database)
+	if err != nil {
+		httpresponder.SendErrorResponse(w, r, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return uuid.Nil, false
+	}
+	member, err := users.Get(r.Context(), database, userID.String())
+	if err != nil {
+		if errors.Is(err, users.ErrUserNotFound) {
+			httpresponder.SendErrorResponse(w, r, "User not found", http.StatusNotFound)
+			return uuid.Nil, false
+		}
+		httpresponder.SendErrorResponse(w, r, "Error fetching user: "+err.Error(), http.StatusInternalServerError)
+		return uuid.Nil, false
+	}
+	if !users.CanManage(manager, member) {
+		httpresponder.SendErrorResponse(w, r, "Forbidden: You can only manage users with permissions you have yourself", http.StatusForbidden)
+		return uuid.Nil, false
+	}
+	return userID, true
+}
+
+/*
+RegisterRoleRoutes registers the role management routes. Listing roles requires ViewUsers, changing them or who has
+them requires ManageUsers and every permission of the role
+*/
+func RegisterRoleRoutes(r chi.Router, database *gorm.DB) {
+	r.Route("/roles", func(r chi.Router) {
+		r.Use(AuthMiddlewareWithDatabase(database))
+		r.Use(RoutesRequiresPermission(database, permissions.ViewUsers))
+
+		// ?userID= lists the roles of that user
+		r.Get("/list", func(w http.ResponseWriter, r *http.Request) {
+			var results []schema.Role
+			var err error
+			if userID := r.URL.Query().Get("userID"); userID != "" {
+				results, err = roles.Of(r.Context(), database, userID)
+			} else {
+				results, err = gorm.G[schema.Role](database).Order("name").Find(r.Context())
+			}
+			if err != nil {
+				httpresponder.SendErrorResponse(w, r, "Error fetching roles: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			response := make([]roleResponse, 0, len(results))
+			for _, role := range results {
+				response = append(response, newRoleResponse(role))
+			}
+			httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+				"roles": response,
+			})
+		})
+
+		r.With(RoutesRequiresPermission(database, permissions.ManageUsers)).Post("/create", func(w http.ResponseWriter, r *http.Request) {
+			var body roleRequest
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				httpresponder.SendErrorResponse(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			var role schema.Role
+			if err := body.apply(&role); err != nil {
+				sendRoleValidationError(w, r, err)
+				return
+			}
+			if err := roles.Validate(r.Context(), database, &role); err != nil {
+				sendRoleValidationError(w, r, err)
+				return
+			}
+			if !canGrant(w, r, database, &role) {
+				return
+			}
+
+			if err := gorm.G[schema.Role](database).Create(r.Context(), &role); err != nil {
+				httpresponder.SendErrorResponse(w, r, "Error creating role: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			httpresponder.SendNormalResponse(w, r, newRoleResponse(role))
+		})
+
+		r.Route("/{roleID}", func(r chi.Router) {
+			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				role, ok := getRoleFromRequest(w, r, database)
+				if !ok {
+					return
+				}
+				httpresponder.SendNormalResponse(w, r, newRoleResponse(*role))
+			})
+
+			r.Get("/users", func(w http.ResponseWriter, r *http.Request) {
+				role, ok := getRoleFromRequest(w, r, database)
+				if !ok {
+					return
+				}
+
+				members, err := roles.Members(r.Context(), database, role.ID)
+				if err != nil {
+					httpresponder.SendErrorResponse(w, r, "Error fetching users: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+				users := []schema.User{}
+				if len(members) > 0 {
+					users, err = gorm.G[schema.User](database).Select("id", "fullname", "email").Where("id IN ?", members).Order("fullname").Find(r.Context())
+					if err != nil {
+						httpresponder.SendErrorResponse(w, r, "Error fetching users: "+err.Error(), http.StatusInternalServerError)
+						return
+					}
+				}
+
+				type roleMember struct {
+					ID       string `json:"id"`
+					Fullname string `json:"fullname"`
+					Email    string `json:"email"`
+				}
+				response := make([]roleMember, 0, len(users))
+				for _, user := range users {
+					response = append(response, roleMember{ID: user.ID.String(), Fullname: user.Fullname, Email: user.Email})
+				}
+				httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+					"users": response,
+				})
+			})
+
+			r.Group(func(r chi.Router) {
+				r.Use(RoutesRequiresPermission(database, permissions.ManageUsers))
+
+				r.Post("/update", func(w http.ResponseWriter, r *http.Request) {
+					role, ok := getRoleFromRequest(w, r, database)
+					if !ok {
+						return
+					}
+					// the role as it was has to be grantable too, or its permissions could be taken away
+					if !canGrant(w, r, database, role) {
+						return
+					}
+
+					var body roleRequest
+					if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+						httpresponder.SendErrorResponse(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+						return
+					}
+					if err := body.apply(role); err != nil {
+						sendRoleValidationError(w, r, err)
+						return
+					}
+					if err := roles.Validate(r.Context(), database, role); err != nil {
+						sendRoleValidationError(w, r, err)
+						return
+					}
+					if !canGrant(w, r, database, role) {
+						return
+					}
+
+					if err := roles.Update(r.Context(), database, role); err != nil {
+						httpresponder.SendErrorResponse(w, r, "Error updating role: "+err.Error(), http.StatusInternalServerError)
+						return
+					}
+
+					httpresponder.SendNormalResponse(w, r, newRoleResponse(*role))
+				})
+
+				r.Post("/delete", func(w http.ResponseWriter, r *http.Request) {
+					role, ok := getRoleFromRequest(w, r, database)
+					if !ok || !canGrant(w, r, database, role) {
+						return
+					}
+
+					if err := roles.Delete(r.Context(), database, role.ID); err != nil {
+						if errors.Is(err, roles.ErrRoleNotFound) {
+							httpresponder.SendErrorResponse(w, r, "Role not found", http.StatusNotFound)
+							return
+						}
+						httpresponder.SendErrorResponse(w, r, "Error deleting role: "+err.Error(), http.StatusInternalServerError)
+						return
+					}
+
+					httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+						"success": true,
+					})
+				})
+
+				r.Post("/assign", func(w http.ResponseWriter, r *http.Request) {
+					role, ok := getRoleFromRequest(w, r, database)
+					if !ok || !canGrant(w, r, database, role) {
+						return
+					}
+					userID, ok := memberFromRequest(w, r, database)
+					if !ok {
+						return
+					}
+
+					if err := roles.Assign(r.Context(), database, userID, role.ID); err != nil {
+						if errors.Is(err, roles.ErrUserNotFound) {
+							httpresponder.SendErrorResponse(w, r, "User not found", http.StatusNotFound)
+							return
+						}
+						httpresponder.SendErrorResponse(w, r, "Error assigning role: "+err.Error(), http.StatusInternalServerError)
+						return
+					}
+
+					httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+						"success": true,
+					})
+				})
+
+				r.Post("/unassign", func(w http.ResponseWriter, r *http.Request) {
+					role, ok := getRoleFromRequest(w, r, database)
+					if !ok || !canGrant(w, r, database, role) {
+						return
+					}
+					userID, ok := memberFromRequest(w, r, database)
+					if !ok {
+						return
+					}
+
+					if err := roles.Unassign(r.Context(), database, userID, role.ID); err != nil {
+						httpresponder.SendErrorResponse(w, r, "Error unassigning role: "+err.Error(), http.StatusInternalServerError)
+						return
+					}
+
+					httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+						"success": true,
+					})
+				})
+			})
+		})
+	})
+}
@@ -10,7 +10,16 @@ import (
 	"github.com/chukfi/backend/src/chumiddleware"
 	"github.com/chukfi/backend/src/httpresponder"
 	usercache "github.com/chukfi/backend/src/lib/cache/user"
+	"github.com/chukfi/backend/src/lib/changefeed"
+	"github.com/chukfi/backend/src/lib/delivery"
+	"github.com/chukfi/backend/src/lib/media"
 	"github.com/chukfi/backend/src/lib/permissions"
+	"github.com/chukfi/backend/src/lib/policy"
+	"github.com/chukfi/backend/src/lib/roles"
+	"github.com/chukfi/backend/src/lib/search"
+	"github.com/chukfi/backend/src/lib/signing"
+	"github.com/chukfi/backend/src/lib/users"
+	"github.com/chukfi/backend/src/lib/webhooks"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	uuid "github.com/satori/go.uuid"
@@ -74,39 +83,48 @@ func GetUserFromRequest(request *http.Request, database *gorm.DB) (*schema.User,
 	if result.Error != nil {
 		return nil, result.Error
 	}
+	if err := roles.Load(request.Context(), database, &user); err != nil {
+		return nil, err
+	}
 
 	usercache.UserCacheInstance.Set(userID, user)
 	return &user, nil
 }
 
 /*
-RequestRequiresPermission checks if the user associated with the request has the required permissions.
+RequestRequiresPermission checks if the user associated with the request has the required permissions, or a policy
+rule allows the access action on the path.
 */
 func RequestRequiresPermission(request *http.Request, database *gorm.DB, requiredPermissions permissions.Permission) bool {
-	user, err := GetUserFromRequest(request, database)
-	if err != nil {
+	if _, err := GetUserFromRequest(request, database); err != nil {
 		return false
 	}
-	userPerms := permissions.Permission(user.Permissions)
+	return authorize(request, database, policy.ActionAccess, policy.Resource{Permission: requiredPermissions, Path: request.URL.Path}).Allowed
+}
 
-	result := permissions.HasPermission(userPerms, requiredPermissions)
-	return result
+/*
+RequestHasCollectionPermission checks if the user associated with the request may do the action (permissions.ActionRead...)
+on the collection, through the permission of the collection (posts.update), the global ViewModels / ManageModels
+or a policy rule. Rules depending on the entry count as allowed, the routes limit their queries to those entries.
+*/
+func RequestHasCollectionPermission(request *http.Request, database *gorm.DB, collection string, action string) bool {
+	return authorize(request, database, action, policy.Resource{Collection: collection}).Allowed
 }
 
 /*
-RoutesRequiresPermission is a middleware that checks if the user has the required permissions to access the route.
-If not, it returns a 403 Forbidden response.
+RoutesRequiresPermission is a middleware that checks if the user has the required permissions to access the route,
+or a policy rule allows the access action on the path. If not, it returns a 403 Forbidden response.
 */
 func RoutesRequiresPermission(database *gorm.DB, required permissions.Permission) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
-			user, err := GetUserFromRequest(r, database)
+			_, err := GetUserFromRequest(r, database)
 			if err != nil {
 				httpresponder.SendErrorResponse(w, r, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
 				return
 			}
-			if !permissions.HasPermission(permissions.Permission(user.Permissions), required) {
+			if !authorize(r, database, policy.ActionAccess, policy.Resource{Permission: required, Path: r.URL.Path}).Allowed {
 				httpresponder.SendErrorResponse(w, r, "Forbidden: Insufficient permissions", http.StatusForbidden)
 				return
 			}
@@ -153,9 +171,45 @@ func AuthMiddlewareWithDatabase(database *gorm.DB) func(http.Handler) http.Handl
 	}
 }
 
+/*
+RegisterRoutes registers every chukfi route on r without starting anything, SetupRouter calls it after
+initializing the search index, signing keys, webhooks etc. Registering needs no database connection,
+which lets the routes be listed (e.g for the OpenAPI document) without one.
+*/
+func RegisterRoutes(r chi.Router, database *gorm.DB) {
+	// admin routes with database so /admin/collection/${collectionName}/get
+
+	r.Route("/admin", func(r chi.Router) {
+		RegisterAuthRoutes(r, database)
+		RegisterCollectionRoutes(r, database)
+		RegisterSearchRoutes(r, database)
+		RegisterMediaRoutes(r, database)
+		RegisterSigningRoutes(r, database)
+		RegisterWebhookRoutes(r, database)
+		RegisterRealtimeRoutes(r, database)
+		RegisterAPIKeyRoutes(r, database)
+		RegisterPolicyRoutes(r, database)
+		RegisterRoleRoutes(r, database)
+		RegisterPermissionRoutes(r, database)
+		RegisterUserRoutes(r, database)
+	})
+
+	// the public content delivery api, /content/{collection} for the collections enabled with delivery.Enable
+	RegisterDeliveryRoutes(r, database)
+
+	// outside of the /admin route so the path can be configured, defaults to /admin/graphql
+	RegisterGraphQLRoutes(r, database)
+
+	// describes everything registered on r, including routes the app adds later
+	RegisterOpenAPIRoutes(r, database)
+}
+
 func SetupRouter(database *gorm.DB, frontendDirectory ...string) *chi.Mux {
 	r := chi.NewRouter()
 
+	yellow := "\033[33m"
+	reset := "\033[0m"
+
 	r.Use(middleware.Logger)
 	r.Use(chumiddleware.CaseSensitiveMiddleware)
 	r.Use(chumiddleware.SaveAuthTokenMiddleware)
@@ -165,17 +219,52 @@ func SetupRouter(database *gorm.DB, frontendDirectory ...string) *chi.Mux {
 		fileServer := http.FileServer(http.Dir(frontendDirectory[0]))
 		r.Handle("/*", http.StripPrefix("/", fileServer))
 	} else {
-		yellow := "\033[33m"
-		reset := "\033[0m"
 		fmt.Println(string(yellow), "Warning: Frontend directory not set. Static files will not be served.", string(reset))
 	}
 
-	// admin routes with database so /admin/collection/${collectionName}/get
+	// hash passwords written through the collection api and keep the user cache in sync with it
+	users.RegisterHooks()
 
-	r.Route("/admin", func(r chi.Router) {
-		RegisterAuthRoutes(r, database)
-		RegisterCollectionRoutes(r, database)
-	})
+	// private media and media deletes follow the media library rules through the collection api too. Without the
+	// private media rule private entries would be readable, so the server doesn't start
+	if err := media.RegisterHooks(database); err != nil {
+		panic("failed to register the media hooks: " + err.Error())
+	}
+
+	// the rules of POLICY_FILE, on top of the ones added in go. A file that doesn't load would drop its deny rules
+	if err := policy.Init(); err != nil {
+		panic("failed to load the policy file: " + err.Error())
+	}
+
+	// fill the search index and keep it in sync with collection writes
+	if err := search.Listen(database); err != nil {
+		fmt.Println(string(yellow), "Warning: Failed to build the search index: "+err.Error(), string(reset))
+	}
+
+	// keys for signed urls (private media, previews)
+	if err := signing.Init(database); err != nil {
+		fmt.Println(string(yellow), "Warning: Failed to load the url signing keys: "+err.Error(), string(reset))
+	}
+
+	// record every write for the /changes delta sync feed
+	if err := changefeed.Init(database); err != nil {
+		fmt.Println(string(yellow), "Warning: Failed to start the change feed: "+err.Error(), string(reset))
+	}
+
+	// deliver collection events to the registered webhooks
+	if err := webhooks.Init(database); err != nil {
+		fmt.Println(string(yellow), "Warning: Failed to start webhooks: "+err.Error(), string(reset))
+	}
+
+	// api keys of the content delivery api
+	if err := delivery.Init(database); err != nil {
+		fmt.Println(string(yellow), "Warning: Failed to migrate the api keys: "+err.Error(), string(reset))
+	}
+
+	// remove tus uploads that were never finished
+	media.StartUploadJanitor(database, time.Hour)
+
+	RegisterRoutes(r, database)
 
 	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusNotFound)
@@ -0,0 +1,182 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/chukfi/backend/src/httpresponder"
+	"github.com/chukfi/backend/src/lib/filter"
+	"github.com/chukfi/backend/src/lib/permissions"
+	"github.com/chukfi/backend/src/lib/policy"
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+	"github.com/chukfi/backend/src/lib/search"
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+type searchRequest struct {
+	Query       string              `json:"query"`
+	Collections []string            `json:"collections"`
+	Filters     map[string][]string `json:"filters"`
+	Facets      []string            `json:"facets"`
+	Take        *int                `json:"take"`
+	Page        *int                `json:"page"`
+}
+
+/*
+RegisterSearchRoutes registers the global search used by the admin dashboard, it searches
+every collection the user can see at once. Per collection search lives at /collection/{name}/search
+*/
+func RegisterSearchRoutes(r chi.Router, database *gorm.DB) {
+	r.Route("/search", func(r chi.Router) {
+		r.Use(AuthMiddlewareWithDatabase(database))
+
+		r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+			user, err := GetUserFromRequest(r, database)
+			if err != nil {
+				httpresponder.SendErrorResponse(w, r, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+				return
+			}
+
+			userPermissions := user.EffectivePermissions()
+			if !permissions.HasPermission(userPermissions, permissions.ViewDashboard) {
+				httpresponder.SendErrorResponse(w, r, "Forbidden: You do not have permission to use the dashboard search", http.StatusForbidden)
+				return
+			}
+
+			var body searchRequest
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				httpresponder.SendErrorResponse(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			// only search what was asked for (or everything), minus the collections the user cant read
+			requested := make(map[string]bool)
+			for _, name := range body.Collections {
+				resolvedName, exists := schemaregistry.ResolveTableName(name)
+				if !exists {
+					httpresponder.SendErrorResponse(w, r, "Invalid collection name: "+name, http.StatusBadRequest)
+					return
+				}
+				requested[resolvedName] = true
+			}
+
+			var collections []string
+			for tableName, meta := range schemaregistry.GetAllRegisteredSchemas() {
+				if len(requested) > 0 && !requested[tableName] {
+					continue
+				}
+				if meta.AdminOnly && !RequestHasCollectionPermission(r, database, tableName, permissions.ActionRead) {
+					continue
+				}
+				collections = append(collections, tableName)
+			}
+
+			runSearch(w, r, database, collections, body)
+		})
+	})
+}
+
+/*
+runSearch runs the search against the current engine, collections must already be checked for access, the ones a
+policy rule denies are left out.
+Fields the user cant read (see hideFields) are not matched, returned or counted, entries they dont own are not hit
+*/
+func runSearch(w http.ResponseWriter, r *http.Request, database *gorm.DB, collections []string, body searchRequest) {
+	take := 20
+	if body.Take != nil && *body.Take > 0 {
+		take = min(*body.Take, 100) // max 100
+	}
+
+	page := 1
+	if body.Page != nil && *body.Page > 0 {
+		page = *body.Page
+	}
+
+	// fields tagged nofilter cant be filtered or counted on, in any of the collections searched
+	names := append([]string{}, body.Facets...)
+	for name := range body.Filters {
+		names = append(names, name)
+	}
+	for _, collectionName := range collections {
+		for _, name := range names {
+			if field, ok := schemaregistry.GetField(collectionName, name); ok && !field.Filterable {
+				httpresponder.SendDetailedErrorResponse(w, r, "Invalid request body: "+name+" can't be filtered on", http.StatusBadRequest, map[string]interface{}{
+					"field":  name,
+					"reason": filter.ReasonNotFilterable,
+				})
+				return
+			}
+		}
+	}
+
+	// policies depending on the entry are checked on the indexed values, a collection whose rules use a field
+	// that isn't indexed can't be checked and is left out
+	filters := make(map[string]*policy.Filter)
+	allowed := make([]string, 0, len(collections))
+	for _, collectionName := range collections {
+		decision := authorize(r, database, permissions.ActionRead, collectionResource(collectionName, permissions.ActionRead, nil))
+		if !decision.Allowed || (decision.Filter != nil && !indexedFilter(collectionName, decision.Filter)) {
+			continue
+		}
+		filters[collectionName] = decision.Filter
+		allowed = append(allowed, collectionName)
+	}
+	collections = allowed
+
+	// collections with an owner field only hit the entries the user owns, see ownerRestriction
+	owned := make(map[string]map[string][]string)
+	for _, collectionName := range collections {
+		if field, userID, restricted := ownerRestriction(r, database, collectionName); restricted {
+			owners := []string{}
+			if userID != "" {
+				owners = append(owners, userID)
+			}
+			owned[collectionName] = map[string][]string{field.Name: owners}
+		}
+	}
+
+	hasPermission := permissionChecker(r, database)
+	results, err := search.GetEngine().Search(search.Query{
+		Text:              body.Query,
+		Collections:       collections,
+		Filters:           body.Filters,
+		CollectionFilters: owned,
+		Facets:            body.Facets,
+		Limit:             take,
+		Offset:            (page - 1) * take,
+		FieldVisible: func(collection string, name string) bool {
+			field, ok := schemaregistry.GetField(collection, name)
+			return !ok || field.Readable(hasPermission)
+		},
+		DocumentVisible: func(collection string, values map[string]interface{}) bool {
+			return filters[collection].Matches(entryAttributes(collection, values))
+		},
+	})
+
+	if err != nil {
+		if errors.Is(err, search.ErrEmptyQuery) {
+			httpresponder.SendErrorResponse(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		httpresponder.SendErrorResponse(w, r, "Error searching: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	httpresponder.SendNormalResponse(w, r, results)
+}
+
+// indexedFilter checks every field the filter uses is in the search documents of the collection (see search.BuildDocument)
+func indexedFilter(collectionName string, filter *policy.Filter) bool {
+	for _, set := range append(slices.Clone(filter.Any), filter.None...) {
+		for _, condition := range set {
+			field, ok := schemaregistry.GetField(collectionName, condition.Field())
+			if !ok || !field.Indexed() || field.Column == "deleted_at" {
+				return false
+			}
+		}
+	}
+	return true
+}
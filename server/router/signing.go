@@ -0,0 +1,265 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chukfi/backend/src/httpresponder"
+	"github.com/chukfi/backend/src/lib/imaging"
+	"github.com/chukfi/backend/src/lib/permissions"
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+	"github.com/chukfi/backend/src/lib/signing"
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// signURLRequest is the body of every endpoint that hands out a signed url, ttl is in seconds
+type signURLRequest struct {
+	TTL       int    `json:"ttl"`
+	SingleUse bool   `json:"singleUse"`
+	Image     string `json:"image"` // media only, image options like "preset=thumbnail", signs the /image url instead of /file
+}
+
+// default lifetime of a signed url when no ttl is given
+const defaultSignedURLTTL = time.Hour
+
+/*
+IsSignedURLRequest checks if the request was let through by a verified signed url instead of an auth token.
+*/
+func IsSignedURLRequest(request *http.Request) bool {
+	signed, ok := request.Context().Value("signedURL").(bool)
+	return ok && signed
+}
+
+// verifySignedURL checks the signature of the request url, sending the error response if it fails
+func verifySignedURL(w http.ResponseWriter, r *http.Request) bool {
+	err := signing.Verify(r.URL.Path, r.URL.Query())
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, signing.ErrNotSigned):
+		httpresponder.SendErrorResponse(w, r, "Unauthorized: Signed url required", http.StatusUnauthorized)
+	case errors.Is(err, signing.ErrExpired), errors.Is(err, signing.ErrAlreadyUsed):
+		httpresponder.SendErrorResponse(w, r, "Signed url is no longer valid: "+err.Error(), http.StatusGone)
+	case errors.Is(err, signing.ErrInvalidURL), errors.Is(err, signing.ErrUnknownKey):
+		httpresponder.SendErrorResponse(w, r, "Forbidden: "+err.Error(), http.StatusForbidden)
+	default:
+		httpresponder.SendErrorResponse(w, r, "Error verifying signed url: "+err.Error(), http.StatusInternalServerError)
+	}
+	return false
+}
+
+/*
+SignedURLMiddleware only lets requests through whose url was signed with signing.Sign and has not expired.
+Single use urls are consumed here.
+*/
+func SignedURLMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !verifySignedURL(w, r) {
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), "signedURL", true)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+/*
+AuthOrSignedURLMiddleware accepts either a signed url or a valid auth token, in which case it behaves like AuthMiddlewareWithDatabase.
+Routes behind it should check IsSignedURLRequest before checking permissions.
+*/
+func AuthOrSignedURLMiddleware(database *gorm.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		authenticated := AuthMiddlewareWithDatabase(database)(next)
+		signed := SignedURLMiddleware(next)
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if signing.IsSigned(r.URL.Query()) {
+				signed.ServeHTTP(w, r)
+				return
+			}
+			authenticated.ServeHTTP(w, r)
+		})
+	}
+}
+
+// decodeSignURLRequest reads the body and turns the ttl into sign options
+func decodeSignURLRequest(w http.ResponseWriter, r *http.Request) (signURLRequest, signing.SignOptions, bool) {
+	var body signURLRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			httpresponder.SendErrorResponse(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return body, signing.SignOptions{}, false
+		}
+	}
+
+	options := signing.SignOptions{TTL: defaultSignedURLTTL, SingleUse: body.SingleUse}
+	if body.TTL != 0 {
+		options.TTL = time.Duration(body.TTL) * time.Second
+	}
+	if options.TTL <= 0 || options.TTL > signing.MaxTTL {
+		httpresponder.SendErrorResponse(w, r, "ttl must be between 1 and "+strconv.Itoa(int(signing.MaxTTL.Seconds()))+" seconds", http.StatusBadRequest)
+		return body, options, false
+	}
+
+	return body, options, true
+}
+
+// sendSignedURL signs the path and sends it back
+func sendSignedURL(w http.ResponseWriter, r *http.Request, path string, query url.Values, options signing.SignOptions) {
+	// the router lowercases paths, the signature has to match what it will see
+	signedURL, expiresAt, err := signing.Sign(strings.ToLower(path), query, options)
+	if err != nil {
+		httpresponder.SendErrorResponse(w, r, "Error signing url: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+		"url":       signedURL,
+		"expiresAt": expiresAt,
+		"singleUse": options.SingleUse,
+	})
+}
+
+func RegisterSigningRoutes(r chi.Router, database *gorm.DB) {
+	r.Route("/signing", func(r chi.Router) {
+		r.Use(AuthMiddlewareWithDatabase(database))
+		r.Use(RoutesRequiresPermission(database, permissions.Administrator))
+
+		r.Get("/keys", func(w http.ResponseWriter, r *http.Request) {
+			httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+				"keys": signing.GetKeys(),
+			})
+		})
+
+		// rotates the signing key, links signed with the old key keep working until they expire
+		r.Post("/rotate", func(w http.ResponseWriter, r *http.Request) {
+			if err := signing.Rotate(); err != nil {
+				if errors.Is(err, signing.ErrStaticKeys) {
+					httpresponder.SendErrorResponse(w, r, err.Error(), http.StatusConflict)
+					return
+				}
+				httpresponder.SendErrorResponse(w, r, "Error rotating signing key: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+				"keys": signing.GetKeys(),
+			})
+		})
+	})
+
+	// previews of single entries through signed links, for sharing content with people without an account
+	r.Route("/preview/{collectionName}/{id}", func(r chi.Router) {
+		r.With(AuthMiddlewareWithDatabase(database)).Post("/link", func(w http.ResponseWriter, r *http.Request) {
+			collectionName, ok := schemaregistry.ResolveTableName(chi.URLParam(r, "collectionName"))
+			if !ok {
+				httpresponder.SendErrorResponse(w, r, "Invalid collection name: "+chi.URLParam(r, "collectionName"), http.StatusBadRequest)
+				return
+			}
+
+			if !RequestHasCollectionPermission(r, database, collectionName, permissions.ActionRead) {
+				httpresponder.SendErrorResponse(w, r, "Forbidden: You do not have permission to share entries", http.StatusForbidden)
+				return
+			}
+
+			// admin only collections hold things like users, those never leave through a link
+			if schemaregistry.IsAdminOnly(collectionName) {
+				httpresponder.SendErrorResponse(w, r, "Forbidden: Entries of admin only collections cannot be shared", http.StatusForbidden)
+				return
+			}
+
+			_, options, ok := decodeSignURLRequest(w, r)
+			if !ok {
+				return
+			}
+
+			id := chi.URLParam(r, "id")
+			if _, found := fetchPreviewEntry(w, r, database, collectionName, id, entryCondition(r, database, collectionName, permissions.ActionRead)); !found {
+				return
+			}
+
+			sendSignedURL(w, r, "/admin/preview/"+collectionName+"/"+id, nil, options)
+		})
+
+		r.With(SignedURLMiddleware).Get("/", func(w http.ResponseWriter, r *http.Request) {
+			collectionName, ok := schemaregistry.ResolveTableName(chi.URLParam(r, "collectionName"))
+			if !ok {
+				httpresponder.SendErrorResponse(w, r, "Invalid collection name: "+chi.URLParam(r, "collectionName"), http.StatusBadRequest)
+				return
+			}
+
+			if schemaregistry.IsAdminOnly(collectionName) {
+				httpresponder.SendErrorResponse(w, r, "Forbidden: Entries of admin only collections cannot be shared", http.StatusForbidden)
+				return
+			}
+
+			entry, found := fetchPreviewEntry(w, r, database, collectionName, chi.URLParam(r, "id"), nil)
+			if !found {
+				return
+			}
+
+			w.Header().Set("Cache-Control", "private, no-store")
+			httpresponder.SendNormalResponse(w, r, entry)
+		})
+	})
+}
+
+/*
+fetchPreviewEntry loads a single entry of a collection, sending the error response if it fails. owned limits it to
+the entries the user may read (see entryCondition), a signed link is served to whoever holds it so it passes nil
+*/
+func fetchPreviewEntry(w http.ResponseWriter, r *http.Request, database *gorm.DB, collectionName string, id string, owned clause.Expression) (map[string]interface{}, bool) {
+	query := database.Table(collectionName).Where("id = ?", id)
+	if owned != nil {
+		query = query.Where(owned)
+	}
+	if schemaregistry.HasSoftDelete(collectionName) {
+		query = query.Where("deleted_at IS NULL")
+	}
+
+	results, err := readWithHooks(r, collectionName, query.Limit(1))
+	if err != nil {
+		sendHookError(w, r, err, "Error fetching entry: ")
+		return nil, false
+	}
+	if len(results) == 0 {
+		httpresponder.SendErrorResponse(w, r, "Entry not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return results[0], true
+}
+
+// signMediaURL hands out a signed link to the file of a media entry, or to a transformed image when image options are given
+func signMediaURL(w http.ResponseWriter, r *http.Request, database *gorm.DB, mediaID string) {
+	body, options, ok := decodeSignURLRequest(w, r)
+	if !ok {
+		return
+	}
+
+	path := "/admin/media/" + mediaID + "/file"
+	var query url.Values
+
+	if body.Image != "" {
+		parsed, err := url.ParseQuery(body.Image)
+		if err == nil {
+			_, err = imaging.ParseOptions(parsed, imagePresetsOnly(r, database))
+		}
+		if err != nil {
+			httpresponder.SendErrorResponse(w, r, "Invalid image options: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		path = "/admin/media/" + mediaID + "/image"
+		query = parsed
+	}
+
+	sendSignedURL(w, r, path, query, options)
+}
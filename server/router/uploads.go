@@ -0,0 +1,246 @@
+package router
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chukfi/backend/database/schema"
+	"github.com/chukfi/backend/src/httpresponder"
+	"github.com/chukfi/backend/src/lib/events"
+	"github.com/chukfi/backend/src/lib/media"
+	"github.com/chukfi/backend/src/lib/permissions"
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+// resumable uploads following the tus protocol (https://tus.io/protocols/resumable-upload)
+// with the creation, creation-with-upload, expiration and termination extensions
+
+const tusVersion = "1.0.0"
+
+// parseUploadMetadata parses the tus Upload-Metadata header: "key base64value,key base64value"
+func parseUploadMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			continue
+		}
+		metadata[key] = string(value)
+	}
+	return metadata
+}
+
+// tusMiddleware sets the Tus-Resumable header and refuses clients speaking another protocol version
+func tusMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+
+		if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			httpresponder.SendErrorResponse(w, r, "Unsupported tus version, expected "+tusVersion, http.StatusPreconditionFailed)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// getUploadFromRequest loads the upload from the {uploadID} url param, only the uploader (or an admin) can use it
+func getUploadFromRequest(w http.ResponseWriter, r *http.Request, database *gorm.DB) (*schema.MediaUpload, bool) {
+	upload, err := media.GetUpload(r.Context(), database, chi.URLParam(r, "uploadID"))
+	if err != nil {
+		if errors.Is(err, media.ErrUploadNotFound) {
+			httpresponder.SendErrorResponse(w, r, "Upload not found", http.StatusNotFound)
+			return nil, false
+		}
+		httpresponder.SendErrorResponse(w, r, "Error fetching upload: "+err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	if upload.UploadedBy != GetUserIDFromRequest(r) && !RequestRequiresPermission(r, database, permissions.Administrator) {
+		httpresponder.SendErrorResponse(w, r, "Upload not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return upload, true
+}
+
+func setUploadHeaders(w http.ResponseWriter, upload *schema.MediaUpload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.UploadOffset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.UploadLength, 10))
+	w.Header().Set("Upload-Expires", time.Unix(upload.ExpiresAt, 0).UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+	if upload.MediaID != "" {
+		w.Header().Set("Chukfi-Media-Id", upload.MediaID)
+	}
+}
+
+// writeUploadChunk writes the request body to the upload and publishes the media entry once it completes
+func writeUploadChunk(w http.ResponseWriter, r *http.Request, database *gorm.DB, upload *schema.MediaUpload) bool {
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		httpresponder.SendErrorResponse(w, r, "Invalid Upload-Offset header", http.StatusBadRequest)
+		return false
+	}
+
+	err = media.WriteChunk(r.Context(), database, upload, offset, r.Body)
+	if err != nil {
+		switch {
+		case errors.Is(err, media.ErrUploadOffsetMismatch):
+			setUploadHeaders(w, upload)
+			httpresponder.SendErrorResponse(w, r, "Upload-Offset does not match the current offset", http.StatusConflict)
+		case errors.Is(err, media.ErrUploadComplete):
+			setUploadHeaders(w, upload)
+			httpresponder.SendErrorResponse(w, r, "Upload is already complete", http.StatusForbidden)
+		case errors.Is(err, media.ErrUploadTooLarge):
+			httpresponder.SendErrorResponse(w, r, "Upload exceeds its Upload-Length", http.StatusRequestEntityTooLarge)
+		case errors.Is(err, media.ErrMediaTypeNotAllowed):
+			httpresponder.SendErrorResponse(w, r, "Invalid upload: "+err.Error(), http.StatusUnsupportedMediaType)
+		default:
+			httpresponder.SendErrorResponse(w, r, "Error writing upload: "+err.Error(), http.StatusInternalServerError)
+		}
+		return false
+	}
+
+	if upload.MediaID != "" {
+		events.Publish(events.Event{
+			Type:       events.EventCreate,
+			Collection: schema.Media{}.TableName(),
+			ID:         upload.MediaID,
+			UserID:     GetUserIDFromRequest(r),
+		})
+	}
+
+	return true
+}
+
+func registerUploadRoutes(r chi.Router, database *gorm.DB) {
+	r.Route("/uploads", func(r chi.Router) {
+		r.Use(tusMiddleware)
+
+		// discovery, doesnt need auth
+		r.Options("/", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Tus-Version", tusVersion)
+			w.Header().Set("Tus-Extension", "creation,creation-with-upload,expiration,termination")
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxUploadSize(), 10))
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(AuthMiddlewareWithDatabase(database))
+
+			r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+				if !RequestHasCollectionPermission(r, database, mediaCollection, permissions.ActionCreate) {
+					httpresponder.SendErrorResponse(w, r, "Forbidden: You do not have permission to upload media", http.StatusForbidden)
+					return
+				}
+
+				length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+				if err != nil || length < 0 {
+					httpresponder.SendErrorResponse(w, r, "Missing or invalid Upload-Length header", http.StatusBadRequest)
+					return
+				}
+				if length > maxUploadSize() {
+					httpresponder.SendErrorResponse(w, r, "Upload-Length exceeds Tus-Max-Size", http.StatusRequestEntityTooLarge)
+					return
+				}
+
+				// filename (or name), altText and private=true are read from the metadata
+				metadata := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+				filename := metadata["filename"]
+				if filename == "" {
+					filename = metadata["name"]
+				}
+				if filename == "" {
+					httpresponder.SendErrorResponse(w, r, "Upload-Metadata needs a filename", http.StatusBadRequest)
+					return
+				}
+
+				upload, err := media.CreateUpload(r.Context(), database, length, filename, metadata["altText"], GetUserIDFromRequest(r), metadata["private"] == "true")
+				if err != nil {
+					httpresponder.SendErrorResponse(w, r, "Error creating upload: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+upload.ID.String())
+
+				// creation-with-upload, the first chunk can come with the creation request
+				if r.Header.Get("Content-Type") == "application/offset+octet-stream" && r.ContentLength != 0 {
+					r.Header.Set("Upload-Offset", "0")
+					if !writeUploadChunk(w, r, database, upload) {
+						return
+					}
+				}
+
+				setUploadHeaders(w, upload)
+				w.WriteHeader(http.StatusCreated)
+			})
+
+			r.Head("/{uploadID}", func(w http.ResponseWriter, r *http.Request) {
+				upload, ok := getUploadFromRequest(w, r, database)
+				if !ok {
+					return
+				}
+
+				// a previous completion may have failed half way, try again. While another request is completing
+				// it the upload is sent without its media id, the client asks again
+				if upload.UploadOffset == upload.UploadLength && upload.MediaID == "" {
+					_, err := media.CompleteUpload(r.Context(), database, upload)
+					if errors.Is(err, media.ErrMediaTypeNotAllowed) {
+						httpresponder.SendErrorResponse(w, r, "Invalid upload: "+err.Error(), http.StatusUnsupportedMediaType)
+						return
+					}
+					if err != nil && !errors.Is(err, media.ErrUploadCompleting) {
+						httpresponder.SendErrorResponse(w, r, "Error completing upload: "+err.Error(), http.StatusInternalServerError)
+						return
+					}
+				}
+
+				setUploadHeaders(w, upload)
+				w.WriteHeader(http.StatusOK)
+			})
+
+			r.Patch("/{uploadID}", func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+					httpresponder.SendErrorResponse(w, r, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+					return
+				}
+
+				upload, ok := getUploadFromRequest(w, r, database)
+				if !ok {
+					return
+				}
+
+				if !writeUploadChunk(w, r, database, upload) {
+					return
+				}
+
+				setUploadHeaders(w, upload)
+				w.WriteHeader(http.StatusNoContent)
+			})
+
+			r.Delete("/{uploadID}", func(w http.ResponseWriter, r *http.Request) {
+				upload, ok := getUploadFromRequest(w, r, database)
+				if !ok {
+					return
+				}
+
+				if err := media.TerminateUpload(r.Context(), database, upload); err != nil {
+					httpresponder.SendErrorResponse(w, r, "Error terminating upload: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				w.WriteHeader(http.StatusNoContent)
+			})
+		})
+	})
+}
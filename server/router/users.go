@@ -0,0 +1,343 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chukfi/backend/database/schema"
+	"github.com/chukfi/backend/src/httpresponder"
+	"github.com/chukfi/backend/src/lib/permissions"
+	"github.com/chukfi/backend/src/lib/roles"
+	"github.com/chukfi/backend/src/lib/users"
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+type userRequest struct {
+	Fullname    *string   `json:"fullname"`
+	Email       *string   `json:"email"`
+	Password    string    `json:"password"`    // only for /create, /password changes it afterwards
+	Permissions *[]string `json:"permissions"` // only for /create, names e.g ["ViewModels", "posts.update"]
+}
+
+type passwordRequest struct {
+	Password string `json:"password"`
+}
+
+type userPermissionsRequest struct {
+	Permissions []string `json:"permissions"`
+}
+
+type userResponse struct {
+	ID          string    `json:"id"`
+	Fullname    string    `json:"fullname"`
+	Email       string    `json:"email"`
+	Disabled    bool      `json:"disabled"`
+	Permissions *[]string `json:"permissions,omitempty"` // granted directly, only sent to users with ManageUsers
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// newUserResponse is the user as sent by the user routes, the permissions are left out unless withPermissions
+func newUserResponse(user schema.User, withPermissions bool) userResponse {
+	response := userResponse{
+		ID:        user.ID.String(),
+		Fullname:  user.Fullname,
+		Email:     user.Email,
+		Disabled:  user.Disabled,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+	}
+	if withPermissions {
+		names := permissionNames(user.Permissions)
+		response.Permissions = &names
+	}
+	return response
+}
+
+// apply copies the set profile fields of the request onto the user
+func (body userRequest) apply(user *schema.User) {
+	if body.Fullname != nil {
+		user.Fullname = *body.Fullname
+	}
+	if body.Email != nil {
+		user.Email = *body.Email
+	}
+}
+
+// getManagedUserFromRequest loads the user from the {userID} url param, sending the error response if it fails
+func getManagedUserFromRequest(w http.ResponseWriter, r *http.Request, database *gorm.DB) (*schema.User, bool) {
+	user, err := users.Get(r.Context(), database, chi.URLParam(r, "userID"))
+	if err != nil {
+		if errors.Is(err, users.ErrUserNotFound) {
+			httpresponder.SendErrorResponse(w, r, "User not found", http.StatusNotFound)
+			return nil, false
+		}
+		httpresponder.SendErrorResponse(w, r, "Error fetching user: "+err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return user, true
+}
+
+// sendUserValidationError sends the right response for an error from users.Validate or users.HashPassword
+func sendUserValidationError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, users.ErrInvalidName), errors.Is(err, users.ErrInvalidEmail), errors.Is(err, users.ErrPasswordTooShort),
+		errors.Is(err, roles.ErrUnknownPermission):
+		httpresponder.SendErrorResponse(w, r, "Invalid user: "+err.Error(), http.StatusBadRequest)
+	case errors.Is(err, users.ErrEmailTaken):
+		httpresponder.SendErrorResponse(w, r, "Invalid user: "+err.Error(), http.StatusConflict)
+	default:
+		httpresponder.SendErrorResponse(w, r, "Error saving user: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+/*
+canManageUser checks the user of the request holds every permission of the user they change, so ManageUsers can't
+be used to take over an account with more permissions (an Administrator). Administrators can manage everyone
+*/
+func canManageUser(w http.ResponseWriter, r *http.Request, database *gorm.DB, target *schema.User) bool {
+	return canGrantPermissions(w, r, database, target.EffectivePermissions(), "Forbidden: You can only manage users with permissions you have yourself")
+}
+
+// canGrantPermissions checks the user of the request holds every one of perms, sending message as a 403 if not
+func canGrantPermissions(w http.ResponseWriter, r *http.Request, database *gorm.DB, perms permissions.Permission, message string) bool {
+	user, err := GetUserFromRequest(r, database)
+	if err != nil {
+		httpresponder.SendErrorResponse(w, r, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+		return false
+	}
+	if !permissions.HasPermission(user.EffectivePermissions(), perms) {
+		httpresponder.SendErrorResponse(w, r, message, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// notSelf refuses changes users can't make to their own account, e.g disabling it
+func notSelf(w http.ResponseWriter, r *http.Request, target *schema.User, action string) bool {
+	if GetUserIDFromRequest(r) == target.ID.String() {
+		httpresponder.SendErrorResponse(w, r, "You can't "+action+" your own account", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+/*
+RegisterUserRoutes registers the user management routes. Listing users requires ViewUsers, changing them requires
+ManageUsers and every permission of the user (see canManageUser). Passwords are only ever saved as bcrypt hashes
+*/
+func RegisterUserRoutes(r chi.Router, database *gorm.DB) {
+	r.Route("/users", func(r chi.Router) {
+		r.Use(AuthMiddlewareWithDatabase(database))
+		r.Use(RoutesRequiresPermission(database, permissions.ViewUsers))
+
+		// ?search= matches the fullname and email
+		r.Get("/list", func(w http.ResponseWriter, r *http.Request) {
+			take := 30
+			if value, err := strconv.Atoi(r.URL.Query().Get("take")); err == nil && value > 0 {
+				take = min(value, 100) // max 100
+			}
+
+			page := 1
+			if value, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && value > 0 {
+				page = value
+			}
+
+			results, total, err := users.Search(r.Context(), database, r.URL.Query().Get("search"), take, (page-1)*take)
+			if err != nil {
+				httpresponder.SendErrorResponse(w, r, "Error fetching users: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			withPermissions := RequestRequiresPermission(r, database, permissions.ManageUsers)
+			response := make([]userResponse, 0, len(results))
+			for _, user := range results {
+				response = append(response, newUserResponse(user, withPermissions))
+			}
+			httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+				"users": response,
+				"total": total,
+				"page":  page,
+				"take":  take,
+			})
+		})
+
+		r.With(RoutesRequiresPermission(database, permissions.ManageUsers)).Post("/create", func(w http.ResponseWriter, r *http.Request) {
+			var body userRequest
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				httpresponder.SendErrorResponse(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			// the default of the permissions column
+			user := schema.User{Permissions: permissions.ViewDashboard}
+			body.apply(&user)
+			if body.Permissions != nil {
+				perms, err := roles.ParsePermissions(*body.Permissions)
+				if err != nil {
+					sendUserValidationError(w, r, err)
+					return
+				}
+				user.Permissions = perms
+			}
+			if !canGrantPermissions(w, r, database, user.Permissions, "Forbidden: You can only grant permissions you have yourself") {
+				return
+			}
+
+			if err := users.Create(r.Context(), database, &user, body.Password); err != nil {
+				sendUserValidationError(w, r, err)
+				return
+			}
+
+			httpresponder.SendNormalResponse(w, r, newUserResponse(user, true))
+		})
+
+		r.Route("/{userID}", func(r chi.Router) {
+			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				user, ok := getManagedUserFromRequest(w, r, database)
+				if !ok {
+					return
+				}
+				httpresponder.SendNormalResponse(w, r, newUserResponse(*user, RequestRequiresPermission(r, database, permissions.ManageUsers)))
+			})
+
+			r.Group(func(r chi.Router) {
+				r.Use(RoutesRequiresPermission(database, permissions.ManageUsers))
+
+				r.Post("/update", func(w http.ResponseWriter, r *http.Request) {
+					user, ok := getManagedUserFromRequest(w, r, database)
+					if !ok || !canManageUser(w, r, database, user) {
+						return
+					}
+
+					var body userRequest
+					if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+						httpresponder.SendErrorResponse(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+						return
+					}
+					body.apply(user)
+
+					if err := users.UpdateProfile(r.Context(), database, user); err != nil {
+						sendUserValidationError(w, r, err)
+						return
+					}
+
+					httpresponder.SendNormalResponse(w, r, newUserResponse(*user, true))
+				})
+
+				// logs the user out everywhere, except for the session changing it when it is their own
+				r.Post("/password", func(w http.ResponseWriter, r *http.Request) {
+					user, ok := getManagedUserFromRequest(w, r, database)
+					if !ok || !canManageUser(w, r, database, user) {
+						return
+					}
+
+					var body passwordRequest
+					if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+						httpresponder.SendErrorResponse(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+						return
+					}
+
+					keepToken := ""
+					if GetUserIDFromRequest(r) == user.ID.String() {
+						keepToken, _ = r.Context().Value("authToken").(string)
+					}
+					if err := users.SetPassword(r.Context(), database, user.ID, body.Password, keepToken); err != nil {
+						sendUserValidationError(w, r, err)
+						return
+					}
+
+					httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+						"success": true,
+					})
+				})
+
+				r.Post("/disable", func(w http.ResponseWriter, r *http.Request) {
+					user, ok := getManagedUserFromRequest(w, r, database)
+					if !ok || !notSelf(w, r, user, "disable") || !canManageUser(w, r, database, user) {
+						return
+					}
+
+					if err := users.SetDisabled(r.Context(), database, user.ID, true); err != nil {
+						httpresponder.SendErrorResponse(w, r, "Error disabling user: "+err.Error(), http.StatusInternalServerError)
+						return
+					}
+
+					user.Disabled = true
+					httpresponder.SendNormalResponse(w, r, newUserResponse(*user, true))
+				})
+
+				r.Post("/enable", func(w http.ResponseWriter, r *http.Request) {
+					user, ok := getManagedUserFromRequest(w, r, database)
+					if !ok || !canManageUser(w, r, database, user) {
+						return
+					}
+
+					if err := users.SetDisabled(r.Context(), database, user.ID, false); err != nil {
+						httpresponder.SendErrorResponse(w, r, "Error enabling user: "+err.Error(), http.StatusInternalServerError)
+						return
+					}
+
+					user.Disabled = false
+					httpresponder.SendNormalResponse(w, r, newUserResponse(*user, true))
+				})
+
+				// replaces the permissions granted to the user directly, the ones of their roles stay
+				r.Post("/permissions", func(w http.ResponseWriter, r *http.Request) {
+					user, ok := getManagedUserFromRequest(w, r, database)
+					if !ok || !canManageUser(w, r, database, user) {
+						return
+					}
+
+					var body userPermissionsRequest
+					if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+						httpresponder.SendErrorResponse(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+						return
+					}
+					perms, err := roles.ParsePermissions(body.Permissions)
+					if err != nil {
+						sendUserValidationError(w, r, err)
+						return
+					}
+					if !canGrantPermissions(w, r, database, perms, "Forbidden: You can only grant permissions you have yourself") {
+						return
+					}
+
+					updated, err := users.UpdatePermissions(r.Context(), database, user.ID.String(), func(permissions.Permission) permissions.Permission {
+						return perms
+					})
+					if err != nil {
+						sendUserPermissionsError(w, r, err)
+						return
+					}
+
+					httpresponder.SendNormalResponse(w, r, newUserResponse(*updated, true))
+				})
+
+				r.Post("/delete", func(w http.ResponseWriter, r *http.Request) {
+					user, ok := getManagedUserFromRequest(w, r, database)
+					if !ok || !notSelf(w, r, user, "delete") || !canManageUser(w, r, database, user) {
+						return
+					}
+
+					if err := users.Delete(r.Context(), database, user.ID); err != nil {
+						if errors.Is(err, users.ErrUserNotFound) {
+							httpresponder.SendErrorResponse(w, r, "User not found", http.StatusNotFound)
+							return
+						}
+						httpresponder.SendErrorResponse(w, r, "Error deleting user: "+err.Error(), http.StatusInternalServerError)
+						return
+					}
+
+					httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+						"success": true,
+					})
+				})
+			})
+		})
+	})
+}
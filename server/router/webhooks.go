@@ -0,0 +1,278 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/chukfi/backend/src/httpresponder"
+	"github.com/chukfi/backend/src/lib/permissions"
+	"github.com/chukfi/backend/src/lib/webhooks"
+	"github.com/go-chi/chi/v5"
+	"gorm.io/gorm"
+)
+
+type webhookRequest struct {
+	Name        *string   `json:"name"`
+	URL         *string   `json:"url"`
+	Collections *[]string `json:"collections"`
+	Events      *[]string `json:"events"`
+	Enabled     *bool     `json:"enabled"`
+}
+
+// apply copies the set fields of the request onto the webhook
+func (body webhookRequest) apply(webhook *webhooks.Webhook) {
+	if body.Name != nil {
+		webhook.Name = *body.Name
+	}
+	if body.URL != nil {
+		webhook.URL = strings.TrimSpace(*body.URL)
+	}
+	if body.Collections != nil {
+		webhook.Collections = strings.Join(*body.Collections, ",")
+	}
+	if body.Events != nil {
+		webhook.Events = strings.ToLower(strings.Join(*body.Events, ","))
+	}
+	if body.Enabled != nil {
+		webhook.Enabled = *body.Enabled
+	}
+}
+
+// getWebhookFromRequest loads the webhook from the {webhookID} url param, sending the error response if it fails
+func getWebhookFromRequest(w http.ResponseWriter, r *http.Request, database *gorm.DB) (*webhooks.Webhook, bool) {
+	webhook, err := gorm.G[webhooks.Webhook](database).Where("id = ?", chi.URLParam(r, "webhookID")).First(r.Context())
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			httpresponder.SendErrorResponse(w, r, "Webhook not found", http.StatusNotFound)
+			return nil, false
+		}
+		httpresponder.SendErrorResponse(w, r, "Error fetching webhook: "+err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return &webhook, true
+}
+
+// sendWebhookValidationError sends the right response for an error from webhooks.Validate
+func sendWebhookValidationError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, webhooks.ErrInvalidName), errors.Is(err, webhooks.ErrInvalidURL),
+		errors.Is(err, webhooks.ErrInvalidEvent), errors.Is(err, webhooks.ErrUnknownCollection):
+		httpresponder.SendErrorResponse(w, r, "Invalid webhook: "+err.Error(), http.StatusBadRequest)
+	default:
+		httpresponder.SendErrorResponse(w, r, "Error saving webhook: "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+/*
+RegisterWebhookRoutes registers the webhook management routes, all of them require Administrator
+*/
+func RegisterWebhookRoutes(r chi.Router, database *gorm.DB) {
+	r.Route("/webhooks", func(r chi.Router) {
+		r.Use(AuthMiddlewareWithDatabase(database))
+		r.Use(RoutesRequiresPermission(database, permissions.Administrator))
+
+		r.Get("/list", func(w http.ResponseWriter, r *http.Request) {
+			results, err := gorm.G[webhooks.Webhook](database).Order("created_at DESC").Find(r.Context())
+			if err != nil {
+				httpresponder.SendErrorResponse(w, r, "Error fetching webhooks: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+				"webhooks": results,
+			})
+		})
+
+		r.Post("/create", func(w http.ResponseWriter, r *http.Request) {
+			var body webhookRequest
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				httpresponder.SendErrorResponse(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			webhook := webhooks.Webhook{Enabled: true, CreatedBy: GetUserIDFromRequest(r)}
+			body.apply(&webhook)
+
+			if err := webhooks.Validate(&webhook); err != nil {
+				sendWebhookValidationError(w, r, err)
+				return
+			}
+
+			secret, err := webhooks.GenerateSecret()
+			if err != nil {
+				httpresponder.SendErrorResponse(w, r, "Error generating secret: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			webhook.Secret = secret
+
+			if err := gorm.G[webhooks.Webhook](database).Create(r.Context(), &webhook); err != nil {
+				httpresponder.SendErrorResponse(w, r, "Error creating webhook: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			// the secret is only ever shown here and when it is rotated
+			httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+				"webhook": webhook,
+				"secret":  secret,
+			})
+		})
+
+		r.Get("/deliveries/{deliveryID}", func(w http.ResponseWriter, r *http.Request) {
+			delivery, err := gorm.G[webhooks.Delivery](database).Where("id = ?", chi.URLParam(r, "deliveryID")).First(r.Context())
+			if err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					httpresponder.SendErrorResponse(w, r, "Delivery not found", http.StatusNotFound)
+					return
+				}
+				httpresponder.SendErrorResponse(w, r, "Error fetching delivery: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			attempts, err := gorm.G[webhooks.Attempt](database).Where("delivery_id = ?", delivery.ID).Order("number").Find(r.Context())
+			if err != nil {
+				httpresponder.SendErrorResponse(w, r, "Error fetching attempts: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+				"delivery": delivery,
+				"attempts": attempts,
+			})
+		})
+
+		// sends the same payload again as a new delivery
+		r.Post("/deliveries/{deliveryID}/replay", func(w http.ResponseWriter, r *http.Request) {
+			replay, err := webhooks.Replay(database, chi.URLParam(r, "deliveryID"))
+			if err != nil {
+				if errors.Is(err, webhooks.ErrDeliveryNotFound) {
+					httpresponder.SendErrorResponse(w, r, "Delivery not found", http.StatusNotFound)
+					return
+				}
+				httpresponder.SendErrorResponse(w, r, "Error replaying delivery: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			httpresponder.SendNormalResponse(w, r, replay)
+		})
+
+		r.Route("/{webhookID}", func(r chi.Router) {
+			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				webhook, ok := getWebhookFromRequest(w, r, database)
+				if !ok {
+					return
+				}
+				httpresponder.SendNormalResponse(w, r, webhook)
+			})
+
+			r.Post("/update", func(w http.ResponseWriter, r *http.Request) {
+				webhook, ok := getWebhookFromRequest(w, r, database)
+				if !ok {
+					return
+				}
+
+				var body webhookRequest
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					httpresponder.SendErrorResponse(w, r, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+				body.apply(webhook)
+
+				if err := webhooks.Validate(webhook); err != nil {
+					sendWebhookValidationError(w, r, err)
+					return
+				}
+
+				if err := database.WithContext(r.Context()).Select("*").Omit("created_at", "created_by", "secret").Updates(webhook).Error; err != nil {
+					httpresponder.SendErrorResponse(w, r, "Error updating webhook: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				httpresponder.SendNormalResponse(w, r, webhook)
+			})
+
+			r.Post("/delete", func(w http.ResponseWriter, r *http.Request) {
+				webhook, ok := getWebhookFromRequest(w, r, database)
+				if !ok {
+					return
+				}
+
+				if err := database.WithContext(r.Context()).Delete(webhook).Error; err != nil {
+					httpresponder.SendErrorResponse(w, r, "Error deleting webhook: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+					"success": true,
+				})
+			})
+
+			r.Post("/rotate-secret", func(w http.ResponseWriter, r *http.Request) {
+				webhook, ok := getWebhookFromRequest(w, r, database)
+				if !ok {
+					return
+				}
+
+				secret, err := webhooks.GenerateSecret()
+				if err != nil {
+					httpresponder.SendErrorResponse(w, r, "Error generating secret: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				if err := database.WithContext(r.Context()).Model(webhook).Update("secret", secret).Error; err != nil {
+					httpresponder.SendErrorResponse(w, r, "Error updating webhook: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+					"webhook": webhook,
+					"secret":  secret,
+				})
+			})
+
+			// the delivery log, newest first, ?status=pending|succeeded|failed&take=&page=
+			r.Get("/deliveries", func(w http.ResponseWriter, r *http.Request) {
+				webhook, ok := getWebhookFromRequest(w, r, database)
+				if !ok {
+					return
+				}
+
+				take := 30
+				if value, err := strconv.Atoi(r.URL.Query().Get("take")); err == nil && value > 0 {
+					take = min(value, 100) // max 100
+				}
+
+				page := 1
+				if value, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && value > 0 {
+					page = value
+				}
+
+				query := gorm.G[webhooks.Delivery](database).Where("webhook_id = ?", webhook.ID).Order("created_at DESC")
+				if status := r.URL.Query().Get("status"); status != "" {
+					query = query.Where("status = ?", status)
+				}
+
+				total, err := query.Count(r.Context(), "id")
+				if err != nil {
+					httpresponder.SendErrorResponse(w, r, "Error counting deliveries: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				results, err := query.Limit(take).Offset((page - 1) * take).Find(r.Context())
+				if err != nil {
+					httpresponder.SendErrorResponse(w, r, "Error fetching deliveries: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+
+				httpresponder.SendNormalResponse(w, r, map[string]interface{}{
+					"deliveries": results,
+					"total":      total,
+					"page":       page,
+					"take":       take,
+				})
+			})
+		})
+	})
+}
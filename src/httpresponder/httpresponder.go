@@ -7,8 +7,9 @@ import (
 )
 
 type ErrorResponse struct {
-	Error string `json:"error"`
-	Code  int    `json:"code,omitempty"`
+	Error   string      `json:"error"`
+	Code    int         `json:"code,omitempty"`
+	Details interface{} `json:"details,omitempty"`
 }
 
 // ReadDataToString reads all data from an io.ReadCloser and returns it as a byte slice.
@@ -41,3 +42,11 @@ func SendErrorResponse(httpWriter http.ResponseWriter, httpRequest *http.Request
 	errorJSON, _ := json.Marshal(ErrorResponse{Error: message, Code: code})
 	httpWriter.Write(errorJSON)
 }
+
+// SendDetailedErrorResponse sends a JSON error response with extra details (e.g which fields were invalid).
+func SendDetailedErrorResponse(httpWriter http.ResponseWriter, httpRequest *http.Request, message string, code int, details interface{}) {
+	httpWriter.Header().Set("Content-Type", "application/json")
+	httpWriter.WriteHeader(code)
+	errorJSON, _ := json.Marshal(ErrorResponse{Error: message, Code: code, Details: details})
+	httpWriter.Write(errorJSON)
+}
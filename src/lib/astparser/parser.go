@@ -7,15 +7,17 @@ import (
 	"go/token"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
 )
 
 type ParsedField struct {
-	Name     string
-	Type     string
-	GormTag  string
-	JSONTag  string
-	Required bool
+	Name      string
+	Type      string
+	GormTag   string
+	JSONTag   string
+	ChukfiTag string
+	Required  bool
 }
 
 type ParsedStruct struct {
@@ -63,15 +65,20 @@ func ParseSchemaFile(filePath string) ([]ParsedStruct, error) {
 
 		for _, field := range structType.Fields.List {
 			if len(field.Names) == 0 {
+				embedded := ""
 				if ident, ok := field.Type.(*ast.Ident); ok {
-					if ident.Name == "BaseModel" {
-						parsedStruct.Fields = append(parsedStruct.Fields, getBaseModelFields()...)
-					}
+					embedded = ident.Name
 				}
 				if sel, ok := field.Type.(*ast.SelectorExpr); ok {
-					if sel.Sel.Name == "BaseModel" {
-						parsedStruct.Fields = append(parsedStruct.Fields, getBaseModelFields()...)
-					}
+					embedded = sel.Sel.Name
+				}
+				switch embedded {
+				case "BaseModel":
+					parsedStruct.Fields = append(parsedStruct.Fields, getBaseModelFields()...)
+				case "AdminOnly":
+					parsedStruct.AdminOnly = true
+				case "Hidden":
+					parsedStruct.Hidden = true
 				}
 				continue
 			}
@@ -88,10 +95,12 @@ func ParseSchemaFile(filePath string) ([]ParsedStruct, error) {
 
 				gormTag := ""
 				jsonTag := ""
+				chukfiTag := ""
 				if field.Tag != nil {
 					tag := strings.Trim(field.Tag.Value, "`")
 					gormTag = extractTag(tag, "gorm")
 					jsonTag = extractTag(tag, "json")
+					chukfiTag = extractTag(tag, "chukfi")
 				}
 
 				if gormTag == "-" || gormTag == "-:all" {
@@ -107,11 +116,12 @@ func ParseSchemaFile(filePath string) ([]ParsedStruct, error) {
 				}
 
 				parsedField := ParsedField{
-					Name:     fieldName,
-					Type:     typeToString(field.Type),
-					GormTag:  gormTag,
-					JSONTag:  jsonTag,
-					Required: strings.Contains(gormTag, "not null"),
+					Name:      fieldName,
+					Type:      typeToString(field.Type),
+					GormTag:   gormTag,
+					JSONTag:   jsonTag,
+					ChukfiTag: chukfiTag,
+					Required:  strings.Contains(gormTag, "not null"),
 				}
 
 				parsedStruct.Fields = append(parsedStruct.Fields, parsedField)
@@ -135,15 +145,8 @@ func getBaseModelFields() []ParsedField {
 }
 
 func extractTag(tag, key string) string {
-	parts := strings.Split(tag, " ")
-	for _, part := range parts {
-		if strings.HasPrefix(part, key+":") {
-			value := strings.TrimPrefix(part, key+":")
-			value = strings.Trim(value, "\"")
-			return value
-		}
-	}
-	return ""
+	// tag values can hold spaces, e.g gorm:"type:varchar(255);not null"
+	return reflect.StructTag(tag).Get(key)
 }
 
 func typeToString(expr ast.Expr) string {
@@ -224,13 +227,23 @@ func GenerateTypescriptFromParsed(structs []ParsedStruct) string {
 		sb.WriteString("export interface " + interfaceName + " {\n")
 
 		for _, field := range s.Fields {
+			// write only fields are never sent back by the api
+			if hasChukfiOption(field.ChukfiTag, "writeOnly") {
+				continue
+			}
+
 			tsType := GoTypeToTypescript(field.Type)
 			optional := ""
-			if !field.Required && !strings.Contains(field.GormTag, "primaryKey") {
+			if (!field.Required && !strings.Contains(field.GormTag, "primaryKey")) || hasChukfiOption(field.ChukfiTag, "readPermission") {
 				optional = "?"
 			}
 
-			sb.WriteString("  " + field.Name + optional + ": " + tsType + ";\n")
+			modifier := ""
+			if hasChukfiOption(field.ChukfiTag, "readonly") {
+				modifier = "readonly "
+			}
+
+			sb.WriteString("  " + modifier + field.Name + optional + ": " + tsType + ";\n")
 		}
 
 		sb.WriteString("}\n")
@@ -241,4 +254,15 @@ func GenerateTypescriptFromParsed(structs []ParsedStruct) string {
 	}
 
 	return sb.String()
-}
\ No newline at end of file
+}
+
+// hasChukfiOption checks if a chukfi tag has the option, with or without a value (chukfi:"readPermission=ViewUsers")
+func hasChukfiOption(tag string, option string) bool {
+	for _, part := range strings.Split(tag, ",") {
+		key, _, _ := strings.Cut(part, "=")
+		if strings.EqualFold(strings.TrimSpace(key), option) {
+			return true
+		}
+	}
+	return false
+}
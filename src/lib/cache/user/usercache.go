@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/chukfi/backend/database/schema"
+	"github.com/chukfi/backend/src/lib/permissions"
 )
 
 type UserCache struct {
@@ -74,4 +75,9 @@ func (uc *UserCache) GetAllUsers() []schema.User {
 
 func init() {
 	initUserCache(5 * time.Minute)
+
+	// cached users would keep a bit that was taken from them, and get the permission it is given to next
+	permissions.OnRevoke(func() {
+		UserCacheInstance.Clear()
+	})
 }
@@ -0,0 +1,211 @@
+package changefeed
+
+// change feed for delta syncing clients. every write is recorded with an increasing sequence number,
+// a client keeps the cursor of the last change it saw and asks for everything after it
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/chukfi/backend/src/lib/events"
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+	"gorm.io/gorm"
+)
+
+/*
+SettleTime holds back the newest changes for a moment. Sequence numbers are handed out when a change is
+inserted, not when it commits, so without it a client could get seq 11 while seq 10 is still committing
+and skip 10 forever.
+*/
+var SettleTime = time.Second
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+var unsubscribe func()
+
+/*
+Init migrates the change table, records the current entries of collections that have never been
+recorded (so a client starting from an empty cursor gets everything) and starts recording writes
+from the events bus.
+*/
+func Init(database *gorm.DB) error {
+	if err := database.AutoMigrate(&Change{}); err != nil {
+		return err
+	}
+
+	if err := backfill(database); err != nil {
+		return err
+	}
+
+	if unsubscribe != nil {
+		unsubscribe()
+	}
+	unsubscribe = events.Subscribe(func(event events.Event) {
+		if event.Type == events.EventPublish || !schemaregistry.IsRegistered(event.Collection) {
+			return
+		}
+
+		change := Change{Collection: event.Collection, EntryID: event.ID, Deleted: event.Type == events.EventDelete}
+		if err := database.Create(&change).Error; err != nil {
+			fmt.Printf("changefeed: failed to record %s/%s: %v\n", event.Collection, event.ID, err)
+		}
+	})
+
+	return nil
+}
+
+// backfill records every entry of collections without any recorded change
+func backfill(database *gorm.DB) error {
+	for tableName := range schemaregistry.GetAllRegisteredSchemas() {
+		var recorded int64
+		if err := database.Model(&Change{}).Where("collection = ?", tableName).Limit(1).Count(&recorded).Error; err != nil {
+			return err
+		}
+		if recorded > 0 {
+			continue
+		}
+
+		var rows []map[string]interface{}
+		query := database.Table(tableName).Select("id")
+		if schemaregistry.HasSoftDelete(tableName) {
+			query = database.Table(tableName).Select("id", "deleted_at")
+		}
+		if err := query.Find(&rows).Error; err != nil {
+			return fmt.Errorf("failed to backfill the change feed for %s: %w", tableName, err)
+		}
+		if len(rows) == 0 {
+			continue
+		}
+
+		changes := make([]Change, 0, len(rows))
+		for _, row := range rows {
+			changes = append(changes, Change{
+				Collection: tableName,
+				EntryID:    fmt.Sprint(row["id"]),
+				Deleted:    row["deleted_at"] != nil,
+			})
+		}
+		if err := database.CreateInBatches(changes, 500).Error; err != nil {
+			return fmt.Errorf("failed to backfill the change feed for %s: %w", tableName, err)
+		}
+	}
+	return nil
+}
+
+// ParseCursor parses a cursor from Changes, an empty cursor starts from the beginning
+func ParseCursor(cursor string) (uint64, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+	seq, err := strconv.ParseUint(cursor, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+	return seq, nil
+}
+
+// Entry is the latest change of an entry, Entry is nil when Deleted is set (a tombstone)
+type Entry struct {
+	ID      string                 `json:"id"`
+	Seq     uint64                 `json:"seq"`
+	Deleted bool                   `json:"deleted"`
+	Entry   map[string]interface{} `json:"entry,omitempty"`
+}
+
+// Page is one response of the change feed
+type Page struct {
+	Changes []Entry `json:"changes"`
+	Cursor  string  `json:"cursor"`  // pass as since to get the next changes
+	HasMore bool    `json:"hasMore"` // true if there are more changes right now, fetch again without waiting
+}
+
+/*
+Changes returns the entries of the collection changed after the since cursor, oldest change first.
+Every entry appears once, with its latest state. load fetches the current rows for the given ids
+(so the caller can apply its own read rules), soft deleted rows included. Soft deleted rows and rows that are
+gone from the table are sent as tombstones, rows load doesnt return that still exist are left out: the caller
+may not read them, a tombstone would tell their id and report a delete that didnt happen.
+*/
+func Changes(database *gorm.DB, collection string, since uint64, take int, load func(ids []string) ([]map[string]interface{}, error)) (*Page, error) {
+	// only changes that have had time to commit, see SettleTime
+	var settled uint64
+	err := database.Model(&Change{}).Select("COALESCE(MAX(seq), 0)").
+		Where("collection = ? AND created_at <= ?", collection, time.Now().Add(-SettleTime)).
+		Scan(&settled).Error
+	if err != nil {
+		return nil, err
+	}
+
+	page := &Page{Changes: []Entry{}, Cursor: strconv.FormatUint(max(since, settled), 10)}
+	if settled <= since {
+		return page, nil
+	}
+
+	var latest []struct {
+		EntryID string
+		Seq     uint64
+	}
+	err = database.Model(&Change{}).Select("entry_id, MAX(seq) AS seq").
+		Where("collection = ? AND seq > ? AND seq <= ?", collection, since, settled).
+		Group("entry_id").Order("MAX(seq)").Limit(take + 1).
+		Scan(&latest).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if len(latest) > take {
+		latest = latest[:take]
+		page.HasMore = true
+		page.Cursor = strconv.FormatUint(latest[len(latest)-1].Seq, 10)
+	}
+
+	ids := make([]string, 0, len(latest))
+	for _, change := range latest {
+		ids = append(ids, change.EntryID)
+	}
+
+	rows, err := load(ids)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]map[string]interface{}, len(rows))
+	for _, row := range rows {
+		byID[fmt.Sprint(row["id"])] = row
+	}
+
+	// the ids load left out that are still in the table, soft deleted or not
+	hidden := make(map[string]bool)
+	var missing []string
+	for _, id := range ids {
+		if _, found := byID[id]; !found {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		var existing []string
+		if err := database.Table(collection).Where("id IN ?", missing).Pluck("id", &existing).Error; err != nil {
+			return nil, err
+		}
+		for _, id := range existing {
+			hidden[id] = true
+		}
+	}
+
+	for _, change := range latest {
+		if hidden[change.EntryID] {
+			continue
+		}
+		entry := Entry{ID: change.EntryID, Seq: change.Seq}
+		row, found := byID[change.EntryID]
+		if !found || row["deleted_at"] != nil {
+			entry.Deleted = true
+		} else {
+			entry.Entry = row
+		}
+		page.Changes = append(page.Changes, entry)
+	}
+
+	return page, nil
+}
@@ -0,0 +1,16 @@
+package changefeed
+
+import "time"
+
+// Change is one write to a collection entry, Seq only ever goes up so it can be used as a sync cursor
+type Change struct {
+	Seq        uint64 `gorm:"primaryKey;autoIncrement;index:idx_change_feed_collection_seq,priority:2"`
+	Collection string `gorm:"type:varchar(100);not null;index:idx_change_feed_collection_seq,priority:1"`
+	EntryID    string `gorm:"type:varchar(64);not null;index"`
+	Deleted    bool   `gorm:"not null;default:false"`
+	CreatedAt  time.Time
+}
+
+func (Change) TableName() string {
+	return "change_feed"
+}
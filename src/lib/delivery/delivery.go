@@ -0,0 +1,221 @@
+package delivery
+
+// the public content delivery api, read only access to the collections an app chooses to deliver,
+// separate from the /admin api so public traffic can be cached and keyed on its own
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+	"gorm.io/gorm"
+)
+
+/*
+Options configure how a collection is delivered:
+
+	Fields         the fields (name or column) sent to clients, empty sends every field. The ID is always sent
+	PublishedOnly  only deliver entries whose Published field is true / PublishedAt is set and not in the future
+	MaxAge         how long clients and CDNs may cache responses, 0 sends no-cache
+	RequireAPIKey  reject requests without a valid X-API-Key header
+*/
+type Options struct {
+	Fields        []string
+	PublishedOnly bool
+	MaxAge        time.Duration
+	RequireAPIKey bool
+}
+
+// Collection is a delivered collection with its options resolved against the schema
+type Collection struct {
+	Name    string
+	Options Options
+	// Columns are the columns selected, nil for all
+	Columns []string
+	// PublishedColumn is the column PublishedOnly filters on, and whether it is a PublishedAt date
+	PublishedColumn string
+	PublishedAt     bool
+}
+
+var (
+	ErrUnknownCollection = errors.New("unknown collection")
+	ErrAdminOnly         = errors.New("admin only collections cant be delivered")
+	ErrUnknownField      = errors.New("unknown field")
+	ErrHiddenField       = errors.New("write only fields and fields behind a permission cant be delivered")
+	ErrNoPublishedField  = errors.New("PublishedOnly needs a Published or PublishedAt field")
+	ErrInvalidAPIKey     = errors.New("invalid api key")
+)
+
+var (
+	collections = make(map[string]Collection)
+	mu          sync.RWMutex
+)
+
+/*
+Enable delivers a collection at /content/{collection} (see DELIVERY_PATH). Call it after the schemas are registered, it checks the
+options against the schema. Calling it again replaces the options.
+*/
+func Enable(collectionName string, options Options) error {
+	tableName, ok := schemaregistry.ResolveTableName(collectionName)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownCollection, collectionName)
+	}
+	if schemaregistry.IsAdminOnly(tableName) {
+		return fmt.Errorf("%w: %s", ErrAdminOnly, tableName)
+	}
+
+	collection := Collection{Name: tableName, Options: options}
+
+	if len(options.Fields) > 0 {
+		collection.Columns = []string{"id"}
+		for _, name := range options.Fields {
+			field, ok := schemaregistry.GetField(tableName, strings.TrimSpace(name))
+			if !ok {
+				return fmt.Errorf("%w: %s.%s", ErrUnknownField, tableName, name)
+			}
+			if field.WriteOnly || field.ReadPermission != "" {
+				return fmt.Errorf("%w: %s.%s", ErrHiddenField, tableName, name)
+			}
+			if field.Column != "id" {
+				collection.Columns = append(collection.Columns, field.Column)
+			}
+		}
+	}
+
+	if options.PublishedOnly {
+		if field, ok := schemaregistry.GetField(tableName, "Published"); ok {
+			collection.PublishedColumn = field.Column
+		} else if field, ok := schemaregistry.GetField(tableName, "PublishedAt"); ok {
+			collection.PublishedColumn, collection.PublishedAt = field.Column, true
+		} else {
+			return fmt.Errorf("%w: %s", ErrNoPublishedField, tableName)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	collections[tableName] = collection
+	return nil
+}
+
+// Disable stops delivering a collection
+func Disable(collectionName string) {
+	tableName, _ := schemaregistry.ResolveTableName(collectionName)
+
+	mu.Lock()
+	defer mu.Unlock()
+	delete(collections, tableName)
+}
+
+// Get returns the delivered collection by its table or singular name
+func Get(collectionName string) (Collection, bool) {
+	tableName, ok := schemaregistry.ResolveTableName(collectionName)
+	if !ok {
+		return Collection{}, false
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+	collection, ok := collections[tableName]
+	return collection, ok
+}
+
+// Collections returns the names of the delivered collections, sorted
+func Collections() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, 0, len(collections))
+	for name := range collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Scope applies the projection and the published filter of the collection to a query
+func (c Collection) Scope(query *gorm.DB) *gorm.DB {
+	if c.Columns != nil {
+		query = query.Select(c.Columns)
+	}
+	if c.PublishedColumn != "" {
+		if c.PublishedAt {
+			query = query.Where(c.PublishedColumn+" IS NOT NULL AND "+c.PublishedColumn+" <= ?", time.Now())
+		} else {
+			query = query.Where(c.PublishedColumn+" = ?", true)
+		}
+	}
+	if schemaregistry.HasSoftDelete(c.Name) {
+		query = query.Where("deleted_at IS NULL")
+	}
+	return query
+}
+
+// CacheControl returns the Cache-Control header for responses of the collection
+func (c Collection) CacheControl() string {
+	if c.Options.MaxAge <= 0 {
+		return "no-cache"
+	}
+	// keyed responses must not be shared by a CDN with clients that have no key
+	visibility := "public"
+	if c.Options.RequireAPIKey {
+		visibility = "private"
+	}
+	return fmt.Sprintf("%s, max-age=%d", visibility, int(c.Options.MaxAge.Seconds()))
+}
+
+/*
+Init migrates the api key table
+*/
+func Init(database *gorm.DB) error {
+	return database.AutoMigrate(&APIKey{})
+}
+
+// GenerateKey creates a new random api key
+func GenerateKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return "chk_" + hex.EncodeToString(key), nil
+}
+
+// HashKey returns the hash an api key is stored and looked up by
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authenticate checks that the key exists and can read the collection, and records that it was used
+func Authenticate(ctx context.Context, database *gorm.DB, key string, collectionName string) (*APIKey, error) {
+	if key == "" {
+		return nil, ErrInvalidAPIKey
+	}
+
+	apiKey, err := gorm.G[APIKey](database).Where("key_hash = ?", HashKey(key)).First(ctx)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidAPIKey
+		}
+		return nil, err
+	}
+	if !apiKey.Allows(collectionName) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	// at most once a minute, so reads dont turn into a write each
+	now := time.Now()
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > time.Minute {
+		database.WithContext(ctx).Model(&apiKey).UpdateColumn("last_used_at", now)
+		apiKey.LastUsedAt = &now
+	}
+	return &apiKey, nil
+}
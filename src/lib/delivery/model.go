@@ -0,0 +1,68 @@
+package delivery
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+// APIKey gives read access to the delivery api. Only a hash of the key is stored, the key itself is shown once.
+// Collections is comma separated, empty means every delivered collection
+type APIKey struct {
+	ID          uuid.UUID      `gorm:"type:char(36);primaryKey" json:"id"`
+	Name        string         `gorm:"type:varchar(100);not null" json:"name"`
+	Prefix      string         `gorm:"type:varchar(16);not null" json:"prefix"` // the start of the key, to tell keys apart
+	KeyHash     string         `gorm:"type:char(64);not null;uniqueIndex" json:"-"`
+	Collections string         `gorm:"type:varchar(1024)" json:"-"`
+	CreatedBy   string         `gorm:"type:char(36)" json:"createdBy"`
+	LastUsedAt  *time.Time     `json:"lastUsedAt"`
+	CreatedAt   time.Time      `json:"createdAt"`
+	UpdatedAt   time.Time      `json:"updatedAt"`
+	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+func (APIKey) TableName() string {
+	return "delivery_api_keys"
+}
+
+func (base *APIKey) BeforeCreate(tx *gorm.DB) (err error) {
+	base.ID = uuid.NewV4()
+	return
+}
+
+// MarshalJSON sends the collections as a list, the hash is never included
+func (k APIKey) MarshalJSON() ([]byte, error) {
+	type plain APIKey
+	return json.Marshal(struct {
+		plain
+		Collections []string `json:"collections"`
+	}{plain(k), k.CollectionList()})
+}
+
+// CollectionList returns the collections the key can read, empty for all
+func (k APIKey) CollectionList() []string {
+	list := []string{}
+	for _, item := range strings.Split(k.Collections, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Allows checks if the key can read the collection
+func (k APIKey) Allows(collection string) bool {
+	collections := k.CollectionList()
+	if len(collections) == 0 {
+		return true
+	}
+	for _, item := range collections {
+		if item == collection {
+			return true
+		}
+	}
+	return false
+}
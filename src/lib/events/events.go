@@ -0,0 +1,96 @@
+package events
+
+// in process event bus for collection writes, everything that needs to react to
+// content changes (search index etc) subscribes here instead of being wired into the routes
+
+import (
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventCreate EventType = "create"
+	EventUpdate EventType = "update"
+	EventDelete EventType = "delete"
+	// EventPublish is sent next to the create/update event when a write publishes an entry
+	// (sets a Published or PublishedAt field)
+	EventPublish EventType = "publish"
+)
+
+// AllEventTypes lists every event type, in the order they are documented
+var AllEventTypes = []EventType{EventCreate, EventUpdate, EventDelete, EventPublish}
+
+// Event describes a single write to a collection.
+// Data is the entry as it was written (for deletes it only contains the ID), without its write only fields.
+type Event struct {
+	Type       EventType              `json:"type"`
+	Collection string                 `json:"collection"`
+	ID         string                 `json:"id"`
+	Data       map[string]interface{} `json:"data,omitempty"`
+	UserID     string                 `json:"userId,omitempty"`
+	Time       time.Time              `json:"time"`
+}
+
+type Handler func(event Event)
+
+type Bus struct {
+	mu       sync.RWMutex
+	handlers map[int]Handler
+	nextID   int
+}
+
+// DefaultBus is the bus used by the collection routes
+var DefaultBus = NewBus()
+
+func NewBus() *Bus {
+	return &Bus{
+		handlers: make(map[int]Handler),
+	}
+}
+
+// Subscribe registers a handler and returns a function that removes it again.
+// handlers are called synchronously, so anything slow should hand off to a goroutine.
+func (b *Bus) Subscribe(handler Handler) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.nextID
+	b.nextID++
+	b.handlers[id] = handler
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.handlers, id)
+	}
+}
+
+// Publish sends the event to every subscriber.
+func (b *Bus) Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	b.mu.RLock()
+	handlers := make([]Handler, 0, len(b.handlers))
+	for _, handler := range b.handlers {
+		handlers = append(handlers, handler)
+	}
+	b.mu.RUnlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+}
+
+// Subscribe registers a handler on the DefaultBus
+func Subscribe(handler Handler) func() {
+	return DefaultBus.Subscribe(handler)
+}
+
+// Publish publishes an event on the DefaultBus
+func Publish(event Event) {
+	DefaultBus.Publish(event)
+}
@@ -0,0 +1,411 @@
+package filter
+
+/*
+the json filter and sort language of the collection api, turned into gorm clauses. A where is an object of
+conditions that must all match:
+
+	{"Title": "Hello"}                             equals, null matches null and a list matches any of its values
+	{"Views": {"gte": 10, "lt": 100}}              operators, all of them must match
+	{"or": [{"Status": "draft"}, {"Views": 0}]}    and / or take a list of wheres, not takes one
+	{"PublishedAt": {"isNull": false}}
+
+the operators are eq, ne, gt, gte, lt, lte, in, nin, like and isNull, which of them a field allows and the
+values it takes depend on its type. orderBy is a list of "field" / "-field" (descending) or
+{"field": "title", "direction": "desc"}, or the same as a comma separated string
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// how deep and/or/not may be nested
+	maxDepth = 8
+	// the most conditions one where may hold
+	maxConditions = 100
+	// the most values of an in / nin
+	maxValues = 500
+)
+
+type kind string
+
+const (
+	kindID       kind = "id"
+	kindString   kind = "string"
+	kindInt      kind = "integer"
+	kindFloat    kind = "number"
+	kindBoolean  kind = "boolean"
+	kindDateTime kind = "datetime"
+)
+
+// the operators every kind allows, fields of other types can only be checked with isNull
+var operators = map[kind][]string{
+	kindID:       {"eq", "ne", "in", "nin", "isNull"},
+	kindString:   {"eq", "ne", "gt", "gte", "lt", "lte", "in", "nin", "like", "isNull"},
+	kindInt:      {"eq", "ne", "gt", "gte", "lt", "lte", "in", "nin", "isNull"},
+	kindFloat:    {"eq", "ne", "gt", "gte", "lt", "lte", "in", "nin", "isNull"},
+	kindBoolean:  {"eq", "ne", "isNull"},
+	kindDateTime: {"eq", "ne", "gt", "gte", "lt", "lte", "in", "nin", "isNull"},
+}
+
+// the layouts a datetime value may be sent in
+var timeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02"}
+
+// kindOf maps the go type of a field to the kind of values it is filtered with, "" if it cant be
+func kindOf(field schemaregistry.FieldMetadata) kind {
+	goType := strings.TrimPrefix(field.Type, "*")
+	if field.PrimaryKey || goType == "uuid.UUID" {
+		return kindID
+	}
+
+	switch goType {
+	case "string", "sql.NullString", "permissions.Permission":
+		return kindString
+	case "int", "int8", "int16", "int32", "int64", "uint", "uint8", "uint16", "uint32", "uint64",
+		"sql.NullInt16", "sql.NullInt32", "sql.NullInt64":
+		return kindInt
+	case "float32", "float64", "sql.NullFloat64":
+		return kindFloat
+	case "bool", "sql.NullBool":
+		return kindBoolean
+	case "time.Time", "sql.NullTime", "gorm.DeletedAt":
+		return kindDateTime
+	}
+	return ""
+}
+
+// the reasons in the details of a rejected field, {"field": "Title", "reason": "unknown"}
+const (
+	ReasonUnknown         = "unknown"
+	ReasonNotFilterable   = "notFilterable"
+	ReasonInvalidOperator = "invalidOperator"
+	ReasonInvalidValue    = "invalidValue"
+)
+
+// fieldError rejects a field of a where / orderBy / select, the details say which field and why
+func fieldError(name string, reason string, format string, args ...interface{}) error {
+	err := schemaregistry.Reject(format, args...)
+	err.Details = map[string]interface{}{"field": name, "reason": reason}
+	return err
+}
+
+// lookup finds a field that may be filtered and sorted on, usage (where, orderBy) is for the error message
+func lookup(collection string, name string, usage string) (schemaregistry.FieldMetadata, error) {
+	field, ok := schemaregistry.GetField(collection, name)
+	if !ok {
+		return field, fieldError(name, ReasonUnknown, "Unknown %s field: %s", usage, name)
+	}
+	if !field.Filterable {
+		return field, fieldError(name, ReasonNotFilterable, "Invalid %s: %s can't be filtered or sorted on", usage, name)
+	}
+	return field, nil
+}
+
+// parser walks a where of one collection, counting the conditions so a huge filter is rejected
+type parser struct {
+	collection string
+	conditions int
+}
+
+/*
+Parse turns a json where into a clause of the collection, nil for an empty where. Unknown fields, operators a
+field doesnt allow and values of the wrong type are errors for the client (schemaregistry.HookError).
+*/
+func Parse(collection string, where map[string]interface{}) (clause.Expression, error) {
+	if len(where) == 0 {
+		return nil, nil
+	}
+	p := &parser{collection: collection}
+	return p.group(where, 0)
+}
+
+// ParseJSON is Parse for a where that has not been decoded yet, an empty value or null is no where
+func ParseJSON(collection string, raw json.RawMessage) (clause.Expression, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var where map[string]interface{}
+	if err := json.Unmarshal(raw, &where); err != nil {
+		return nil, schemaregistry.Reject("Invalid where: %s", err.Error())
+	}
+	return Parse(collection, where)
+}
+
+/*
+ParseLegacy parses the old "field:value,field:value" where, every pair must be equal. The fields are
+checked against the collection, the values are compared as they are
+*/
+func ParseLegacy(collection string, where string) (clause.Expression, error) {
+	var expressions []clause.Expression
+	for _, condition := range strings.Split(where, ",") {
+		name, value, ok := strings.Cut(condition, ":")
+		if !ok {
+			continue
+		}
+		name = strings.TrimSpace(name)
+		field, err := lookup(collection, name, "where")
+		if err != nil {
+			return nil, err
+		}
+		expressions = append(expressions, clause.Eq{Column: clause.Column{Name: field.Column}, Value: strings.TrimSpace(value)})
+	}
+	if len(expressions) == 0 {
+		return nil, nil
+	}
+	return clause.And(expressions...), nil
+}
+
+// group parses an object of conditions that must all match
+func (p *parser) group(where map[string]interface{}, depth int) (clause.Expression, error) {
+	if depth > maxDepth {
+		return nil, schemaregistry.Reject("Invalid where: nested more than %d levels", maxDepth)
+	}
+
+	// sorted so the same where always builds the same query
+	keys := make([]string, 0, len(where))
+	for key := range where {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var expressions []clause.Expression
+	for _, key := range keys {
+		value := where[key]
+
+		switch key {
+		case "and", "or":
+			list, ok := value.([]interface{})
+			if !ok {
+				return nil, schemaregistry.Reject("Invalid where: %s takes a list", key)
+			}
+			var children []clause.Expression
+			for _, item := range list {
+				child, ok := item.(map[string]interface{})
+				if !ok {
+					return nil, schemaregistry.Reject("Invalid where: %s takes a list of objects", key)
+				}
+				expression, err := p.group(child, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				if expression != nil {
+					children = append(children, expression)
+				}
+			}
+			if len(children) == 0 {
+				continue
+			}
+			if key == "and" {
+				expressions = append(expressions, clause.And(children...))
+			} else {
+				expressions = append(expressions, clause.Or(children...))
+			}
+
+		case "not":
+			child, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, schemaregistry.Reject("Invalid where: not takes an object")
+			}
+			expression, err := p.group(child, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			if expression != nil {
+				expressions = append(expressions, clause.Not(expression))
+			}
+
+		default:
+			expression, err := p.field(key, value)
+			if err != nil {
+				return nil, err
+			}
+			expressions = append(expressions, expression)
+		}
+	}
+
+	switch len(expressions) {
+	case 0:
+		return nil, nil
+	case 1:
+		return expressions[0], nil
+	}
+	return clause.And(expressions...), nil
+}
+
+// field parses the conditions of one field, a value or an object of operators
+func (p *parser) field(name string, value interface{}) (clause.Expression, error) {
+	field, err := lookup(p.collection, name, "where")
+	if err != nil {
+		return nil, err
+	}
+	column := clause.Column{Name: field.Column}
+	k := kindOf(field)
+
+	conditions, isObject := value.(map[string]interface{})
+	if !isObject {
+		// shorthands, a value is eq, a list is in, null is isNull
+		switch value.(type) {
+		case nil:
+			conditions = map[string]interface{}{"isNull": true}
+		case []interface{}:
+			conditions = map[string]interface{}{"in": value}
+		default:
+			conditions = map[string]interface{}{"eq": value}
+		}
+	}
+	if len(conditions) == 0 {
+		return nil, fieldError(name, ReasonInvalidValue, "Invalid where: no condition for %s", name)
+	}
+
+	operatorNames := make([]string, 0, len(conditions))
+	for operator := range conditions {
+		operatorNames = append(operatorNames, operator)
+	}
+	sort.Strings(operatorNames)
+
+	var expressions []clause.Expression
+	for _, operator := range operatorNames {
+		p.conditions++
+		if p.conditions > maxConditions {
+			return nil, schemaregistry.Reject("Invalid where: more than %d conditions", maxConditions)
+		}
+
+		argument := conditions[operator]
+		if operator != "isNull" && !allows(k, operator) {
+			return nil, fieldError(name, ReasonInvalidOperator, "Invalid where: %s can't be used on %s", operator, name)
+		}
+
+		switch operator {
+		case "isNull":
+			isNull, ok := argument.(bool)
+			if !ok {
+				return nil, fieldError(name, ReasonInvalidValue, "Invalid where: isNull of %s takes true or false", name)
+			}
+			if isNull {
+				expressions = append(expressions, clause.Expr{SQL: "? IS NULL", Vars: []interface{}{column}})
+			} else {
+				expressions = append(expressions, clause.Expr{SQL: "? IS NOT NULL", Vars: []interface{}{column}})
+			}
+
+		case "in", "nin":
+			list, ok := argument.([]interface{})
+			if !ok || len(list) == 0 {
+				return nil, fieldError(name, ReasonInvalidValue, "Invalid where: %s of %s takes a list of values", operator, name)
+			}
+			if len(list) > maxValues {
+				return nil, fieldError(name, ReasonInvalidValue, "Invalid where: %s of %s takes at most %d values", operator, name, maxValues)
+			}
+			values := make([]interface{}, len(list))
+			for i, item := range list {
+				converted, err := convert(k, item)
+				if err != nil {
+					return nil, fieldError(name, ReasonInvalidValue, "Invalid where: %s of %s: %s", operator, name, err.Error())
+				}
+				values[i] = converted
+			}
+			if operator == "in" {
+				expressions = append(expressions, clause.IN{Column: column, Values: values})
+			} else {
+				expressions = append(expressions, clause.Not(clause.IN{Column: column, Values: values}))
+			}
+
+		default:
+			converted, err := convert(k, argument)
+			if err != nil {
+				return nil, fieldError(name, ReasonInvalidValue, "Invalid where: %s of %s: %s", operator, name, err.Error())
+			}
+			switch operator {
+			case "eq":
+				expressions = append(expressions, clause.Eq{Column: column, Value: converted})
+			case "ne":
+				expressions = append(expressions, clause.Neq{Column: column, Value: converted})
+			case "gt":
+				expressions = append(expressions, clause.Gt{Column: column, Value: converted})
+			case "gte":
+				expressions = append(expressions, clause.Gte{Column: column, Value: converted})
+			case "lt":
+				expressions = append(expressions, clause.Lt{Column: column, Value: converted})
+			case "lte":
+				expressions = append(expressions, clause.Lte{Column: column, Value: converted})
+			case "like":
+				expressions = append(expressions, clause.Like{Column: column, Value: converted})
+			}
+		}
+	}
+
+	if len(expressions) == 1 {
+		return expressions[0], nil
+	}
+	return clause.And(expressions...), nil
+}
+
+func allows(k kind, operator string) bool {
+	for _, allowed := range operators[k] {
+		if allowed == operator {
+			return true
+		}
+	}
+	return false
+}
+
+// convert checks a json value against the kind of the field and turns it into what the database driver takes
+func convert(k kind, value interface{}) (interface{}, error) {
+	switch k {
+	case kindString:
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		return nil, fmt.Errorf("expected a string")
+
+	case kindID:
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected an id")
+		}
+		if _, err := uuid.FromString(s); err != nil {
+			return nil, fmt.Errorf("invalid id %q", s)
+		}
+		return s, nil
+
+	case kindInt:
+		n, ok := value.(float64)
+		if !ok || n != math.Trunc(n) {
+			return nil, fmt.Errorf("expected an integer")
+		}
+		return int64(n), nil
+
+	case kindFloat:
+		if n, ok := value.(float64); ok {
+			return n, nil
+		}
+		return nil, fmt.Errorf("expected a number")
+
+	case kindBoolean:
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+		return nil, fmt.Errorf("expected true or false")
+
+	case kindDateTime:
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a date")
+		}
+		for _, layout := range timeLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				return t, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid date %q, use RFC 3339", s)
+	}
+	return nil, fmt.Errorf("the field can only be checked with isNull")
+}
@@ -0,0 +1,250 @@
+package filter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type filterPost struct {
+	ID          uuid.UUID `gorm:"type:char(36);primaryKey"`
+	Title       string
+	Views       int
+	Rating      float64
+	Published   bool
+	PublishedAt *time.Time
+	Tags        []string
+	Notes       string `chukfi:"nofilter"`
+	Secret      string `chukfi:"writeOnly"`
+	Salary      int    `chukfi:"readPermission=ManageUsers"`
+}
+
+func (filterPost) TableName() string {
+	return "filter_posts"
+}
+
+const collection = "filter_posts"
+
+func init() {
+	schemaregistry.RegisterSchema(filterPost{})
+}
+
+// toSQL renders the where as the query it filters, so the tests compare what the database gets
+func toSQL(t *testing.T, where clause.Expression) string {
+	t.Helper()
+	db, err := gorm.Open(mysql.New(mysql.Config{SkipInitializeWithVersion: true}), &gorm.Config{DryRun: true, DisableAutomaticPing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db.ToSQL(func(tx *gorm.DB) *gorm.DB {
+		var rows []map[string]interface{}
+		query := tx.Table(collection)
+		if where != nil {
+			query = query.Where(where)
+		}
+		return query.Find(&rows)
+	})
+}
+
+func TestParse(t *testing.T) {
+	const id = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+	tests := []struct {
+		name  string
+		where string
+		sql   string
+	}{
+		{"empty", `{}`, ""},
+		{"equals", `{"Title": "Hello"}`, "`title` = 'Hello'"},
+		{"by column", `{"published_at": {"isNull": false}}`, "`published_at` IS NOT NULL"},
+		{"null shorthand", `{"PublishedAt": null}`, "`published_at` IS NULL"},
+		{"list shorthand", `{"Views": [1, 2]}`, "`views` IN (1,2)"},
+		{"operators", `{"Views": {"gte": 10, "lt": 100}}`, "`views` >= 10 AND `views` < 100"},
+		{"not in", `{"Title": {"nin": ["a", "b"]}}`, "`title` NOT IN ('a','b')"},
+		{"like", `{"Title": {"like": "%news%"}}`, "`title` LIKE '%news%'"},
+		{"id", `{"ID": "` + id + `"}`, "`id` = '" + id + "'"},
+		{"boolean", `{"Published": {"ne": true}}`, "`published` <> true"},
+		{"date", `{"PublishedAt": {"gt": "2024-01-02"}}`, "`published_at` > '2024-01-02 00:00:00'"},
+		{"fields sorted", `{"Views": 1, "Title": "a"}`, "`title` = 'a' AND `views` = 1"},
+		{"or", `{"or": [{"Title": "a"}, {"Views": 0}]}`, "(`title` = 'a' OR `views` = 0)"},
+		{"or next to a field", `{"Views": 1, "or": [{"Title": "a"}, {"Title": "b"}]}`, "`views` = 1 AND (`title` = 'a' OR `title` = 'b')"},
+		{"or of ands", `{"or": [{"Title": "a", "Views": 1}, {"Views": 2}]}`, "((`title` = 'a' AND `views` = 1) OR `views` = 2)"},
+		{"not", `{"not": {"Title": "a"}}`, "`title` <> 'a'"},
+		{"isNull on any type", `{"Tags": {"isNull": true}}`, "`tags` IS NULL"},
+		{"empty or", `{"or": []}`, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expression, err := ParseJSON(collection, json.RawMessage(test.where))
+			if err != nil {
+				t.Fatalf("ParseJSON(%s) failed: %v", test.where, err)
+			}
+
+			want := "SELECT * FROM `filter_posts`"
+			if test.sql != "" {
+				want += " WHERE " + test.sql
+			}
+			if got := toSQL(t, expression); got != want {
+				t.Fatalf("ParseJSON(%s)\n got %s\nwant %s", test.where, got, want)
+			}
+		})
+	}
+}
+
+// nested builds a where that nests not depth times
+func nested(depth int) string {
+	return strings.Repeat(`{"not": `, depth) + `{"Views": 1}` + strings.Repeat("}", depth)
+}
+
+// repeated builds a list of count copies of item
+func repeated(item string, count int) string {
+	return "[" + strings.TrimSuffix(strings.Repeat(item+",", count), ",") + "]"
+}
+
+func TestParseRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		where  string
+		field  string // the field in the details of the error, empty for errors about the whole where
+		reason string
+	}{
+		{"unknown field", `{"Missing": 1}`, "Missing", ReasonUnknown},
+		{"write only field", `{"Secret": "x"}`, "Secret", ReasonNotFilterable},
+		{"field behind a permission", `{"Salary": {"gt": 1000}}`, "Salary", ReasonNotFilterable},
+		{"nofilter field", `{"Notes": "x"}`, "Notes", ReasonNotFilterable},
+		{"hidden field in an or", `{"or": [{"Title": "a"}, {"Secret": "x"}]}`, "Secret", ReasonNotFilterable},
+		{"unknown operator", `{"Title": {"startsWith": "a"}}`, "Title", ReasonInvalidOperator},
+		{"like on a number", `{"Views": {"like": "1%"}}`, "Views", ReasonInvalidOperator},
+		{"order on a boolean", `{"Published": {"gt": false}}`, "Published", ReasonInvalidOperator},
+		{"compare a type without a kind", `{"Tags": ["a"]}`, "Tags", ReasonInvalidOperator},
+		{"string for a number", `{"Views": "10"}`, "Views", ReasonInvalidValue},
+		{"fraction for an integer", `{"Views": 1.5}`, "Views", ReasonInvalidValue},
+		{"number for a string", `{"Title": 1}`, "Title", ReasonInvalidValue},
+		{"invalid id", `{"ID": "1"}`, "ID", ReasonInvalidValue},
+		{"invalid date", `{"PublishedAt": {"lt": "yesterday"}}`, "PublishedAt", ReasonInvalidValue},
+		{"isNull without a boolean", `{"Title": {"isNull": "yes"}}`, "Title", ReasonInvalidValue},
+		{"empty in", `{"Views": {"in": []}}`, "Views", ReasonInvalidValue},
+		{"no conditions", `{"Views": {}}`, "Views", ReasonInvalidValue},
+		{"one bad value in a list", `{"Views": [1, "2"]}`, "Views", ReasonInvalidValue},
+		{"too many values", `{"Views": {"in": ` + repeated("1", maxValues+1) + `}}`, "Views", ReasonInvalidValue},
+		{"or without a list", `{"or": {"Title": "a"}}`, "", ""},
+		{"or of values", `{"or": ["a"]}`, "", ""},
+		{"not with a list", `{"not": [{"Title": "a"}]}`, "", ""},
+		{"nested too deep", nested(maxDepth + 1), "", ""},
+		{"too many conditions", `{"or": ` + repeated(`{"Views": 1}`, maxConditions+1) + `}`, "", ""},
+		{"not json", `{"Title": `, "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseJSON(collection, json.RawMessage(test.where))
+			if err == nil {
+				t.Fatalf("ParseJSON(%.80s) was accepted", test.where)
+			}
+
+			var hookErr *schemaregistry.HookError
+			if !errors.As(err, &hookErr) || hookErr.Status != http.StatusBadRequest {
+				t.Fatalf("ParseJSON(%.80s) = %v, want a 400 HookError", test.where, err)
+			}
+			if test.field == "" {
+				return
+			}
+			details, _ := hookErr.Details.(map[string]interface{})
+			if details["field"] != test.field || details["reason"] != test.reason {
+				t.Fatalf("ParseJSON(%.80s) details = %v, want field %s reason %s", test.where, hookErr.Details, test.field, test.reason)
+			}
+		})
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	tests := []struct {
+		name  string
+		where string
+	}{
+		{"deepest nesting", nested(maxDepth)},
+		{"most conditions", `{"or": ` + repeated(`{"Views": 1}`, maxConditions) + `}`},
+		{"most values", `{"Views": {"in": ` + repeated("1", maxValues) + `}}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ParseJSON(collection, json.RawMessage(test.where)); err != nil {
+				t.Fatalf("ParseJSON at the limit failed: %v", err)
+			}
+		})
+	}
+}
+
+func TestParseLegacy(t *testing.T) {
+	expression, err := ParseLegacy(collection, "Title:Hello, views:3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := toSQL(t, expression), "SELECT * FROM `filter_posts` WHERE `title` = 'Hello' AND `views` = '3'"; got != want {
+		t.Fatalf("ParseLegacy\n got %s\nwant %s", got, want)
+	}
+
+	for _, where := range []string{"Secret:x", "Missing:1", "Title:a,Salary:1"} {
+		if _, err := ParseLegacy(collection, where); err == nil {
+			t.Errorf("ParseLegacy(%s) was accepted", where)
+		}
+	}
+}
+
+func TestParseOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		orderBy string
+		want    string // the order by of the query, empty if it is rejected
+	}{
+		{"string", `"Title,-views"`, "`title`,`views` DESC"},
+		{"list", `["-Rating", "ID"]`, "`rating` DESC,`id`"},
+		{"objects", `[{"field": "Title", "direction": "DESC"}, {"field": "Views"}]`, "`title` DESC,`views`"},
+		{"unknown field", `"Missing"`, ""},
+		{"write only field", `["Secret"]`, ""},
+		{"field behind a permission", `["-Salary"]`, ""},
+		{"nofilter field", `"Notes"`, ""},
+		{"type without a kind", `"Tags"`, ""},
+		{"invalid direction", `[{"field": "Title", "direction": "up"}]`, ""},
+		{"not a list", `{"field": "Title"}`, ""},
+		{"too many fields", `"` + strings.TrimSuffix(strings.Repeat("Title,", maxOrderColumns+1), ",") + `"`, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			columns, err := ParseOrderJSON(collection, json.RawMessage(test.orderBy))
+			if test.want == "" {
+				if err == nil {
+					t.Fatalf("ParseOrderJSON(%s) = %v, want an error", test.orderBy, columns)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseOrderJSON(%s) failed: %v", test.orderBy, err)
+			}
+
+			var rendered []string
+			for _, column := range columns {
+				name := fmt.Sprintf("`%s`", column.Column.Name)
+				if column.Desc {
+					name += " DESC"
+				}
+				rendered = append(rendered, name)
+			}
+			if got := strings.Join(rendered, ","); got != test.want {
+				t.Fatalf("ParseOrderJSON(%s) = %s, want %s", test.orderBy, got, test.want)
+			}
+		})
+	}
+}
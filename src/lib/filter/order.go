@@ -0,0 +1,105 @@
+package filter
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+	"gorm.io/gorm/clause"
+)
+
+// the most columns one orderBy may sort on
+const maxOrderColumns = 10
+
+/*
+ParseOrder turns an orderBy into the columns to sort on: "title,-created_at", ["title", "-created_at"] or
+[{"field": "title", "direction": "asc"}, {"field": "created_at", "direction": "desc"}]
+*/
+func ParseOrder(collection string, orderBy interface{}) ([]clause.OrderByColumn, error) {
+	var items []interface{}
+	switch v := orderBy.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				items = append(items, part)
+			}
+		}
+	case []interface{}:
+		items = v
+	default:
+		return nil, schemaregistry.Reject("Invalid orderBy: expected a list")
+	}
+	if len(items) > maxOrderColumns {
+		return nil, schemaregistry.Reject("Invalid orderBy: at most %d fields", maxOrderColumns)
+	}
+
+	columns := make([]clause.OrderByColumn, 0, len(items))
+	for _, item := range items {
+		var name string
+		var desc bool
+
+		switch v := item.(type) {
+		case string:
+			name, desc = strings.CutPrefix(strings.TrimSpace(v), "-")
+		case map[string]interface{}:
+			name, _ = v["field"].(string)
+			direction, _ := v["direction"].(string)
+			switch strings.ToLower(direction) {
+			case "", "asc":
+			case "desc":
+				desc = true
+			default:
+				return nil, schemaregistry.Reject("Invalid orderBy: direction is asc or desc")
+			}
+		default:
+			return nil, schemaregistry.Reject("Invalid orderBy: expected field names or {field, direction}")
+		}
+
+		field, err := lookup(collection, name, "orderBy")
+		if err != nil {
+			return nil, err
+		}
+		if kindOf(field) == "" {
+			return nil, fieldError(name, ReasonNotFilterable, "Invalid orderBy: %s can't be sorted on", name)
+		}
+		columns = append(columns, clause.OrderByColumn{Column: clause.Column{Name: field.Column}, Desc: desc})
+	}
+	return columns, nil
+}
+
+// ParseOrderJSON is ParseOrder for an orderBy that has not been decoded yet
+func ParseOrderJSON(collection string, raw json.RawMessage) ([]clause.OrderByColumn, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var orderBy interface{}
+	if err := json.Unmarshal(raw, &orderBy); err != nil {
+		return nil, schemaregistry.Reject("Invalid orderBy: %s", err.Error())
+	}
+	return ParseOrder(collection, orderBy)
+}
+
+/*
+Select turns a comma separated list of fields (names or columns) into the columns to select, the id is
+always selected. Every field of the collection can be selected, filterable or not
+*/
+func Select(collection string, list string) ([]string, error) {
+	columns := []string{"id"}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		field, ok := schemaregistry.GetField(collection, name)
+		if !ok {
+			return nil, fieldError(name, ReasonUnknown, "Unknown select field: %s", name)
+		}
+		if !slices.Contains(columns, field.Column) {
+			columns = append(columns, field.Column)
+		}
+	}
+	return columns, nil
+}
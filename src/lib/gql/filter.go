@@ -0,0 +1,203 @@
+package gql
+
+// where filters and ordering of the list queries, turned into gorm clauses
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"gorm.io/gorm/clause"
+)
+
+// operators of every filter input, in the order they show up in the schema
+var filterOperators = map[kind][]string{
+	kindID:       {"eq", "ne", "in", "notIn", "isNull"},
+	kindString:   {"eq", "ne", "contains", "startsWith", "endsWith", "in", "notIn", "isNull"},
+	kindInt:      {"eq", "ne", "gt", "gte", "lt", "lte", "in", "notIn", "isNull"},
+	kindInt64:    {"eq", "ne", "gt", "gte", "lt", "lte", "in", "notIn", "isNull"},
+	kindFloat:    {"eq", "ne", "gt", "gte", "lt", "lte", "in", "notIn", "isNull"},
+	kindBoolean:  {"eq", "ne", "isNull"},
+	kindDateTime: {"eq", "ne", "gt", "gte", "lt", "lte", "isNull"},
+}
+
+var filterNames = map[kind]string{
+	kindID:       "IDFilter",
+	kindString:   "StringFilter",
+	kindInt:      "IntFilter",
+	kindInt64:    "Int64Filter",
+	kindFloat:    "FloatFilter",
+	kindBoolean:  "BooleanFilter",
+	kindDateTime: "DateTimeFilter",
+}
+
+// newFilterInputs creates the operator input of every kind, e.g StringFilter { eq, contains, in, ... }
+func newFilterInputs() map[kind]*graphql.InputObject {
+	inputs := make(map[kind]*graphql.InputObject)
+	for k, operators := range filterOperators {
+		scalar := scalarOf(k)
+		fields := graphql.InputObjectConfigFieldMap{}
+		for _, operator := range operators {
+			switch operator {
+			case "in", "notIn":
+				fields[operator] = &graphql.InputObjectFieldConfig{Type: graphql.NewList(graphql.NewNonNull(scalar))}
+			case "isNull":
+				fields[operator] = &graphql.InputObjectFieldConfig{Type: graphql.Boolean}
+			default:
+				fields[operator] = &graphql.InputObjectFieldConfig{Type: scalar}
+			}
+		}
+		inputs[k] = graphql.NewInputObject(graphql.InputObjectConfig{Name: filterNames[k], Fields: fields})
+	}
+	return inputs
+}
+
+var sortDirection = graphql.NewEnum(graphql.EnumConfig{
+	Name: "SortDirection",
+	Values: graphql.EnumValueConfigMap{
+		"ASC":  &graphql.EnumValueConfig{Value: "ASC"},
+		"DESC": &graphql.EnumValueConfig{Value: "DESC"},
+	},
+})
+
+// escapeLike escapes the wildcards of a LIKE pattern
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+/*
+filterExpression turns the where argument of a list query into a gorm expression, every key is a field
+(with its operators) or AND / OR / NOT. nil means no filter.
+*/
+func filterExpression(collection *collection, where map[string]interface{}) (clause.Expression, error) {
+	var exprs []clause.Expression
+
+	for key, value := range where {
+		if value == nil {
+			continue
+		}
+
+		switch key {
+		case "AND", "OR":
+			var nested []clause.Expression
+			for _, item := range value.([]interface{}) {
+				itemMap, _ := item.(map[string]interface{})
+				expr, err := filterExpression(collection, itemMap)
+				if err != nil {
+					return nil, err
+				}
+				if expr != nil {
+					nested = append(nested, expr)
+				}
+			}
+			if len(nested) == 0 {
+				continue
+			}
+			if key == "AND" {
+				exprs = append(exprs, clause.And(nested...))
+			} else {
+				exprs = append(exprs, clause.Or(nested...))
+			}
+
+		case "NOT":
+			valueMap, _ := value.(map[string]interface{})
+			expr, err := filterExpression(collection, valueMap)
+			if err != nil {
+				return nil, err
+			}
+			if expr != nil {
+				exprs = append(exprs, clause.Not(expr))
+			}
+
+		default:
+			field, ok := collection.byName[key]
+			if !ok {
+				return nil, fmt.Errorf("unknown filter field: %s", key)
+			}
+			operators, _ := value.(map[string]interface{})
+			for operator, operand := range operators {
+				expr := operatorExpression(clause.Column{Name: field.column}, operator, operand)
+				if expr != nil {
+					exprs = append(exprs, expr)
+				}
+			}
+		}
+	}
+
+	switch len(exprs) {
+	case 0:
+		return nil, nil
+	case 1:
+		return exprs[0], nil
+	}
+	return clause.And(exprs...), nil
+}
+
+func operatorExpression(column clause.Column, operator string, operand interface{}) clause.Expression {
+	switch operator {
+	case "isNull":
+		isNull, ok := operand.(bool)
+		if !ok {
+			return nil
+		}
+		if isNull {
+			return clause.Eq{Column: column, Value: nil}
+		}
+		return clause.Neq{Column: column, Value: nil}
+	}
+
+	if operand == nil {
+		return nil
+	}
+
+	switch operator {
+	case "eq":
+		return clause.Eq{Column: column, Value: operand}
+	case "ne":
+		return clause.Neq{Column: column, Value: operand}
+	case "gt":
+		return clause.Gt{Column: column, Value: operand}
+	case "gte":
+		return clause.Gte{Column: column, Value: operand}
+	case "lt":
+		return clause.Lt{Column: column, Value: operand}
+	case "lte":
+		return clause.Lte{Column: column, Value: operand}
+	case "contains":
+		return clause.Like{Column: column, Value: "%" + escapeLike(fmt.Sprint(operand)) + "%"}
+	case "startsWith":
+		return clause.Like{Column: column, Value: escapeLike(fmt.Sprint(operand)) + "%"}
+	case "endsWith":
+		return clause.Like{Column: column, Value: "%" + escapeLike(fmt.Sprint(operand))}
+	case "in", "notIn":
+		values, _ := operand.([]interface{})
+		if len(values) == 0 {
+			// in nothing matches nothing, not in nothing matches everything
+			if operator == "in" {
+				return clause.Expr{SQL: "1 = 0"}
+			}
+			return nil
+		}
+		in := clause.IN{Column: column, Values: values}
+		if operator == "notIn" {
+			return clause.Not(in)
+		}
+		return in
+	}
+	return nil
+}
+
+// orderColumns turns the orderBy argument of a list query into order by columns
+func orderColumns(collection *collection, orderBy []interface{}) []clause.OrderByColumn {
+	var columns []clause.OrderByColumn
+	for _, item := range orderBy {
+		order, _ := item.(map[string]interface{})
+		column, _ := order["field"].(string)
+		if column == "" {
+			continue
+		}
+		direction, _ := order["direction"].(string)
+		columns = append(columns, clause.OrderByColumn{Column: clause.Column{Name: column}, Desc: direction == "DESC"})
+	}
+	return columns
+}
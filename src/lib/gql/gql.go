@@ -0,0 +1,629 @@
+package gql
+
+// builds a graphql schema from the schemaregistry: a type per collection with its relations,
+// a single entry and a paginated, filterable list query per collection, and create / update / delete
+// mutations. the reads and writes themselves are done by a Backend so they follow the same rules as the rest api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+	"github.com/graphql-go/graphql"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// DefaultTake is how many entries a list query returns without a take argument
+	DefaultTake = 30
+	// MaxTake is the most entries a list query returns
+	MaxTake = 100
+)
+
+// ListQuery is what a list query asks the Backend for
+type ListQuery struct {
+	Filter clause.Expression // nil when the query isnt filtered
+	Order  []clause.OrderByColumn
+	Take   int
+	Page   int // starts at 1
+}
+
+/*
+Backend reads and writes the entries, checking the user may do so. Errors that are a
+schemaregistry.HookError are sent with their status, anything else as an internal error.
+Get returns nil without an error when the entry doesnt exist.
+*/
+type Backend interface {
+	Get(ctx context.Context, collection string, id string) (map[string]interface{}, error)
+	List(ctx context.Context, collection string, query ListQuery) ([]map[string]interface{}, int64, error)
+	Create(ctx context.Context, collection string, data map[string]interface{}) (map[string]interface{}, error)
+	Update(ctx context.Context, collection string, id string, data map[string]interface{}) (map[string]interface{}, error)
+	Delete(ctx context.Context, collection string, id string) error
+}
+
+type Options struct {
+	// AdminOnly includes the admin only collections, leave it off for schemas served to anonymous users
+	AdminOnly bool
+	// Mutations adds the create / update / delete mutations
+	Mutations bool
+}
+
+type field struct {
+	meta   schemaregistry.FieldMetadata
+	name   string // name in the graphql schema
+	column string
+	kind   kind
+}
+
+type relation struct {
+	name   string
+	field  *field
+	target string // table name of the referenced collection
+}
+
+type collection struct {
+	table     string
+	typeName  string
+	single    string // query name of one entry
+	list      string // query name of the paginated list
+	fields    []*field
+	byName    map[string]*field
+	relations []relation
+}
+
+// names graphql or this package already use
+var reservedNames = map[string]bool{
+	"Query": true, "Mutation": true, "Subscription": true, "SortDirection": true,
+	"String": true, "Int": true, "Int64": true, "Float": true, "Boolean": true, "ID": true, "DateTime": true,
+}
+
+func init() {
+	for _, name := range filterNames {
+		reservedNames[name] = true
+	}
+}
+
+// pascalCase turns a table name into a type name, e.g api_keys -> ApiKeys
+func pascalCase(name string) string {
+	var sb strings.Builder
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		runes := []rune(part)
+		runes[0] = unicode.ToUpper(runes[0])
+		sb.WriteString(string(runes))
+	}
+	result := sb.String()
+	if result == "" || unicode.IsDigit([]rune(result)[0]) {
+		result = "T" + result
+	}
+	return result
+}
+
+// lowerFirst lowercases the leading capitals, e.g ID -> id, AuthorID -> authorID, HTMLBody -> htmlBody
+func lowerFirst(name string) string {
+	runes := []rune(name)
+	upper := 0
+	for upper < len(runes) && unicode.IsUpper(runes[upper]) {
+		upper++
+	}
+	switch {
+	case upper == len(runes):
+		return strings.ToLower(name)
+	case upper > 1:
+		upper-- // the last capital starts the next word
+	}
+	for i := 0; i < upper; i++ {
+		runes[i] = unicode.ToLower(runes[i])
+	}
+	return string(runes)
+}
+
+// fieldName turns a field or table name into a valid graphql field name, e.g created_at -> createdAt
+func fieldName(name string) string {
+	parts := strings.FieldsFunc(name, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+	if len(parts) == 0 {
+		return "_"
+	}
+	joined := parts[0]
+	if len(parts) > 1 {
+		joined += pascalCase(strings.Join(parts[1:], "_"))
+	}
+	joined = lowerFirst(joined)
+	if unicode.IsDigit([]rune(joined)[0]) {
+		joined = "_" + joined
+	}
+	return joined
+}
+
+func newCollection(meta schemaregistry.SchemaMetadata) *collection {
+	c := &collection{
+		table:    meta.TableName,
+		typeName: pascalCase(schemaregistry.SingularName(meta.TableName)),
+		byName:   make(map[string]*field),
+	}
+	c.single = fieldName(c.typeName)
+	c.list = fieldName(meta.TableName)
+	if c.list == c.single {
+		c.list += "List"
+	}
+
+	for _, meta := range meta.Fields {
+		k, ok := kindOf(meta)
+		if !ok {
+			continue
+		}
+		f := &field{meta: meta, name: fieldName(meta.Name), column: meta.Column, kind: k}
+		if _, taken := c.byName[f.name]; taken {
+			continue
+		}
+		c.fields = append(c.fields, f)
+		c.byName[f.name] = f
+	}
+	return c
+}
+
+// typeNames returns every type name the collection adds to the schema
+func (c *collection) typeNames() []string {
+	return []string{c.typeName, c.typeName + "Page", c.typeName + "Filter", c.typeName + "Order", c.typeName + "OrderField", c.typeName + "CreateInput", c.typeName + "UpdateInput"}
+}
+
+/*
+findRelations links the fields referencing another collection, tagged chukfi:"ref=<collection>"
+or chukfi:"media". AuthorID gets an author field resolving to the referenced entry.
+*/
+func (c *collection) findRelations(collections map[string]*collection) {
+	for _, f := range c.fields {
+		if f.meta.WriteOnly {
+			continue
+		}
+		target, ok := f.meta.Option("ref")
+		if !ok && f.meta.HasOption("media") {
+			target, ok = "media", true
+		}
+		if !ok {
+			continue
+		}
+		table, exists := schemaregistry.ResolveTableName(target)
+		if !exists || collections[table] == nil {
+			// not registered, or admin only and left out of this schema
+			continue
+		}
+
+		name := f.name
+		for _, suffix := range []string{"ID", "Id"} {
+			name = strings.TrimSuffix(name, suffix)
+		}
+		if _, taken := c.byName[name]; taken || name == "" || name == f.name {
+			name = f.name + "Entry"
+		}
+		c.relations = append(c.relations, relation{name: name, field: f, target: table})
+	}
+}
+
+// value returns the value of the field in a row, rows are keyed by column (or by field name after an AfterRead hook)
+func (f *field) value(source interface{}) interface{} {
+	row, _ := source.(map[string]interface{})
+	value, ok := row[f.column]
+	if !ok {
+		value = row[f.meta.Name]
+	}
+	return coerce(f.kind, value)
+}
+
+// writable fields are the ones a mutation may set, timestamps, the id and read only fields are set by the server
+func (f *field) writable() bool {
+	switch f.column {
+	case "created_at", "updated_at", "deleted_at":
+		return false
+	}
+	return !f.meta.PrimaryKey && !f.meta.ReadOnly
+}
+
+/*
+Build generates the schema from the collections currently registered, build it again after registering more.
+Collections whose names clash with one already in the schema are left out with a warning.
+*/
+func Build(backend Backend, options Options) (graphql.Schema, error) {
+	registered := schemaregistry.GetAllRegisteredSchemas()
+	tables := make([]string, 0, len(registered))
+	for table, meta := range registered {
+		if meta.AdminOnly && !options.AdminOnly {
+			continue
+		}
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	collections := make(map[string]*collection)
+	var ordered []*collection
+	usedTypes := make(map[string]string)
+	usedQueries := map[string]string{"collections": ""}
+
+	for _, table := range tables {
+		meta, ok := schemaregistry.GetMetadata(table)
+		if !ok {
+			continue
+		}
+		c := newCollection(meta)
+
+		clash := ""
+		for _, name := range c.typeNames() {
+			if reservedNames[name] || usedTypes[name] != "" {
+				clash = name
+			}
+		}
+		for _, name := range []string{c.single, c.list} {
+			if _, taken := usedQueries[name]; taken {
+				clash = name
+			}
+		}
+		if clash != "" {
+			fmt.Printf("graphql: leaving %s out of the schema, %s is already taken\n", table, clash)
+			continue
+		}
+		if len(c.fields) == 0 {
+			continue
+		}
+
+		for _, name := range c.typeNames() {
+			usedTypes[name] = table
+		}
+		usedQueries[c.single] = table
+		usedQueries[c.list] = table
+		collections[table] = c
+		ordered = append(ordered, c)
+	}
+
+	for _, c := range ordered {
+		c.findRelations(collections)
+	}
+
+	objects := make(map[string]*graphql.Object)
+	for _, c := range ordered {
+		objects[c.table] = newObject(backend, c, objects)
+	}
+
+	filters := newFilterInputs()
+	queries := graphql.Fields{
+		"collections": &graphql.Field{
+			Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String))),
+			Description: "The collections in this schema",
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				names := make([]string, 0, len(ordered))
+				for _, c := range ordered {
+					names = append(names, c.table)
+				}
+				return names, nil
+			},
+		},
+	}
+	mutations := graphql.Fields{}
+
+	for _, c := range ordered {
+		addQueries(queries, backend, c, objects[c.table], filters)
+		if options.Mutations {
+			addMutations(mutations, backend, c, objects[c.table])
+		}
+	}
+
+	config := graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{Name: "Query", Fields: queries}),
+	}
+	if len(mutations) > 0 {
+		config.Mutation = graphql.NewObject(graphql.ObjectConfig{Name: "Mutation", Fields: mutations})
+	}
+	return graphql.NewSchema(config)
+}
+
+func newObject(backend Backend, c *collection, objects map[string]*graphql.Object) *graphql.Object {
+	return graphql.NewObject(graphql.ObjectConfig{
+		Name: c.typeName,
+		// a thunk so relations can point at collections created after this one
+		Fields: graphql.FieldsThunk(func() graphql.Fields {
+			fields := graphql.Fields{}
+			for _, f := range c.fields {
+				// write only fields can only be set by the mutations, fields behind a permission resolve to null without it
+				if f.meta.WriteOnly {
+					continue
+				}
+				f := f
+				var fieldType graphql.Output = scalarOf(f.kind)
+				if f.meta.PrimaryKey {
+					fieldType = graphql.NewNonNull(fieldType)
+				}
+				fields[f.name] = &graphql.Field{
+					Type: fieldType,
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						return f.value(p.Source), nil
+					},
+				}
+			}
+			for _, rel := range c.relations {
+				rel := rel
+				fields[rel.name] = &graphql.Field{
+					Type: objects[rel.target],
+					Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+						id, _ := rel.field.value(p.Source).(string)
+						if id == "" {
+							return nil, nil
+						}
+						return load(p.Context, backend, rel.target, id)
+					},
+				}
+			}
+			return fields
+		}),
+	})
+}
+
+func addQueries(queries graphql.Fields, backend Backend, c *collection, object *graphql.Object, filters map[kind]*graphql.InputObject) {
+	orderValues := graphql.EnumValueConfigMap{}
+	for _, f := range c.fields {
+		if f.meta.Filterable {
+			orderValues[f.name] = &graphql.EnumValueConfig{Value: f.column}
+		}
+	}
+
+	var filter *graphql.InputObject
+	filter = graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: c.typeName + "Filter",
+		// a thunk so AND / OR / NOT can refer to the filter itself
+		Fields: graphql.InputObjectConfigFieldMapThunk(func() graphql.InputObjectConfigFieldMap {
+			fields := graphql.InputObjectConfigFieldMap{
+				"AND": &graphql.InputObjectFieldConfig{Type: graphql.NewList(graphql.NewNonNull(filter))},
+				"OR":  &graphql.InputObjectFieldConfig{Type: graphql.NewList(graphql.NewNonNull(filter))},
+				"NOT": &graphql.InputObjectFieldConfig{Type: filter},
+			}
+			for _, f := range c.fields {
+				if f.meta.Filterable {
+					fields[f.name] = &graphql.InputObjectFieldConfig{Type: filters[f.kind]}
+				}
+			}
+			return fields
+		}),
+	})
+
+	order := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: c.typeName + "Order",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"field":     &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.NewEnum(graphql.EnumConfig{Name: c.typeName + "OrderField", Values: orderValues}))},
+			"direction": &graphql.InputObjectFieldConfig{Type: sortDirection, DefaultValue: "ASC"},
+		},
+	})
+
+	page := graphql.NewObject(graphql.ObjectConfig{
+		Name: c.typeName + "Page",
+		Fields: graphql.Fields{
+			"items":   &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(object)))},
+			"total":   &graphql.Field{Type: graphql.NewNonNull(Int64)},
+			"page":    &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"take":    &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"hasMore": &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+		},
+	})
+
+	queries[c.single] = &graphql.Field{
+		Type: object,
+		Args: graphql.FieldConfigArgument{
+			"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return load(p.Context, backend, c.table, p.Args["id"].(string))
+		},
+	}
+
+	queries[c.list] = &graphql.Field{
+		Type: graphql.NewNonNull(page),
+		Args: graphql.FieldConfigArgument{
+			"where":   &graphql.ArgumentConfig{Type: filter},
+			"orderBy": &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(order))},
+			"take":    &graphql.ArgumentConfig{Type: graphql.Int, Description: fmt.Sprintf("Defaults to %d, at most %d", DefaultTake, MaxTake)},
+			"page":    &graphql.ArgumentConfig{Type: graphql.Int, Description: "Starts at 1"},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			query := ListQuery{Take: DefaultTake, Page: 1}
+			if take, ok := p.Args["take"].(int); ok && take > 0 {
+				query.Take = min(take, MaxTake)
+			}
+			if page, ok := p.Args["page"].(int); ok && page > 0 {
+				query.Page = page
+			}
+
+			where, _ := p.Args["where"].(map[string]interface{})
+			expr, err := filterExpression(c, where)
+			if err != nil {
+				return nil, wrapError(schemaregistry.Reject("%s", err.Error()))
+			}
+			query.Filter = expr
+
+			orderBy, _ := p.Args["orderBy"].([]interface{})
+			query.Order = orderColumns(c, orderBy)
+			// a stable order so pages dont overlap
+			if len(query.Order) == 0 && c.byName["createdAt"] != nil {
+				query.Order = append(query.Order, clause.OrderByColumn{Column: clause.Column{Name: c.byName["createdAt"].column}, Desc: true})
+			}
+			for _, f := range c.fields {
+				if f.meta.PrimaryKey {
+					query.Order = append(query.Order, clause.OrderByColumn{Column: clause.Column{Name: f.column}})
+				}
+			}
+
+			items, total, err := backend.List(p.Context, c.table, query)
+			if err != nil {
+				return nil, wrapError(err)
+			}
+			if items == nil {
+				items = []map[string]interface{}{}
+			}
+			return map[string]interface{}{
+				"items":   items,
+				"total":   total,
+				"page":    query.Page,
+				"take":    query.Take,
+				"hasMore": int64(query.Page*query.Take) < total,
+			}, nil
+		},
+	}
+}
+
+func addMutations(mutations graphql.Fields, backend Backend, c *collection, object *graphql.Object) {
+	createFields := graphql.InputObjectConfigFieldMap{}
+	updateFields := graphql.InputObjectConfigFieldMap{}
+	for _, f := range c.fields {
+		if !f.writable() {
+			continue
+		}
+		var inputType graphql.Input = scalarOf(f.kind)
+		updateFields[f.name] = &graphql.InputObjectFieldConfig{Type: inputType}
+		if f.meta.Required {
+			inputType = graphql.NewNonNull(inputType)
+		}
+		createFields[f.name] = &graphql.InputObjectFieldConfig{Type: inputType}
+	}
+
+	// input names are graphql field names, the collection helpers want the schema field names
+	toData := func(input interface{}) map[string]interface{} {
+		data := make(map[string]interface{})
+		values, _ := input.(map[string]interface{})
+		for name, value := range values {
+			if f, ok := c.byName[name]; ok {
+				data[f.meta.Name] = value
+			}
+		}
+		return data
+	}
+
+	if len(createFields) > 0 {
+		createInput := graphql.NewInputObject(graphql.InputObjectConfig{Name: c.typeName + "CreateInput", Fields: createFields})
+		updateInput := graphql.NewInputObject(graphql.InputObjectConfig{Name: c.typeName + "UpdateInput", Fields: updateFields})
+
+		mutations["create"+c.typeName] = &graphql.Field{
+			Type: object,
+			Args: graphql.FieldConfigArgument{
+				"data": &graphql.ArgumentConfig{Type: graphql.NewNonNull(createInput)},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				entry, err := backend.Create(p.Context, c.table, toData(p.Args["data"]))
+				if err != nil || entry == nil {
+					return nil, wrapError(err)
+				}
+				return entry, nil
+			},
+		}
+
+		mutations["update"+c.typeName] = &graphql.Field{
+			Type: object,
+			Args: graphql.FieldConfigArgument{
+				"id":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+				"data": &graphql.ArgumentConfig{Type: graphql.NewNonNull(updateInput)},
+			},
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				entry, err := backend.Update(p.Context, c.table, p.Args["id"].(string), toData(p.Args["data"]))
+				if err != nil || entry == nil {
+					return nil, wrapError(err)
+				}
+				return entry, nil
+			},
+		}
+	}
+
+	mutations["delete"+c.typeName] = &graphql.Field{
+		Type: graphql.NewNonNull(graphql.Boolean),
+		Args: graphql.FieldConfigArgument{
+			"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+		},
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			if err := backend.Delete(p.Context, c.table, p.Args["id"].(string)); err != nil {
+				return nil, wrapError(err)
+			}
+			return true, nil
+		},
+	}
+}
+
+type cacheKey struct{}
+
+type cache struct {
+	mu      sync.Mutex
+	entries map[string]map[string]interface{}
+}
+
+/*
+WithCache adds a cache of the entries loaded by id to the context of a request, so an entry referenced by
+many others (e.g the author of every post in a list) is only loaded once
+*/
+func WithCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, cacheKey{}, &cache{entries: make(map[string]map[string]interface{})})
+}
+
+// load gets an entry by id through the cache of the request, if it has one
+func load(ctx context.Context, backend Backend, collection string, id string) (interface{}, error) {
+	c, _ := ctx.Value(cacheKey{}).(*cache)
+	key := collection + "/" + id
+
+	if c != nil {
+		c.mu.Lock()
+		entry, found := c.entries[key]
+		c.mu.Unlock()
+		if found {
+			if entry == nil {
+				return nil, nil
+			}
+			return entry, nil
+		}
+	}
+
+	entry, err := backend.Get(ctx, collection, id)
+	if err != nil {
+		return nil, wrapError(err)
+	}
+
+	if c != nil {
+		c.mu.Lock()
+		c.entries[key] = entry
+		c.mu.Unlock()
+	}
+	if entry == nil {
+		return nil, nil
+	}
+	return entry, nil
+}
+
+// gqlError carries the http status of an error in the extensions of the graphql error
+type gqlError struct {
+	status  int
+	message string
+	details interface{}
+}
+
+func (e *gqlError) Error() string {
+	return e.message
+}
+
+func (e *gqlError) Extensions() map[string]interface{} {
+	extensions := map[string]interface{}{"status": e.status}
+	if e.details != nil {
+		extensions["details"] = e.details
+	}
+	return extensions
+}
+
+func wrapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var wrapped *gqlError
+	if errors.As(err, &wrapped) {
+		return wrapped
+	}
+	var hookErr *schemaregistry.HookError
+	if errors.As(err, &hookErr) {
+		return &gqlError{status: hookErr.Status, message: hookErr.Message, details: hookErr.Details}
+	}
+	return &gqlError{status: http.StatusInternalServerError, message: err.Error()}
+}
@@ -0,0 +1,235 @@
+package gql
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+)
+
+// the kinds of values a column can hold, every kind maps to one graphql scalar
+type kind string
+
+const (
+	kindID       kind = "id"
+	kindString   kind = "string"
+	kindInt      kind = "int"
+	kindInt64    kind = "int64"
+	kindFloat    kind = "float"
+	kindBoolean  kind = "boolean"
+	kindDateTime kind = "datetime"
+)
+
+/*
+Int64 holds 64 bit integers (graphqls Int is 32 bit), e.g the permissions of a user. Sent as a number,
+variables may also pass it as a string so javascript clients dont lose precision.
+*/
+var Int64 = graphql.NewScalar(graphql.ScalarConfig{
+	Name:        "Int64",
+	Description: "A 64 bit integer, accepts a number or a string holding one",
+	Serialize: func(value interface{}) interface{} {
+		return coerce(kindInt64, value)
+	},
+	ParseValue: func(value interface{}) interface{} {
+		switch v := value.(type) {
+		case float64:
+			if v != math.Trunc(v) {
+				return nil
+			}
+			return int64(v)
+		case string:
+			if parsed, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return parsed
+			}
+			if parsed, err := strconv.ParseUint(v, 10, 64); err == nil {
+				return parsed
+			}
+			return nil
+		}
+		return coerce(kindInt64, value)
+	},
+	ParseLiteral: func(value ast.Value) interface{} {
+		var raw string
+		switch v := value.(type) {
+		case *ast.IntValue:
+			raw = v.Value
+		case *ast.StringValue:
+			raw = v.Value
+		default:
+			return nil
+		}
+		if parsed, err := strconv.ParseInt(raw, 10, 64); err == nil {
+			return parsed
+		}
+		if parsed, err := strconv.ParseUint(raw, 10, 64); err == nil {
+			return parsed
+		}
+		return nil
+	},
+})
+
+// kindOf returns the kind of a field, false for fields that arent exposed (soft delete columns, structs, slices...)
+func kindOf(field schemaregistry.FieldMetadata) (kind, bool) {
+	if field.Column == "deleted_at" {
+		return "", false
+	}
+	if field.PrimaryKey {
+		return kindID, true
+	}
+
+	switch strings.TrimPrefix(field.Type, "*") {
+	case "string", "uuid.UUID", "sql.NullString", "permissions.Permission":
+		return kindString, true
+	case "int", "int8", "int16", "int32", "uint8", "uint16", "sql.NullInt32", "sql.NullInt16":
+		return kindInt, true
+	case "int64", "uint", "uint32", "uint64", "sql.NullInt64":
+		return kindInt64, true
+	case "float32", "float64", "sql.NullFloat64":
+		return kindFloat, true
+	case "bool", "sql.NullBool":
+		return kindBoolean, true
+	case "time.Time", "sql.NullTime":
+		return kindDateTime, true
+	}
+	return "", false
+}
+
+func scalarOf(k kind) *graphql.Scalar {
+	switch k {
+	case kindID:
+		return graphql.ID
+	case kindInt:
+		return graphql.Int
+	case kindInt64:
+		return Int64
+	case kindFloat:
+		return graphql.Float
+	case kindBoolean:
+		return graphql.Boolean
+	case kindDateTime:
+		return graphql.DateTime
+	}
+	return graphql.String
+}
+
+// the formats datetimes come back in when the dsn doesnt set parseTime
+var timeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999", "2006-01-02 15:04:05", "2006-01-02"}
+
+/*
+coerce turns a value as the database driver returns it (int64 for a tinyint bool, []byte for text...)
+into the go type the graphql scalar of the kind expects, nil if it cant be converted
+*/
+func coerce(k kind, value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	if bytes, ok := value.([]byte); ok {
+		value = string(bytes)
+	}
+	if t, ok := value.(*time.Time); ok {
+		if t == nil {
+			return nil
+		}
+		value = *t
+	}
+
+	rv := reflect.ValueOf(value)
+	switch k {
+	case kindID, kindString:
+		if s, ok := value.(string); ok {
+			return s
+		}
+		return fmt.Sprint(value)
+
+	case kindInt, kindInt64:
+		var n int64
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			n = rv.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if rv.Uint() > math.MaxInt64 {
+				if k == kindInt64 {
+					return rv.Uint()
+				}
+				return nil
+			}
+			n = int64(rv.Uint())
+		case reflect.Float32, reflect.Float64:
+			n = int64(rv.Float())
+		case reflect.Bool:
+			if rv.Bool() {
+				n = 1
+			}
+		case reflect.String:
+			parsed, err := strconv.ParseInt(rv.String(), 10, 64)
+			if err != nil {
+				if k == kindInt64 {
+					if unsigned, err := strconv.ParseUint(rv.String(), 10, 64); err == nil {
+						return unsigned
+					}
+				}
+				return nil
+			}
+			n = parsed
+		default:
+			return nil
+		}
+		if k == kindInt {
+			if n > math.MaxInt32 || n < math.MinInt32 {
+				return nil
+			}
+			return int(n)
+		}
+		return n
+
+	case kindFloat:
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return float64(rv.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return float64(rv.Uint())
+		case reflect.Float32, reflect.Float64:
+			return rv.Float()
+		case reflect.String:
+			if parsed, err := strconv.ParseFloat(rv.String(), 64); err == nil {
+				return parsed
+			}
+		}
+		return nil
+
+	case kindBoolean:
+		switch rv.Kind() {
+		case reflect.Bool:
+			return rv.Bool()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return rv.Int() != 0
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return rv.Uint() != 0
+		case reflect.String:
+			if parsed, err := strconv.ParseBool(rv.String()); err == nil {
+				return parsed
+			}
+		}
+		return nil
+
+	case kindDateTime:
+		switch v := value.(type) {
+		case time.Time:
+			return v
+		case string:
+			for _, layout := range timeLayouts {
+				if parsed, err := time.Parse(layout, v); err == nil {
+					return parsed
+				}
+			}
+		}
+		return nil
+	}
+	return value
+}
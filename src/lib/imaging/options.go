@@ -0,0 +1,220 @@
+package imaging
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type Fit string
+
+const (
+	// FitCover fills the whole box, cropping whatever sticks out (centered)
+	FitCover Fit = "cover"
+	// FitContain scales the image to fit inside the box, keeping the aspect ratio
+	FitContain Fit = "contain"
+	// FitFill stretches the image to exactly the box
+	FitFill Fit = "fill"
+)
+
+const (
+	// largest width/height that can be requested
+	MaxDimension   = 4096
+	defaultQuality = 82
+)
+
+var (
+	ErrInvalidOptions      = errors.New("invalid image options")
+	ErrUnknownPreset       = errors.New("unknown image preset")
+	ErrUnsupportedFormat   = errors.New("unsupported image format")
+	ErrNotAnImage          = errors.New("media is not an image")
+	ErrImageTooLarge       = errors.New("image is too large to transform")
+	ErrArbitraryNotAllowed = errors.New("only presets are allowed")
+)
+
+// Rect is a crop rectangle in source pixels (after EXIF orientation is applied)
+type Rect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// Options describes a single variant of an image
+type Options struct {
+	Width   int    `json:"width,omitempty"`
+	Height  int    `json:"height,omitempty"`
+	Fit     Fit    `json:"fit,omitempty"`
+	Crop    *Rect  `json:"crop,omitempty"`
+	Format  string `json:"format,omitempty"`
+	Quality int    `json:"quality,omitempty"`
+}
+
+var (
+	presets = map[string]Options{
+		"thumbnail": {Width: 150, Height: 150, Fit: FitCover},
+		"small":     {Width: 480, Fit: FitContain},
+		"medium":    {Width: 960, Fit: FitContain},
+		"large":     {Width: 1920, Fit: FitContain},
+	}
+	presetsMu sync.RWMutex
+)
+
+// RegisterPreset adds (or replaces) a named preset usable with ?preset=name
+func RegisterPreset(name string, options Options) error {
+	if err := options.Validate(); err != nil {
+		return err
+	}
+
+	presetsMu.Lock()
+	defer presetsMu.Unlock()
+	presets[strings.ToLower(name)] = options
+	return nil
+}
+
+// GetPreset returns a named preset
+func GetPreset(name string) (Options, bool) {
+	presetsMu.RLock()
+	defer presetsMu.RUnlock()
+	options, ok := presets[strings.ToLower(name)]
+	return options, ok
+}
+
+// GetAllPresets returns every registered preset
+func GetAllPresets() map[string]Options {
+	presetsMu.RLock()
+	defer presetsMu.RUnlock()
+
+	all := make(map[string]Options, len(presets))
+	for name, options := range presets {
+		all[name] = options
+	}
+	return all
+}
+
+// Validate checks the options are within limits and fills in the defaults
+func (o *Options) Validate() error {
+	if o.Width < 0 || o.Height < 0 || o.Width > MaxDimension || o.Height > MaxDimension {
+		return fmt.Errorf("%w: width and height must be between 0 and %d", ErrInvalidOptions, MaxDimension)
+	}
+
+	switch o.Fit {
+	case "":
+		o.Fit = FitContain
+	case FitCover, FitContain, FitFill:
+	default:
+		return fmt.Errorf("%w: fit must be cover, contain or fill", ErrInvalidOptions)
+	}
+
+	if (o.Fit == FitCover || o.Fit == FitFill) && (o.Width == 0 || o.Height == 0) {
+		return fmt.Errorf("%w: fit %s needs both a width and a height", ErrInvalidOptions, o.Fit)
+	}
+
+	if o.Crop != nil && (o.Crop.X < 0 || o.Crop.Y < 0 || o.Crop.Width <= 0 || o.Crop.Height <= 0) {
+		return fmt.Errorf("%w: crop must be x,y,width,height with a positive size", ErrInvalidOptions)
+	}
+
+	o.Format = strings.ToLower(o.Format)
+	if o.Format == "jpg" {
+		o.Format = "jpeg"
+	}
+	if o.Format != "" && !canEncode(o.Format) {
+		return fmt.Errorf("%w: %s (supported: %s)", ErrUnsupportedFormat, o.Format, strings.Join(EncodableFormats(), ", "))
+	}
+
+	if o.Quality == 0 {
+		o.Quality = defaultQuality
+	}
+	if o.Quality < 1 || o.Quality > 100 {
+		return fmt.Errorf("%w: quality must be between 1 and 100", ErrInvalidOptions)
+	}
+
+	return nil
+}
+
+// cacheKey is a stable string for the options, used to name the cached variant
+func (o Options) cacheKey() string {
+	crop := ""
+	if o.Crop != nil {
+		crop = fmt.Sprintf("%d,%d,%d,%d", o.Crop.X, o.Crop.Y, o.Crop.Width, o.Crop.Height)
+	}
+	return fmt.Sprintf("w=%d;h=%d;fit=%s;crop=%s;format=%s;q=%d", o.Width, o.Height, o.Fit, crop, o.Format, o.Quality)
+}
+
+/*
+ParseOptions reads the options from url parameters:
+
+	?preset=thumbnail
+	?w=300&h=200&fit=cover&crop=10,10,500,500&format=png&q=80
+
+a preset can be combined with format and q to override them.
+if presetsOnly is set, only ?preset= (plus format/q) is accepted
+*/
+func ParseOptions(query url.Values, presetsOnly bool) (Options, error) {
+	var options Options
+
+	if name := query.Get("preset"); name != "" {
+		preset, ok := GetPreset(name)
+		if !ok {
+			return options, fmt.Errorf("%w: %s", ErrUnknownPreset, name)
+		}
+		options = preset
+	} else if presetsOnly {
+		return options, ErrArbitraryNotAllowed
+	} else {
+		var err error
+		if options.Width, err = parseInt(query, "w"); err != nil {
+			return options, err
+		}
+		if options.Height, err = parseInt(query, "h"); err != nil {
+			return options, err
+		}
+		options.Fit = Fit(strings.ToLower(query.Get("fit")))
+
+		if crop := query.Get("crop"); crop != "" {
+			parts := strings.Split(crop, ",")
+			if len(parts) != 4 {
+				return options, fmt.Errorf("%w: crop must be x,y,width,height", ErrInvalidOptions)
+			}
+			values := make([]int, 4)
+			for i, part := range parts {
+				value, err := strconv.Atoi(strings.TrimSpace(part))
+				if err != nil {
+					return options, fmt.Errorf("%w: crop must be x,y,width,height", ErrInvalidOptions)
+				}
+				values[i] = value
+			}
+			options.Crop = &Rect{X: values[0], Y: values[1], Width: values[2], Height: values[3]}
+		}
+	}
+
+	if format := query.Get("format"); format != "" {
+		options.Format = format
+	}
+
+	quality, err := parseInt(query, "q")
+	if err != nil {
+		return options, err
+	}
+	if quality != 0 {
+		options.Quality = quality
+	}
+
+	return options, options.Validate()
+}
+
+func parseInt(query url.Values, key string) (int, error) {
+	value := query.Get(key)
+	if value == "" {
+		return 0, nil
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s must be a number", ErrInvalidOptions, key)
+	}
+	return parsed, nil
+}
@@ -0,0 +1,287 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// images over this many pixels are refused, decoding them would eat all the memory
+const maxSourcePixels = 50_000_000
+
+// EncodableFormats are the formats variants can be written as, webp can only be read
+// since there is no pure go webp encoder
+func EncodableFormats() []string {
+	return []string{"jpeg", "png", "gif"}
+}
+
+func canEncode(format string) bool {
+	for _, encodable := range EncodableFormats() {
+		if encodable == format {
+			return true
+		}
+	}
+	return false
+}
+
+// ContentType returns the mime type of an output format
+func ContentType(format string) string {
+	return "image/" + format
+}
+
+/*
+Transform decodes the image, applies the EXIF orientation, crops and resizes it and encodes it
+in the requested format. Re-encoding drops every bit of metadata (EXIF, GPS, ICC, comments)
+*/
+func Transform(reader io.Reader, options Options, defaultFormat string) ([]byte, string, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, "", err
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrNotAnImage, err)
+	}
+	if config.Width*config.Height > maxSourcePixels {
+		return nil, "", ErrImageTooLarge
+	}
+
+	source, sourceFormat, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", ErrNotAnImage, err)
+	}
+
+	if sourceFormat == "jpeg" {
+		source = applyOrientation(source, jpegOrientation(data))
+	}
+
+	if options.Crop != nil {
+		crop := image.Rect(options.Crop.X, options.Crop.Y, options.Crop.X+options.Crop.Width, options.Crop.Y+options.Crop.Height)
+		crop = crop.Add(source.Bounds().Min).Intersect(source.Bounds())
+		if crop.Empty() {
+			return nil, "", fmt.Errorf("%w: crop is outside of the image", ErrInvalidOptions)
+		}
+		source = subImage(source, crop)
+	}
+
+	result := resize(source, options)
+
+	format := options.Format
+	if format == "" {
+		format = defaultFormat
+	}
+	if !canEncode(format) {
+		format = "png"
+	}
+
+	var buffer bytes.Buffer
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buffer, flatten(result), &jpeg.Options{Quality: options.Quality})
+	case "png":
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buffer, result)
+	case "gif":
+		err = gif.Encode(&buffer, result, nil)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	return buffer.Bytes(), format, nil
+}
+
+func subImage(source image.Image, rect image.Rectangle) image.Image {
+	if sub, ok := source.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(rect)
+	}
+
+	cropped := image.NewNRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(cropped, cropped.Bounds(), source, rect.Min, draw.Src)
+	return cropped
+}
+
+// resize scales the image according to the width, height and fit of the options
+func resize(source image.Image, options Options) image.Image {
+	bounds := source.Bounds()
+	sourceWidth, sourceHeight := float64(bounds.Dx()), float64(bounds.Dy())
+
+	if options.Width == 0 && options.Height == 0 {
+		return source
+	}
+
+	sourceRect := bounds
+	var width, height int
+
+	switch options.Fit {
+	case FitFill:
+		width, height = options.Width, options.Height
+	case FitCover:
+		width, height = options.Width, options.Height
+		// take the biggest centered part of the source with the aspect ratio of the box
+		targetRatio := float64(width) / float64(height)
+		if sourceWidth/sourceHeight > targetRatio {
+			cropWidth := int(math.Round(sourceHeight * targetRatio))
+			left := bounds.Min.X + (bounds.Dx()-cropWidth)/2
+			sourceRect = image.Rect(left, bounds.Min.Y, left+cropWidth, bounds.Max.Y)
+		} else {
+			cropHeight := int(math.Round(sourceWidth / targetRatio))
+			top := bounds.Min.Y + (bounds.Dy()-cropHeight)/2
+			sourceRect = image.Rect(bounds.Min.X, top, bounds.Max.X, top+cropHeight)
+		}
+	default:
+		scale := math.Inf(1)
+		if options.Width > 0 {
+			scale = float64(options.Width) / sourceWidth
+		}
+		if options.Height > 0 {
+			scale = math.Min(scale, float64(options.Height)/sourceHeight)
+		}
+		// never upscale when fitting inside a box
+		scale = math.Min(scale, 1)
+		width = max(1, int(math.Round(sourceWidth*scale)))
+		height = max(1, int(math.Round(sourceHeight*scale)))
+	}
+
+	if width == bounds.Dx() && height == bounds.Dy() && sourceRect == bounds {
+		return source
+	}
+
+	result := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(result, result.Bounds(), source, sourceRect, draw.Src, nil)
+	return result
+}
+
+// flatten draws the image on white, jpeg has no alpha channel
+func flatten(source image.Image) image.Image {
+	if opaque, ok := source.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return source
+	}
+
+	bounds := source.Bounds()
+	result := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(result, result.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(result, result.Bounds(), source, bounds.Min, draw.Over)
+	return result
+}
+
+// applyOrientation rotates/flips the image so it looks the way the EXIF orientation says it should
+func applyOrientation(source image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return source
+	}
+
+	bounds := source.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// orientations 5-8 swap width and height
+	outWidth, outHeight := width, height
+	if orientation >= 5 {
+		outWidth, outHeight = height, width
+	}
+
+	result := image.NewNRGBA(image.Rect(0, 0, outWidth, outHeight))
+	for y := 0; y < outHeight; y++ {
+		for x := 0; x < outWidth; x++ {
+			var sourceX, sourceY int
+			switch orientation {
+			case 2: // mirrored horizontally
+				sourceX, sourceY = width-1-x, y
+			case 3: // rotated 180
+				sourceX, sourceY = width-1-x, height-1-y
+			case 4: // mirrored vertically
+				sourceX, sourceY = x, height-1-y
+			case 5: // transposed
+				sourceX, sourceY = y, x
+			case 6: // rotated 90 clockwise
+				sourceX, sourceY = y, height-1-x
+			case 7: // transversed
+				sourceX, sourceY = width-1-y, height-1-x
+			case 8: // rotated 90 counter clockwise
+				sourceX, sourceY = width-1-y, x
+			}
+			result.Set(x, y, source.At(bounds.Min.X+sourceX, bounds.Min.Y+sourceY))
+		}
+	}
+
+	return result
+}
+
+// jpegOrientation reads the EXIF orientation tag from a jpeg, returns 1 (normal) if there is none
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	offset := 2
+	for offset+4 <= len(data) {
+		if data[offset] != 0xFF {
+			return 1
+		}
+		marker := data[offset+1]
+		length := int(binary.BigEndian.Uint16(data[offset+2:]))
+		if length < 2 || offset+2+length > len(data) {
+			return 1
+		}
+
+		// start of scan, no more metadata after this
+		if marker == 0xDA {
+			return 1
+		}
+
+		segment := data[offset+4 : offset+2+length]
+		if marker == 0xE1 && len(segment) > 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return exifOrientation(segment[6:])
+		}
+
+		offset += 2 + length
+	}
+
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+
+	return 1
+}
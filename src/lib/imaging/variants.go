@@ -0,0 +1,120 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/chukfi/backend/database/schema"
+	"github.com/chukfi/backend/src/lib/media"
+	"github.com/chukfi/backend/src/lib/storage"
+)
+
+// Variant is a transformed copy of a media entry, cached in storage
+type Variant struct {
+	Key         string
+	ContentType string
+	// ETag is unique for the source file + options, so it can be cached forever
+	ETag string
+}
+
+type inflightCall struct {
+	wg  sync.WaitGroup
+	err error
+}
+
+var (
+	inflight   = make(map[string]*inflightCall)
+	inflightMu sync.Mutex
+)
+
+// defaultFormat picks the output format when none was requested, keeping the source format if possible
+func defaultFormat(record *schema.Media) string {
+	format := strings.TrimPrefix(record.MimeType, "image/")
+	if canEncode(format) {
+		return format
+	}
+	return "png"
+}
+
+/*
+GetVariant returns the cached variant of the media entry for the options, creating it first if it
+does not exist yet. Concurrent requests for the same variant only transform the image once.
+*/
+func GetVariant(ctx context.Context, record *schema.Media, options Options) (*Variant, error) {
+	if !strings.HasPrefix(record.MimeType, "image/") {
+		return nil, ErrNotAnImage
+	}
+
+	if options.Format == "" {
+		options.Format = defaultFormat(record)
+	}
+	format := options.Format
+
+	hash := sha256.Sum256([]byte(record.Checksum + "|" + options.cacheKey()))
+	etag := hex.EncodeToString(hash[:])[:32]
+
+	variant := &Variant{
+		Key:         media.VariantPrefix(record.ID.String()) + etag + "." + format,
+		ContentType: ContentType(format),
+		ETag:        etag,
+	}
+
+	store := storage.GetStorage()
+	exists, err := store.Exists(ctx, variant.Key)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return variant, nil
+	}
+
+	inflightMu.Lock()
+	if call, ok := inflight[variant.Key]; ok {
+		inflightMu.Unlock()
+		call.wg.Wait()
+		return variant, call.err
+	}
+	call := &inflightCall{}
+	call.wg.Add(1)
+	inflight[variant.Key] = call
+	inflightMu.Unlock()
+
+	call.err = createVariant(ctx, record, options, variant)
+
+	inflightMu.Lock()
+	delete(inflight, variant.Key)
+	inflightMu.Unlock()
+	call.wg.Done()
+
+	return variant, call.err
+}
+
+func createVariant(ctx context.Context, record *schema.Media, options Options, variant *Variant) error {
+	source, err := media.Open(ctx, record)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	data, _, err := Transform(source, options, options.Format)
+	if err != nil {
+		return err
+	}
+
+	return storage.GetStorage().Put(ctx, variant.Key, bytes.NewReader(data), int64(len(data)), variant.ContentType)
+}
+
+// OpenVariant opens a cached variant for reading
+func OpenVariant(ctx context.Context, variant *Variant) (io.ReadCloser, error) {
+	reader, err := storage.GetStorage().Get(ctx, variant.Key)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return nil, errors.New("variant disappeared from storage")
+	}
+	return reader, err
+}
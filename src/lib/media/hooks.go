@@ -0,0 +1,89 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/chukfi/backend/database/schema"
+	"github.com/chukfi/backend/src/lib/events"
+	"github.com/chukfi/backend/src/lib/permissions"
+	"github.com/chukfi/backend/src/lib/policy"
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+	"gorm.io/gorm"
+)
+
+// collection is the collection of the media entries
+var collection = schema.Media{}.TableName()
+
+var registerHooks sync.Once
+
+/*
+privateMediaRule keeps private media entries from users who can't read media (media.read or ViewModels). It is a
+policy rule so every read of the collection api (get, search, the change feed, graphql, realtime) leaves them out
+*/
+var privateMediaRule = policy.Rule{
+	Name:        "private-media",
+	Description: "private media is only readable with media.read",
+	Effect:      policy.Deny,
+	Actions:     []string{permissions.ActionRead},
+	Collections: []string{collection},
+	When:        []policy.Condition{{Attribute: "entry.private", Op: policy.OpIn, Value: []interface{}{true, 1}}},
+	Match: func(ctx context.Context, request policy.Request) bool {
+		return !permissions.HasCollectionPermission(request.Subject.Permissions, collection, permissions.ActionRead) &&
+			!permissions.HasPermission(request.Subject.Permissions, permissions.Administrator)
+	},
+}
+
+/*
+RegisterHooks makes the collection api follow the rules of the media library: private media is only readable by
+users who can read media and deleting an entry is refused while it is referenced, the stored file and its variants
+are removed once the delete is published (like Delete, after it committed). Registering more than once does nothing
+*/
+func RegisterHooks(database *gorm.DB) error {
+	var err error
+	registerHooks.Do(func() {
+		if err = policy.AddRule(privateMediaRule); err != nil {
+			return
+		}
+		schemaregistry.RegisterHook(collection, schemaregistry.BeforeDelete, checkReferencesHook)
+		events.Subscribe(func(event events.Event) {
+			if event.Type == events.EventDelete && event.Collection == collection {
+				go removeDeletedFiles(database, event.ID)
+			}
+		})
+	})
+	return err
+}
+
+func checkReferencesHook(hook *schemaregistry.HookContext) error {
+	references, err := lockedReferences(hook.Context, hook.Tx, hook.ID)
+	if err != nil {
+		return err
+	}
+	if len(references) > 0 {
+		return &schemaregistry.HookError{
+			Status:  http.StatusConflict,
+			Message: "Media is still referenced by other entries",
+			Details: map[string]interface{}{"references": references},
+		}
+	}
+	return nil
+}
+
+// removeDeletedFiles removes the files of a deleted media entry, deletes are only published once they committed
+func removeDeletedFiles(database *gorm.DB, id string) {
+	ctx := context.Background()
+	record, err := gorm.G[schema.Media](database.Unscoped()).Where("id = ? AND deleted_at IS NOT NULL", id).First(ctx)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return
+	}
+	if err == nil {
+		err = removeFiles(ctx, &record)
+	}
+	if err != nil {
+		fmt.Printf("media: failed to remove the files of %s: %v\n", id, err)
+	}
+}
@@ -0,0 +1,328 @@
+package media
+
+// media library, turns uploaded files into schema.Media records with the file kept in storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/chukfi/backend/database/schema"
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+	"github.com/chukfi/backend/src/lib/storage"
+	uuid "github.com/satori/go.uuid"
+	_ "golang.org/x/image/webp"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// how much of the start of a file is kept around to read image dimensions from
+	dimensionPrefixSize = 1 << 20
+	// the option used to mark a field as referencing a media entry: chukfi:"media"
+	referenceOption = "media"
+)
+
+var (
+	ErrMediaNotFound = errors.New("media not found")
+	ErrMediaInUse    = errors.New("media is still referenced")
+	// returned by Ingest for files a browser would run script from, like html and svg
+	ErrMediaTypeNotAllowed = errors.New("media type not allowed")
+)
+
+// activeTypes run script when a browser opens them, they are refused on upload
+var activeTypes = []string{
+	"text/html", "application/xhtml+xml", "image/svg+xml", "text/xml", "application/xml", "text/xsl",
+	"text/javascript", "application/javascript", "application/x-javascript", "application/ecmascript",
+}
+
+// inlineTypes are shown in the browser when served, every other type is sent as a download
+var inlineTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp", "image/avif", "image/bmp", "application/pdf",
+}
+
+// Reference is a collection entry that points at a media entry
+type Reference struct {
+	Collection string `json:"collection"`
+	Field      string `json:"field"`
+	ID         string `json:"id"`
+}
+
+// prefixWriter keeps the first limit bytes written to it and discards the rest
+type prefixWriter struct {
+	buffer bytes.Buffer
+	limit  int
+}
+
+func (p *prefixWriter) Write(data []byte) (int, error) {
+	if remaining := p.limit - p.buffer.Len(); remaining > 0 {
+		p.buffer.Write(data[:min(len(data), remaining)])
+	}
+	return len(data), nil
+}
+
+/*
+Ingest streams the reader into storage and creates the media record for it.
+The mime type is sniffed from the content (falling back to the file extension),
+the checksum and size are calculated while streaming and image dimensions are read for images.
+size may be -1 if unknown. private media is only served through signed urls or to users who can view models.
+*/
+func Ingest(ctx context.Context, database *gorm.DB, reader io.Reader, size int64, filename string, altText string, uploadedBy string, private bool) (*schema.Media, error) {
+	buffered := bufio.NewReaderSize(reader, 512)
+	head, err := buffered.Peek(512)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+
+	mimeType := DetectMimeType(head, filename)
+	if IsActiveType(mimeType) {
+		return nil, fmt.Errorf("%w: %s", ErrMediaTypeNotAllowed, mimeType)
+	}
+
+	id := uuid.NewV4()
+	key := "media/" + id.String() + strings.ToLower(filepath.Ext(filename))
+
+	hasher := sha256.New()
+	prefix := &prefixWriter{limit: dimensionPrefixSize}
+	counter := &countingWriter{}
+	tee := io.TeeReader(buffered, io.MultiWriter(hasher, prefix, counter))
+
+	store := storage.GetStorage()
+	if err := store.Put(ctx, key, tee, size, mimeType); err != nil {
+		return nil, fmt.Errorf("failed to store file: %w", err)
+	}
+
+	record := schema.Media{
+		Filename:   filepath.Base(filename),
+		MimeType:   mimeType,
+		Size:       counter.count,
+		Checksum:   hex.EncodeToString(hasher.Sum(nil)),
+		AltText:    altText,
+		StorageKey: key,
+		UploadedBy: uploadedBy,
+		Private:    private,
+	}
+
+	if strings.HasPrefix(mimeType, "image/") {
+		if config, _, err := image.DecodeConfig(bytes.NewReader(prefix.buffer.Bytes())); err == nil {
+			record.Width = config.Width
+			record.Height = config.Height
+		}
+	}
+
+	if err := gorm.G[schema.Media](database).Create(ctx, &record); err != nil {
+		store.Delete(ctx, key)
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+type countingWriter struct {
+	count int64
+}
+
+func (c *countingWriter) Write(data []byte) (int, error) {
+	c.count += int64(len(data))
+	return len(data), nil
+}
+
+// DetectMimeType sniffs the mime type from the start of the file, using the extension when sniffing is inconclusive
+func DetectMimeType(head []byte, filename string) string {
+	detected := http.DetectContentType(head)
+
+	if detected == "application/octet-stream" || strings.HasPrefix(detected, "text/plain") {
+		if byExtension := mime.TypeByExtension(strings.ToLower(filepath.Ext(filename))); byExtension != "" {
+			return byExtension
+		}
+	}
+
+	return detected
+}
+
+// baseType strips the parameters (charset etc) of a mime type
+func baseType(mimeType string) string {
+	if mediaType, _, err := mime.ParseMediaType(mimeType); err == nil {
+		return mediaType
+	}
+	return strings.ToLower(strings.TrimSpace(mimeType))
+}
+
+// IsActiveType checks if a browser could run script from a file of the mime type (html, svg, xml, javascript)
+func IsActiveType(mimeType string) bool {
+	base := baseType(mimeType)
+	return slices.Contains(activeTypes, base) || strings.HasSuffix(base, "+xml")
+}
+
+// IsInlineType checks if files of the mime type are safe to show in the browser: raster images, video, audio and pdf
+func IsInlineType(mimeType string) bool {
+	base := baseType(mimeType)
+	return slices.Contains(inlineTypes, base) || strings.HasPrefix(base, "video/") || strings.HasPrefix(base, "audio/")
+}
+
+// VariantPrefix is where transformed copies (thumbnails etc) of a media entry are stored
+func VariantPrefix(mediaID string) string {
+	return "variants/" + mediaID + "/"
+}
+
+// Get finds a media entry by its ID
+func Get(ctx context.Context, database *gorm.DB, id string) (*schema.Media, error) {
+	record, err := gorm.G[schema.Media](database).Where("id = ?", id).First(ctx)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrMediaNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// Open opens the stored file of a media entry
+func Open(ctx context.Context, record *schema.Media) (io.ReadCloser, error) {
+	return storage.GetStorage().Get(ctx, record.StorageKey)
+}
+
+/*
+Delete removes the media entry and its file. It refuses with ErrMediaInUse (and the references)
+while any collection entry still points at it. The references are checked in the transaction of the delete,
+the file is only removed once it committed.
+*/
+func Delete(ctx context.Context, database *gorm.DB, record *schema.Media) ([]Reference, error) {
+	var references []Reference
+	err := database.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		if references, err = lockedReferences(ctx, tx, record.ID.String()); err != nil {
+			return err
+		}
+		if len(references) > 0 {
+			return ErrMediaInUse
+		}
+
+		_, err = gorm.G[schema.Media](tx).Where("id = ?", record.ID).Delete(ctx)
+		return err
+	})
+	if errors.Is(err, ErrMediaInUse) {
+		return references, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, removeFiles(ctx, record)
+}
+
+/*
+lockedReferences locks the media entry for the rest of the transaction and finds its references. Writes referencing
+it wait for the lock (see ValidateReferences), so none is added between the check and the delete
+*/
+func lockedReferences(ctx context.Context, tx *gorm.DB, mediaID string) ([]Reference, error) {
+	var ids []string
+	if err := tx.WithContext(ctx).Model(&schema.Media{}).Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("id = ?", mediaID).Pluck("id", &ids).Error; err != nil {
+		return nil, err
+	}
+	return FindReferences(tx, mediaID)
+}
+
+// removeFiles removes the stored file of a media entry and its variants
+func removeFiles(ctx context.Context, record *schema.Media) error {
+	store := storage.GetStorage()
+	if err := store.Delete(ctx, record.StorageKey); err != nil {
+		return fmt.Errorf("media entry deleted but removing the file failed: %w", err)
+	}
+
+	// variants are only a cache, failing to clean them up isnt worth failing the delete over
+	if variants, err := store.List(ctx, VariantPrefix(record.ID.String())); err == nil {
+		for _, key := range variants {
+			store.Delete(ctx, key)
+		}
+	}
+	return nil
+}
+
+// MediaFields returns the fields of a collection that reference media entries
+func MediaFields(tableName string) []schemaregistry.FieldMetadata {
+	fields, _ := schemaregistry.GetFields(tableName)
+
+	var mediaFields []schemaregistry.FieldMetadata
+	for _, field := range fields {
+		if field.HasOption(referenceOption) {
+			mediaFields = append(mediaFields, field)
+		}
+	}
+	return mediaFields
+}
+
+// FindReferences finds every collection entry that references the media entry
+func FindReferences(database *gorm.DB, mediaID string) ([]Reference, error) {
+	var references []Reference
+
+	for tableName := range schemaregistry.GetAllRegisteredSchemas() {
+		for _, field := range MediaFields(tableName) {
+			query := database.Table(tableName).Select("id").Where(field.Column+" = ?", mediaID)
+			if schemaregistry.HasSoftDelete(tableName) {
+				query = query.Where("deleted_at IS NULL")
+			}
+
+			var ids []string
+			if err := query.Pluck("id", &ids).Error; err != nil {
+				return nil, err
+			}
+
+			for _, id := range ids {
+				references = append(references, Reference{Collection: tableName, Field: field.Name, ID: id})
+			}
+		}
+	}
+
+	return references, nil
+}
+
+/*
+ValidateReferences checks that every media field in the body points at an existing media entry.
+Empty values are allowed (the field is just not set). Run it in the transaction of the write, the referenced
+entries stay locked until it commits so they can't be deleted in the meantime.
+*/
+func ValidateReferences(ctx context.Context, database *gorm.DB, tableName string, body map[string]interface{}) error {
+	for _, field := range MediaFields(tableName) {
+		value, exists := body[field.Name]
+		if !exists {
+			value, exists = body[field.Column]
+		}
+		if !exists || value == nil || value == "" {
+			continue
+		}
+
+		id, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a media ID", field.Name)
+		}
+		if _, err := uuid.FromString(id); err != nil {
+			return fmt.Errorf("%s must be a media ID: %w", field.Name, err)
+		}
+
+		_, err := gorm.G[schema.Media](database.Clauses(clause.Locking{Strength: "SHARE"})).Where("id = ?", id).First(ctx)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("%s references media %s which does not exist", field.Name, id)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
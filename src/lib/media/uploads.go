@@ -0,0 +1,338 @@
+package media
+
+// resumable uploads, the state lives in the database and every received chunk is its own object
+// in storage, so an upload can continue after the server restarts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/chukfi/backend/database/schema"
+	"github.com/chukfi/backend/src/lib/storage"
+	"gorm.io/gorm"
+)
+
+// UploadExpiry is how long an upload may sit without receiving data before it is thrown away
+var UploadExpiry = 24 * time.Hour
+
+// CompletionLease is how long a request completing an upload holds it, after that a new attempt may take over
+var CompletionLease = 10 * time.Minute
+
+var (
+	ErrUploadNotFound       = errors.New("upload not found")
+	ErrUploadOffsetMismatch = errors.New("upload offset does not match")
+	ErrUploadTooLarge       = errors.New("upload is larger than its declared length")
+	ErrUploadComplete       = errors.New("upload is already complete")
+	ErrUploadCompleting     = errors.New("upload is being completed by another request")
+)
+
+// chunkPrefix is where the chunks of an upload are stored
+func chunkPrefix(uploadID string) string {
+	return "uploads/" + uploadID + "/"
+}
+
+func chunkKey(uploadID string, offset int64) string {
+	// zero padded so the keys sort in upload order
+	return fmt.Sprintf("%s%020d", chunkPrefix(uploadID), offset)
+}
+
+// CreateUpload starts a new resumable upload of length bytes
+func CreateUpload(ctx context.Context, database *gorm.DB, length int64, filename string, altText string, uploadedBy string, private bool) (*schema.MediaUpload, error) {
+	upload := schema.MediaUpload{
+		UploadLength: length,
+		Filename:     filename,
+		AltText:      altText,
+		UploadedBy:   uploadedBy,
+		Private:      private,
+		ExpiresAt:    time.Now().Add(UploadExpiry).Unix(),
+	}
+
+	if err := gorm.G[schema.MediaUpload](database).Create(ctx, &upload); err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// GetUpload finds an upload that has not expired
+func GetUpload(ctx context.Context, database *gorm.DB, id string) (*schema.MediaUpload, error) {
+	upload, err := gorm.G[schema.MediaUpload](database).Where("id = ? AND expires_at > ?", id, time.Now().Unix()).First(ctx)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+/*
+WriteChunk appends the reader to the upload at offset, which has to be the current offset.
+Whatever arrives before the connection drops is kept, so the client can resume from the new offset.
+When the last byte arrives the upload is completed and the media entry is created.
+*/
+func WriteChunk(ctx context.Context, database *gorm.DB, upload *schema.MediaUpload, offset int64, reader io.Reader) error {
+	// the client going away cancels the request context, but what did arrive still has to be saved
+	ctx = context.WithoutCancel(ctx)
+
+	if upload.MediaID != "" {
+		return ErrUploadComplete
+	}
+	if offset != upload.UploadOffset {
+		return ErrUploadOffsetMismatch
+	}
+
+	remaining := upload.UploadLength - upload.UploadOffset
+
+	// spool to disk first, so a dropped connection still leaves us with the part that did arrive
+	tmp, err := os.CreateTemp("", "chukfi-chunk-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	// read one byte past the end to notice clients sending more than they declared
+	received, readErr := io.Copy(tmp, io.LimitReader(reader, remaining+1))
+	if received > remaining {
+		return ErrUploadTooLarge
+	}
+
+	if received > 0 {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+
+		key := chunkKey(upload.ID.String(), offset)
+		if err := storage.GetStorage().Put(ctx, key, tmp, received, "application/octet-stream"); err != nil {
+			return err
+		}
+
+		// only move the offset if nobody else wrote this chunk in the meantime
+		result := database.WithContext(ctx).Model(&schema.MediaUpload{}).
+			Where("id = ? AND upload_offset = ?", upload.ID, offset).
+			Updates(map[string]interface{}{
+				"upload_offset": offset + received,
+				"expires_at":    time.Now().Add(UploadExpiry).Unix(),
+				"updated_at":    time.Now(),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			storage.GetStorage().Delete(ctx, key)
+			return ErrUploadOffsetMismatch
+		}
+
+		upload.UploadOffset = offset + received
+	}
+
+	if readErr != nil {
+		return readErr
+	}
+
+	if upload.UploadOffset == upload.UploadLength {
+		// every byte is saved, if another request is completing the upload the client sees it with HEAD
+		if _, err := CompleteUpload(ctx, database, upload); err != nil && !errors.Is(err, ErrUploadCompleting) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+CompleteUpload joins the chunks of a fully received upload into a media entry and removes the chunks.
+It is safe to call again if a previous attempt failed half way. Only one request completes an upload at a time,
+the others get ErrUploadCompleting
+*/
+func CompleteUpload(ctx context.Context, database *gorm.DB, upload *schema.MediaUpload) (*schema.Media, error) {
+	if upload.MediaID != "" {
+		return Get(ctx, database, upload.MediaID)
+	}
+	if upload.UploadOffset != upload.UploadLength {
+		return nil, ErrUploadOffsetMismatch
+	}
+
+	claimed, err := claimUpload(ctx, database, upload)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return Get(ctx, database, upload.MediaID)
+	}
+
+	record, err := ingestUpload(ctx, database, upload)
+	if err != nil {
+		// let the next attempt take over right away
+		database.WithContext(ctx).Model(&schema.MediaUpload{}).Where("id = ?", upload.ID).Update("completing_until", 0)
+		return nil, err
+	}
+	return record, nil
+}
+
+/*
+claimUpload takes the lease on completing the upload. If another request holds it (or already completed the upload)
+the upload is reloaded: the media entry is then set on it, or ErrUploadCompleting is returned
+*/
+func claimUpload(ctx context.Context, database *gorm.DB, upload *schema.MediaUpload) (bool, error) {
+	now := time.Now()
+	result := database.WithContext(ctx).Model(&schema.MediaUpload{}).
+		Where("id = ? AND (media_id = '' OR media_id IS NULL) AND completing_until < ?", upload.ID, now.Unix()).
+		Update("completing_until", now.Add(CompletionLease).Unix())
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected > 0 {
+		return true, nil
+	}
+
+	current, err := gorm.G[schema.MediaUpload](database).Where("id = ?", upload.ID).First(ctx)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, ErrUploadNotFound
+	}
+	if err != nil {
+		return false, err
+	}
+	*upload = current
+	if upload.MediaID == "" {
+		return false, ErrUploadCompleting
+	}
+	return false, nil
+}
+
+// ingestUpload turns the chunks of a claimed upload into a media entry
+func ingestUpload(ctx context.Context, database *gorm.DB, upload *schema.MediaUpload) (*schema.Media, error) {
+	store := storage.GetStorage()
+	keys, err := store.List(ctx, chunkPrefix(upload.ID.String()))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+
+	reader := &chunkReader{ctx: ctx, store: store, keys: keys}
+	defer reader.Close()
+
+	record, err := Ingest(ctx, database, reader, upload.UploadLength, upload.Filename, upload.AltText, upload.UploadedBy, upload.Private)
+	if err != nil {
+		return nil, err
+	}
+
+	// the lease may have run out while ingesting, only the first attempt to finish keeps its entry
+	result := database.WithContext(ctx).Model(&schema.MediaUpload{}).
+		Where("id = ? AND (media_id = '' OR media_id IS NULL)", upload.ID).
+		Updates(map[string]interface{}{"media_id": record.ID.String(), "completing_until": 0})
+	if result.Error != nil || result.RowsAffected == 0 {
+		database.WithContext(ctx).Unscoped().Where("id = ?", record.ID).Delete(&schema.Media{})
+		store.Delete(ctx, record.StorageKey)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		return nil, ErrUploadCompleting
+	}
+	upload.MediaID = record.ID.String()
+
+	for _, key := range keys {
+		store.Delete(ctx, key)
+	}
+
+	return record, nil
+}
+
+// TerminateUpload throws away an upload and everything received so far
+func TerminateUpload(ctx context.Context, database *gorm.DB, upload *schema.MediaUpload) error {
+	store := storage.GetStorage()
+	keys, err := store.List(ctx, chunkPrefix(upload.ID.String()))
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := store.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	return database.WithContext(ctx).Unscoped().Where("id = ?", upload.ID).Delete(&schema.MediaUpload{}).Error
+}
+
+// CleanupExpiredUploads removes every upload that has expired, returns how many were removed
+func CleanupExpiredUploads(ctx context.Context, database *gorm.DB) (int, error) {
+	expired, err := gorm.G[schema.MediaUpload](database).Where("expires_at <= ?", time.Now().Unix()).Find(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, upload := range expired {
+		if err := TerminateUpload(ctx, database, &upload); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+var janitorOnce sync.Once
+
+// StartUploadJanitor removes expired uploads every interval in the background, only the first call does anything
+func StartUploadJanitor(database *gorm.DB, interval time.Duration) {
+	janitorOnce.Do(func() {
+		go func() {
+			for {
+				if removed, err := CleanupExpiredUploads(context.Background(), database); err != nil {
+					fmt.Println("media: failed to clean up expired uploads:", err)
+				} else if removed > 0 {
+					fmt.Printf("media: removed %d expired uploads\n", removed)
+				}
+				time.Sleep(interval)
+			}
+		}()
+	})
+}
+
+// chunkReader reads the chunks one after the other, only opening a chunk once it is needed
+type chunkReader struct {
+	ctx     context.Context
+	store   storage.Storage
+	keys    []string
+	current io.ReadCloser
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.current == nil {
+			if len(c.keys) == 0 {
+				return 0, io.EOF
+			}
+			next, err := c.store.Get(c.ctx, c.keys[0])
+			if err != nil {
+				return 0, err
+			}
+			c.current = next
+			c.keys = c.keys[1:]
+		}
+
+		n, err := c.current.Read(p)
+		if err == io.EOF {
+			c.current.Close()
+			c.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *chunkReader) Close() error {
+	if c.current != nil {
+		return c.current.Close()
+	}
+	return nil
+}
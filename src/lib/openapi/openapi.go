@@ -0,0 +1,316 @@
+package openapi
+
+// the types of an openapi 3.1 document and the component schemas generated from the schemaregistry,
+// the paths are described by the router which knows its routes
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+)
+
+const Version = "3.1.0"
+
+type Document struct {
+	OpenAPI    string               `json:"openapi"`
+	Info       Info                 `json:"info"`
+	Servers    []Server             `json:"servers,omitempty"`
+	Tags       []Tag                `json:"tags,omitempty"`
+	Paths      map[string]*PathItem `json:"paths"`
+	Components Components           `json:"components"`
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type Server struct {
+	URL string `json:"url"`
+}
+
+type Tag struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// PathItem holds the operations of a path by lowercase method
+type PathItem map[string]*Operation
+
+type Operation struct {
+	OperationID string                `json:"operationId"`
+	Summary     string                `json:"summary,omitempty"`
+	Description string                `json:"description,omitempty"`
+	Tags        []string              `json:"tags,omitempty"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*Response  `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"` // path, query, header or cookie
+	Required    bool    `json:"required,omitempty"`
+	Description string  `json:"description,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required,omitempty"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema         `json:"schemas"`
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type SecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme,omitempty"`
+	In           string `json:"in,omitempty"`
+	Name         string `json:"name,omitempty"`
+	Description  string `json:"description,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+}
+
+/*
+Schema is a json schema (the 2020-12 dialect openapi 3.1 uses), Type is a string or a list of them,
+e.g []string{"string", "null"} for a nullable string
+*/
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 interface{}        `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	ReadOnly             bool               `json:"readOnly,omitempty"`
+	WriteOnly            bool               `json:"writeOnly,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+}
+
+// Ref returns a schema pointing at a component schema
+func Ref(name string) *Schema {
+	return &Schema{Ref: "#/components/schemas/" + name}
+}
+
+// JSON returns the content of a json request or response body with the schema
+func JSON(schema *Schema) map[string]MediaType {
+	return map[string]MediaType{"application/json": {Schema: schema}}
+}
+
+// New creates an empty document with the auth schemes of chukfi
+func New(info Info) *Document {
+	return &Document{
+		OpenAPI: Version,
+		Info:    info,
+		Paths:   make(map[string]*PathItem),
+		Components: Components{
+			Schemas: map[string]*Schema{
+				"Error": {
+					Type: "object",
+					Properties: map[string]*Schema{
+						"error":   {Type: "string"},
+						"code":    {Type: "integer"},
+						"details": {Description: "Extra information, e.g which fields were invalid"},
+					},
+					Required: []string{"error"},
+				},
+			},
+			SecuritySchemes: map[string]*SecurityScheme{
+				"bearerAuth": {Type: "http", Scheme: "bearer", Description: "The token returned by /admin/auth/login"},
+				"cookieAuth": {Type: "apiKey", In: "cookie", Name: "chukfi_auth_token", Description: "Set by /admin/auth/login"},
+				"apiKey":     {Type: "apiKey", In: "header", Name: "X-API-Key", Description: "A key of the content delivery api, created at /admin/apikeys/create"},
+			},
+		},
+	}
+}
+
+// Add adds an operation, replacing one already there for the path and method
+func (d *Document) Add(method string, path string, operation *Operation) {
+	item, ok := d.Paths[path]
+	if !ok {
+		item = &PathItem{}
+		d.Paths[path] = item
+	}
+	(*item)[strings.ToLower(method)] = operation
+}
+
+// AddTag adds a tag once, in the order tags are added
+func (d *Document) AddTag(name string, description string) {
+	for _, tag := range d.Tags {
+		if tag.Name == name {
+			return
+		}
+	}
+	d.Tags = append(d.Tags, Tag{Name: name, Description: description})
+}
+
+// PascalCase joins the words of a name, e.g api_keys -> ApiKeys
+func PascalCase(name string) string {
+	var sb strings.Builder
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		runes := []rune(part)
+		runes[0] = unicode.ToUpper(runes[0])
+		sb.WriteString(string(runes))
+	}
+	return sb.String()
+}
+
+// TypeName is the name of the component schemas of a collection, e.g api_keys -> ApiKey
+func TypeName(tableName string) string {
+	return PascalCase(schemaregistry.SingularName(tableName))
+}
+
+// fieldSchema maps the go type of a field to a json schema type
+func fieldSchema(field schemaregistry.FieldMetadata) *Schema {
+	goType := strings.TrimPrefix(field.Type, "*")
+	schema := &Schema{}
+
+	switch {
+	case goType == "uuid.UUID":
+		schema.Type, schema.Format = "string", "uuid"
+	case goType == "string", goType == "sql.NullString":
+		schema.Type = "string"
+	case goType == "permissions.Permission":
+		schema.Type, schema.Description = "string", "Bitset of permissions as a decimal number"
+	case goType == "bool", goType == "sql.NullBool":
+		schema.Type = "boolean"
+	case goType == "float32", goType == "float64", goType == "sql.NullFloat64":
+		schema.Type = "number"
+	case goType == "int8", goType == "int16", goType == "int32", goType == "uint8", goType == "uint16", goType == "sql.NullInt16", goType == "sql.NullInt32":
+		schema.Type, schema.Format = "integer", "int32"
+	case goType == "int", goType == "int64", goType == "uint", goType == "uint32", goType == "uint64", goType == "sql.NullInt64":
+		schema.Type, schema.Format = "integer", "int64"
+	case goType == "time.Time", goType == "sql.NullTime", goType == "gorm.DeletedAt":
+		schema.Type, schema.Format = "string", "date-time"
+	case strings.HasPrefix(goType, "[]"):
+		schema.Type = "array"
+	case strings.HasPrefix(goType, "map["):
+		schema.Type = "object"
+	}
+
+	if field.PrimaryKey && schema.Type == "string" {
+		schema.Format = "uuid"
+	}
+	if field.HasOption("media") {
+		schema.Description = "ID of a media entry"
+	} else if ref, ok := field.Option("ref"); ok {
+		schema.Description = "ID of an entry of " + ref
+	}
+	return schema
+}
+
+// nullable allows null next to the type of the schema
+func nullable(schema *Schema) *Schema {
+	if typeName, ok := schema.Type.(string); ok {
+		schema.Type = []string{typeName, "null"}
+	}
+	return schema
+}
+
+// isServerSet is true for the fields the server fills in itself
+func isServerSet(field schemaregistry.FieldMetadata) bool {
+	switch field.Column {
+	case "created_at", "updated_at", "deleted_at":
+		return true
+	}
+	return field.PrimaryKey || field.ReadOnly
+}
+
+/*
+AddCollectionSchemas adds three component schemas for every collection:
+
+	Post        an entry as the api returns it, keyed by column (title, created_at...)
+	PostInput   the body of create, keyed by field name (Title...), required are the not null fields
+	PostUpdate  the body of update, the ID and any fields to change
+
+Write only fields are only in the input schemas, fields behind a read permission are never required in the entry.
+Admin only collections are only added with includeAdminOnly. Returns the table names added, sorted.
+*/
+func (d *Document) AddCollectionSchemas(includeAdminOnly bool) []string {
+	var tables []string
+	for table, meta := range schemaregistry.GetAllRegisteredSchemas() {
+		if meta.AdminOnly && !includeAdminOnly {
+			continue
+		}
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	for _, table := range tables {
+		meta, ok := schemaregistry.GetMetadata(table)
+		if !ok {
+			continue
+		}
+		name := TypeName(table)
+
+		entry := &Schema{Type: "object", Properties: map[string]*Schema{}}
+		input := &Schema{Type: "object", Properties: map[string]*Schema{}, AdditionalProperties: false}
+		update := &Schema{Type: "object", Properties: map[string]*Schema{}, AdditionalProperties: false}
+		if meta.AdminOnly {
+			entry.Description = "Admin only, reading it requires ViewModels or " + table + ".read"
+		}
+
+		for _, field := range meta.Fields {
+			if !field.WriteOnly {
+				schema := fieldSchema(field)
+				if (field.Required || field.PrimaryKey) && field.ReadPermission == "" {
+					entry.Required = append(entry.Required, field.Column)
+				} else {
+					schema = nullable(schema)
+				}
+				if field.ReadPermission != "" {
+					schema.Description = "Only returned to users with " + field.ReadPermission
+				}
+				schema.ReadOnly = isServerSet(field)
+				entry.Properties[field.Column] = schema
+			}
+
+			if field.PrimaryKey {
+				update.Properties[field.Name] = fieldSchema(field)
+				update.Required = append(update.Required, field.Name)
+				continue
+			}
+			if isServerSet(field) {
+				continue
+			}
+			// the owner defaults to the user creating the entry
+			owner := field.HasOption("owner")
+			if field.Required && !owner {
+				input.Required = append(input.Required, field.Name)
+				input.Properties[field.Name] = fieldSchema(field)
+			} else {
+				input.Properties[field.Name] = nullable(fieldSchema(field))
+			}
+			if owner {
+				input.Properties[field.Name].Description = "The owner, defaults to the user creating the entry. Only users with " + table + ".all can set someone else"
+			}
+			input.Properties[field.Name].WriteOnly = field.WriteOnly
+			update.Properties[field.Name] = input.Properties[field.Name]
+		}
+
+		d.Components.Schemas[name] = entry
+		d.Components.Schemas[name+"Input"] = input
+		d.Components.Schemas[name+"Update"] = update
+	}
+	return tables
+}
@@ -0,0 +1,148 @@
+package permissions
+
+// Permission is a bitset without a fixed size: the builtin permissions are the first bits, every custom permission
+// gets the next one. It is stored as the decimal number of the bits, so the bigint columns of before (at most 64
+// bits) read the same after they are changed to the string column
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// Permission is a set of permissions, the zero value has none. Permissions are comparable, equal sets are ==
+type Permission struct {
+	bits string // big endian bytes of the number, without leading zeros
+}
+
+// Bit returns the permission of the bit at position
+func Bit(position uint) Permission {
+	return fromInt(new(big.Int).SetBit(new(big.Int), int(position), 1))
+}
+
+// FromUint64 returns the permissions of a bitmask of before the bitset, e.g from an old bigint column
+func FromUint64(mask uint64) Permission {
+	return fromInt(new(big.Int).SetUint64(mask))
+}
+
+// ParsePermission parses the decimal number of a Permission (see String)
+func ParsePermission(value string) (Permission, error) {
+	number, ok := new(big.Int).SetString(value, 10)
+	if !ok || number.Sign() < 0 {
+		return Permission{}, fmt.Errorf("invalid permission bitset %q", value)
+	}
+	return fromInt(number), nil
+}
+
+func fromInt(number *big.Int) Permission {
+	return Permission{bits: string(number.Bytes())}
+}
+
+func (p Permission) int() *big.Int {
+	return new(big.Int).SetBytes([]byte(p.bits))
+}
+
+// Union returns the permissions of p and all others
+func (p Permission) Union(others ...Permission) Permission {
+	combined := p.int()
+	for _, other := range others {
+		combined.Or(combined, other.int())
+	}
+	return fromInt(combined)
+}
+
+// Intersect returns the permissions both p and other have
+func (p Permission) Intersect(other Permission) Permission {
+	return fromInt(new(big.Int).And(p.int(), other.int()))
+}
+
+// Without returns p without the permissions of other
+func (p Permission) Without(other Permission) Permission {
+	return fromInt(new(big.Int).AndNot(p.int(), other.int()))
+}
+
+// Contains checks p has every permission of other, unlike HasPermission Administrator doesn't include everything
+func (p Permission) Contains(other Permission) bool {
+	return p.Intersect(other) == other
+}
+
+// IsZero checks p has no permissions
+func (p Permission) IsZero() bool {
+	return p.bits == ""
+}
+
+// Bits returns the positions of the bits of p, lowest first
+func (p Permission) Bits() []uint {
+	number := p.int()
+	var positions []uint
+	for position := 0; position < number.BitLen(); position++ {
+		if number.Bit(position) == 1 {
+			positions = append(positions, uint(position))
+		}
+	}
+	return positions
+}
+
+// String returns the decimal number of the bits, e.g "5" for ViewDashboard and ViewUsers
+func (p Permission) String() string {
+	return p.int().String()
+}
+
+// Value stores the permissions as their decimal number
+func (p Permission) Value() (driver.Value, error) {
+	return p.String(), nil
+}
+
+// Scan reads the permissions from the string column, or from a bigint column not migrated yet
+func (p *Permission) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*p = Permission{}
+	case int64:
+		if v < 0 {
+			return fmt.Errorf("invalid permission bitset %d", v)
+		}
+		*p = FromUint64(uint64(v))
+	case uint64:
+		*p = FromUint64(v)
+	case []byte:
+		return p.Scan(string(v))
+	case string:
+		parsed, err := ParsePermission(v)
+		if err != nil {
+			return err
+		}
+		*p = parsed
+	default:
+		return fmt.Errorf("cannot scan %T into a permission bitset", value)
+	}
+	return nil
+}
+
+// MarshalJSON sends the permissions as a string of their decimal number, json numbers lose bits past 2^53
+func (p Permission) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+// UnmarshalJSON reads the decimal number as a string, or as a number like the bitmask of before
+func (p *Permission) UnmarshalJSON(data []byte) error {
+	var value string
+	if len(data) > 0 && data[0] == '"' {
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+	} else {
+		value = string(data)
+		if value == "null" {
+			*p = Permission{}
+			return nil
+		}
+	}
+	parsed, err := ParsePermission(value)
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
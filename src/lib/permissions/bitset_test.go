@@ -0,0 +1,188 @@
+package permissions
+
+import (
+	"encoding/json"
+	"math"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestPermissionRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		permission Permission
+		decimal    string
+	}{
+		{"none", Permission{}, "0"},
+		{"first bit", Bit(0), "1"},
+		{"builtin", ViewDashboard.Union(ViewUsers), "5"},
+		{"last bit of a bigint", Bit(63), "9223372036854775808"},
+		{"past a bigint", Bit(64), "18446744073709551616"},
+		{"far custom bit", Bit(200).Union(Administrator), "1606938044258990275541962092341162602522202993782792835301408"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.permission.String(); got != test.decimal {
+				t.Fatalf("String() = %s, want %s", got, test.decimal)
+			}
+
+			parsed, err := ParsePermission(test.decimal)
+			if err != nil || parsed != test.permission {
+				t.Fatalf("ParsePermission(%s) = %v, %v", test.decimal, parsed, err)
+			}
+
+			value, err := test.permission.Value()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, stored := range []interface{}{value, []byte(value.(string))} {
+				var scanned Permission
+				if err := scanned.Scan(stored); err != nil || scanned != test.permission {
+					t.Fatalf("Scan(%#v) = %v, %v", stored, scanned, err)
+				}
+			}
+
+			encoded, err := json.Marshal(test.permission)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := strconv.Quote(test.decimal); string(encoded) != want {
+				t.Fatalf("MarshalJSON() = %s, want %s", encoded, want)
+			}
+			var decoded Permission
+			if err := json.Unmarshal(encoded, &decoded); err != nil || decoded != test.permission {
+				t.Fatalf("UnmarshalJSON(%s) = %v, %v", encoded, decoded, err)
+			}
+		})
+	}
+}
+
+// the bigint columns of before hold the bitmask as a number, they have to read the same after the migration
+func TestPermissionFromBigint(t *testing.T) {
+	tests := []struct {
+		name string
+		mask uint64
+		bits []uint
+	}{
+		{"none", 0, nil},
+		{"view dashboard", 1, []uint{0}},
+		{"basic user", 7, []uint{0, 1, 2}},
+		{"every builtin", 63, []uint{0, 1, 2, 3, 4, 5}},
+		{"custom permission", 1<<6 | 1<<40, []uint{6, 40}},
+		{"highest bit", 1 << 63, []uint{63}},
+		{"every bit", math.MaxUint64, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			migrated := FromUint64(test.mask)
+
+			if got, want := migrated.String(), strconv.FormatUint(test.mask, 10); got != want {
+				t.Fatalf("String() = %s, want the bigint %s", got, want)
+			}
+			if test.bits != nil && !slices.Equal(migrated.Bits(), test.bits) {
+				t.Fatalf("Bits() = %v, want %v", migrated.Bits(), test.bits)
+			}
+			if test.mask == math.MaxUint64 && len(migrated.Bits()) != 64 {
+				t.Fatalf("Bits() has %d bits, want 64", len(migrated.Bits()))
+			}
+
+			// an unmigrated bigint column scans as int64, a mysql unsigned one as uint64
+			if test.mask <= math.MaxInt64 {
+				var scanned Permission
+				if err := scanned.Scan(int64(test.mask)); err != nil || scanned != migrated {
+					t.Fatalf("Scan(int64) = %v, %v", scanned, err)
+				}
+			}
+			var scanned Permission
+			if err := scanned.Scan(test.mask); err != nil || scanned != migrated {
+				t.Fatalf("Scan(uint64) = %v, %v", scanned, err)
+			}
+
+			// clients of before send the bitmask as a json number
+			var decoded Permission
+			if err := json.Unmarshal([]byte(strconv.FormatUint(test.mask, 10)), &decoded); err != nil || decoded != migrated {
+				t.Fatalf("UnmarshalJSON(number) = %v, %v", decoded, err)
+			}
+		})
+	}
+}
+
+// HasPermission has to answer like the uint64 check of before: Administrator or every required bit
+func TestHasPermissionMatchesBitmask(t *testing.T) {
+	hasPermission := func(user uint64, required uint64) bool {
+		return user&(1<<5) != 0 || user&required == required
+	}
+
+	masks := []uint64{0, 1, 2, 3, 5, 7, 8, 15, 16, 31, 32, 33, 63, 64, 1 << 10, 1<<10 | 7, 1 << 63, 1<<63 | 1<<5, math.MaxUint64}
+	for _, user := range masks {
+		for _, required := range masks {
+			want := hasPermission(user, required)
+			if got := HasPermission(FromUint64(user), FromUint64(required)); got != want {
+				t.Errorf("HasPermission(%d, %d) = %v, want %v", user, required, got, want)
+			}
+		}
+	}
+}
+
+func TestPermissionSetOperations(t *testing.T) {
+	tests := []struct {
+		name string
+		got  Permission
+		want Permission
+	}{
+		{"union", Bit(0).Union(Bit(1), Bit(70)), FromUint64(3).Union(Bit(70))},
+		{"union with none", Bit(3).Union(Permission{}), Bit(3)},
+		{"intersect", FromUint64(7).Union(Bit(70)).Intersect(Bit(70).Union(Bit(1))), Bit(1).Union(Bit(70))},
+		{"intersect nothing in common", Bit(0).Intersect(Bit(100)), Permission{}},
+		{"without", FromUint64(7).Union(Bit(70)).Without(Bit(70).Union(Bit(0))), FromUint64(6)},
+		{"without the high bit leaves no leading zeros", Bit(0).Union(Bit(100)).Without(Bit(100)), Bit(0)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.got != test.want {
+				t.Fatalf("got %s, want %s", test.got, test.want)
+			}
+		})
+	}
+
+	if !Bit(0).Union(Bit(100)).Contains(Bit(100)) || Bit(0).Contains(Bit(100)) {
+		t.Fatal("Contains does not follow the bits")
+	}
+	if Administrator.Contains(ManageUsers) {
+		t.Fatal("Contains must not treat Administrator as every permission")
+	}
+	if !(Permission{}).IsZero() || !Bit(5).Without(Bit(5)).IsZero() || Bit(5).IsZero() {
+		t.Fatal("IsZero does not follow the bits")
+	}
+}
+
+func TestPermissionRejectsInvalidValues(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+	}{
+		{"negative bigint", int64(-1)},
+		{"negative decimal", "-5"},
+		{"not a number", "ViewModels"},
+		{"empty", ""},
+		{"float", 1.5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var scanned Permission
+			if err := scanned.Scan(test.value); err == nil {
+				t.Fatalf("Scan(%#v) = %v, want an error", test.value, scanned)
+			}
+		})
+	}
+
+	var decoded Permission
+	if err := json.Unmarshal([]byte(`"1e3"`), &decoded); err == nil {
+		t.Fatalf("UnmarshalJSON accepted 1e3 as %v", decoded)
+	}
+}
@@ -0,0 +1,59 @@
+package permissions
+
+// per collection permissions, every registered collection gets one for each action (posts.read, posts.update...).
+// the global permissions stay wildcards: ViewModels reads every collection, ManageModels writes every collection
+
+const (
+	ActionRead   = "read"
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+// CollectionActions are the actions every collection has a permission for
+var CollectionActions = []string{ActionRead, ActionCreate, ActionUpdate, ActionDelete}
+
+// ActionAll is the override of collections with an owner field (posts.all), it lets a user read and write every entry
+// instead of only their own. It is not one of the CollectionActions, ViewModels and ManageModels dont include it
+const ActionAll = "all"
+
+// CollectionPermissionName returns the name of the permission for an action on a collection, e.g posts.update
+func CollectionPermissionName(collection string, action string) string {
+	return collection + "." + action
+}
+
+// RegisterCollectionPermissions registers the permission of every action on the collection
+func RegisterCollectionPermissions(collection string) error {
+	for _, action := range CollectionActions {
+		if _, err := RegisterPermission(CollectionPermissionName(collection, action)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CollectionWildcard returns the global permission that allows the action on every collection
+func CollectionWildcard(action string) Permission {
+	if action == ActionRead {
+		return ViewModels
+	}
+	return ManageModels
+}
+
+// HasCollectionPermission checks if the userPermissions allow the action on the collection, through the wildcard or the permission of the collection
+func HasCollectionPermission(userPermissions Permission, collection string, action string) bool {
+	if HasPermission(userPermissions, CollectionWildcard(action)) {
+		return true
+	}
+	perm, ok := GetPermissionByName(CollectionPermissionName(collection, action))
+	return ok && HasPermission(userPermissions, perm)
+}
+
+// HasOwnerOverride checks if the userPermissions let the user read and write every entry of a collection with an owner field
+func HasOwnerOverride(userPermissions Permission, collection string) bool {
+	if HasPermission(userPermissions, Administrator) {
+		return true
+	}
+	perm, ok := GetPermissionByName(CollectionPermissionName(collection, ActionAll))
+	return ok && HasPermission(userPermissions, perm)
+}
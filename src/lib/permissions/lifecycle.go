@@ -0,0 +1,205 @@
+package permissions
+
+// what keeps the bits users hold in line with the registered permissions: unregistering a permission takes its bit
+// from every holder in the same transaction, so the bit can be given to a new permission without granting it to
+// anyone. Bits holders have without a permission (left by older versions) are flagged at startup and not reused
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// holders are the tables with a permissions column (schema.User, schema.Role)
+var holders = []string{"users", "roles"}
+
+// listeners are called when bits were taken from holders, see OnRevoke
+var listeners []func()
+
+// Inconsistency is a bit rows of a holder table have that no permission has
+type Inconsistency struct {
+	Table string `json:"table"`
+	Bit   uint   `json:"bit"`
+	Rows  int    `json:"rows"`
+}
+
+/*
+RegisterHolder adds a table with a permissions column (a Permission) and an id to the ones unregistering a permission takes its
+bit from. users and roles are holders already
+*/
+func RegisterHolder(table string) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if !slices.Contains(holders, table) {
+		holders = append(holders, table)
+	}
+}
+
+// OnRevoke adds a listener called after bits were taken from holders, e.g to drop cached users
+func OnRevoke(listener func()) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	listeners = append(listeners, listener)
+}
+
+// Inconsistencies returns the bits holders have without a permission, as found by the last check
+func Inconsistencies() []Inconsistency {
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	return slices.Clone(registry.inconsistencies)
+}
+
+type holderRow struct {
+	ID          string
+	Permissions Permission
+}
+
+// holderRows loads the permissions of every row of the holder tables that exist, soft deleted rows included
+func holderRows(tx *gorm.DB, table string, lock bool) ([]holderRow, error) {
+	if !tx.Migrator().HasTable(table) {
+		return nil, nil
+	}
+	query := tx.Table(table).Select("id", "permissions")
+	if lock {
+		query = query.Clauses(clause.Locking{Strength: "UPDATE"})
+	}
+	var rows []holderRow
+	err := query.Find(&rows).Error
+	return rows, err
+}
+
+// stripBits takes the bits from every holder row that has them
+func stripBits(tx *gorm.DB, bits Permission) error {
+	for _, table := range holders {
+		rows, err := holderRows(tx, table, true)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if row.Permissions.Intersect(bits).IsZero() {
+				continue
+			}
+			if err := tx.Table(table).Where("id = ?", row.ID).Update("permissions", row.Permissions.Without(bits)).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// unregisteredBits returns the bits of perms no permission has, the registry has to be locked
+func unregisteredBits(perms Permission) []uint {
+	var bits []uint
+	for _, bit := range perms.Bits() {
+		if _, registered := registry.permissionToName[Bit(bit)]; !registered {
+			bits = append(bits, bit)
+		}
+	}
+	return bits
+}
+
+// checkConsistency finds the bits holders have without a permission, the registry has to be locked
+func checkConsistency(db *gorm.DB) ([]Inconsistency, error) {
+	var found []Inconsistency
+	for _, table := range holders {
+		rows, err := holderRows(db, table, false)
+		if err != nil {
+			return nil, err
+		}
+
+		counts := map[uint]int{}
+		for _, row := range rows {
+			for _, bit := range unregisteredBits(row.Permissions) {
+				counts[bit]++
+			}
+		}
+		for bit, count := range counts {
+			found = append(found, Inconsistency{Table: table, Bit: bit, Rows: count})
+		}
+	}
+	slices.SortFunc(found, func(a, b Inconsistency) int {
+		return cmp.Or(cmp.Compare(a.Bit, b.Bit), strings.Compare(a.Table, b.Table))
+	})
+	return found, nil
+}
+
+// reserve keeps the bits of the inconsistencies from being given to a new permission, the registry has to be locked
+func reserve(inconsistencies []Inconsistency) {
+	registry.inconsistencies = inconsistencies
+	registry.reserved = make(map[uint]bool)
+	for _, inconsistency := range inconsistencies {
+		registry.reserved[inconsistency.Bit] = true
+	}
+}
+
+// freeBit returns the lowest bit no permission has and no holder has left over, the registry has to be locked
+func freeBit() uint {
+	used := make(map[uint]bool)
+	for perm := range registry.permissionToName {
+		for _, bit := range perm.Bits() {
+			used[bit] = true
+		}
+	}
+	for bit := uint(maxBuiltinBit); ; bit++ {
+		if !used[bit] && !registry.reserved[bit] {
+			return bit
+		}
+	}
+}
+
+// notifyRevoked calls the OnRevoke listeners, the registry has to be locked
+func notifyRevoked() {
+	for _, listener := range listeners {
+		listener()
+	}
+}
+
+/*
+StripUnregisteredBits takes the bits no permission has from every holder, in one transaction. Afterwards those bits
+can be given to new permissions again. It returns what was fixed
+*/
+func StripUnregisteredBits() ([]Inconsistency, error) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	if registry.db == nil {
+		return nil, nil
+	}
+
+	var fixed []Inconsistency
+	err := registry.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if fixed, err = checkConsistency(tx); err != nil {
+			return err
+		}
+		var bits Permission
+		for _, inconsistency := range fixed {
+			bits = bits.Union(Bit(inconsistency.Bit))
+		}
+		if bits.IsZero() {
+			return nil
+		}
+		return stripBits(tx, bits)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	reserve(nil)
+	if len(fixed) > 0 {
+		notifyRevoked()
+	}
+	return fixed, nil
+}
+
+// warnInconsistencies prints the inconsistencies found at startup
+func warnInconsistencies(inconsistencies []Inconsistency) {
+	for _, inconsistency := range inconsistencies {
+		fmt.Printf("permissions: %d rows of %s have bit %d but no permission does, it won't be given to a new permission until it is taken from them (StripUnregisteredBits)\n",
+			inconsistency.Rows, inconsistency.Table, inconsistency.Bit)
+	}
+}
@@ -2,77 +2,111 @@ package permissions
 
 import (
 	"errors"
+	"fmt"
+	"slices"
+	"strings"
 	"sync"
+	"unicode"
 
 	"gorm.io/gorm"
 )
 
-type Permission uint64
-
-const (
-	ViewDashboard Permission = 1 << iota
-	ViewModels
-	ViewUsers
-	ManageUsers
-	ManageModels
-	Administrator
-
-	maxBuiltinBit = iota
+var (
+	ViewDashboard = Bit(0)
+	ViewModels    = Bit(1)
+	ViewUsers     = Bit(2)
+	ManageUsers   = Bit(3)
+	ManageModels  = Bit(4)
+	Administrator = Bit(5)
 )
 
+// maxBuiltinBit is the first bit of the custom permissions
+const maxBuiltinBit = 6
+
 var (
-	BasicUser = ViewDashboard | ViewModels | ViewUsers
+	BasicUser = ViewDashboard.Union(ViewModels, ViewUsers)
 	Admin     = Administrator
 )
 
 var (
+	// Deprecated: permissions are a bitset without a fixed size, it is never returned
 	ErrMaxPermissionsReached = errors.New("maximum permissions reached (64)")
 	ErrPermissionNotFound    = errors.New("permission not found")
+	ErrBuiltinPermission     = errors.New("builtin permissions can't be unregistered or renamed")
+	ErrPermissionExists      = errors.New("a permission with this name already exists")
+	ErrInvalidName           = errors.New("permission names can't be empty, longer than 100 characters or contain spaces")
 )
 
+// builtinNames are the names of the builtin permissions, by bit
+var builtinNames = []string{"ViewDashboard", "ViewModels", "ViewUsers", "ManageUsers", "ManageModels", "Administrator"}
+
 type PermissionRegistry struct {
 	mu               sync.RWMutex
 	nameToPermission map[string]Permission
 	permissionToName map[Permission]string
-	nextBit          uint
 	db               *gorm.DB
+	unsaved          []CustomPermission // registered before InitPermissions, only known in memory
+	reserved         map[uint]bool      // bits holders have without a permission, not given to new ones
+	inconsistencies  []Inconsistency
 }
 
 var registry = &PermissionRegistry{
 	nameToPermission: make(map[string]Permission),
 	permissionToName: make(map[Permission]string),
-	nextBit:          maxBuiltinBit,
+	reserved:         make(map[uint]bool),
 }
 
 func init() {
-	builtins := map[Permission]string{
-		ViewDashboard: "ViewDashboard",
-		ViewModels:    "ViewModels",
-		ViewUsers:     "ViewUsers",
-		ManageUsers:   "ManageUsers",
-		ManageModels:  "ManageModels",
-		Administrator: "Administrator",
-	}
-
-	for perm, name := range builtins {
-		registry.permissionToName[perm] = name
-		registry.nameToPermission[name] = perm
+	for bit, name := range builtinNames {
+		registry.permissionToName[Bit(uint(bit))] = name
+		registry.nameToPermission[name] = Bit(uint(bit))
 	}
 }
 
-// InitPermissions initializes the permission system with the given database connection.
+/*
+InitPermissions initializes the permission system with the given database connection. Permissions registered
+before it (e.g the collection permissions of schemas registered first) are saved now, their bit can change
+so it doesnt clash with one already saved.
+*/
 func InitPermissions(db *gorm.DB) error {
 	registry.mu.Lock()
 	registry.db = db
+	unsaved := registry.unsaved
+	registry.unsaved = nil
+	for _, cp := range unsaved {
+		delete(registry.permissionToName, registry.nameToPermission[cp.Name])
+		delete(registry.nameToPermission, cp.Name)
+	}
 	registry.mu.Unlock()
 
 	db.AutoMigrate(&CustomPermission{})
 
-	return LoadCustomPermissions(db)
+	if err := LoadCustomPermissions(db); err != nil {
+		return err
+	}
+
+	for _, cp := range unsaved {
+		if _, err := RegisterPermissionWithDescription(cp.Name, cp.Description); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// LoadCustomPermissions loads custom permissions from the database into the registry.
+/*
+LoadCustomPermissions loads custom permissions from the database into the registry. Bits users or roles have that no
+permission has are printed and kept from new permissions (see StripUnregisteredBits)
+*/
 func LoadCustomPermissions(db *gorm.DB) error {
+	// older versions soft deleted unregistered permissions, the rows only keep their name and bit from being used again
+	removed := db.Unscoped().Where("deleted_at IS NOT NULL").Delete(&CustomPermission{})
+	if removed.Error != nil {
+		return removed.Error
+	}
+	if removed.RowsAffected > 0 {
+		fmt.Printf("permissions: removed %d permissions unregistered by an older version\n", removed.RowsAffected)
+	}
+
 	var customPerms []CustomPermission
 	if err := db.Order("bit_position asc").Find(&customPerms).Error; err != nil {
 		return err
@@ -82,20 +116,29 @@ func LoadCustomPermissions(db *gorm.DB) error {
 	defer registry.mu.Unlock()
 
 	for _, cp := range customPerms {
-		perm := Permission(1 << cp.BitPosition)
+		perm := Bit(cp.BitPosition)
 		registry.nameToPermission[cp.Name] = perm
 		registry.permissionToName[perm] = cp.Name
+	}
 
-		if cp.BitPosition >= registry.nextBit {
-			registry.nextBit = cp.BitPosition + 1
-		}
+	inconsistencies, err := checkConsistency(db)
+	if err != nil {
+		return err
 	}
+	reserve(inconsistencies)
+	warnInconsistencies(inconsistencies)
 
 	return nil
 }
 
 // RegisterPermission registers a new custom permission with the given name.
 func RegisterPermission(name string) (Permission, error) {
+	return RegisterPermissionWithDescription(name, "")
+}
+
+// RegisterPermissionWithDescription registers a new custom permission like RegisterPermission, saving its description.
+// When the permission already exists it is returned as is
+func RegisterPermissionWithDescription(name string, description string) (Permission, error) {
 	registry.mu.Lock()
 	defer registry.mu.Unlock()
 
@@ -105,34 +148,31 @@ func RegisterPermission(name string) (Permission, error) {
 		return foundperm, nil
 	}
 
-	if registry.nextBit >= 64 {
-		return 0, ErrMaxPermissionsReached
-	}
-
-	bitPos := registry.nextBit
-	perm := Permission(1 << bitPos)
-	registry.nextBit++
+	bitPos := freeBit()
+	perm := Bit(bitPos)
 
 	registry.nameToPermission[name] = perm
 	registry.permissionToName[perm] = name
 
-	if registry.db != nil {
+	if registry.db == nil {
+		registry.unsaved = append(registry.unsaved, CustomPermission{Name: name, BitPosition: bitPos, Description: description})
+	} else {
 		customPerm := CustomPermission{
 			Name:        name,
 			BitPosition: bitPos,
+			Description: description,
 		}
 		if err := registry.db.Create(&customPerm).Error; err != nil {
 			delete(registry.nameToPermission, name)
 			delete(registry.permissionToName, perm)
-			registry.nextBit--
-			return 0, err
+			return Permission{}, err
 		}
 	}
 
 	return perm, nil
 }
 
-// UnregisterPermission removes a custom permission by name.
+// UnregisterPermission removes a custom permission by name, taking it from every user and role in the same transaction.
 func UnregisterPermission(name string) error {
 	registry.mu.Lock()
 	defer registry.mu.Unlock()
@@ -142,20 +182,67 @@ func UnregisterPermission(name string) error {
 		return ErrPermissionNotFound
 	}
 
-	for builtinPerm := range registry.permissionToName {
-		if builtinPerm == perm && builtinPerm < (1<<maxBuiltinBit) {
-			return errors.New("cannot unregister builtin permission")
-		}
+	if bits := perm.Bits(); len(bits) == 1 && bits[0] < maxBuiltinBit {
+		return ErrBuiltinPermission
 	}
 
 	if registry.db != nil {
-		if err := registry.db.Where("name = ?", name).Delete(&CustomPermission{}).Error; err != nil {
+		err := registry.db.Transaction(func(tx *gorm.DB) error {
+			// not soft deleted, the name and bit can be used again
+			if err := tx.Unscoped().Where("name = ?", name).Delete(&CustomPermission{}).Error; err != nil {
+				return err
+			}
+			return stripBits(tx, perm)
+		})
+		if err != nil {
 			return err
 		}
 	}
 
 	delete(registry.nameToPermission, name)
 	delete(registry.permissionToName, perm)
+	registry.unsaved = slices.DeleteFunc(registry.unsaved, func(unsaved CustomPermission) bool { return unsaved.Name == name })
+	if registry.db != nil {
+		notifyRevoked()
+	}
+
+	return nil
+}
+
+// RenamePermission changes the name of a custom permission. It keeps its bit, so whoever had it still has it.
+func RenamePermission(name string, newName string) error {
+	if err := ValidateName(newName); err != nil {
+		return err
+	}
+
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	perm, exists := registry.nameToPermission[name]
+	if !exists {
+		return ErrPermissionNotFound
+	}
+	if bits := perm.Bits(); len(bits) == 1 && bits[0] < maxBuiltinBit {
+		return ErrBuiltinPermission
+	}
+	if _, taken := registry.nameToPermission[newName]; taken {
+		return ErrPermissionExists
+	}
+
+	if registry.db != nil {
+		if err := registry.db.Model(&CustomPermission{}).Where("name = ?", name).Update("name", newName).Error; err != nil {
+			return err
+		}
+	}
+
+	delete(registry.nameToPermission, name)
+	registry.nameToPermission[newName] = perm
+	registry.permissionToName[perm] = newName
+	for i := range registry.unsaved {
+		if registry.unsaved[i].Name == name {
+			registry.unsaved[i].Name = newName
+		}
+	}
 
 	return nil
 }
@@ -168,24 +255,44 @@ func GetPermissionByName(name string) (Permission, bool) {
 	return perm, ok
 }
 
-// GetAllCustomPermissions retrieves all custom permissions from the database.
+// GetAllCustomPermissions retrieves all custom permissions from the database, or the ones in memory before InitPermissions.
 func GetAllCustomPermissions() []CustomPermission {
 	registry.mu.RLock()
 	defer registry.mu.RUnlock()
 
 	var perms []CustomPermission
 	if registry.db != nil {
-		registry.db.Find(&perms)
+		registry.db.Order("bit_position asc").Find(&perms)
+	} else {
+		perms = slices.Clone(registry.unsaved)
 	}
 	return perms
 }
 
+// BuiltinPermissions returns the names of the builtin permissions, by bit.
+func BuiltinPermissions() []string {
+	return slices.Clone(builtinNames)
+}
+
+// IsBuiltin checks if name is the name of a builtin permission.
+func IsBuiltin(name string) bool {
+	return slices.Contains(builtinNames, name)
+}
+
+// ValidateName checks name can be the name of a custom permission.
+func ValidateName(name string) error {
+	if name == "" || len(name) > 100 || strings.ContainsFunc(name, unicode.IsSpace) {
+		return ErrInvalidName
+	}
+	return nil
+}
+
 // HasPermission checks if the userPermissions include the requiredPermissions.
 func HasPermission(userPermissions, requiredPermissions Permission) bool {
-	if userPermissions&Administrator == Administrator {
+	if userPermissions.Contains(Administrator) {
 		return true
 	}
-	return userPermissions&requiredPermissions == requiredPermissions
+	return userPermissions.Contains(requiredPermissions)
 }
 
 // AllPermissionsAsStrings returns a slice of all registered permission names.
@@ -207,7 +314,7 @@ func PermissionsToStrings(userPermissions Permission) []string {
 
 	var names []string
 	for perm, name := range registry.permissionToName {
-		if userPermissions&perm == perm {
+		if userPermissions.Contains(perm) {
 			names = append(names, name)
 		}
 	}
@@ -222,7 +329,7 @@ func StringsToPermission(names []string) Permission {
 	var combined Permission
 	for _, name := range names {
 		if perm, ok := registry.nameToPermission[name]; ok {
-			combined |= perm
+			combined = combined.Union(perm)
 		}
 	}
 	return combined
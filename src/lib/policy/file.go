@@ -0,0 +1,90 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+/*
+File is the format of a policy file, json:
+
+	{
+		"rules": [
+			{
+				"name": "editors-update-drafts",
+				"effect": "allow",
+				"actions": ["update"],
+				"collections": ["posts"],
+				"permissions": ["Editor"],
+				"when": [{"attribute": "entry.status", "op": "eq", "value": "draft"}]
+			}
+		]
+	}
+
+or the same in yaml (.yaml / .yml):
+
+	rules:
+	  - name: editors-update-drafts
+	    effect: allow
+	    actions: [update]
+	    collections: [posts]
+	    permissions: [Editor]
+	    when:
+	      - {attribute: entry.status, op: eq, value: draft}
+*/
+type File struct {
+	Rules []Rule `json:"rules" yaml:"rules"`
+}
+
+/*
+LoadFile adds the rules of a json or yaml policy file (by its extension) to the engine the routes authorize with.
+Every rule is checked first, so a file with an invalid rule adds none of them
+*/
+func LoadFile(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var file File
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		decoder.KnownFields(true)
+		err = decoder.Decode(&file)
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&file)
+	}
+	if err != nil {
+		return fmt.Errorf("policy file %s: %w", path, err)
+	}
+	for _, rule := range file.Rules {
+		if err := validate(rule); err != nil {
+			return fmt.Errorf("policy file %s: %w", path, err)
+		}
+	}
+
+	for _, rule := range file.Rules {
+		if err := AddRule(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Init loads the policy file set in POLICY_FILE, if any. The error has to stop the server, the deny rules of the file would be missing
+func Init() error {
+	path := os.Getenv("POLICY_FILE")
+	if path == "" {
+		return nil
+	}
+	return LoadFile(path)
+}
@@ -0,0 +1,502 @@
+package policy
+
+// attribute based authorization on top of the permission bits. A decision starts from the permissions of the
+// subject (posts.update, ManageModels...), rules then allow more or deny, based on the subject, the action, the
+// collection and the entry. Rules are added in go (AddRule) or loaded from a json or yaml file (LoadFile)
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/chukfi/backend/src/lib/permissions"
+)
+
+// Effect is what a matching rule does, deny wins over allow
+type Effect string
+
+const (
+	Allow Effect = "allow"
+	Deny  Effect = "deny"
+)
+
+// ActionAccess is the action of routes guarded by a permission (RoutesRequiresPermission), next to the collection actions (permissions.ActionRead...)
+const ActionAccess = "access"
+
+// condition operators
+const (
+	OpEq     = "eq"
+	OpNe     = "ne"
+	OpIn     = "in"
+	OpNotIn  = "notIn"
+	OpExists = "exists"
+)
+
+var (
+	ErrInvalidRule = errors.New("invalid policy rule")
+)
+
+// Subject is who asks, Attributes are what rules can check as subject.<name> (id, email... and whatever SetAttributeProvider adds)
+type Subject struct {
+	ID          string                 `json:"id"`
+	Permissions permissions.Permission `json:"-"`
+	Attributes  map[string]interface{} `json:"attributes"`
+}
+
+// Resource is what the action is done on
+type Resource struct {
+	Collection string `json:"collection,omitempty"`
+	// Entry is the entry the action is done on, nil for the collection as a whole (listing it, or before the entry is known)
+	Entry map[string]interface{} `json:"entry,omitempty"`
+	// Permission is the permission a route requires, for ActionAccess
+	Permission permissions.Permission `json:"-"`
+	Path       string                 `json:"path,omitempty"`
+	// Public is set for collections anyone may read, reading them needs no permission
+	Public bool `json:"public,omitempty"`
+}
+
+/*
+Condition compares an attribute with a value, or with another attribute (Ref). Attributes are action,
+subject.<name>, resource.collection, resource.path and entry.<field> (by name or column). Ref can't be an
+entry attribute, entry conditions have to become sql when the entry isn't known yet
+*/
+type Condition struct {
+	Attribute string      `json:"attribute" yaml:"attribute"`
+	Op        string      `json:"op" yaml:"op"`
+	Value     interface{} `json:"value,omitempty" yaml:"value,omitempty"`
+	Ref       string      `json:"ref,omitempty" yaml:"ref,omitempty"`
+}
+
+// Request is what a go rule (Rule.Match) is asked about, Resource.Entry is nil when the entry isnt known
+type Request struct {
+	Subject  Subject
+	Action   string
+	Resource Resource
+}
+
+/*
+Rule allows or denies actions. Empty Actions or Collections match all of them, Permissions are names the subject
+needs all of. When are the conditions, Match an extra check for rules written in go. Match can't become sql, so it
+should only look at the subject and the action, conditions on the entry go in When
+*/
+type Rule struct {
+	Name        string                                          `json:"name" yaml:"name"`
+	Description string                                          `json:"description,omitempty" yaml:"description,omitempty"`
+	Effect      Effect                                          `json:"effect" yaml:"effect"`
+	Actions     []string                                        `json:"actions,omitempty" yaml:"actions,omitempty"`
+	Collections []string                                        `json:"collections,omitempty" yaml:"collections,omitempty"`
+	Permissions []string                                        `json:"permissions,omitempty" yaml:"permissions,omitempty"`
+	When        []Condition                                     `json:"when,omitempty" yaml:"when,omitempty"`
+	Match       func(ctx context.Context, request Request) bool `json:"-" yaml:"-"`
+}
+
+/*
+Filter limits the entries a decision allows when it depends on the entry and no entry was given. An entry is
+allowed if it matches every condition of one of Any (Any nil allows every entry) and none of the sets in None.
+Conditions are on entry attributes only, refs already resolved
+*/
+type Filter struct {
+	Any  [][]Condition `json:"any,omitempty"`
+	None [][]Condition `json:"none,omitempty"`
+}
+
+// Step is how one rule took part in a decision, for explaining it
+type Step struct {
+	Rule        string `json:"rule"`
+	Effect      Effect `json:"effect,omitempty"`
+	Matched     bool   `json:"matched"`
+	Conditional bool   `json:"conditional,omitempty"` // matched depending on the entry, see Filter
+	Reason      string `json:"reason"`
+}
+
+// Decision is the result of Authorize
+type Decision struct {
+	Allowed bool    `json:"allowed"`
+	Reason  string  `json:"reason"`
+	Filter  *Filter `json:"filter,omitempty"`
+	Steps   []Step  `json:"steps"`
+}
+
+// Engine holds the rules and makes decisions with them
+type Engine struct {
+	mu        sync.RWMutex
+	rules     []Rule
+	attribute func(ctx context.Context, subject *Subject)
+}
+
+func NewEngine() *Engine {
+	return &Engine{}
+}
+
+var (
+	engine   = NewEngine()
+	engineMu sync.RWMutex
+)
+
+// GetEngine returns the engine the routes authorize with
+func GetEngine() *Engine {
+	engineMu.RLock()
+	defer engineMu.RUnlock()
+	return engine
+}
+
+// SetEngine replaces the engine the routes authorize with
+func SetEngine(e *Engine) {
+	engineMu.Lock()
+	defer engineMu.Unlock()
+	engine = e
+}
+
+// AddRule adds a rule to the engine the routes authorize with
+func AddRule(rule Rule) error {
+	return GetEngine().AddRule(rule)
+}
+
+// SetAttributeProvider sets what fills in the attributes of subjects (e.g team_id) on the engine the routes authorize with
+func SetAttributeProvider(provider func(ctx context.Context, subject *Subject)) {
+	GetEngine().SetAttributeProvider(provider)
+}
+
+// Authorize decides with the engine the routes authorize with
+func Authorize(ctx context.Context, subject Subject, action string, resource Resource) Decision {
+	return GetEngine().Authorize(ctx, subject, action, resource)
+}
+
+// AddRule checks the rule and adds it, a rule with the name of one already added replaces it
+func (e *Engine) AddRule(rule Rule) error {
+	if err := validate(rule); err != nil {
+		return err
+	}
+
+	// copied, Authorize keeps using the rules it started with
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	rules := slices.Clone(e.rules)
+	if i := slices.IndexFunc(rules, func(existing Rule) bool { return existing.Name == rule.Name }); i >= 0 {
+		rules[i] = rule
+	} else {
+		rules = append(rules, rule)
+	}
+	e.rules = rules
+	return nil
+}
+
+// RemoveRule removes the rule with the name, false if there is none
+func (e *Engine) RemoveRule(name string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	before := len(e.rules)
+	e.rules = slices.DeleteFunc(slices.Clone(e.rules), func(rule Rule) bool { return rule.Name == name })
+	return len(e.rules) != before
+}
+
+// Rules returns the rules in the order they were added
+func (e *Engine) Rules() []Rule {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return slices.Clone(e.rules)
+}
+
+/*
+SetAttributeProvider sets what fills in the attributes of a subject before a decision, e.g loading the team of
+the user. It runs on every Authorize, so it should be cheap (cache what it loads)
+*/
+func (e *Engine) SetAttributeProvider(provider func(ctx context.Context, subject *Subject)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.attribute = provider
+}
+
+func validate(rule Rule) error {
+	if rule.Name == "" {
+		return fmt.Errorf("%w: missing name", ErrInvalidRule)
+	}
+	if rule.Effect != Allow && rule.Effect != Deny {
+		return fmt.Errorf("%w: %s: effect must be allow or deny", ErrInvalidRule, rule.Name)
+	}
+	for _, condition := range rule.When {
+		switch condition.Op {
+		case OpEq, OpNe, OpIn, OpNotIn, OpExists:
+		default:
+			return fmt.Errorf("%w: %s: unknown op %q", ErrInvalidRule, rule.Name, condition.Op)
+		}
+		if condition.Attribute == "" {
+			return fmt.Errorf("%w: %s: condition without an attribute", ErrInvalidRule, rule.Name)
+		}
+		if strings.HasPrefix(condition.Ref, "entry.") {
+			return fmt.Errorf("%w: %s: ref can't be an entry attribute, put the entry attribute first", ErrInvalidRule, rule.Name)
+		}
+		if condition.Ref != "" && (condition.Op == OpIn || condition.Op == OpNotIn) {
+			return fmt.Errorf("%w: %s: %s can't be used with a ref", ErrInvalidRule, rule.Name, condition.Op)
+		}
+	}
+	return nil
+}
+
+/*
+Authorize decides if the subject may do the action on the resource. The permissions of the subject allow it first
+(the collection permission or its wildcard, the route permission for ActionAccess), then every rule that matches:
+a deny rule denies, an allow rule allows. Rules depending on the entry when resource.Entry is nil end up in the
+Filter of the decision instead, Allowed then means the action is allowed on some entries.
+*/
+func (e *Engine) Authorize(ctx context.Context, subject Subject, action string, resource Resource) Decision {
+	e.mu.RLock()
+	rules := e.rules
+	provider := e.attribute
+	e.mu.RUnlock()
+
+	if subject.Attributes == nil {
+		subject.Attributes = map[string]interface{}{}
+	}
+	if provider != nil {
+		provider(ctx, &subject)
+	}
+
+	decision := Decision{Steps: []Step{}}
+	allowedBy := ""
+	if granted, by := basePermission(subject, action, resource); granted {
+		allowedBy = by
+		decision.Steps = append(decision.Steps, Step{Rule: "permissions", Effect: Allow, Matched: true, Reason: "allowed by " + by})
+	} else {
+		decision.Steps = append(decision.Steps, Step{Rule: "permissions", Reason: by})
+	}
+
+	deniedBy := ""
+	var alternatives, excluded [][]Condition
+	for _, rule := range rules {
+		step, conditions := e.evaluate(ctx, rule, subject, action, resource)
+		decision.Steps = append(decision.Steps, step)
+		switch {
+		case !step.Matched:
+		case step.Conditional && rule.Effect == Allow:
+			alternatives = append(alternatives, conditions)
+		case step.Conditional:
+			excluded = append(excluded, conditions)
+		case rule.Effect == Deny && deniedBy == "":
+			deniedBy = rule.Name
+		case rule.Effect == Allow && allowedBy == "":
+			allowedBy = "rule " + rule.Name
+		}
+	}
+
+	target := action
+	if resource.Collection != "" {
+		target += " on " + resource.Collection
+	}
+
+	switch {
+	case deniedBy != "":
+		decision.Reason = "denied by rule " + deniedBy
+	case allowedBy != "":
+		decision.Allowed = true
+		decision.Reason = "allowed by " + allowedBy
+		if len(excluded) > 0 {
+			decision.Filter = &Filter{None: excluded}
+		}
+	case len(alternatives) > 0:
+		decision.Allowed = true
+		decision.Reason = "allowed on the entries matching the conditions of the rules"
+		decision.Filter = &Filter{Any: alternatives, None: excluded}
+	default:
+		decision.Reason = "no permission or rule allows " + target
+	}
+	return decision
+}
+
+// basePermission checks what the permission bits allow, returning what allowed it (or why not)
+func basePermission(subject Subject, action string, resource Resource) (bool, string) {
+	if action == ActionAccess {
+		if permissions.HasPermission(subject.Permissions, resource.Permission) {
+			return true, "permission " + strings.Join(permissions.PermissionsToStrings(resource.Permission), ", ")
+		}
+		return false, "missing permission " + strings.Join(permissions.PermissionsToStrings(resource.Permission), ", ")
+	}
+	if resource.Collection == "" {
+		return false, "no collection"
+	}
+	if resource.Public && action == permissions.ActionRead {
+		return true, "public collection"
+	}
+	if permissions.HasPermission(subject.Permissions, permissions.Administrator) {
+		return true, "permission Administrator"
+	}
+	if permissions.HasCollectionPermission(subject.Permissions, resource.Collection, action) {
+		return true, "permission " + permissions.CollectionPermissionName(resource.Collection, action) + " or " + permissions.PermissionToName(permissions.CollectionWildcard(action))
+	}
+	return false, "missing permission " + permissions.CollectionPermissionName(resource.Collection, action)
+}
+
+// evaluate checks a rule against the request, returning the entry conditions (refs resolved) if it matched conditionally
+func (e *Engine) evaluate(ctx context.Context, rule Rule, subject Subject, action string, resource Resource) (Step, []Condition) {
+	step := Step{Rule: rule.Name, Effect: rule.Effect}
+
+	if len(rule.Actions) > 0 && !slices.Contains(rule.Actions, action) {
+		step.Reason = "action " + action + " not in " + strings.Join(rule.Actions, ", ")
+		return step, nil
+	}
+	if len(rule.Collections) > 0 && !slices.Contains(rule.Collections, resource.Collection) {
+		step.Reason = "collection " + resource.Collection + " not in " + strings.Join(rule.Collections, ", ")
+		return step, nil
+	}
+	for _, name := range rule.Permissions {
+		perm, ok := permissions.GetPermissionByName(name)
+		if !ok || !permissions.HasPermission(subject.Permissions, perm) {
+			step.Reason = "missing permission " + name
+			return step, nil
+		}
+	}
+	if rule.Match != nil && !rule.Match(ctx, Request{Subject: subject, Action: action, Resource: resource}) {
+		step.Reason = "match returned false"
+		return step, nil
+	}
+
+	attributes := attributesOf(subject, action, resource)
+	var pending []Condition
+	for _, condition := range rule.When {
+		if resource.Entry == nil && strings.HasPrefix(condition.Attribute, "entry.") {
+			// becomes part of the filter, with the ref resolved now
+			if condition.Ref != "" {
+				condition.Value = attributes(condition.Ref)
+				condition.Ref = ""
+			}
+			pending = append(pending, condition)
+			continue
+		}
+		if !condition.holds(attributes) {
+			step.Reason = "condition " + condition.String() + " does not hold"
+			return step, nil
+		}
+	}
+
+	step.Matched = true
+	step.Conditional = len(pending) > 0
+	step.Reason = "matched"
+	if step.Conditional {
+		step.Reason = "matched on the entries where " + describe(pending)
+	}
+	return step, pending
+}
+
+// attributesOf returns the lookup of the attributes a condition can use, nil for unknown ones
+func attributesOf(subject Subject, action string, resource Resource) func(name string) interface{} {
+	return func(name string) interface{} {
+		switch {
+		case name == "action":
+			return action
+		case name == "resource.collection":
+			return resource.Collection
+		case name == "resource.path":
+			return resource.Path
+		case name == "subject.id":
+			return subject.ID
+		case strings.HasPrefix(name, "subject."):
+			return subject.Attributes[strings.TrimPrefix(name, "subject.")]
+		case strings.HasPrefix(name, "entry."):
+			return resource.Entry[strings.TrimPrefix(name, "entry.")]
+		}
+		return nil
+	}
+}
+
+// holds checks the condition against the attributes, values compare as text so 1 and "1" are the same
+func (c Condition) holds(attributes func(name string) interface{}) bool {
+	value := attributes(c.Attribute)
+	expected := c.Value
+	if c.Ref != "" {
+		expected = attributes(c.Ref)
+	}
+
+	switch c.Op {
+	case OpExists:
+		return value != nil && value != ""
+	case OpEq:
+		return value != nil && expected != nil && same(value, expected)
+	case OpNe:
+		return !same(value, expected)
+	case OpIn, OpNotIn:
+		found := false
+		if value != nil {
+			for _, candidate := range c.Values() {
+				if same(value, candidate) {
+					found = true
+					break
+				}
+			}
+		}
+		return found == (c.Op == OpIn)
+	}
+	return false
+}
+
+// Matches checks an entry against the filter
+func (f *Filter) Matches(entry map[string]interface{}) bool {
+	if f == nil {
+		return true
+	}
+	attributes := attributesOf(Subject{}, "", Resource{Entry: entry})
+	all := func(conditions []Condition) bool {
+		for _, condition := range conditions {
+			if !condition.holds(attributes) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if f.Any != nil && !slices.ContainsFunc(f.Any, all) {
+		return false
+	}
+	return !slices.ContainsFunc(f.None, all)
+}
+
+// Field returns the entry field the condition is on, "" if it isnt on the entry
+func (c Condition) Field() string {
+	field, _ := strings.CutPrefix(c.Attribute, "entry.")
+	if field == c.Attribute {
+		return ""
+	}
+	return field
+}
+
+// Values returns the values of an in / notIn condition
+func (c Condition) Values() []interface{} {
+	if values, ok := c.Value.([]interface{}); ok {
+		return values
+	}
+	if values, ok := c.Value.([]string); ok {
+		result := make([]interface{}, len(values))
+		for i, value := range values {
+			result[i] = value
+		}
+		return result
+	}
+	return []interface{}{c.Value}
+}
+
+func (c Condition) String() string {
+	if c.Ref != "" {
+		return c.Attribute + " " + c.Op + " " + c.Ref
+	}
+	if c.Op == OpExists {
+		return c.Attribute + " " + c.Op
+	}
+	return fmt.Sprintf("%s %s %v", c.Attribute, c.Op, c.Value)
+}
+
+func describe(conditions []Condition) string {
+	parts := make([]string, len(conditions))
+	for i, condition := range conditions {
+		parts[i] = condition.String()
+	}
+	return strings.Join(parts, " and ")
+}
+
+func same(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return fmt.Sprint(a) == fmt.Sprint(b)
+}
@@ -0,0 +1,209 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/chukfi/backend/src/lib/permissions"
+)
+
+const collection = "policy_posts"
+
+var editor permissions.Permission
+
+func init() {
+	if err := permissions.RegisterCollectionPermissions(collection); err != nil {
+		panic(err)
+	}
+	var err error
+	if editor, err = permissions.RegisterPermission("PolicyEditor"); err != nil {
+		panic(err)
+	}
+}
+
+func collectionPermission(action string) permissions.Permission {
+	permission, _ := permissions.GetPermissionByName(permissions.CollectionPermissionName(collection, action))
+	return permission
+}
+
+var (
+	draftsOnly = Rule{
+		Name: "editors-update-drafts", Effect: Allow, Actions: []string{permissions.ActionUpdate},
+		Collections: []string{collection}, Permissions: []string{"PolicyEditor"},
+		When: []Condition{{Attribute: "entry.status", Op: OpEq, Value: "draft"}},
+	}
+	lockedEntries = Rule{
+		Name: "no-locked-entries", Effect: Deny, Actions: []string{permissions.ActionUpdate, permissions.ActionDelete},
+		Collections: []string{collection},
+		When:        []Condition{{Attribute: "entry.locked", Op: OpIn, Value: []interface{}{true, 1}}},
+	}
+	readOnly = Rule{
+		Name: "read-only", Effect: Deny, Actions: []string{permissions.ActionUpdate}, Collections: []string{collection},
+	}
+	ownEntries = Rule{
+		Name: "update-own", Effect: Allow, Actions: []string{permissions.ActionUpdate}, Collections: []string{collection},
+		When: []Condition{{Attribute: "entry.author_id", Op: OpEq, Ref: "subject.id"}},
+	}
+	everyone = Rule{
+		Name: "everyone-updates", Effect: Allow, Actions: []string{permissions.ActionUpdate}, Collections: []string{collection},
+	}
+	neverMatches = Rule{
+		Name: "never", Effect: Deny, Collections: []string{collection},
+		Match: func(ctx context.Context, request Request) bool { return false },
+	}
+	otherCollection = Rule{Name: "other-collection", Effect: Deny, Collections: []string{"other"}}
+)
+
+func TestAuthorize(t *testing.T) {
+	admin := Subject{ID: "admin", Permissions: permissions.Administrator}
+	updater := Subject{ID: "updater", Permissions: collectionPermission(permissions.ActionUpdate)}
+	editorSubject := Subject{ID: "editor", Permissions: editor}
+	nobody := Subject{ID: "nobody"}
+
+	tests := []struct {
+		name     string
+		rules    []Rule
+		subject  Subject
+		action   string
+		resource Resource
+		allowed  bool
+		filter   *Filter
+	}{
+		{"no permission", nil, nobody, permissions.ActionUpdate, Resource{Collection: collection}, false, nil},
+		{"collection permission", nil, updater, permissions.ActionUpdate, Resource{Collection: collection}, true, nil},
+		{"other action", nil, updater, permissions.ActionDelete, Resource{Collection: collection}, false, nil},
+		{"administrator", nil, admin, permissions.ActionDelete, Resource{Collection: collection}, true, nil},
+		{"public read", nil, nobody, permissions.ActionRead, Resource{Collection: collection, Public: true}, true, nil},
+		{"public is only for reads", nil, nobody, permissions.ActionUpdate, Resource{Collection: collection, Public: true}, false, nil},
+		{"no collection", nil, admin, permissions.ActionRead, Resource{}, false, nil},
+
+		// deny wins over the permissions and over allow rules
+		{"deny over a permission", []Rule{readOnly}, updater, permissions.ActionUpdate, Resource{Collection: collection}, false, nil},
+		{"deny over administrator", []Rule{readOnly}, admin, permissions.ActionUpdate, Resource{Collection: collection}, false, nil},
+		{"deny over an allow rule", []Rule{everyone, readOnly}, nobody, permissions.ActionUpdate, Resource{Collection: collection}, false, nil},
+		{"deny added before the allow", []Rule{readOnly, everyone}, nobody, permissions.ActionUpdate, Resource{Collection: collection}, false, nil},
+		{"deny over a conditional allow", []Rule{draftsOnly, readOnly}, editorSubject, permissions.ActionUpdate, Resource{Collection: collection}, false, nil},
+		{"deny of another action", []Rule{readOnly}, updater, permissions.ActionRead, Resource{Collection: collection, Public: true}, true, nil},
+		{"deny of another collection", []Rule{otherCollection}, updater, permissions.ActionUpdate, Resource{Collection: collection}, true, nil},
+		{"deny whose match fails", []Rule{neverMatches}, updater, permissions.ActionUpdate, Resource{Collection: collection}, true, nil},
+
+		// entry conditions without an entry become the filter
+		{"conditional allow", []Rule{draftsOnly}, editorSubject, permissions.ActionUpdate, Resource{Collection: collection}, true,
+			&Filter{Any: [][]Condition{{{Attribute: "entry.status", Op: OpEq, Value: "draft"}}}}},
+		{"conditional allow without its permission", []Rule{draftsOnly}, nobody, permissions.ActionUpdate, Resource{Collection: collection}, false, nil},
+		{"conditional deny", []Rule{lockedEntries}, updater, permissions.ActionUpdate, Resource{Collection: collection}, true,
+			&Filter{None: [][]Condition{{{Attribute: "entry.locked", Op: OpIn, Value: []interface{}{true, 1}}}}}},
+		{"conditional deny for administrator", []Rule{lockedEntries}, admin, permissions.ActionDelete, Resource{Collection: collection}, true,
+			&Filter{None: [][]Condition{{{Attribute: "entry.locked", Op: OpIn, Value: []interface{}{true, 1}}}}}},
+		{"conditional allow and deny", []Rule{draftsOnly, lockedEntries}, editorSubject, permissions.ActionUpdate, Resource{Collection: collection}, true,
+			&Filter{
+				Any:  [][]Condition{{{Attribute: "entry.status", Op: OpEq, Value: "draft"}}},
+				None: [][]Condition{{{Attribute: "entry.locked", Op: OpIn, Value: []interface{}{true, 1}}}},
+			}},
+		{"conditional deny alone allows nothing", []Rule{lockedEntries}, nobody, permissions.ActionUpdate, Resource{Collection: collection}, false, nil},
+		{"ref resolved into the filter", []Rule{ownEntries}, nobody, permissions.ActionUpdate, Resource{Collection: collection}, true,
+			&Filter{Any: [][]Condition{{{Attribute: "entry.author_id", Op: OpEq, Value: "nobody"}}}}},
+
+		// with the entry the conditions are checked right away
+		{"allow matching the entry", []Rule{draftsOnly}, editorSubject, permissions.ActionUpdate,
+			Resource{Collection: collection, Entry: map[string]interface{}{"status": "draft"}}, true, nil},
+		{"allow not matching the entry", []Rule{draftsOnly}, editorSubject, permissions.ActionUpdate,
+			Resource{Collection: collection, Entry: map[string]interface{}{"status": "published"}}, false, nil},
+		{"deny matching the entry", []Rule{lockedEntries}, admin, permissions.ActionUpdate,
+			Resource{Collection: collection, Entry: map[string]interface{}{"locked": int64(1)}}, false, nil},
+		{"deny not matching the entry", []Rule{lockedEntries}, updater, permissions.ActionUpdate,
+			Resource{Collection: collection, Entry: map[string]interface{}{"locked": false}}, true, nil},
+		{"deny on a missing field", []Rule{lockedEntries}, updater, permissions.ActionUpdate,
+			Resource{Collection: collection, Entry: map[string]interface{}{}}, true, nil},
+		{"ref matching the entry", []Rule{ownEntries}, nobody, permissions.ActionUpdate,
+			Resource{Collection: collection, Entry: map[string]interface{}{"author_id": "nobody"}}, true, nil},
+		{"ref not matching the entry", []Rule{ownEntries}, nobody, permissions.ActionUpdate,
+			Resource{Collection: collection, Entry: map[string]interface{}{"author_id": "someone"}}, false, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			engine := NewEngine()
+			for _, rule := range test.rules {
+				if err := engine.AddRule(rule); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			decision := engine.Authorize(context.Background(), test.subject, test.action, test.resource)
+			if decision.Allowed != test.allowed {
+				t.Fatalf("Allowed = %v (%s), want %v", decision.Allowed, decision.Reason, test.allowed)
+			}
+			if !reflect.DeepEqual(decision.Filter, test.filter) {
+				t.Fatalf("Filter = %+v, want %+v", decision.Filter, test.filter)
+			}
+		})
+	}
+}
+
+func TestFilterMatches(t *testing.T) {
+	filter := &Filter{
+		Any: [][]Condition{
+			{{Attribute: "entry.status", Op: OpEq, Value: "draft"}},
+			{{Attribute: "entry.author_id", Op: OpEq, Value: "me"}, {Attribute: "entry.team", Op: OpExists}},
+		},
+		None: [][]Condition{{{Attribute: "entry.locked", Op: OpIn, Value: []interface{}{true, 1}}}},
+	}
+
+	tests := []struct {
+		name    string
+		filter  *Filter
+		entry   map[string]interface{}
+		matches bool
+	}{
+		{"no filter", nil, map[string]interface{}{}, true},
+		{"first alternative", filter, map[string]interface{}{"status": "draft"}, true},
+		{"second alternative", filter, map[string]interface{}{"author_id": "me", "team": "a"}, true},
+		{"part of an alternative", filter, map[string]interface{}{"author_id": "me", "team": ""}, false},
+		{"no alternative", filter, map[string]interface{}{"status": "published"}, false},
+		{"excluded", filter, map[string]interface{}{"status": "draft", "locked": true}, false},
+		{"excluded as a number", filter, map[string]interface{}{"status": "draft", "locked": int64(1)}, false},
+		{"not excluded", filter, map[string]interface{}{"status": "draft", "locked": int64(0)}, true},
+		{"only exclusions", &Filter{None: filter.None}, map[string]interface{}{}, true},
+		{"ne on a missing field", &Filter{Any: [][]Condition{{{Attribute: "entry.status", Op: OpNe, Value: "x"}}}}, map[string]interface{}{}, true},
+		{"notIn on a missing field", &Filter{Any: [][]Condition{{{Attribute: "entry.status", Op: OpNotIn, Value: []interface{}{"x"}}}}}, map[string]interface{}{}, true},
+		{"eq on a missing field", &Filter{Any: [][]Condition{{{Attribute: "entry.status", Op: OpEq, Value: "x"}}}}, map[string]interface{}{}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.filter.Matches(test.entry); got != test.matches {
+				t.Fatalf("Matches(%v) = %v, want %v", test.entry, got, test.matches)
+			}
+		})
+	}
+}
+
+func TestAddRuleRejectsInvalidRules(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+	}{
+		{"no name", Rule{Effect: Allow}},
+		{"no effect", Rule{Name: "a"}},
+		{"unknown effect", Rule{Name: "a", Effect: "maybe"}},
+		{"unknown op", Rule{Name: "a", Effect: Deny, When: []Condition{{Attribute: "entry.a", Op: "gt", Value: 1}}}},
+		{"condition without an attribute", Rule{Name: "a", Effect: Deny, When: []Condition{{Op: OpExists}}}},
+		{"ref to the entry", Rule{Name: "a", Effect: Deny, When: []Condition{{Attribute: "subject.id", Op: OpEq, Ref: "entry.author_id"}}}},
+		{"in with a ref", Rule{Name: "a", Effect: Deny, When: []Condition{{Attribute: "entry.team", Op: OpIn, Ref: "subject.teams"}}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			engine := NewEngine()
+			if err := engine.AddRule(test.rule); !errors.Is(err, ErrInvalidRule) {
+				t.Fatalf("AddRule = %v, want ErrInvalidRule", err)
+			}
+			if len(engine.Rules()) != 0 {
+				t.Fatal("the invalid rule was added")
+			}
+		})
+	}
+}
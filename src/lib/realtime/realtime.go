@@ -0,0 +1,238 @@
+package realtime
+
+// fans collection events out to connected clients (sse / websocket). the last events are kept
+// in a ring buffer so a client that reconnects with the id of the last event it saw gets what it missed
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/chukfi/backend/src/lib/events"
+)
+
+var (
+	// BufferSize is how many events are kept for clients resuming with a last event id
+	BufferSize = 1024
+	// SubscriberBuffer is how many events may queue up for a slow client before it is disconnected
+	SubscriberBuffer = 256
+)
+
+// Message is an event with the id clients resume from
+type Message struct {
+	ID    string       `json:"id"`
+	Event events.Event `json:"event"`
+}
+
+/*
+Filter decides which events a subscription receives: events of the listed collections ("*" for every
+collection) and events of the listed entry ids, whatever collection they are in
+*/
+type Filter struct {
+	Collections []string `json:"collections"`
+	IDs         []string `json:"ids"`
+}
+
+func (f Filter) matches(event events.Event) bool {
+	for _, collection := range f.Collections {
+		if collection == "*" || collection == event.Collection {
+			return true
+		}
+	}
+	for _, id := range f.IDs {
+		if id == event.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// Empty is true when the filter matches nothing
+func (f Filter) Empty() bool {
+	return len(f.Collections) == 0 && len(f.IDs) == 0
+}
+
+type Subscription struct {
+	hub *Hub
+
+	// C receives the matching events, it is closed when the subscription ends (Close, or the client was too slow)
+	C chan Message
+
+	mu      sync.Mutex
+	filter  Filter
+	closed  bool
+	dropped bool
+}
+
+// SetFilter replaces what the subscription receives
+func (s *Subscription) SetFilter(filter Filter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.filter = filter
+}
+
+// Filter returns what the subscription currently receives
+func (s *Subscription) Filter() Filter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.filter
+}
+
+// Dropped is true if the subscription was closed because the client could not keep up
+func (s *Subscription) Dropped() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+func (s *Subscription) wants(event events.Event) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.filter.matches(event)
+}
+
+// deliver queues the message, closing the subscription if the client is too far behind. hub lock held
+func (s *Subscription) deliver(message Message) {
+	select {
+	case s.C <- message:
+	default:
+		s.mu.Lock()
+		s.dropped = true
+		s.mu.Unlock()
+		s.hub.removeLocked(s)
+	}
+}
+
+// Close ends the subscription
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.removeLocked(s)
+}
+
+type Hub struct {
+	mu          sync.Mutex
+	epoch       string // changes on every start, ids from an earlier run cant be resumed
+	seq         uint64
+	buffer      []Message
+	subscribers map[*Subscription]struct{}
+	unsubscribe func()
+}
+
+func NewHub() *Hub {
+	epochBytes := make([]byte, 4)
+	rand.Read(epochBytes)
+
+	return &Hub{
+		epoch:       hex.EncodeToString(epochBytes),
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// DefaultHub is fed from the events bus by Listen
+var DefaultHub = NewHub()
+
+// Listen feeds the DefaultHub from the events bus, calling it again does nothing
+func Listen() {
+	DefaultHub.mu.Lock()
+	defer DefaultHub.mu.Unlock()
+
+	if DefaultHub.unsubscribe == nil {
+		DefaultHub.unsubscribe = events.Subscribe(DefaultHub.Publish)
+	}
+}
+
+// Publish assigns the event an id, stores it for resuming and sends it to every matching subscription
+func (h *Hub) Publish(event events.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seq++
+	message := Message{ID: h.epoch + "-" + strconv.FormatUint(h.seq, 10), Event: event}
+
+	h.buffer = append(h.buffer, message)
+	if len(h.buffer) > BufferSize {
+		h.buffer = h.buffer[len(h.buffer)-BufferSize:]
+	}
+
+	for subscription := range h.subscribers {
+		if subscription.wants(event) {
+			subscription.deliver(message)
+		}
+	}
+}
+
+/*
+Subscribe starts a subscription. If lastEventID is set, the matching events after it that are still buffered
+are returned, resumed is false when that is not possible (unknown id, or too old) and the client should refetch.
+The hub only filters, checking the subscriber may see an event is up to the caller.
+*/
+func (h *Hub) Subscribe(filter Filter, lastEventID string) (subscription *Subscription, missed []Message, resumed bool) {
+	subscription = &Subscription{
+		hub:    h,
+		C:      make(chan Message, SubscriberBuffer),
+		filter: filter,
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	resumed = true
+	if lastEventID != "" {
+		missed, resumed = h.since(lastEventID)
+
+		kept := missed[:0]
+		for _, message := range missed {
+			if subscription.wants(message.Event) {
+				kept = append(kept, message)
+			}
+		}
+		missed = kept
+	}
+
+	h.subscribers[subscription] = struct{}{}
+	return subscription, missed, resumed
+}
+
+// since returns the buffered events after id. hub lock held
+func (h *Hub) since(id string) ([]Message, bool) {
+	epoch, seqString, found := strings.Cut(id, "-")
+	seq, err := strconv.ParseUint(seqString, 10, 64)
+	if !found || err != nil || epoch != h.epoch || seq > h.seq {
+		return nil, false
+	}
+
+	if len(h.buffer) == 0 {
+		return nil, seq == h.seq
+	}
+
+	// the buffer holds consecutive sequence numbers
+	first := h.seq - uint64(len(h.buffer)) + 1
+	if seq+1 < first {
+		return nil, false
+	}
+
+	return append([]Message(nil), h.buffer[seq+1-first:]...), true
+}
+
+// removeLocked ends a subscription. hub lock held
+func (h *Hub) removeLocked(subscription *Subscription) {
+	subscription.mu.Lock()
+	defer subscription.mu.Unlock()
+
+	if subscription.closed {
+		return
+	}
+	subscription.closed = true
+	delete(h.subscribers, subscription)
+	close(subscription.C)
+}
+
+// Count returns how many subscriptions are open
+func (h *Hub) Count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers)
+}
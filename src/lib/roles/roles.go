@@ -0,0 +1,199 @@
+package roles
+
+// named sets of permissions stored in the database (schema.Role). A user has the permissions granted to them
+// directly plus the ones of all their roles, changing a role drops its users from the user cache so the change
+// applies on their next request
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/chukfi/backend/database/schema"
+	usercache "github.com/chukfi/backend/src/lib/cache/user"
+	"github.com/chukfi/backend/src/lib/permissions"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrInvalidName       = errors.New("role name is required")
+	ErrNameTaken         = errors.New("a role with this name already exists")
+	ErrUnknownPermission = errors.New("unknown permission")
+	ErrRoleNotFound      = errors.New("role not found")
+	ErrUserNotFound      = errors.New("user not found")
+)
+
+const joinUserRoles = "JOIN user_roles ON user_roles.role_id = roles.id AND user_roles.deleted_at IS NULL"
+
+// PermissionsOf returns the permissions of all roles of the user
+func PermissionsOf(ctx context.Context, database *gorm.DB, userID string) (permissions.Permission, error) {
+	var values []permissions.Permission
+	err := database.WithContext(ctx).Model(&schema.Role{}).
+		Joins(joinUserRoles).
+		Where("user_roles.user_id = ?", userID).
+		Pluck("roles.permissions", &values).Error
+	if err != nil {
+		return permissions.Permission{}, err
+	}
+	return permissions.Permission{}.Union(values...), nil
+}
+
+// Load fills in the RolePermissions of the user, call it whenever a user is loaded to check their permissions
+func Load(ctx context.Context, database *gorm.DB, user *schema.User) error {
+	rolePermissions, err := PermissionsOf(ctx, database, user.ID.String())
+	if err != nil {
+		return err
+	}
+	user.RolePermissions = rolePermissions
+	return nil
+}
+
+// Of returns the roles of the user, by name
+func Of(ctx context.Context, database *gorm.DB, userID string) ([]schema.Role, error) {
+	var roles []schema.Role
+	err := database.WithContext(ctx).Joins(joinUserRoles).Where("user_roles.user_id = ?", userID).Order("roles.name").Find(&roles).Error
+	return roles, err
+}
+
+// Members returns the ids of the users with the role
+func Members(ctx context.Context, database *gorm.DB, roleID uuid.UUID) ([]string, error) {
+	var userIDs []string
+	err := database.WithContext(ctx).Model(&schema.UserRole{}).Where("role_id = ?", roleID).Pluck("user_id", &userIDs).Error
+	return userIDs, err
+}
+
+// ParsePermissions turns permission names into a Permission, unlike permissions.StringsToPermission an unknown name is an error
+func ParsePermissions(names []string) (permissions.Permission, error) {
+	var combined permissions.Permission
+	for _, name := range names {
+		perm, ok := permissions.GetPermissionByName(name)
+		if !ok {
+			return permissions.Permission{}, fmt.Errorf("%w: %s", ErrUnknownPermission, name)
+		}
+		combined = combined.Union(perm)
+	}
+	return combined, nil
+}
+
+// Validate checks the role can be saved, the name is trimmed
+func Validate(ctx context.Context, database *gorm.DB, role *schema.Role) error {
+	role.Name = strings.TrimSpace(role.Name)
+	if role.Name == "" {
+		return ErrInvalidName
+	}
+
+	var count int64
+	query := database.WithContext(ctx).Model(&schema.Role{}).Where("name = ?", role.Name)
+	if role.ID != uuid.Nil {
+		query = query.Where("id <> ?", role.ID)
+	}
+	if err := query.Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrNameTaken
+	}
+	return nil
+}
+
+// Get loads a role by id
+func Get(ctx context.Context, database *gorm.DB, roleID string) (*schema.Role, error) {
+	role, err := gorm.G[schema.Role](database).Where("id = ?", roleID).First(ctx)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrRoleNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// Update saves the changed role and drops its users from the user cache
+func Update(ctx context.Context, database *gorm.DB, role *schema.Role) error {
+	err := database.WithContext(ctx).Model(role).Select("name", "description", "permissions").Updates(map[string]interface{}{
+		"name":        role.Name,
+		"description": role.Description,
+		"permissions": role.Permissions,
+	}).Error
+	if err != nil {
+		return err
+	}
+	return Invalidate(ctx, database, role.ID)
+}
+
+// Delete deletes the role, taking it from every user that has it
+func Delete(ctx context.Context, database *gorm.DB, roleID uuid.UUID) error {
+	members, err := Members(ctx, database, roleID)
+	if err != nil {
+		return err
+	}
+
+	err = database.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("role_id = ?", roleID).Delete(&schema.UserRole{}).Error; err != nil {
+			return err
+		}
+		// not soft deleted, the name can be used again
+		res := tx.Unscoped().Where("id = ?", roleID).Delete(&schema.Role{})
+		if res.Error == nil && res.RowsAffected == 0 {
+			return ErrRoleNotFound
+		}
+		return res.Error
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, userID := range members {
+		usercache.UserCacheInstance.Delete(userID)
+	}
+	return nil
+}
+
+// Assign gives the user the role, giving it again is not an error
+func Assign(ctx context.Context, database *gorm.DB, userID uuid.UUID, roleID uuid.UUID) error {
+	var count int64
+	if err := database.WithContext(ctx).Model(&schema.User{}).Where("id = ?", userID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrUserNotFound
+	}
+
+	if err := database.WithContext(ctx).Model(&schema.UserRole{}).Where("user_id = ? AND role_id = ?", userID, roleID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		if err := gorm.G[schema.UserRole](database).Create(ctx, &schema.UserRole{UserID: userID, RoleID: roleID}); err != nil {
+			return err
+		}
+	}
+
+	usercache.UserCacheInstance.Delete(userID.String())
+	return nil
+}
+
+// Unassign takes the role from the user, taking a role the user doesn't have is not an error
+func Unassign(ctx context.Context, database *gorm.DB, userID uuid.UUID, roleID uuid.UUID) error {
+	// not soft deleted, the role can be given again (user_id, role_id is unique)
+	err := database.WithContext(ctx).Unscoped().Where("user_id = ? AND role_id = ?", userID, roleID).Delete(&schema.UserRole{}).Error
+	if err != nil {
+		return err
+	}
+
+	usercache.UserCacheInstance.Delete(userID.String())
+	return nil
+}
+
+// Invalidate drops the users with the role from the user cache, their permissions are loaded again on their next request
+func Invalidate(ctx context.Context, database *gorm.DB, roleID uuid.UUID) error {
+	members, err := Members(ctx, database, roleID)
+	if err != nil {
+		return err
+	}
+	for _, userID := range members {
+		usercache.UserCacheInstance.Delete(userID)
+	}
+	return nil
+}
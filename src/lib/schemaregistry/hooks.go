@@ -0,0 +1,128 @@
+package schemaregistry
+
+// lifecycle hooks, go code that runs around the reads and writes of the collection api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+type HookType string
+
+const (
+	BeforeCreate HookType = "beforeCreate"
+	AfterCreate  HookType = "afterCreate"
+	BeforeUpdate HookType = "beforeUpdate"
+	AfterUpdate  HookType = "afterUpdate"
+	BeforeDelete HookType = "beforeDelete"
+	AfterDelete  HookType = "afterDelete"
+	BeforeRead   HookType = "beforeRead"
+	AfterRead    HookType = "afterRead"
+)
+
+/*
+HookContext is what a hook gets to work with. Which fields are set depends on the hook:
+
+	Before/After Create, Update, Delete: Tx, ID (not for BeforeCreate) and Data
+	BeforeRead: Query, hooks may replace it (e.g hook.Query = hook.Query.Where("published = ?", true))
+	AfterRead: Results, the rows about to be sent, hooks may change or remove fields
+*/
+type HookContext struct {
+	Context    context.Context
+	Type       HookType
+	Collection string
+	ID         string
+	UserID     string
+
+	// Tx is the transaction the write runs in, anything done with it is rolled back if the write fails
+	Tx *gorm.DB
+	// Data is the body of the write (for deletes only the ID), hooks may change it
+	Data map[string]interface{}
+
+	Query   *gorm.DB
+	Results []map[string]interface{}
+}
+
+type Hook func(hook *HookContext) error
+
+/*
+HookError aborts the request with the given http status. Any other error returned by a hook
+is sent as a 500.
+*/
+type HookError struct {
+	Status  int
+	Message string
+	Details interface{}
+}
+
+func (e *HookError) Error() string {
+	return e.Message
+}
+
+// NewHookError creates a HookError, e.g schemaregistry.NewHookError(http.StatusConflict, "slug already taken")
+func NewHookError(status int, message string) *HookError {
+	return &HookError{Status: status, Message: message}
+}
+
+// Reject is a shorthand for a 400 HookError
+func Reject(format string, args ...interface{}) *HookError {
+	return NewHookError(http.StatusBadRequest, fmt.Sprintf(format, args...))
+}
+
+var (
+	hooks   = make(map[string]map[HookType][]Hook)
+	hooksMu sync.RWMutex
+)
+
+/*
+RegisterHook adds a hook for a collection, hooks of the same type run in the order they were registered.
+The first one to return an error stops the rest and aborts the request.
+
+	schemaregistry.RegisterHook("posts", schemaregistry.BeforeCreate, func(hook *schemaregistry.HookContext) error {
+		hook.Data["Slug"] = slugify(hook.Data["Title"])
+		return nil
+	})
+*/
+func RegisterHook(tableName string, hookType HookType, hook Hook) {
+	if resolved, ok := ResolveTableName(tableName); ok {
+		tableName = resolved
+	}
+
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+
+	if hooks[tableName] == nil {
+		hooks[tableName] = make(map[HookType][]Hook)
+	}
+	hooks[tableName][hookType] = append(hooks[tableName][hookType], hook)
+}
+
+// HasHooks checks if any hook of the type is registered for the collection
+func HasHooks(tableName string, hookType HookType) bool {
+	hooksMu.RLock()
+	defer hooksMu.RUnlock()
+
+	return len(hooks[tableName][hookType]) > 0
+}
+
+// RunHooks runs every hook of hook.Type registered for hook.Collection
+func RunHooks(hook *HookContext) error {
+	hooksMu.RLock()
+	registered := append([]Hook(nil), hooks[hook.Collection][hook.Type]...)
+	hooksMu.RUnlock()
+
+	if hook.Context == nil {
+		hook.Context = context.Background()
+	}
+
+	for _, run := range registered {
+		if err := run(hook); err != nil {
+			return err
+		}
+	}
+	return nil
+}
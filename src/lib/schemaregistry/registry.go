@@ -2,20 +2,33 @@ package schemaregistry
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
 	"strings"
 	"sync"
 
+	"github.com/chukfi/backend/src/lib/permissions"
 	"gorm.io/gorm/schema"
 )
 
 type FieldMetadata struct {
 	Name       string
+	Column     string
 	Type       string
 	GormTag    string
 	JSONTag    string
+	ChukfiTag  string
 	Required   bool
 	PrimaryKey bool
+	Searchable bool
+	// Filterable fields can be used in where filters and to sort on, tag a field chukfi:"nofilter" to prevent it
+	Filterable bool
+	// WriteOnly fields (chukfi:"writeOnly") can be written but are never sent back, e.g a password hash
+	WriteOnly bool
+	// ReadOnly fields (chukfi:"readonly") are set by the server (hooks), clients cant write them
+	ReadOnly bool
+	// ReadPermission (chukfi:"readPermission=ViewUsers") is the permission needed to read the field, empty for none
+	ReadPermission string
 }
 
 type SchemaMetadata struct {
@@ -96,19 +109,98 @@ func extractFieldsRecursive(t reflect.Type, fields *[]FieldMetadata) {
 		required := strings.Contains(gormTag, "not null")
 		primaryKey := strings.Contains(gormTag, "primaryKey") || strings.Contains(gormTag, "primarykey")
 
+		chukfiTag := field.Tag.Get("chukfi")
+		options := parseChukfiTag(chukfiTag)
+
 		fieldMeta := FieldMetadata{
 			Name:       jsonName,
+			Column:     columnName(field.Name, gormTag),
 			Type:       field.Type.String(),
 			GormTag:    gormTag,
 			JSONTag:    jsonTag,
+			ChukfiTag:  chukfiTag,
 			Required:   required,
 			PrimaryKey: primaryKey,
 		}
+		fieldMeta.applyOptions(options, field.Type.Kind() == reflect.String)
 
 		*fields = append(*fields, fieldMeta)
 	}
 }
 
+/*
+applyOptions sets what the chukfi tag options allow. Only text is full text searchable, and only if the schema
+didnt opt the field out. Write only fields and fields behind a permission can't be searched or filtered on either,
+the results would tell what the hidden value is
+*/
+func (field *FieldMetadata) applyOptions(options map[string]string, isString bool) {
+	_, noFilter := options["nofilter"]
+	_, field.WriteOnly = options["writeonly"]
+	_, field.ReadOnly = options["readonly"]
+	field.ReadPermission = options["readpermission"]
+
+	hidden := field.WriteOnly || field.ReadPermission != ""
+	field.Searchable = isString && field.Indexed()
+	field.Filterable = !noFilter && !hidden
+}
+
+/*
+Readable checks the field may be sent to a reader, hasPermission tells if the reader holds a permission (by name).
+Write only fields are never readable
+*/
+func (field FieldMetadata) Readable(hasPermission func(name string) bool) bool {
+	if field.WriteOnly {
+		return false
+	}
+	if field.ReadPermission != "" {
+		return hasPermission != nil && hasPermission(field.ReadPermission)
+	}
+	return true
+}
+
+// Indexed checks if the field is kept in the search index at all, fields tagged nosearch and write only fields never are
+func (field FieldMetadata) Indexed() bool {
+	return !field.HasOption("nosearch") && !field.WriteOnly
+}
+
+// HasOption checks if the field has the given option in its chukfi tag
+func (field FieldMetadata) HasOption(option string) bool {
+	_, ok := parseChukfiTag(field.ChukfiTag)[strings.ToLower(option)]
+	return ok
+}
+
+// Option returns the value of an option in the fields chukfi tag, e.g chukfi:"key=value"
+func (field FieldMetadata) Option(option string) (string, bool) {
+	value, ok := parseChukfiTag(field.ChukfiTag)[strings.ToLower(option)]
+	return value, ok
+}
+
+// columnName returns the database column for a struct field, honouring gorm:"column:..."
+func columnName(fieldName string, gormTag string) string {
+	for _, part := range strings.Split(gormTag, ";") {
+		part = strings.TrimSpace(part)
+		if strings.HasPrefix(strings.ToLower(part), "column:") {
+			return part[len("column:"):]
+		}
+	}
+
+	return schema.NamingStrategy{}.ColumnName("", fieldName)
+}
+
+// parseChukfiTag parses chukfi:"option,key=value" into a map, options without a value map to ""
+func parseChukfiTag(tag string) map[string]string {
+	options := make(map[string]string)
+	for _, part := range strings.Split(tag, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(part, "=")
+		options[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+	return options
+}
+
 func hasHiddenField(model interface{}) bool {
 	t := reflect.TypeOf(model)
 	if t.Kind() == reflect.Ptr {
@@ -159,6 +251,26 @@ func singularize(name string) string {
 	return name
 }
 
+// SingularName returns the singular form of a table name, e.g posts -> post
+func SingularName(tableName string) string {
+	return singularize(tableName)
+}
+
+/*
+registerPermissions registers the permissions of the collection (posts.read, posts.create...), and the override of
+collections with an owner field (posts.all). Without them (they couldnt be saved) the collection is only
+allowed through ViewModels / ManageModels
+*/
+func registerPermissions(tableName string, fields []FieldMetadata) {
+	err := permissions.RegisterCollectionPermissions(tableName)
+	if _, owned := ownerField(fields); owned && err == nil {
+		_, err = permissions.RegisterPermission(permissions.CollectionPermissionName(tableName, permissions.ActionAll))
+	}
+	if err != nil {
+		fmt.Printf("schemaregistry: no permissions for %s: %v\n", tableName, err)
+	}
+}
+
 func RegisterSchema(model interface{}) {
 	tableName := getTableName(model)
 	adminOnly := hasAdminOnlyField(model)
@@ -170,6 +282,8 @@ func RegisterSchema(model interface{}) {
 		return
 	}
 
+	registerPermissions(tableName, fields)
+
 	mu.Lock()
 	defer mu.Unlock()
 
@@ -185,6 +299,32 @@ func RegisterSchema(model interface{}) {
 	}
 }
 
+/*
+RegisterMetadata registers a schema from its metadata instead of a model, for schemas only known from
+their source (e.g the cli parsing a schema file). Columns left empty are derived from the field name.
+*/
+func RegisterMetadata(meta SchemaMetadata) {
+	for i := range meta.Fields {
+		field := &meta.Fields[i]
+		if field.Column == "" {
+			field.Column = columnName(field.Name, field.GormTag)
+		}
+		field.applyOptions(parseChukfiTag(field.ChukfiTag), field.Type == "string")
+	}
+
+	registerPermissions(meta.TableName, meta.Fields)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	registry[meta.TableName] = meta
+
+	singular := singularize(meta.TableName)
+	if singular != meta.TableName {
+		aliases[singular] = meta.TableName
+	}
+}
+
 func RegisterSchemas(models []interface{}) {
 	for _, model := range models {
 		RegisterSchema(model)
@@ -221,6 +361,71 @@ func GetFields(tableName string) ([]FieldMetadata, bool) {
 	return nil, false
 }
 
+// GetSearchableFields returns the fields that are full text searchable, the text fields of the Indexed ones
+func GetSearchableFields(tableName string) []FieldMetadata {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	var searchable []FieldMetadata
+	if meta, exists := registry[tableName]; exists {
+		for _, field := range meta.Fields {
+			if field.Searchable {
+				searchable = append(searchable, field)
+			}
+		}
+	}
+
+	return searchable
+}
+
+// HasField checks if the table has a field with the given name (or column name)
+func HasField(tableName string, name string) bool {
+	_, ok := GetField(tableName, name)
+	return ok
+}
+
+// GetField looks up a field by its name or its column name
+func GetField(tableName string, name string) (FieldMetadata, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if meta, exists := registry[tableName]; exists {
+		for _, field := range meta.Fields {
+			if field.Name == name || field.Column == name {
+				return field, true
+			}
+		}
+	}
+
+	return FieldMetadata{}, false
+}
+
+/*
+GetOwnerField returns the owner field of the collection, tagged chukfi:"owner" (e.g AuthorID). It holds the id of the
+user who created the entry, other users only see and change the entry with the override permission (posts.all)
+*/
+func GetOwnerField(tableName string) (FieldMetadata, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return ownerField(registry[tableName].Fields)
+}
+
+// ownerField returns the first field tagged chukfi:"owner"
+func ownerField(fields []FieldMetadata) (FieldMetadata, bool) {
+	for _, field := range fields {
+		if field.HasOption("owner") {
+			return field, true
+		}
+	}
+	return FieldMetadata{}, false
+}
+
+// HasSoftDelete checks if the table uses gorm soft deletes (has a DeletedAt field)
+func HasSoftDelete(tableName string) bool {
+	return HasField(tableName, "deleted_at")
+}
+
 func GetRequiredFields(tableName string) []string {
 	mu.RLock()
 	defer mu.RUnlock()
@@ -295,7 +500,8 @@ func ValidateBody(tableName string, body map[string]interface{}) (missingFields
 	}
 
 	for _, field := range meta.Fields {
-		if field.Required && !field.PrimaryKey {
+		// read only fields are set by the server, a hook has to fill them in
+		if field.Required && !field.PrimaryKey && !field.ReadOnly {
 			if _, exists := body[field.Name]; !exists {
 				missingFields = append(missingFields, field.Name)
 			}
@@ -311,6 +517,53 @@ func ValidateBody(tableName string, body map[string]interface{}) (missingFields
 	return missingFields, unknownFields
 }
 
+// ReadOnlyFields returns the read only fields set in the body, which clients may not write
+func ReadOnlyFields(tableName string, body map[string]interface{}) []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	var readOnly []string
+	for _, field := range registry[tableName].Fields {
+		if !field.ReadOnly {
+			continue
+		}
+		for _, key := range []string{field.Name, field.Column} {
+			if _, exists := body[key]; exists {
+				readOnly = append(readOnly, field.Name)
+				break
+			}
+		}
+	}
+	return readOnly
+}
+
+/*
+HideFields removes the fields the reader may not see from rows of the collection, rows are keyed by column
+(or by field name after an AfterRead hook). See FieldMetadata.Readable for hasPermission
+*/
+func HideFields(tableName string, rows []map[string]interface{}, hasPermission func(name string) bool) {
+	if len(rows) == 0 {
+		return
+	}
+
+	mu.RLock()
+	fields := registry[tableName].Fields
+	mu.RUnlock()
+
+	for _, field := range fields {
+		if !field.WriteOnly && field.ReadPermission == "" {
+			continue
+		}
+		if field.Readable(hasPermission) {
+			continue
+		}
+		for _, row := range rows {
+			delete(row, field.Name)
+			delete(row, field.Column)
+		}
+	}
+}
+
 // ResolveTableName resolves the actual table name from the provided name,
 // considering aliases and naming strategies.
 func ResolveTableName(name string) (string, bool) {
@@ -363,9 +616,14 @@ func GenerateTypescriptInterface(tableName string) (string, bool) {
 	var sb strings.Builder
 	sb.WriteString("export interface " + strings.Title(singularize(tableName)) + " {\n")
 	for _, field := range meta.Fields {
+		// never sent by the api, so not part of what a client gets
+		if field.WriteOnly {
+			continue
+		}
+
 		tsType := "any"
 		switch {
-		case strings.Contains(field.Type, "string"), strings.Contains(field.Type, "Text"), strings.Contains(field.Type, "UUID"):
+		case strings.Contains(field.Type, "string"), strings.Contains(field.Type, "Text"), strings.Contains(field.Type, "UUID"), field.Type == "permissions.Permission":
 			tsType = "string"
 		case strings.Contains(field.Type, "int"), strings.Contains(field.Type, "uint"), strings.Contains(field.Type, "float"), strings.Contains(field.Type, "double"):
 			tsType = "number"
@@ -375,12 +633,18 @@ func GenerateTypescriptInterface(tableName string) (string, bool) {
 			tsType = "Date"
 		}
 
+		// fields behind a permission are left out for readers without it
 		optional := ""
-		if !field.Required && !field.PrimaryKey {
+		if (!field.Required && !field.PrimaryKey) || field.ReadPermission != "" {
 			optional = "?"
 		}
 
-		sb.WriteString("  " + field.Name + optional + ": " + tsType + ";\n")
+		modifier := ""
+		if field.ReadOnly {
+			modifier = "readonly "
+		}
+
+		sb.WriteString("  " + modifier + field.Name + optional + ": " + tsType + ";\n")
 	}
 	sb.WriteString("}\n")
 
@@ -0,0 +1,381 @@
+package search
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// MemoryIndex is an in-process inverted index.
+// it is rebuilt from the database on startup (see Listen) so nothing is persisted.
+type MemoryIndex struct {
+	mu sync.RWMutex
+	// term -> document key -> field -> term frequency
+	postings  map[string]map[string]map[string]int
+	documents map[string]*indexedDocument
+}
+
+type indexedDocument struct {
+	collection string
+	id         string
+	values     map[string]interface{}
+	terms      []string
+}
+
+type termMatch struct {
+	term   string
+	weight float64
+}
+
+func NewMemoryIndex() *MemoryIndex {
+	return &MemoryIndex{
+		postings:  make(map[string]map[string]map[string]int),
+		documents: make(map[string]*indexedDocument),
+	}
+}
+
+func documentKey(collection string, id string) string {
+	return collection + "/" + id
+}
+
+// tokenize lowercases the text and splits it on anything that isnt a letter or a number
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func (m *MemoryIndex) Index(collection string, id string, document Document) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := documentKey(collection, id)
+	m.removeLocked(key)
+
+	doc := &indexedDocument{
+		collection: collection,
+		id:         id,
+		values:     make(map[string]interface{}, len(document.Values)),
+	}
+	for field, value := range document.Values {
+		doc.values[field] = value
+	}
+
+	seen := make(map[string]bool)
+	for _, field := range document.Searchable {
+		text, ok := document.Values[field].(string)
+		if !ok {
+			continue
+		}
+
+		for _, term := range tokenize(text) {
+			fields, exists := m.postings[term]
+			if !exists {
+				fields = make(map[string]map[string]int)
+				m.postings[term] = fields
+			}
+			if fields[key] == nil {
+				fields[key] = make(map[string]int)
+			}
+			fields[key][field]++
+
+			if !seen[term] {
+				seen[term] = true
+				doc.terms = append(doc.terms, term)
+			}
+		}
+	}
+
+	m.documents[key] = doc
+	return nil
+}
+
+func (m *MemoryIndex) Remove(collection string, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.removeLocked(documentKey(collection, id))
+	return nil
+}
+
+func (m *MemoryIndex) removeLocked(key string) {
+	doc, exists := m.documents[key]
+	if !exists {
+		return
+	}
+
+	for _, term := range doc.terms {
+		delete(m.postings[term], key)
+		if len(m.postings[term]) == 0 {
+			delete(m.postings, term)
+		}
+	}
+	delete(m.documents, key)
+}
+
+// expandTerm finds every indexed term that should count as a match for the query token.
+// exact matches weigh the most, then prefixes (only for the last token, for search as you type),
+// then terms within the typo tolerance of the token
+func (m *MemoryIndex) expandTerm(token string, allowPrefix bool) []termMatch {
+	maxDistance := typoTolerance(token)
+
+	var matches []termMatch
+	for term := range m.postings {
+		switch {
+		case term == token:
+			matches = append(matches, termMatch{term: term, weight: 1})
+		case allowPrefix && len(token) >= 2 && strings.HasPrefix(term, token):
+			matches = append(matches, termMatch{term: term, weight: 0.8})
+		case maxDistance > 0:
+			if distance := editDistance(token, term, maxDistance); distance <= maxDistance {
+				matches = append(matches, termMatch{term: term, weight: 0.7 / float64(1+distance)})
+			}
+		}
+	}
+
+	return matches
+}
+
+// typoTolerance returns how many edits a token may be away from an indexed term
+func typoTolerance(token string) int {
+	length := len([]rune(token))
+	switch {
+	case length < 4:
+		return 0
+	case length < 8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// editDistance returns the edit distance between a and b, counting a swap of two neighbouring
+// letters as one typo. gives up (returning max+1) once it is over max
+func editDistance(a string, b string, max int) int {
+	ar, br := []rune(a), []rune(b)
+	if diff := len(ar) - len(br); diff > max || -diff > max {
+		return max + 1
+	}
+
+	beforePrevious := make([]int, len(br)+1)
+	previous := make([]int, len(br)+1)
+	current := make([]int, len(br)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(ar); i++ {
+		current[0] = i
+		rowMin := current[0]
+		for j := 1; j <= len(br); j++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+			if i > 1 && j > 1 && ar[i-1] == br[j-2] && ar[i-2] == br[j-1] {
+				current[j] = min(current[j], beforePrevious[j-2]+1)
+			}
+			rowMin = min(rowMin, current[j])
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		beforePrevious, previous, current = previous, current, beforePrevious
+	}
+
+	return previous[len(br)]
+}
+
+func (m *MemoryIndex) Search(query Query) (*Results, error) {
+	tokens := tokenize(query.Text)
+	if len(tokens) == 0 && len(query.Filters) == 0 {
+		return nil, ErrEmptyQuery
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	collections := make(map[string]bool, len(query.Collections))
+	for _, collection := range query.Collections {
+		collections[collection] = true
+	}
+
+	type candidate struct {
+		score   float64
+		matches map[string]bool
+	}
+
+	var candidates map[string]*candidate
+
+	if len(tokens) == 0 {
+		// no text, only filters, so every document is a candidate
+		candidates = make(map[string]*candidate)
+		for key, doc := range m.documents {
+			if collections[doc.collection] {
+				candidates[key] = &candidate{matches: make(map[string]bool)}
+			}
+		}
+	}
+
+	total := float64(len(m.documents))
+
+	for i, token := range tokens {
+		tokenScores := make(map[string]float64)
+		tokenFields := make(map[string]map[string]bool)
+
+		for _, match := range m.expandTerm(token, i == len(tokens)-1) {
+			postings := m.postings[match.term]
+			idf := math.Log(1 + total/float64(len(postings)))
+
+			for key, fields := range postings {
+				doc := m.documents[key]
+				if !collections[doc.collection] {
+					continue
+				}
+
+				for field, frequency := range fields {
+					if !query.isVisible(doc.collection, field) {
+						continue
+					}
+					score := match.weight * idf * (1 + math.Log(float64(frequency)))
+					if score > tokenScores[key] {
+						tokenScores[key] = score
+					}
+					if tokenFields[key] == nil {
+						tokenFields[key] = make(map[string]bool)
+					}
+					tokenFields[key][field] = true
+				}
+			}
+		}
+
+		// every token has to match, so only keep documents that matched this one as well
+		next := make(map[string]*candidate)
+		for key, score := range tokenScores {
+			if candidates != nil {
+				if _, ok := candidates[key]; !ok {
+					continue
+				}
+			}
+
+			c := candidates[key]
+			if c == nil {
+				c = &candidate{matches: make(map[string]bool)}
+			}
+			c.score += score
+			for field := range tokenFields[key] {
+				c.matches[field] = true
+			}
+			next[key] = c
+		}
+		candidates = next
+	}
+
+	results := &Results{Hits: []Hit{}}
+	if len(query.Facets) > 0 {
+		results.Facets = make(map[string]map[string]int)
+		for _, facet := range query.Facets {
+			results.Facets[facet] = make(map[string]int)
+		}
+	}
+
+	for key, c := range candidates {
+		doc := m.documents[key]
+		if !matchesFilters(doc, query) {
+			continue
+		}
+
+		for _, facet := range query.Facets {
+			if !query.isVisible(doc.collection, facet) {
+				continue
+			}
+			if value, ok := doc.values[facet]; ok && value != nil {
+				results.Facets[facet][fmt.Sprint(value)]++
+			}
+		}
+
+		hit := Hit{
+			Collection: doc.collection,
+			ID:         doc.id,
+			Score:      c.score,
+			Matches:    make([]string, 0, len(c.matches)),
+			Document:   make(map[string]interface{}),
+		}
+		for field := range c.matches {
+			hit.Matches = append(hit.Matches, field)
+		}
+		sort.Strings(hit.Matches)
+		for field, value := range doc.values {
+			if query.isVisible(doc.collection, field) {
+				hit.Document[field] = value
+			}
+		}
+
+		results.Hits = append(results.Hits, hit)
+	}
+
+	sort.Slice(results.Hits, func(i, j int) bool {
+		a, b := results.Hits[i], results.Hits[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Collection != b.Collection {
+			return a.Collection < b.Collection
+		}
+		return a.ID < b.ID
+	})
+
+	results.Total = len(results.Hits)
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = 20
+	}
+	offset := max(query.Offset, 0)
+	if offset > len(results.Hits) {
+		offset = len(results.Hits)
+	}
+	results.Hits = results.Hits[offset:min(offset+limit, len(results.Hits))]
+
+	return results, nil
+}
+
+func matchesFilters(doc *indexedDocument, query Query) bool {
+	for field, allowed := range query.Filters {
+		if len(allowed) == 0 {
+			continue
+		}
+		// filtering on a field you cant see would leak its value
+		if !query.isVisible(doc.collection, field) {
+			return false
+		}
+		if !hasValue(doc, field, allowed) {
+			return false
+		}
+	}
+	for field, allowed := range query.CollectionFilters[doc.collection] {
+		if !hasValue(doc, field, allowed) {
+			return false
+		}
+	}
+	return query.DocumentVisible == nil || query.DocumentVisible(doc.collection, doc.values)
+}
+
+// hasValue checks the field of the document is one of the allowed values
+func hasValue(doc *indexedDocument, field string, allowed []string) bool {
+	value, ok := doc.values[field]
+	if !ok || value == nil {
+		return false
+	}
+
+	for _, candidate := range allowed {
+		if fmt.Sprint(value) == candidate {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package search
+
+// pluggable full text search, the collection routes keep whatever Engine is set here in sync
+// through the events bus (see Listen). ships with an in-process inverted index (MemoryIndex)
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	ErrEmptyQuery = errors.New("search query is empty")
+)
+
+// Engine is the interface every search backend has to implement
+type Engine interface {
+	// Index adds or replaces the document with the given id in the collection
+	Index(collection string, id string, document Document) error
+	// Remove removes a document from the index, removing a missing document is not an error
+	Remove(collection string, id string) error
+	// Search runs the query and returns the matching documents
+	Search(query Query) (*Results, error)
+}
+
+// Document is what gets indexed for a single entry.
+type Document struct {
+	// Values are stored and returned with hits, and used for filters and facets
+	Values map[string]interface{}
+	// Searchable are the fields in Values whose text is full text indexed
+	Searchable []string
+}
+
+// Query is a search request.
+type Query struct {
+	Text string
+	// Collections limits the search to these collections, empty searches nothing
+	Collections []string
+	// Filters narrows the hits to documents where field == one of the values
+	Filters map[string][]string
+	// CollectionFilters are Filters for the documents of one collection (collection -> field -> values), e.g to
+	// limit a collection to the entries a user owns. They apply whether FieldVisible allows the field or not
+	CollectionFilters map[string]map[string][]string
+	// Facets are the fields to count values for across all hits
+	Facets []string
+	Limit  int
+	Offset int
+	// FieldVisible decides if a field can be matched, returned, filtered or faceted on.
+	// nil means every field is visible
+	FieldVisible func(collection string, field string) bool
+	// DocumentVisible decides if a document can be hit at all, before hits are counted and paged, e.g for
+	// policies depending on the entry. nil means every document is visible
+	DocumentVisible func(collection string, values map[string]interface{}) bool
+}
+
+type Hit struct {
+	Collection string                 `json:"collection"`
+	ID         string                 `json:"id"`
+	Score      float64                `json:"score"`
+	Matches    []string               `json:"matches"`
+	Document   map[string]interface{} `json:"document"`
+}
+
+type Results struct {
+	Total  int                       `json:"total"`
+	Hits   []Hit                     `json:"hits"`
+	Facets map[string]map[string]int `json:"facets,omitempty"`
+}
+
+func (q Query) isVisible(collection string, field string) bool {
+	if q.FieldVisible == nil {
+		return true
+	}
+	return q.FieldVisible(collection, field)
+}
+
+var (
+	engine   Engine = NewMemoryIndex()
+	engineMu sync.RWMutex
+)
+
+// SetEngine replaces the search engine used by the collection routes.
+// Call it before Listen so the new engine gets backfilled.
+func SetEngine(e Engine) {
+	engineMu.Lock()
+	defer engineMu.Unlock()
+	engine = e
+}
+
+// GetEngine returns the current search engine
+func GetEngine() Engine {
+	engineMu.RLock()
+	defer engineMu.RUnlock()
+	return engine
+}
@@ -0,0 +1,130 @@
+package search
+
+import (
+	"fmt"
+
+	"github.com/chukfi/backend/src/lib/events"
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+	"gorm.io/gorm"
+)
+
+var unsubscribe func()
+
+/*
+Listen backfills the current engine from the database and keeps it in sync with every
+collection write published on the events bus. Calling it again resubscribes.
+*/
+func Listen(database *gorm.DB) error {
+	if unsubscribe != nil {
+		unsubscribe()
+	}
+
+	if err := Reindex(database); err != nil {
+		return err
+	}
+
+	unsubscribe = events.Subscribe(func(event events.Event) {
+		engine := GetEngine()
+
+		// a publish always comes with a create/update for the same entry
+		if event.Type == events.EventPublish {
+			return
+		}
+
+		if event.Type == events.EventDelete {
+			engine.Remove(event.Collection, event.ID)
+			return
+		}
+
+		if err := indexEntry(database, engine, event.Collection, event.ID); err != nil {
+			fmt.Printf("search: failed to index %s/%s: %v\n", event.Collection, event.ID, err)
+		}
+	})
+
+	return nil
+}
+
+// Reindex loads every entry of every registered collection into the current engine
+func Reindex(database *gorm.DB) error {
+	engine := GetEngine()
+
+	for tableName := range schemaregistry.GetAllRegisteredSchemas() {
+		query := database.Table(tableName)
+		if schemaregistry.HasSoftDelete(tableName) {
+			query = query.Where("deleted_at IS NULL")
+		}
+
+		var rows []map[string]interface{}
+		if err := query.Find(&rows).Error; err != nil {
+			return fmt.Errorf("failed to reindex %s: %w", tableName, err)
+		}
+
+		for _, row := range rows {
+			id := fmt.Sprint(row["id"])
+			if err := engine.Index(tableName, id, BuildDocument(tableName, row)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// indexEntry reads the entry back from the database so partial updates still index the whole row
+func indexEntry(database *gorm.DB, engine Engine, tableName string, id string) error {
+	query := database.Table(tableName).Where("id = ?", id)
+	if schemaregistry.HasSoftDelete(tableName) {
+		query = query.Where("deleted_at IS NULL")
+	}
+
+	var rows []map[string]interface{}
+	if err := query.Limit(1).Find(&rows).Error; err != nil {
+		return err
+	}
+
+	if len(rows) == 0 {
+		return engine.Remove(tableName, id)
+	}
+
+	return engine.Index(tableName, id, BuildDocument(tableName, rows[0]))
+}
+
+/*
+BuildDocument turns a database row into a search document keyed by the registry field names.
+Only Indexed fields are stored (never chukfi:"nosearch" or chukfi:"writeOnly"), the searchable ones of them are tokenized.
+*/
+func BuildDocument(tableName string, row map[string]interface{}) Document {
+	fields, _ := schemaregistry.GetFields(tableName)
+
+	document := Document{
+		Values: make(map[string]interface{}, len(fields)),
+	}
+	for _, field := range fields {
+		if !field.Indexed() || field.Column == "deleted_at" {
+			continue
+		}
+
+		value, ok := row[field.Column]
+		if !ok {
+			value, ok = row[field.Name]
+		}
+		if !ok {
+			continue
+		}
+
+		if bytes, isBytes := value.([]byte); isBytes {
+			value = string(bytes)
+		}
+
+		document.Values[field.Name] = value
+	}
+
+	// only searchable fields get tokenized, everything else is kept as a plain value for facets
+	for _, field := range schemaregistry.GetSearchableFields(tableName) {
+		if _, ok := document.Values[field.Name]; ok {
+			document.Searchable = append(document.Searchable, field.Name)
+		}
+	}
+
+	return document
+}
@@ -0,0 +1,35 @@
+package signing
+
+import (
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+// SigningKey is a HMAC key used to sign urls. The newest key signs, every key that isnt retired verifies
+type SigningKey struct {
+	ID        uuid.UUID `gorm:"type:char(36);primaryKey"`
+	KeyID     string    `gorm:"type:varchar(32);uniqueIndex;not null"`
+	Secret    string    `gorm:"type:varchar(128);not null"` // base64 encoded
+	RetiresAt int64     `gorm:"not null;default:0;index"`   // 0 while the key is still in use
+	CreatedAt time.Time
+}
+
+func (base *SigningKey) BeforeCreate(tx *gorm.DB) (err error) {
+	base.ID = uuid.NewV4()
+	return
+}
+
+// UsedSignedURL remembers the nonce of a single use url once it has been used
+type UsedSignedURL struct {
+	ID        uuid.UUID `gorm:"type:char(36);primaryKey"`
+	Nonce     string    `gorm:"type:char(32);uniqueIndex;not null"`
+	ExpiresAt int64     `gorm:"not null;index"`
+	CreatedAt time.Time
+}
+
+func (base *UsedSignedURL) BeforeCreate(tx *gorm.DB) (err error) {
+	base.ID = uuid.NewV4()
+	return
+}
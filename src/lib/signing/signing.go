@@ -0,0 +1,348 @@
+package signing
+
+// signed, expiring urls. a signed url carries its expiry, the id of the key it was signed with,
+// an optional single use nonce and a HMAC-SHA256 over the path and every other query parameter
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	ParamExpires   = "expires"
+	ParamKeyID     = "kid"
+	ParamNonce     = "nonce"
+	ParamSignature = "sig"
+)
+
+var (
+	// MaxTTL is the longest a signed url can be valid for
+	MaxTTL = 7 * 24 * time.Hour
+	// RotationInterval is how old the signing key may get before Init rotates it, 0 disables rotation
+	RotationInterval = 30 * 24 * time.Hour
+)
+
+var (
+	ErrNotSigned      = errors.New("url is not signed")
+	ErrInvalidURL     = errors.New("invalid signature")
+	ErrExpired        = errors.New("signed url has expired")
+	ErrUnknownKey     = errors.New("signed url was signed with an unknown key")
+	ErrAlreadyUsed    = errors.New("signed url has already been used")
+	ErrNoSigningKey   = errors.New("no signing key available, call signing.Init first")
+	ErrStaticKeys     = errors.New("signing keys are set through SIGNING_KEYS and cannot be rotated")
+	ErrTTLOutOfBounds = errors.New("ttl must be positive and at most the max ttl")
+)
+
+type key struct {
+	id        string
+	secret    []byte
+	retiresAt int64
+}
+
+type keySet struct {
+	mu       sync.RWMutex
+	keys     []key // newest first, keys[0] signs
+	static   bool
+	database *gorm.DB
+}
+
+var keys = &keySet{}
+
+type SignOptions struct {
+	TTL       time.Duration
+	SingleUse bool
+}
+
+/*
+Init loads the signing keys. If SIGNING_KEYS is set ("kid:base64secret,kid2:base64secret", the
+first one signs) those are used as is, otherwise the keys are kept in the database, one is created
+if there is none and the current key is rotated once it is older than RotationInterval.
+*/
+func Init(database *gorm.DB) error {
+	keys.mu.Lock()
+	defer keys.mu.Unlock()
+
+	keys.database = database
+
+	if env := os.Getenv("SIGNING_KEYS"); env != "" {
+		parsed, err := parseStaticKeys(env)
+		if err != nil {
+			return err
+		}
+		keys.keys = parsed
+		keys.static = true
+		return nil
+	}
+
+	if err := database.AutoMigrate(&SigningKey{}, &UsedSignedURL{}); err != nil {
+		return err
+	}
+
+	if err := keys.loadLocked(); err != nil {
+		return err
+	}
+
+	var current SigningKey
+	err := database.Where("retires_at = 0").Order("created_at desc").First(&current).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && RotationInterval > 0 && time.Since(current.CreatedAt) > RotationInterval) {
+		return keys.rotateLocked()
+	}
+	return err
+}
+
+func parseStaticKeys(env string) ([]key, error) {
+	var parsed []key
+	for _, entry := range strings.Split(env, ",") {
+		id, encoded, found := strings.Cut(strings.TrimSpace(entry), ":")
+		if !found || id == "" {
+			return nil, fmt.Errorf("invalid SIGNING_KEYS entry %q, expected kid:base64secret", entry)
+		}
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(secret) < 32 {
+			return nil, fmt.Errorf("invalid SIGNING_KEYS secret for %q, expected at least 32 base64 encoded bytes", id)
+		}
+		parsed = append(parsed, key{id: id, secret: secret})
+	}
+	return parsed, nil
+}
+
+// loadLocked reads every key that is not retired from the database
+func (k *keySet) loadLocked() error {
+	var stored []SigningKey
+	if err := k.database.Where("retires_at = 0 OR retires_at > ?", time.Now().Unix()).Order("created_at desc").Find(&stored).Error; err != nil {
+		return err
+	}
+
+	k.keys = k.keys[:0]
+	for _, s := range stored {
+		secret, err := base64.StdEncoding.DecodeString(s.Secret)
+		if err != nil {
+			return fmt.Errorf("signing key %s is corrupt: %w", s.KeyID, err)
+		}
+		k.keys = append(k.keys, key{id: s.KeyID, secret: secret, retiresAt: s.RetiresAt})
+	}
+	return nil
+}
+
+/*
+rotateLocked creates a new signing key. The old keys keep verifying until every url they could have
+signed has expired (MaxTTL), after that they are deleted
+*/
+func (k *keySet) rotateLocked() error {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	err := k.database.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&SigningKey{}).Where("retires_at = 0").Update("retires_at", now.Add(MaxTTL).Unix()).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("retires_at <> 0 AND retires_at <= ?", now.Unix()).Delete(&SigningKey{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&SigningKey{
+			KeyID:  hex.EncodeToString(idBytes),
+			Secret: base64.StdEncoding.EncodeToString(secret),
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	return k.loadLocked()
+}
+
+// Rotate replaces the signing key, urls signed with the old key stay valid until they expire
+func Rotate() error {
+	keys.mu.Lock()
+	defer keys.mu.Unlock()
+
+	if keys.static {
+		return ErrStaticKeys
+	}
+	if keys.database == nil {
+		return ErrNoSigningKey
+	}
+	return keys.rotateLocked()
+}
+
+// KeyInfo describes a signing key without its secret
+type KeyInfo struct {
+	KeyID     string     `json:"keyId"`
+	Current   bool       `json:"current"`
+	RetiresAt *time.Time `json:"retiresAt,omitempty"`
+}
+
+// GetKeys lists the keys that can currently verify urls
+func GetKeys() []KeyInfo {
+	keys.mu.RLock()
+	defer keys.mu.RUnlock()
+
+	infos := make([]KeyInfo, 0, len(keys.keys))
+	for i, k := range keys.keys {
+		info := KeyInfo{KeyID: k.id, Current: i == 0}
+		if k.retiresAt != 0 {
+			retiresAt := time.Unix(k.retiresAt, 0)
+			info.RetiresAt = &retiresAt
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// payload is what gets signed: the path and every query parameter except the signature, sorted
+func payload(path string, query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		if name != ParamSignature {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString(path)
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			sb.WriteString("\n" + url.QueryEscape(name) + "=" + url.QueryEscape(value))
+		}
+	}
+	return sb.String()
+}
+
+func computeSignature(secret []byte, path string, query url.Values) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload(path, query)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+/*
+Sign signs the path (and any query parameters already set, they cannot be changed afterwards)
+and returns the url with the signature parameters added, plus when it expires.
+*/
+func Sign(path string, query url.Values, options SignOptions) (string, time.Time, error) {
+	if options.TTL <= 0 || options.TTL > MaxTTL {
+		return "", time.Time{}, ErrTTLOutOfBounds
+	}
+
+	keys.mu.RLock()
+	if len(keys.keys) == 0 {
+		keys.mu.RUnlock()
+		return "", time.Time{}, ErrNoSigningKey
+	}
+	current := keys.keys[0]
+	keys.mu.RUnlock()
+
+	signed := url.Values{}
+	for name, values := range query {
+		signed[name] = append([]string(nil), values...)
+	}
+
+	expiresAt := time.Now().Add(options.TTL).Truncate(time.Second)
+	signed.Set(ParamExpires, strconv.FormatInt(expiresAt.Unix(), 10))
+	signed.Set(ParamKeyID, current.id)
+	signed.Del(ParamNonce)
+
+	if options.SingleUse {
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return "", time.Time{}, err
+		}
+		signed.Set(ParamNonce, hex.EncodeToString(nonce))
+	}
+
+	signed.Set(ParamSignature, computeSignature(current.secret, path, signed))
+
+	return path + "?" + signed.Encode(), expiresAt, nil
+}
+
+// IsSigned checks if the query carries a signature at all
+func IsSigned(query url.Values) bool {
+	return query.Get(ParamSignature) != ""
+}
+
+/*
+Verify checks the signature and expiry of a signed url. Single use urls are consumed by this call,
+so only call it when the request is actually going to be served.
+*/
+func Verify(path string, query url.Values) error {
+	if !IsSigned(query) {
+		return ErrNotSigned
+	}
+
+	expires, err := strconv.ParseInt(query.Get(ParamExpires), 10, 64)
+	if err != nil {
+		return ErrInvalidURL
+	}
+
+	keys.mu.RLock()
+	var secret []byte
+	for _, k := range keys.keys {
+		if k.id == query.Get(ParamKeyID) {
+			secret = k.secret
+			break
+		}
+	}
+	database := keys.database
+	keys.mu.RUnlock()
+
+	if secret == nil {
+		return ErrUnknownKey
+	}
+
+	expected := computeSignature(secret, path, query)
+	if !hmac.Equal([]byte(expected), []byte(query.Get(ParamSignature))) {
+		return ErrInvalidURL
+	}
+
+	// checked after the signature so an expired url cant be probed for a valid signature
+	if time.Now().Unix() > expires {
+		return ErrExpired
+	}
+
+	if nonce := query.Get(ParamNonce); nonce != "" {
+		if database == nil {
+			return ErrNoSigningKey
+		}
+
+		result := database.Clauses(clause.OnConflict{DoNothing: true}).Create(&UsedSignedURL{
+			Nonce:     nonce,
+			ExpiresAt: expires,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrAlreadyUsed
+		}
+
+		// nonces of expired urls are useless, keep the table small
+		database.Where("expires_at < ?", time.Now().Unix()).Delete(&UsedSignedURL{})
+	}
+
+	return nil
+}
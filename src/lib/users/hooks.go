@@ -0,0 +1,109 @@
+package users
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/chukfi/backend/database/schema"
+	usercache "github.com/chukfi/backend/src/lib/cache/user"
+	"github.com/chukfi/backend/src/lib/permissions"
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+)
+
+var registerHooks sync.Once
+
+/*
+RegisterHooks makes writing users through the collection api follow the rules of /admin/users: every create, update
+and delete needs a user who may manage the user (see CanManage), nobody deletes their own account, passwords are
+always hashed before they are saved and the user is dropped from the user cache after every write. Permissions and
+Disabled are read only there, they go through /admin/users and /admin/permissions. Registering more than once does nothing
+*/
+func RegisterHooks() {
+	registerHooks.Do(func() {
+		schemaregistry.RegisterHook("users", schemaregistry.BeforeCreate, manageHook)
+		schemaregistry.RegisterHook("users", schemaregistry.BeforeUpdate, manageHook)
+		schemaregistry.RegisterHook("users", schemaregistry.BeforeDelete, manageHook)
+		schemaregistry.RegisterHook("users", schemaregistry.BeforeCreate, hashPasswordHook)
+		schemaregistry.RegisterHook("users", schemaregistry.BeforeUpdate, hashPasswordHook)
+		schemaregistry.RegisterHook("users", schemaregistry.AfterUpdate, afterWriteHook)
+		schemaregistry.RegisterHook("users", schemaregistry.AfterDelete, afterWriteHook)
+	})
+}
+
+/*
+CanManage checks manager may change the account of user: they need ManageUsers and every permission user has
+(Administrators have all of them), so nobody can take over an account with more permissions than their own
+*/
+func CanManage(manager *schema.User, user *schema.User) bool {
+	managerPermissions := manager.EffectivePermissions()
+	return permissions.HasPermission(managerPermissions, permissions.ManageUsers) &&
+		permissions.HasPermission(managerPermissions, user.EffectivePermissions())
+}
+
+// dataValue returns the value of a field in the body of a write, which has it by name or by column
+func dataValue(data map[string]interface{}, name string, column string) (interface{}, string, bool) {
+	if value, ok := data[name]; ok {
+		return value, name, true
+	}
+	value, ok := data[column]
+	return value, column, ok
+}
+
+// manageHook checks the user of the request may manage the user they write, like canManageUser and notSelf of /admin/users
+func manageHook(hook *schemaregistry.HookContext) error {
+	if hook.Type == schemaregistry.BeforeDelete && hook.ID == hook.UserID {
+		return schemaregistry.Reject("You can't delete your own account")
+	}
+
+	manager, err := Get(hook.Context, hook.Tx, hook.UserID)
+	if errors.Is(err, ErrUserNotFound) {
+		return schemaregistry.NewHookError(http.StatusForbidden, "Forbidden: You can only manage users with permissions you have yourself")
+	}
+	if err != nil {
+		return err
+	}
+
+	// a new user gets the default of the permissions column, Permissions can't be set through the collection api
+	user := &schema.User{Permissions: permissions.ViewDashboard}
+	if hook.Type != schemaregistry.BeforeCreate {
+		user, err = Get(hook.Context, hook.Tx, hook.ID)
+		if errors.Is(err, ErrUserNotFound) {
+			return schemaregistry.NewHookError(http.StatusBadRequest, "No entry found with the given ID")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !CanManage(manager, user) {
+		return schemaregistry.NewHookError(http.StatusForbidden, "Forbidden: You can only manage users with permissions you have yourself")
+	}
+	return nil
+}
+
+// hashPasswordHook hashes the password of the write, whatever the client sent
+func hashPasswordHook(hook *schemaregistry.HookContext) error {
+	value, key, ok := dataValue(hook.Data, "Password", "password")
+	if !ok {
+		return nil
+	}
+
+	password, isString := value.(string)
+	if !isString {
+		return schemaregistry.Reject("Password must be a string")
+	}
+	hash, err := HashPassword(password)
+	if errors.Is(err, ErrPasswordTooShort) {
+		return schemaregistry.Reject("Invalid password: %s", err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	hook.Data[key] = hash
+	return nil
+}
+
+func afterWriteHook(hook *schemaregistry.HookContext) error {
+	usercache.UserCacheInstance.Delete(hook.ID)
+	return nil
+}
@@ -0,0 +1,253 @@
+package users
+
+// changes to users that have to keep the user cache right, the cached user of a request is dropped so the change
+// applies on their next request
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"strings"
+
+	"github.com/chukfi/backend/database/schema"
+	usercache "github.com/chukfi/backend/src/lib/cache/user"
+	"github.com/chukfi/backend/src/lib/permissions"
+	"github.com/chukfi/backend/src/lib/roles"
+	uuid "github.com/satori/go.uuid"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrUserNotFound     = errors.New("user not found")
+	ErrInvalidName      = errors.New("fullname is required and can't be longer than 100 characters")
+	ErrInvalidEmail     = errors.New("invalid email address")
+	ErrEmailTaken       = errors.New("a user with this email already exists")
+	ErrPasswordTooShort = errors.New("password must be at least 8 characters")
+)
+
+// MinPasswordLength is the length passwords need when they are set through the api
+const MinPasswordLength = 8
+
+// HashPassword checks the password is long enough and returns its bcrypt hash
+func HashPassword(password string) (string, error) {
+	if len(password) < MinPasswordLength {
+		return "", ErrPasswordTooShort
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Validate checks the profile of the user can be saved, the fullname and email are trimmed
+func Validate(ctx context.Context, database *gorm.DB, user *schema.User) error {
+	user.Fullname = strings.TrimSpace(user.Fullname)
+	if user.Fullname == "" || len(user.Fullname) > 100 {
+		return ErrInvalidName
+	}
+
+	user.Email = strings.TrimSpace(user.Email)
+	address, err := mail.ParseAddress(user.Email)
+	if err != nil || address.Address != user.Email || len(user.Email) > 100 {
+		return ErrInvalidEmail
+	}
+
+	// soft deleted users keep their email in the unique index
+	var count int64
+	query := database.WithContext(ctx).Unscoped().Model(&schema.User{}).Where("email = ?", user.Email)
+	if user.ID != uuid.Nil {
+		query = query.Where("id <> ?", user.ID)
+	}
+	if err := query.Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrEmailTaken
+	}
+	return nil
+}
+
+// Get loads a user by id, with the permissions of their roles
+func Get(ctx context.Context, database *gorm.DB, userID string) (*schema.User, error) {
+	user, err := gorm.G[schema.User](database).Where("id = ?", userID).First(ctx)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := roles.Load(ctx, database, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Search returns a page of the users whose fullname or email contains text (every user when it is empty) and how many there are
+func Search(ctx context.Context, database *gorm.DB, text string, limit int, offset int) ([]schema.User, int64, error) {
+	query := database.WithContext(ctx).Model(&schema.User{})
+	if text = strings.TrimSpace(text); text != "" {
+		pattern := "%" + escapeLike(text) + "%"
+		query = query.Where("fullname LIKE ? OR email LIKE ?", pattern, pattern)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var found []schema.User
+	err := query.Order("fullname").Order("email").Limit(limit).Offset(offset).Find(&found).Error
+	return found, total, err
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern
+func escapeLike(text string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(text)
+}
+
+// Create validates and saves a new user, password is the plain text password
+func Create(ctx context.Context, database *gorm.DB, user *schema.User, password string) error {
+	if err := Validate(ctx, database, user); err != nil {
+		return err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	user.Password = hash
+
+	// every field, a user without permissions would get the default of the column
+	return database.WithContext(ctx).Select("*").Create(user).Error
+}
+
+// UpdateProfile validates and saves the fullname and email of the user
+func UpdateProfile(ctx context.Context, database *gorm.DB, user *schema.User) error {
+	if err := Validate(ctx, database, user); err != nil {
+		return err
+	}
+	err := database.WithContext(ctx).Model(user).Select("fullname", "email").Updates(map[string]interface{}{
+		"fullname": user.Fullname,
+		"email":    user.Email,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	usercache.UserCacheInstance.Delete(user.ID.String())
+	return nil
+}
+
+// SetPassword changes the password of the user and logs them out everywhere but keepToken (the session changing it, if any)
+func SetPassword(ctx context.Context, database *gorm.DB, userID uuid.UUID, password string, keepToken string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	err = database.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&schema.User{}).Where("id = ?", userID).Update("password", hash).Error; err != nil {
+			return err
+		}
+		return Logout(tx, userID, keepToken)
+	})
+	if err != nil {
+		return err
+	}
+
+	usercache.UserCacheInstance.Delete(userID.String())
+	return nil
+}
+
+// SetDisabled disables or enables the user. Disabled users can't log in and are logged out everywhere
+func SetDisabled(ctx context.Context, database *gorm.DB, userID uuid.UUID, disabled bool) error {
+	err := database.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&schema.User{}).Where("id = ?", userID).Update("disabled", disabled).Error; err != nil {
+			return err
+		}
+		if !disabled {
+			return nil
+		}
+		return Logout(tx, userID, "")
+	})
+	if err != nil {
+		return err
+	}
+
+	usercache.UserCacheInstance.Delete(userID.String())
+	return nil
+}
+
+// Logout deletes the auth tokens of the user but keepToken ("" for all of them)
+func Logout(tx *gorm.DB, userID uuid.UUID, keepToken string) error {
+	query := tx.Unscoped().Where("user_id = ?", userID)
+	if keepToken != "" {
+		query = query.Where("token <> ?", keepToken)
+	}
+	return query.Delete(&schema.UserToken{}).Error
+}
+
+// Delete deletes the user with their tokens and roles. Not soft deleted, the email can be used again
+func Delete(ctx context.Context, database *gorm.DB, userID uuid.UUID) error {
+	err := database.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := Logout(tx, userID, ""); err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&schema.UserRole{}).Error; err != nil {
+			return err
+		}
+		res := tx.Unscoped().Where("id = ?", userID).Delete(&schema.User{})
+		if res.Error == nil && res.RowsAffected == 0 {
+			return ErrUserNotFound
+		}
+		return res.Error
+	})
+	if err != nil {
+		return err
+	}
+
+	usercache.UserCacheInstance.Delete(userID.String())
+	return nil
+}
+
+/*
+UpdatePermissions changes the permissions granted to the user directly, change gets the current ones and returns the
+new ones. The user is locked while it runs, so concurrent changes don't overwrite each other
+*/
+func UpdatePermissions(ctx context.Context, database *gorm.DB, userID string, change func(permissions.Permission) permissions.Permission) (*schema.User, error) {
+	var user schema.User
+	err := database.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id = ?", userID).First(&user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUserNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		user.Permissions = change(user.Permissions)
+		return tx.Model(&user).Update("permissions", user.Permissions).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	usercache.UserCacheInstance.Delete(user.ID.String())
+	return &user, nil
+}
+
+// Grant gives the user the permissions, on top of the ones they have
+func Grant(ctx context.Context, database *gorm.DB, userID string, granted permissions.Permission) (*schema.User, error) {
+	return UpdatePermissions(ctx, database, userID, func(current permissions.Permission) permissions.Permission {
+		return current.Union(granted)
+	})
+}
+
+// Revoke takes the permissions from the user, the ones they have through a role stay
+func Revoke(ctx context.Context, database *gorm.DB, userID string, revoked permissions.Permission) (*schema.User, error) {
+	return UpdatePermissions(ctx, database, userID, func(current permissions.Permission) permissions.Permission {
+		return current.Without(revoked)
+	})
+}
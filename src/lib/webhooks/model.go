@@ -0,0 +1,139 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+// Webhook is an endpoint that receives collection events.
+// Collections and Events are comma separated, empty means every collection / every event type
+type Webhook struct {
+	ID          uuid.UUID      `gorm:"type:char(36);primaryKey" json:"id"`
+	Name        string         `gorm:"type:varchar(100);not null" json:"name"`
+	URL         string         `gorm:"type:varchar(2048);not null" json:"url"`
+	Secret      string         `gorm:"type:varchar(128);not null" json:"-"`
+	Collections string         `gorm:"type:varchar(1024)" json:"-"`
+	Events      string         `gorm:"type:varchar(255)" json:"-"`
+	Enabled     bool           `gorm:"not null;default:true" json:"enabled"`
+	CreatedBy   string         `gorm:"type:char(36)" json:"createdBy"`
+	CreatedAt   time.Time      `json:"createdAt"`
+	UpdatedAt   time.Time      `json:"updatedAt"`
+	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+func (base *Webhook) BeforeCreate(tx *gorm.DB) (err error) {
+	base.ID = uuid.NewV4()
+	return
+}
+
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// MarshalJSON sends the collections and events as lists, the secret is never included
+func (w Webhook) MarshalJSON() ([]byte, error) {
+	type plain Webhook
+	return json.Marshal(struct {
+		plain
+		Collections []string `json:"collections"`
+		Events      []string `json:"events"`
+	}{plain(w), w.CollectionList(), w.EventList()})
+}
+
+// CollectionList returns the collections the webhook listens to, empty for all
+func (w Webhook) CollectionList() []string {
+	return splitList(w.Collections)
+}
+
+// EventList returns the event types the webhook listens to, empty for all
+func (w Webhook) EventList() []string {
+	return splitList(w.Events)
+}
+
+// Matches checks if the webhook wants an event of eventType on collection
+func (w Webhook) Matches(collection string, eventType string) bool {
+	if !w.Enabled {
+		return false
+	}
+
+	collections := w.CollectionList()
+	if len(collections) > 0 && !contains(collections, collection) {
+		return false
+	}
+
+	types := w.EventList()
+	return len(types) == 0 || contains(types, eventType)
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	StatusPending   = "pending"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// Delivery is a single event sent (or being sent) to a webhook, every http request made for it is an Attempt
+type Delivery struct {
+	ID            uuid.UUID `gorm:"type:char(36);primaryKey" json:"id"`
+	WebhookID     uuid.UUID `gorm:"type:char(36);not null;index" json:"webhookId"`
+	EventType     string    `gorm:"type:varchar(32);not null" json:"eventType"`
+	Collection    string    `gorm:"type:varchar(100);not null" json:"collection"`
+	EntryID       string    `gorm:"type:varchar(64)" json:"entryId"`
+	Payload       string    `gorm:"not null" json:"payload"`
+	Status        string    `gorm:"type:varchar(16);not null;index" json:"status"`
+	Attempts      int       `gorm:"not null;default:0" json:"attempts"`
+	NextAttemptAt int64     `gorm:"not null;index" json:"nextAttemptAt"` // unix, also used as a lease while sending
+	ReplayOf      string    `gorm:"type:char(36)" json:"replayOf,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+func (Delivery) TableName() string {
+	return "webhook_deliveries"
+}
+
+func (base *Delivery) BeforeCreate(tx *gorm.DB) (err error) {
+	if base.ID == uuid.Nil {
+		base.ID = uuid.NewV4()
+	}
+	return
+}
+
+// Attempt is one http request made for a delivery
+type Attempt struct {
+	ID             uuid.UUID `gorm:"type:char(36);primaryKey" json:"id"`
+	DeliveryID     uuid.UUID `gorm:"type:char(36);not null;index" json:"deliveryId"`
+	Number         int       `gorm:"not null" json:"number"`
+	ResponseStatus int       `json:"responseStatus"`
+	ResponseBody   string    `gorm:"type:text" json:"responseBody"` // truncated
+	Error          string    `gorm:"type:text" json:"error,omitempty"`
+	DurationMs     int64     `json:"durationMs"`
+	CreatedAt      time.Time `json:"createdAt"`
+}
+
+func (Attempt) TableName() string {
+	return "webhook_attempts"
+}
+
+func (base *Attempt) BeforeCreate(tx *gorm.DB) (err error) {
+	base.ID = uuid.NewV4()
+	return
+}
@@ -0,0 +1,440 @@
+package webhooks
+
+// outgoing webhooks. every collection event matching a webhook becomes a Delivery row, a dispatcher
+// sends the due deliveries and retries failures with exponential backoff. since the queue lives in
+// the database nothing is lost on restart and several instances can share it
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chukfi/backend/src/lib/events"
+	"github.com/chukfi/backend/src/lib/schemaregistry"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	// MaxAttempts is how often a delivery is tried before it is marked as failed
+	MaxAttempts = 8
+	// RetryBaseDelay is the wait before the first retry, it doubles with every attempt
+	RetryBaseDelay = 30 * time.Second
+	// MaxRetryDelay caps the backoff
+	MaxRetryDelay = 6 * time.Hour
+	// Timeout is how long an endpoint gets to respond
+	Timeout = 10 * time.Second
+	// PollInterval is how often the dispatcher looks for due deliveries when nothing new comes in
+	PollInterval = 5 * time.Second
+	// Workers is how many deliveries are sent at the same time
+	Workers = 4
+	// QueueSize is how many events wait to be turned into deliveries before publishing them blocks
+	QueueSize = 1024
+	// Client sends the requests, replace it to add a proxy etc
+	Client = &http.Client{}
+)
+
+const (
+	// how much of a response body is kept in the delivery log
+	maxResponseBody = 2048
+
+	HeaderSignature = "Chukfi-Signature"
+	HeaderEvent     = "Chukfi-Event"
+	HeaderDelivery  = "Chukfi-Delivery"
+	HeaderWebhook   = "Chukfi-Webhook"
+)
+
+var (
+	ErrInvalidURL        = errors.New("webhook url must be an absolute http or https url")
+	ErrInvalidEvent      = errors.New("unknown event type")
+	ErrInvalidName       = errors.New("webhook name is required")
+	ErrUnknownCollection = errors.New("unknown collection")
+	ErrWebhookNotFound   = errors.New("webhook not found")
+	ErrDeliveryNotFound  = errors.New("delivery not found")
+)
+
+// Payload is the json body sent to the endpoints
+type Payload struct {
+	ID         string                 `json:"id"` // the delivery id, also sent as the Chukfi-Delivery header
+	Type       events.EventType       `json:"type"`
+	Collection string                 `json:"collection"`
+	EntryID    string                 `json:"entryId"`
+	Data       map[string]interface{} `json:"data,omitempty"`
+	UserID     string                 `json:"userId,omitempty"`
+	Time       time.Time              `json:"time"`
+}
+
+type dispatcher struct {
+	database    *gorm.DB
+	events      chan events.Event
+	wake        chan struct{}
+	unsubscribe func()
+	stop        chan struct{}
+}
+
+var active *dispatcher
+
+/*
+Init migrates the webhook tables, starts the dispatcher and subscribes to the events bus.
+*/
+func Init(database *gorm.DB) error {
+	if err := database.AutoMigrate(&Webhook{}, &Delivery{}, &Attempt{}); err != nil {
+		return err
+	}
+
+	if active != nil {
+		active.unsubscribe()
+		close(active.stop)
+	}
+
+	d := &dispatcher{
+		database: database,
+		events:   make(chan events.Event, QueueSize),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	d.unsubscribe = events.Subscribe(d.receive)
+	active = d
+
+	go d.queue()
+	go d.run()
+	return nil
+}
+
+// GenerateSecret creates a new random secret for signing payloads
+func GenerateSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(secret), nil
+}
+
+/*
+Sign returns the value of the Chukfi-Signature header: "t=<unix timestamp>,v1=<hex hmac>" where the hmac is
+HMAC-SHA256(secret, "<timestamp>.<body>"). receivers should recompute it and reject old timestamps.
+*/
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10) + "."))
+	mac.Write(body)
+	return "t=" + strconv.FormatInt(timestamp.Unix(), 10) + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Validate checks and normalises a webhook before it is saved
+func Validate(webhook *Webhook) error {
+	webhook.Name = strings.TrimSpace(webhook.Name)
+	if webhook.Name == "" {
+		return ErrInvalidName
+	}
+
+	parsed, err := url.Parse(webhook.URL)
+	if err != nil || !parsed.IsAbs() || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return ErrInvalidURL
+	}
+
+	collections := webhook.CollectionList()
+	for i, collection := range collections {
+		resolved, ok := schemaregistry.ResolveTableName(collection)
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownCollection, collection)
+		}
+		collections[i] = resolved
+	}
+	webhook.Collections = strings.Join(collections, ",")
+
+	for _, eventType := range webhook.EventList() {
+		known := false
+		for _, t := range events.AllEventTypes {
+			if string(t) == eventType {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("%w: %s", ErrInvalidEvent, eventType)
+		}
+	}
+
+	return nil
+}
+
+// receive hands the event to queue, subscribers run on the request path of the write
+func (d *dispatcher) receive(event events.Event) {
+	select {
+	case d.events <- event:
+	case <-d.stop:
+	}
+}
+
+// queue enqueues the received events one after another, so their deliveries keep the order of the writes
+func (d *dispatcher) queue() {
+	for {
+		select {
+		case event := <-d.events:
+			d.enqueue(event)
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// enqueue turns an event into a delivery for every matching webhook
+func (d *dispatcher) enqueue(event events.Event) {
+	var hooks []Webhook
+	if err := d.database.Where("enabled = ?", true).Find(&hooks).Error; err != nil {
+		fmt.Println("webhooks: failed to load webhooks:", err)
+		return
+	}
+
+	queued := false
+	for _, hook := range hooks {
+		if !hook.Matches(event.Collection, string(event.Type)) {
+			continue
+		}
+
+		delivery := Delivery{
+			WebhookID:     hook.ID,
+			EventType:     string(event.Type),
+			Collection:    event.Collection,
+			EntryID:       event.ID,
+			Status:        StatusPending,
+			NextAttemptAt: time.Now().Unix(),
+		}
+		// the id is needed inside the payload, so it is set here instead of in BeforeCreate
+		id := uuid.NewV4()
+		delivery.ID = id
+
+		body, err := json.Marshal(Payload{
+			ID:         id.String(),
+			Type:       event.Type,
+			Collection: event.Collection,
+			EntryID:    event.ID,
+			Data:       event.Data,
+			UserID:     event.UserID,
+			Time:       event.Time,
+		})
+		if err != nil {
+			fmt.Println("webhooks: failed to encode payload:", err)
+			continue
+		}
+		delivery.Payload = string(body)
+
+		if err := d.database.Create(&delivery).Error; err != nil {
+			fmt.Println("webhooks: failed to queue delivery:", err)
+			continue
+		}
+		queued = true
+	}
+
+	if queued {
+		d.notify()
+	}
+}
+
+func (d *dispatcher) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *dispatcher) run() {
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+
+	for {
+		d.dispatchDue()
+
+		select {
+		case <-d.wake:
+		case <-ticker.C:
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// dispatchDue sends every delivery that is due, Workers at a time
+func (d *dispatcher) dispatchDue() {
+	for {
+		var due []Delivery
+		err := d.database.Where("status = ? AND next_attempt_at <= ?", StatusPending, time.Now().Unix()).
+			Order("next_attempt_at").Limit(Workers * 4).Find(&due).Error
+		if err != nil {
+			fmt.Println("webhooks: failed to load due deliveries:", err)
+			return
+		}
+		if len(due) == 0 {
+			return
+		}
+
+		work := make(chan Delivery)
+		var wg sync.WaitGroup
+		var sent atomic.Int32
+		for range min(Workers, len(due)) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for delivery := range work {
+					if d.attempt(&delivery) {
+						sent.Add(1)
+					}
+				}
+			}()
+		}
+		for _, delivery := range due {
+			work <- delivery
+		}
+		close(work)
+		wg.Wait()
+
+		// nothing could be claimed (another instance has them or the database is failing), try again on the next tick
+		if sent.Load() == 0 {
+			return
+		}
+	}
+}
+
+// claim takes a lease on the delivery so no other worker (or instance) sends it at the same time
+func (d *dispatcher) claim(delivery *Delivery) bool {
+	lease := time.Now().Add(2 * Timeout).Unix()
+	result := d.database.Model(&Delivery{}).
+		Where("id = ? AND status = ? AND next_attempt_at = ?", delivery.ID, StatusPending, delivery.NextAttemptAt).
+		Update("next_attempt_at", lease)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false
+	}
+	delivery.NextAttemptAt = lease
+	return true
+}
+
+// backoff is the wait before the given retry (1 for the first retry), with some jitter
+func backoff(retry int) time.Duration {
+	delay := time.Duration(float64(RetryBaseDelay) * math.Pow(2, float64(retry-1)))
+	if delay > MaxRetryDelay || delay <= 0 {
+		delay = MaxRetryDelay
+	}
+	return delay + time.Duration(mathrand.Int64N(int64(delay)/10+1))
+}
+
+// attempt sends the delivery once and schedules the retry, returns false if it could not be claimed
+func (d *dispatcher) attempt(delivery *Delivery) bool {
+	if !d.claim(delivery) {
+		return false
+	}
+
+	var hook Webhook
+	err := d.database.Where("id = ?", delivery.WebhookID).First(&hook).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// the webhook was deleted, nothing to send to anymore
+		d.database.Model(delivery).Updates(map[string]interface{}{"status": StatusFailed})
+		return true
+	}
+	if err != nil {
+		fmt.Println("webhooks: failed to load webhook:", err)
+		return true
+	}
+
+	record := Attempt{DeliveryID: delivery.ID, Number: delivery.Attempts + 1}
+	record.ResponseStatus, record.ResponseBody, record.DurationMs, err = send(&hook, delivery)
+	if err != nil {
+		record.Error = err.Error()
+	}
+	d.database.Create(&record)
+
+	updates := map[string]interface{}{"attempts": record.Number}
+	switch {
+	case err == nil && record.ResponseStatus >= 200 && record.ResponseStatus < 300:
+		updates["status"] = StatusSucceeded
+	case record.Number >= MaxAttempts:
+		updates["status"] = StatusFailed
+	default:
+		updates["next_attempt_at"] = time.Now().Add(backoff(record.Number)).Unix()
+	}
+	if err := d.database.Model(delivery).Updates(updates).Error; err != nil {
+		fmt.Println("webhooks: failed to update delivery:", err)
+	}
+	return true
+}
+
+// send makes the http request for a delivery, returns the response status, the (truncated) body and how long it took
+func send(hook *Webhook, delivery *Delivery) (int, string, int64, error) {
+	body := []byte(delivery.Payload)
+
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "Chukfi-Webhooks/1.0")
+	request.Header.Set(HeaderSignature, Sign(hook.Secret, time.Now(), body))
+	request.Header.Set(HeaderEvent, delivery.EventType)
+	request.Header.Set(HeaderDelivery, delivery.ID.String())
+	request.Header.Set(HeaderWebhook, hook.ID.String())
+
+	start := time.Now()
+	response, err := Client.Do(request)
+	if err != nil {
+		return 0, "", time.Since(start).Milliseconds(), err
+	}
+	defer response.Body.Close()
+
+	responseBody, _ := io.ReadAll(io.LimitReader(response.Body, maxResponseBody))
+	// drain a bit more so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+
+	return response.StatusCode, string(responseBody), time.Since(start).Milliseconds(), nil
+}
+
+/*
+Replay queues a new delivery with the same payload as an earlier one, to the same webhook.
+The new delivery gets its own id, the payload keeps the original one so receivers can deduplicate.
+*/
+func Replay(database *gorm.DB, deliveryID string) (*Delivery, error) {
+	var original Delivery
+	if err := database.Where("id = ?", deliveryID).First(&original).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrDeliveryNotFound
+		}
+		return nil, err
+	}
+
+	replay := Delivery{
+		WebhookID:     original.WebhookID,
+		EventType:     original.EventType,
+		Collection:    original.Collection,
+		EntryID:       original.EntryID,
+		Payload:       original.Payload,
+		Status:        StatusPending,
+		NextAttemptAt: time.Now().Unix(),
+		ReplayOf:      original.ID.String(),
+	}
+	if err := database.Create(&replay).Error; err != nil {
+		return nil, err
+	}
+
+	if active != nil {
+		active.notify()
+	}
+	return &replay, nil
+}